@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[1:]))
+}
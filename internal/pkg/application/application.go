@@ -3,24 +3,34 @@ package application
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	"github.com/google/uuid"
 	"github.com/sethvargo/go-retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
 	"github.com/nais/cloudsql-migrator/internal/pkg/database"
 	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	"github.com/nais/cloudsql-migrator/internal/pkg/wait"
 	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
 	"github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
 	autoscaling_v1 "k8s.io/api/autoscaling/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	rolloutTimeout = 10 * time.Minute
+	sqlUserTimeout = 5 * time.Minute
+)
+
 func ScaleApplication(ctx context.Context, cfg *config.Config, mgr *common_main.Manager, replicas int32) error {
 	mgr.Logger.Info("scaling application", "name", cfg.ApplicationName, "replicas", replicas)
 	scaleApplyConfiguration := autoscaling_v1.Scale{
@@ -50,6 +60,11 @@ func UpdateApplicationInstance(ctx context.Context, cfg *config.Config, instance
 	}
 	correlationID := correlationUUID.String()
 
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return nil, err
+	}
+
 	b := retry.NewConstant(1 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
@@ -60,30 +75,39 @@ func UpdateApplicationInstance(ctx context.Context, cfg *config.Config, instance
 			return nil, err
 		}
 
+		// Someone may have deployed the application since we last looked at it
+		err = verifySqlInstancesUnchanged(lastFingerprint(st, app), app)
+		if err != nil {
+			return nil, err
+		}
+
 		app.ObjectMeta.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] = correlationID
 		targetInstance := instance.DefineInstance(instanceSettings, app)
 		app.Spec.GCP.SqlInstances = []nais_io_v1.CloudSqlInstance{
 			*targetInstance,
 		}
 
+		err = recordPending(ctx, cfg, app, mgr)
+		if err != nil {
+			return nil, err
+		}
+
 		app, err = mgr.AppClient.Update(ctx, app)
 		if err != nil {
-			if errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Info("retrying update of application")
-				return nil, retry.RetryableError(err)
 			}
-			return nil, err
+			return nil, classify.Retry(err)
 		}
 		mgr.Logger.Info("application update applied", "name", cfg.ApplicationName)
 
 		app.Status.SynchronizationHash = "resync"
 		app, err = mgr.AppClient.UpdateStatus(ctx, app)
 		if err != nil {
-			if errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Info("retrying resync of application")
-				return nil, retry.RetryableError(err)
 			}
-			return nil, err
+			return nil, classify.Retry(err)
 		}
 		mgr.Logger.Info("application resync forced", "name", cfg.ApplicationName)
 
@@ -94,33 +118,26 @@ func UpdateApplicationInstance(ctx context.Context, cfg *config.Config, instance
 	}
 
 	// Make sure naiserator and sqeletor has reacted before returning, so downstream resources have been updated
-	time.Sleep(15 * time.Second)
-	for app.Status.CorrelationID != correlationID || (app.Status.SynchronizationState != "RolloutComplete" && app.Status.SynchronizationState != "Synchronized") {
-		mgr.Logger.Info("waiting for app rollout", "appName", app.Name, "synchronizationState", app.Status.SynchronizationState, "wantedCorrelationID", correlationID, "currentCorrelationID", app.Status.CorrelationID)
-		time.Sleep(5 * time.Second)
-		app, err = mgr.AppClient.Get(ctx, app.Name)
-		if err != nil {
-			return nil, err
-		}
+	app, err = wait.ApplicationRollout(ctx, app.Name, correlationID, rolloutTimeout, mgr, "RolloutComplete", "Synchronized")
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for app rollout: %w", err)
 	}
 
-	return app, err
+	err = RecordFingerprint(ctx, cfg, app, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	return app, nil
 }
 
 func UpdateApplicationUser(ctx context.Context, target *resolved.Instance, gcpProject *resolved.GcpProject, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
 	mgr.Logger.Info("updating application user", "user", target.AppUsername)
 
-	b := retry.NewConstant(5 * time.Second)
-	b = retry.WithMaxDuration(5*time.Minute, b)
-
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
-		sqlUser, err := mgr.SqlUserClient.Get(ctx, target.AppUsername)
-		if err != nil {
-			if errors.IsNotFound(err) {
-				mgr.Logger.Warn("sql user not found, retrying", "user", target.AppUsername)
-				return retry.RetryableError(err)
-			}
-			return fmt.Errorf("failed to get sql user: %w", err)
+	_, err := wait.For(ctx, mgr.SqlUserClient, target.AppUsername, sqlUserTimeout, func(sqlUser *v1beta1.SQLUser) (bool, error) {
+		if sqlUser == nil {
+			mgr.Logger.Warn("sql user not found, waiting", "user", target.AppUsername)
+			return false, nil
 		}
 
 		annotationUpdated := sqlUser.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] == app.Status.CorrelationID
@@ -128,19 +145,123 @@ func UpdateApplicationUser(ctx context.Context, target *resolved.Instance, gcpPr
 		conditionsUpToDate := len(conditions) > 0 && conditions[0].Reason == "UpToDate"
 		if annotationUpdated && conditionsUpToDate {
 			mgr.Logger.Info("sql user is up to date, setting database password", "user", target.AppUsername)
-			return nil
+			return true, nil
 		}
 
-		mgr.Logger.Info("sql user not up to date, retrying", "user", target.AppUsername)
-		return retry.RetryableError(fmt.Errorf("sql user not up to date"))
+		mgr.Logger.Info("sql user not up to date, waiting", "user", target.AppUsername)
+		return false, nil
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed waiting for sql user: %w", err)
 	}
 
 	return database.SetDatabasePassword(ctx, target.Name, target.AppUsername, target.AppPassword, gcpProject, mgr)
 }
 
+// RecordSecretKeys records the keys of the database secret of the application in the migration state, for promote
+// to compare the secret with before and after it moves the application. Keys that are already recorded are kept.
+func RecordSecretKeys(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
+	keys, err := resolved.ResolveSecretKeys(ctx, app, mgr)
+	if err != nil {
+		return err
+	}
+
+	return state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		if st.SecretKeys == nil {
+			mgr.Logger.Info("recording database secret keys", "keys", keys)
+			st.SecretKeys = keys
+		}
+		return nil
+	})
+}
+
+// RecordedSecretKeys returns the keys of the database secret recorded by setup. A migration set up before the keys
+// were recorded has none, so the keys of the secret as it is now are returned, which only tells if promote changes
+// them when the application has not been moved yet.
+func RecordedSecretKeys(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) ([]string, error) {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return nil, err
+	}
+	if st.SecretKeys != nil {
+		return st.SecretKeys, nil
+	}
+
+	mgr.Logger.Warn("database secret keys were not recorded by setup, using the keys of the secret as it is now")
+	return resolved.ResolveSecretKeys(ctx, app, mgr)
+}
+
+// VerifySecretKeysWillBePreserved checks, before the application is moved, that the database secret of the new
+// instance will have the recorded keys. Naiserator names every key of a database with the same prefix, so the names
+// are preserved when each recorded key has the prefix of one of the databases of the new instance, and each of those
+// prefixes is used by a recorded key.
+func VerifySecretKeysWillBePreserved(recordedKeys []string, instanceSettings *config.InstanceSettings, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
+	targetInstance := instance.DefineInstance(instanceSettings, app)
+	prefixes := make([]string, 0, len(targetInstance.Databases))
+	for _, db := range targetInstance.Databases {
+		prefix := db.EnvVarPrefix
+		if len(prefix) == 0 {
+			databaseName := db.Name
+			if len(databaseName) == 0 {
+				databaseName = app.Name
+			}
+			prefix = instance.DefaultEnvVarPrefix(targetInstance.Name, databaseName)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	unmatched := make([]string, 0)
+	for _, key := range recordedKeys {
+		if !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(key, prefix+"_") }) {
+			unmatched = append(unmatched, key)
+		}
+	}
+	unused := make([]string, 0)
+	for _, prefix := range prefixes {
+		if !slices.ContainsFunc(recordedKeys, func(key string) bool { return strings.HasPrefix(key, prefix+"_") }) {
+			unused = append(unused, prefix)
+		}
+	}
+
+	if len(unmatched) > 0 || len(unused) > 0 {
+		return fmt.Errorf("database environment variable names would change: keys without a prefix of the new instance %v, new prefixes %v", unmatched, unused)
+	}
+
+	mgr.Logger.Info("database environment variable names will be unchanged", "prefixes", prefixes)
+	return nil
+}
+
+// VerifySecretKeysPreserved checks that the database secret of the application has exactly the keys it had
+// before the application was moved to the new instance, i.e. that the environment variable names are unchanged.
+// It runs after the application has been moved, so it reports a change that VerifySecretKeysWillBePreserved could
+// not predict, such as one made by a promote that was rerun after the switch, rather than preventing it.
+func VerifySecretKeysPreserved(ctx context.Context, previousKeys []string, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
+	currentKeys, err := resolved.ResolveSecretKeys(ctx, app, mgr)
+	if err != nil {
+		return err
+	}
+
+	missing := make([]string, 0)
+	for _, key := range previousKeys {
+		if !slices.Contains(currentKeys, key) {
+			missing = append(missing, key)
+		}
+	}
+	added := make([]string, 0)
+	for _, key := range currentKeys {
+		if !slices.Contains(previousKeys, key) {
+			added = append(added, key)
+		}
+	}
+
+	if len(missing) > 0 || len(added) > 0 {
+		return fmt.Errorf("database environment variable names have changed: missing %v, added %v", missing, added)
+	}
+
+	mgr.Logger.Info("database environment variable names are unchanged", "keys", currentKeys)
+	return nil
+}
+
 func DeleteHelperApplication(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) error {
 	helperName, err := common_main.HelperName(cfg.ApplicationName)
 	if err != nil {
@@ -157,20 +278,20 @@ func DeleteHelperApplication(ctx context.Context, cfg *config.Config, mgr *commo
 	return nil
 }
 
-func DisableCascadingDelete(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) error {
+func DisableCascadingDelete(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) (*nais_io_v1alpha1.Application, error) {
 	mgr.Logger.Info("disabling cascading delete", "name", cfg.ApplicationName)
 
 	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	app.Spec.GCP.SqlInstances[0].CascadingDelete = false
 
-	_, err = mgr.AppClient.Update(ctx, app)
+	app, err = mgr.AppClient.Update(ctx, app)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return app, nil
 }
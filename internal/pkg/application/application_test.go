@@ -0,0 +1,215 @@
+package application_test
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/application"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	appName   = "my-app"
+	namespace = "my-team"
+)
+
+var applications = nais_io_v1alpha1.GroupVersion.WithResource("applications")
+
+var _ = Describe("ReconcileDrift", func() {
+	var ctx context.Context
+	var mgr *common_main.Manager
+	var cfg *config.Config
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(cancel)
+
+		dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			applications: "ApplicationList",
+		})
+		mgr = &common_main.Manager{
+			Logger:    slog.New(slog.DiscardHandler),
+			AppClient: k8s.New[*nais_io_v1alpha1.Application](dynamicClient, namespace, applications),
+			K8sClient: fake.NewClientset(),
+		}
+		cfg = &config.Config{ApplicationName: appName, Namespace: namespace}
+
+		_, err := mgr.AppClient.Create(ctx, &nais_io_v1alpha1.Application{
+			TypeMeta: metav1.TypeMeta{APIVersion: nais_io_v1alpha1.GroupVersion.String(), Kind: "Application"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        appName,
+				Namespace:   namespace,
+				Annotations: map[string]string{nais_io_v1.DeploymentCorrelationIDAnnotation: "deploy-1"},
+			},
+			Spec: nais_io_v1alpha1.ApplicationSpec{
+				Image:    "my-app:1",
+				Replicas: &nais_io_v1.Replicas{Min: ptr.To(2), Max: ptr.To(4)},
+				GCP: &nais_io_v1.GCP{SqlInstances: []nais_io_v1.CloudSqlInstance{{
+					Type: "POSTGRES_16",
+					Tier: "db-custom-1-3840",
+				}}},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// change applies a change to the application in the cluster, like a deploy by someone else, and returns it
+	change := func(f func(app *nais_io_v1alpha1.Application)) *nais_io_v1alpha1.Application {
+		app, err := mgr.AppClient.Get(ctx, appName)
+		Expect(err).NotTo(HaveOccurred())
+		f(app)
+		app, err = mgr.AppClient.Update(ctx, app)
+		Expect(err).NotTo(HaveOccurred())
+		return app
+	}
+	recordFingerprint := func() {
+		app, err := mgr.AppClient.Get(ctx, appName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(application.RecordFingerprint(ctx, cfg, app, mgr)).To(Succeed())
+	}
+	drift := func() *application.Drift {
+		app, err := mgr.AppClient.Get(ctx, appName)
+		Expect(err).NotTo(HaveOccurred())
+		d, err := application.DetectDrift(ctx, cfg, app, mgr)
+		Expect(err).NotTo(HaveOccurred())
+		return d
+	}
+
+	It("returns the application when no fingerprint is recorded", func() {
+		app := change(func(app *nais_io_v1alpha1.Application) { app.Spec.GCP.SqlInstances[0].Tier = "db-custom-2-7680" })
+
+		reconciled, err := application.ReconcileDrift(ctx, cfg, app, mgr, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(Equal(app))
+		st, err := state.Load(ctx, cfg, mgr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Fingerprint).To(BeNil())
+	})
+
+	DescribeTable("changes after the fingerprint was recorded",
+		func(f func(app *nais_io_v1alpha1.Application), allowInstanceChanges bool, refused string) {
+			recordFingerprint()
+			app := change(f)
+
+			reconciled, err := application.ReconcileDrift(ctx, cfg, app, mgr, allowInstanceChanges)
+			if refused != "" {
+				Expect(err).To(MatchError(ContainSubstring(refused)))
+				Expect(drift().Empty()).To(BeFalse())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reconciled.Spec.GCP.SqlInstances[0].CascadingDelete).To(BeFalse())
+			Expect(drift().Empty()).To(BeTrue())
+		},
+		Entry("nothing changed", func(*nais_io_v1alpha1.Application) {}, false, ""),
+		Entry("redeployed without changes", func(app *nais_io_v1alpha1.Application) {
+			app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] = "deploy-2"
+		}, false, ""),
+		Entry("other fields are accepted", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.Image = "my-app:2"
+		}, false, ""),
+		Entry("sql instances are refused", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.GCP.SqlInstances[0].Tier = "db-custom-2-7680"
+		}, false, "sql instances of application my-app have been changed"),
+		Entry("sql instances are accepted when instance changes are allowed", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.GCP.SqlInstances[0].Tier = "db-custom-2-7680"
+		}, true, ""),
+		Entry("replicas are refused", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.Replicas.Min = ptr.To(1)
+		}, false, "replicas of application my-app have been changed"),
+		Entry("replicas are accepted when instance changes are allowed", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.Replicas.Min = ptr.To(1)
+		}, true, ""),
+		Entry("cascading delete is disabled again", func(app *nais_io_v1alpha1.Application) {
+			app.Spec.GCP.SqlInstances[0].CascadingDelete = true
+		}, false, ""),
+	)
+
+	It("disables cascading delete in the cluster when it has been turned back on", func() {
+		recordFingerprint()
+		app := change(func(app *nais_io_v1alpha1.Application) { app.Spec.GCP.SqlInstances[0].CascadingDelete = true })
+		Expect(drift().CascadingDeleteEnabled()).To(BeTrue())
+
+		_, err := application.ReconcileDrift(ctx, cfg, app, mgr, false)
+		Expect(err).NotTo(HaveOccurred())
+		app, err = mgr.AppClient.Get(ctx, appName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(app.Spec.GCP.SqlInstances[0].CascadingDelete).To(BeFalse())
+	})
+
+	It("sorts the changes by what they change", func() {
+		recordFingerprint()
+		change(func(app *nais_io_v1alpha1.Application) {
+			app.Spec.Image = "my-app:2"
+			app.Spec.Replicas.Max = ptr.To(6)
+			app.Spec.GCP.SqlInstances[0].Tier = "db-custom-2-7680"
+			app.Spec.GCP.SqlInstances[0].CascadingDelete = true
+		})
+
+		d := drift()
+		Expect(d.Redeployed).To(BeFalse())
+		Expect(d.Other).To(ConsistOf(HaveField("Path", "image")))
+		Expect(d.Replicas).To(ConsistOf(HaveField("Path", "replicas.max")))
+		Expect(d.SqlInstances).To(ConsistOf(HaveField("Path", "gcp.sqlInstances[0].tier")))
+		Expect(d.CascadingDelete).To(ConsistOf(HaveField("Path", "gcp.sqlInstances[0].cascadingDelete")))
+	})
+})
+
+var _ = Describe("VerifySecretKeysWillBePreserved", func() {
+	mgr := &common_main.Manager{Logger: slog.New(slog.DiscardHandler)}
+	sourceKeys := []string{
+		"NAIS_DATABASE_MY_APP_MY_APP_DATABASE",
+		"NAIS_DATABASE_MY_APP_MY_APP_HOST",
+		"NAIS_DATABASE_MY_APP_MY_APP_PASSWORD",
+		"NAIS_DATABASE_MY_APP_MY_APP_USERNAME",
+	}
+
+	define := func(databases ...nais_io_v1.CloudSqlDatabase) *nais_io_v1alpha1.Application {
+		return &nais_io_v1alpha1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: appName, Namespace: namespace},
+			Spec: nais_io_v1alpha1.ApplicationSpec{
+				GCP: &nais_io_v1.GCP{SqlInstances: []nais_io_v1.CloudSqlInstance{{
+					Type:      "POSTGRES_16",
+					Databases: databases,
+				}}},
+			},
+		}
+	}
+
+	DescribeTable("compares the prefixes of the target databases with the recorded keys",
+		func(preserve bool, app *nais_io_v1alpha1.Application, recorded []string, matchError string) {
+			settings := &config.InstanceSettings{Name: "my-app-pg17", PreserveEnvVarNames: preserve}
+			err := application.VerifySecretKeysWillBePreserved(recorded, settings, app, mgr)
+			if matchError == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(matchError)))
+			}
+		},
+		Entry("preserved names", true, define(nais_io_v1.CloudSqlDatabase{Name: appName}), sourceKeys, ""),
+		Entry("database without a name", true, define(nais_io_v1.CloudSqlDatabase{}), sourceKeys, ""),
+		Entry("explicit prefix", false, define(nais_io_v1.CloudSqlDatabase{Name: appName, EnvVarPrefix: "DB"}),
+			[]string{"DB_HOST", "DB_PASSWORD", "DB_USERNAME"}, ""),
+		Entry("names of the target instance", false, define(nais_io_v1.CloudSqlDatabase{Name: appName}), sourceKeys,
+			"new prefixes [NAIS_DATABASE_MY_APP_PG17_MY_APP]"),
+		Entry("recorded key of another database", true, define(nais_io_v1.CloudSqlDatabase{Name: appName}),
+			append(slices.Clone(sourceKeys), "NAIS_DATABASE_MY_APP_OTHER_HOST"),
+			"keys without a prefix of the new instance [NAIS_DATABASE_MY_APP_OTHER_HOST]"),
+	)
+})
@@ -0,0 +1,229 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/diff"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	"github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+)
+
+var cascadingDeletePath = regexp.MustCompile(`^gcp\.sqlInstances\[\d+]\.cascadingDelete$`)
+
+// Drift is the set of changes made to an Application by someone other than the migrator,
+// since the migrator last recorded its fingerprint.
+type Drift struct {
+	// Redeployed is true if the application has been deployed since the fingerprint was recorded
+	Redeployed bool
+	// SqlInstances are changes to the sql instances, except cascading delete
+	SqlInstances []diff.Change
+	// CascadingDelete are changes to cascading delete on the sql instances
+	CascadingDelete []diff.Change
+	// Replicas are changes to the replica configuration
+	Replicas []diff.Change
+	// Other are all remaining changes to the spec
+	Other []diff.Change
+}
+
+func (d *Drift) Empty() bool {
+	return !d.Redeployed && len(d.SqlInstances) == 0 && len(d.CascadingDelete) == 0 && len(d.Replicas) == 0 && len(d.Other) == 0
+}
+
+// CascadingDeleteEnabled is true if cascading delete has been turned back on for any sql instance
+func (d *Drift) CascadingDeleteEnabled() bool {
+	for _, change := range d.CascadingDelete {
+		if change.New == true {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordFingerprint stores a snapshot of the application spec, so that later phases can detect changes made by others
+func RecordFingerprint(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
+	fingerprint, err := makeFingerprint(app)
+	if err != nil {
+		return err
+	}
+
+	mgr.Logger.Info("recording application fingerprint", "name", app.Name, "hash", fingerprint.Hash)
+	return state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		st.Fingerprint = fingerprint
+		st.Pending = nil
+		return nil
+	})
+}
+
+// recordPending stores a snapshot of an update the migrator is about to apply, so that the update is recognized
+// as the migrator's own if it is applied, but the migrator stops before recording the fingerprint
+func recordPending(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) error {
+	fingerprint, err := makeFingerprint(app)
+	if err != nil {
+		return err
+	}
+
+	return state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		st.Pending = fingerprint
+		return nil
+	})
+}
+
+// lastFingerprint returns the pending fingerprint if the application has been updated by the migrator since
+// the fingerprint was recorded, and otherwise the recorded fingerprint
+func lastFingerprint(st *state.State, app *nais_io_v1alpha1.Application) *state.Fingerprint {
+	if st.Pending != nil && st.Pending.CorrelationID == app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] {
+		return st.Pending
+	}
+	return st.Fingerprint
+}
+
+// DetectDrift compares the application with the recorded fingerprint.
+// Returns nil if no fingerprint has been recorded.
+func DetectDrift(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) (*Drift, error) {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := lastFingerprint(st, app)
+	if fingerprint == nil {
+		return nil, nil
+	}
+
+	return compareFingerprint(fingerprint, app)
+}
+
+// ReconcileDrift detects changes to the application since the migrator last touched it, and logs exactly what changed.
+// Cascading delete is disabled again if it has been turned back on.
+// Changes to the sql instances and the replicas are refused unless allowInstanceChanges is set.
+// The fingerprint is updated to the reconciled application, which is returned.
+func ReconcileDrift(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager, allowInstanceChanges bool) (*nais_io_v1alpha1.Application, error) {
+	mgr.Logger.Info("checking application for changes since it was last updated by the migrator", "name", app.Name)
+
+	drift, err := DetectDrift(ctx, cfg, app, mgr)
+	if err != nil {
+		return nil, err
+	}
+	if drift == nil {
+		mgr.Logger.Info("no application fingerprint recorded, unable to detect changes")
+		return app, nil
+	}
+	if drift.Empty() {
+		mgr.Logger.Info("application is unchanged")
+		return app, nil
+	}
+
+	if drift.Redeployed {
+		mgr.Logger.Warn("application has been deployed by someone else during the migration", "correlationID", app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation])
+	}
+	for _, change := range drift.Other {
+		mgr.Logger.Info("application spec changed", "change", change.String())
+	}
+	for _, change := range drift.Replicas {
+		mgr.Logger.Warn("application replicas changed", "change", change.String())
+	}
+	for _, change := range drift.SqlInstances {
+		mgr.Logger.Warn("application sql instances changed", "change", change.String())
+	}
+
+	if len(drift.SqlInstances) > 0 && !allowInstanceChanges {
+		return nil, fmt.Errorf("sql instances of application %s have been changed during the migration, refusing to continue: %s", app.Name, formatChanges(drift.SqlInstances))
+	}
+	if len(drift.Replicas) > 0 && !allowInstanceChanges {
+		return nil, fmt.Errorf("replicas of application %s have been changed during the migration, refusing to continue: %s", app.Name, formatChanges(drift.Replicas))
+	}
+
+	if drift.CascadingDeleteEnabled() {
+		mgr.Logger.Warn("cascading delete has been re-enabled on the application, disabling it again", "changes", formatChanges(drift.CascadingDelete))
+		app, err = DisableCascadingDelete(ctx, cfg, mgr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = RecordFingerprint(ctx, cfg, app, mgr)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// verifySqlInstancesUnchanged fails if the sql instances of the application differ from the fingerprint, ignoring cascading delete
+func verifySqlInstancesUnchanged(fingerprint *state.Fingerprint, app *nais_io_v1alpha1.Application) error {
+	if fingerprint == nil {
+		return nil
+	}
+	drift, err := compareFingerprint(fingerprint, app)
+	if err != nil {
+		return err
+	}
+	if len(drift.SqlInstances) > 0 {
+		return fmt.Errorf("sql instances of application %s have been changed by someone else, refusing to overwrite: %s", app.Name, formatChanges(drift.SqlInstances))
+	}
+	return nil
+}
+
+func makeFingerprint(app *nais_io_v1alpha1.Application) (*state.Fingerprint, error) {
+	spec, err := json.Marshal(app.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal application spec: %w", err)
+	}
+
+	hash := sha256.Sum256(spec)
+	return &state.Fingerprint{
+		Hash:          hex.EncodeToString(hash[:]),
+		CorrelationID: app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation],
+		Spec:          spec,
+		RecordedAt:    time.Now(),
+	}, nil
+}
+
+func compareFingerprint(fingerprint *state.Fingerprint, app *nais_io_v1alpha1.Application) (*Drift, error) {
+	current, err := makeFingerprint(app)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := &Drift{
+		Redeployed: current.CorrelationID != fingerprint.CorrelationID,
+	}
+	if current.Hash == fingerprint.Hash {
+		return drift, nil
+	}
+
+	changes, err := diff.Compare(fingerprint.Spec, current.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		switch {
+		case cascadingDeletePath.MatchString(change.Path):
+			drift.CascadingDelete = append(drift.CascadingDelete, change)
+		case change.Path == "gcp" || strings.HasPrefix(change.Path, "gcp.sqlInstances"):
+			drift.SqlInstances = append(drift.SqlInstances, change)
+		case strings.HasPrefix(change.Path, "replicas"):
+			drift.Replicas = append(drift.Replicas, change)
+		default:
+			drift.Other = append(drift.Other, change)
+		}
+	}
+	return drift, nil
+}
+
+func formatChanges(changes []diff.Change) string {
+	formatted := make([]string, 0, len(changes))
+	for _, change := range changes {
+		formatted = append(formatted, change.String())
+	}
+	return strings.Join(formatted, ", ")
+}
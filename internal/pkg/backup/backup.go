@@ -2,16 +2,15 @@ package backup
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"net/http"
 	"time"
 
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/operation"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
 	"github.com/sethvargo/go-retry"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/sqladmin/v1"
 )
 
@@ -22,12 +21,25 @@ func CreateBackup(ctx context.Context, cfg *config.Config, name string, gcpProje
 	}
 	mgr.Logger.Info("creating backup")
 
-	backupRunsService := mgr.SqlAdminService.BackupRuns
-	operationsService := mgr.SqlAdminService.Operations
+	backupRunsService := mgr.SqlAdmin.BackupRuns
+	operationKey := "backup/" + name
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
+	op, err := operation.ResumeSqlAdmin(ctx, cfg, operationKey, gcpProject, mgr)
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		err = operation.WaitSqlAdmin(ctx, "backup", op, 5*time.Minute, gcpProject, mgr, operation.Tracked(cfg, operationKey))
+		if err != nil {
+			return fmt.Errorf("failed to create backup: %w", err)
+		}
+		mgr.Logger.Info("backup creation complete")
+		return nil
+	}
+
 	backupRun := &sqladmin.BackupRun{
 		Description: "Pre-migration backup",
 	}
@@ -35,16 +47,13 @@ func CreateBackup(ctx context.Context, cfg *config.Config, name string, gcpProje
 	b := retry.NewConstant(5 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
-	op, err := retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.Operation, error) {
-		op, err := backupRunsService.Insert(gcpProject.Id, name, backupRun).Context(ctx).Do()
+	op, err = retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.Operation, error) {
+		op, err := backupRunsService.Insert(ctx, gcpProject.Id, name, backupRun)
 		if err != nil {
-			var ae *googleapi.Error
-			if errors.As(err, &ae) && ae.Code == http.StatusConflict {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("another operation is in progress, retrying", "error", err)
-				return nil, retry.RetryableError(err)
 			}
-
-			return nil, err
+			return nil, classify.Retry(err)
 		}
 		return op, nil
 	})
@@ -52,12 +61,9 @@ func CreateBackup(ctx context.Context, cfg *config.Config, name string, gcpProje
 		return fmt.Errorf("failed to create backup: %w", err)
 	}
 
-	for op.Status != "DONE" {
-		time.Sleep(1 * time.Second)
-		op, err = operationsService.Get(gcpProject.Id, op.Name).Context(ctx).Do()
-		if err != nil {
-			return fmt.Errorf("failed to get backup operation status: %w", err)
-		}
+	err = operation.WaitSqlAdmin(ctx, "backup", op, 5*time.Minute, gcpProject, mgr, operation.Tracked(cfg, operationKey))
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
 	}
 
 	mgr.Logger.Info("backup creation complete")
@@ -0,0 +1,227 @@
+// Package classify sorts errors from the Google APIs (REST and gRPC) and the Kubernetes API into a small set of classes,
+// and decides which of them are worth retrying.
+//
+// Inside a retry loop, return classify.Retry(err) instead of choosing between retry.RetryableError and a plain error,
+// so that transient errors are retried and permission or validation errors fail fast.
+package classify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type Class int
+
+const (
+	// Unknown errors are typically network errors, and are retried
+	Unknown Class = iota
+	// NotFound means the resource does not exist
+	NotFound
+	// Conflict means a concurrent write, or another operation in progress on the same resource
+	Conflict
+	// Unavailable means a transient server-side error or timeout
+	Unavailable
+	// RateLimited means a quota or rate limit was exceeded
+	RateLimited
+	// Forbidden means the migrator lacks permissions, or is not authenticated
+	Forbidden
+	// Invalid means the request was rejected as invalid, or the resource is in a state that does not allow it
+	Invalid
+	// Canceled means the context was cancelled or its deadline expired
+	Canceled
+)
+
+func (c Class) String() string {
+	switch c {
+	case NotFound:
+		return "not found"
+	case Conflict:
+		return "conflict"
+	case Unavailable:
+		return "unavailable"
+	case RateLimited:
+		return "rate limited"
+	case Forbidden:
+		return "forbidden"
+	case Invalid:
+		return "invalid"
+	case Canceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable reports whether errors of this class may go away by themselves.
+// NotFound is not retryable, callers waiting for a resource to appear must handle it explicitly.
+func (c Class) Retryable() bool {
+	switch c {
+	case Unknown, Conflict, Unavailable, RateLimited:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c Class) hint() string {
+	switch c {
+	case Forbidden:
+		return "check that the migrator has the required IAM roles in the project and RBAC permissions in the namespace"
+	case Invalid:
+		return "the request was rejected and will not succeed if retried, check the configuration and the state of the resources involved"
+	default:
+		return ""
+	}
+}
+
+// Error is a permanent error, annotated with its class and a hint about how to resolve it
+type Error struct {
+	Class Class
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if hint := e.Class.hint(); hint != "" {
+		return fmt.Sprintf("%v (%s: %s)", e.Err, e.Class, hint)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Of returns the class of err
+func Of(err error) Class {
+	if err == nil {
+		return Unknown
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Class
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Canceled
+	}
+
+	var ae *googleapi.Error
+	if errors.As(err, &ae) {
+		return ofHttp(ae)
+	}
+
+	var statusErr k8s_errors.APIStatus
+	if errors.As(err, &statusErr) {
+		return ofKubernetes(err)
+	}
+
+	if st, ok := status.FromError(err); ok {
+		return ofGrpc(st.Code())
+	}
+
+	return Unknown
+}
+
+// Is reports whether err belongs to class
+func Is(err error, class Class) bool {
+	return err != nil && Of(err) == class
+}
+
+// Retry prepares err to be returned from a go-retry function.
+// Retryable errors are marked as such, other errors are returned as a permanent *Error.
+func Retry(err error) error {
+	if err == nil {
+		return nil
+	}
+	class := Of(err)
+	if class.Retryable() {
+		return retry.RetryableError(err)
+	}
+	return Permanent(err)
+}
+
+// Permanent annotates err with its class, so the message explains what needs fixing
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &Error{Class: Of(err), Err: err}
+}
+
+func ofHttp(ae *googleapi.Error) Class {
+	switch ae.Code {
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusConflict:
+		return Conflict
+	case http.StatusTooManyRequests:
+		return RateLimited
+	case http.StatusUnauthorized:
+		return Forbidden
+	case http.StatusForbidden:
+		for _, item := range ae.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+				return RateLimited
+			}
+		}
+		return Forbidden
+	case http.StatusBadRequest, http.StatusPreconditionFailed, http.StatusUnprocessableEntity:
+		return Invalid
+	}
+	if ae.Code >= 500 {
+		return Unavailable
+	}
+	return Unknown
+}
+
+func ofKubernetes(err error) Class {
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return NotFound
+	case k8s_errors.IsConflict(err), k8s_errors.IsAlreadyExists(err):
+		return Conflict
+	case k8s_errors.IsTooManyRequests(err):
+		return RateLimited
+	case k8s_errors.IsForbidden(err), k8s_errors.IsUnauthorized(err):
+		return Forbidden
+	case k8s_errors.IsInvalid(err), k8s_errors.IsBadRequest(err), k8s_errors.IsMethodNotSupported(err):
+		return Invalid
+	case k8s_errors.IsServerTimeout(err), k8s_errors.IsTimeout(err), k8s_errors.IsServiceUnavailable(err), k8s_errors.IsInternalError(err):
+		return Unavailable
+	}
+	return Unknown
+}
+
+func ofGrpc(code codes.Code) Class {
+	switch code {
+	case codes.NotFound:
+		return NotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return Conflict
+	case codes.ResourceExhausted:
+		return RateLimited
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return Forbidden
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented:
+		return Invalid
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return Unavailable
+	case codes.Canceled:
+		return Canceled
+	}
+	return Unknown
+}
@@ -0,0 +1,79 @@
+package classify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var sqlInstances = schema.GroupResource{Group: "sql.cnrm.cloud.google.com", Resource: "sqlinstances"}
+
+var _ = Describe("Classify", func() {
+	DescribeTable("Of",
+		func(err error, expected classify.Class) {
+			Expect(classify.Of(err)).To(Equal(expected))
+			Expect(classify.Of(fmt.Errorf("wrapped: %w", err))).To(Equal(expected))
+		},
+		Entry("googleapi not found", &googleapi.Error{Code: http.StatusNotFound}, classify.NotFound),
+		Entry("googleapi conflict", &googleapi.Error{Code: http.StatusConflict}, classify.Conflict),
+		Entry("googleapi forbidden", &googleapi.Error{Code: http.StatusForbidden}, classify.Forbidden),
+		Entry("googleapi quota exceeded", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, classify.RateLimited),
+		Entry("googleapi too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, classify.RateLimited),
+		Entry("googleapi bad request", &googleapi.Error{Code: http.StatusBadRequest}, classify.Invalid),
+		Entry("googleapi server error", &googleapi.Error{Code: http.StatusServiceUnavailable}, classify.Unavailable),
+		Entry("grpc not found", status.Error(codes.NotFound, "gone"), classify.NotFound),
+		Entry("grpc permission denied", status.Error(codes.PermissionDenied, "denied"), classify.Forbidden),
+		Entry("grpc failed precondition", status.Error(codes.FailedPrecondition, "wrong state"), classify.Invalid),
+		Entry("grpc resource exhausted", status.Error(codes.ResourceExhausted, "quota"), classify.RateLimited),
+		Entry("grpc unavailable", status.Error(codes.Unavailable, "try again"), classify.Unavailable),
+		Entry("kubernetes not found", k8s_errors.NewNotFound(sqlInstances, "name"), classify.NotFound),
+		Entry("kubernetes conflict", k8s_errors.NewConflict(sqlInstances, "name", errors.New("modified")), classify.Conflict),
+		Entry("kubernetes forbidden", k8s_errors.NewForbidden(sqlInstances, "name", errors.New("rbac")), classify.Forbidden),
+		Entry("kubernetes too many requests", k8s_errors.NewTooManyRequests("slow down", 1), classify.RateLimited),
+		Entry("kubernetes invalid", k8s_errors.NewBadRequest("invalid"), classify.Invalid),
+		Entry("context cancelled", context.Canceled, classify.Canceled),
+		Entry("anything else", errors.New("connection reset"), classify.Unknown),
+	)
+
+	Describe("Retry", func() {
+		It("marks transient errors as retryable", func() {
+			err := classify.Retry(&googleapi.Error{Code: http.StatusServiceUnavailable})
+
+			attempts := 0
+			_ = retry.Do(context.Background(), retry.WithMaxRetries(1, retry.NewConstant(time.Millisecond)), func(context.Context) error {
+				attempts++
+				return err
+			})
+			Expect(attempts).To(Equal(2))
+		})
+
+		It("stops retrying on permission errors with an actionable message", func() {
+			err := classify.Retry(status.Error(codes.PermissionDenied, "caller does not have permission"))
+
+			attempts := 0
+			err = retry.Do(context.Background(), retry.WithMaxRetries(1, retry.NewConstant(time.Millisecond)), func(context.Context) error {
+				attempts++
+				return err
+			})
+			Expect(attempts).To(Equal(1))
+			Expect(classify.Is(err, classify.Forbidden)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("required IAM roles"))
+		})
+
+		It("leaves nil alone", func() {
+			Expect(classify.Retry(nil)).To(Succeed())
+		})
+	})
+})
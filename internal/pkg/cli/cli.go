@@ -0,0 +1,270 @@
+// Package cli runs the phases of a migration as subcommands of the cloudsql-migrator binary.
+//
+// The flags of a subcommand are generated from the env tags of its configuration struct, so TARGET_INSTANCE_NAME can
+// also be given as --target-instance-name, and the help tag is used as the description of the flag.
+// A flag takes precedence over the environment variable.
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/dryrun"
+	"github.com/nais/cloudsql-migrator/internal/pkg/hook"
+	"github.com/nais/cloudsql-migrator/internal/pkg/phase"
+	"github.com/sethvargo/go-envconfig"
+)
+
+const (
+	binaryName  = "cloudsql-migrator"
+	planFileEnv = "PLAN_FILE"
+)
+
+// Configuration is implemented by config.Config, and the phase specific configurations embedding it
+type Configuration interface {
+	Common() *config.Config
+}
+
+type Command struct {
+	Name    string
+	Summary string
+	// Timeout for the whole phase
+	Timeout time.Duration
+	// Report commands write their result to stdout, so they log to stderr and never render progress
+	Report bool
+
+	newConfig func() Configuration
+	run       func(ctx context.Context, cfg Configuration, mgr *common_main.Manager)
+}
+
+func command[C any, P interface {
+	*C
+	Configuration
+}](name, summary string, timeout time.Duration, run func(context.Context, P, *common_main.Manager)) *Command {
+	return &Command{
+		Name:      name,
+		Summary:   summary,
+		Timeout:   timeout,
+		newConfig: func() Configuration { return P(new(C)) },
+		run: func(ctx context.Context, cfg Configuration, mgr *common_main.Manager) {
+			run(ctx, cfg.(P), mgr)
+		},
+	}
+}
+
+// Commands are the subcommands, in the order they are used in a migration
+var Commands = []*Command{
+	report(command("plan", "Show what setup will do, without changing anything", 5*time.Minute, phase.Plan)),
+	command("setup", "Create the target instance and start replicating from the source instance", 45*time.Minute, phase.Setup),
+	command("promote", "Promote the target instance and move the application over to it", 30*time.Minute, phase.Promote),
+	command("finalize", "Remove the source instance and the resources only needed during the migration", 30*time.Minute, phase.Finalize),
+	command("rollback", "Move the application back to the source instance after a promotion", 30*time.Minute, phase.Rollback),
+}
+
+func report(cmd *Command) *Command {
+	cmd.Report = true
+	return cmd
+}
+
+// Lookup returns the subcommand with the given name, or nil if there is none
+func Lookup(name string) *Command {
+	for _, cmd := range Commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Run runs the subcommand named by the first argument, and returns the exit code of the process
+func Run(args []string) int {
+	if len(args) == 0 {
+		Usage(os.Stderr)
+		return 1
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			if cmd := Lookup(args[1]); cmd != nil {
+				cmd.Usage(os.Stdout)
+				return 0
+			}
+		}
+		Usage(os.Stdout)
+		return 0
+	}
+
+	cmd := Lookup(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		Usage(os.Stderr)
+		return 1
+	}
+	return cmd.Run(args[1:])
+}
+
+// Run runs the phase with flags from args, and returns the exit code of the process.
+// Failing steps exit the process directly, with the exit code of the step.
+func (c *Command) Run(args []string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cfg, err := c.Load(ctx, args, envconfig.OsLookuper())
+	if errors.Is(err, flag.ErrHelp) {
+		c.Usage(os.Stdout)
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\nRun '%s %s --help' for usage\n", err, binaryName, c.Name)
+		return 1
+	}
+
+	if c.Report {
+		interactive := false
+		cfg.Common().Logging.Interactive = &interactive
+		cfg.Common().Logging.Output = os.Stderr
+	}
+	logger := config.SetupLogging(cfg.Common())
+	mgr, err := common_main.Main(ctx, cfg.Common(), c.Name, logger)
+	if err != nil {
+		logger.Error("failed to complete configuration", "error", err)
+		return 2
+	}
+	if mgr.DryRun != nil {
+		ctx = dryrun.NewContext(ctx, mgr.DryRun)
+	}
+
+	err = hook.Run(ctx, cfg.Common(), c.Name, config.HookBefore, mgr)
+	if err != nil {
+		mgr.Fail(hook.ExitCode, "failed to run hook before "+c.Name, "error", err)
+	}
+	// The hooks after the phase run before it is reported as done and releases the lock, so a failing hook fails the phase
+	mgr.BeforeDone = func() {
+		err := hook.Run(ctx, cfg.Common(), c.Name, config.HookAfter, mgr)
+		if err != nil {
+			mgr.Fail(hook.ExitCode, "failed to run hook after "+c.Name, "error", err)
+		}
+	}
+
+	c.run(ctx, cfg, mgr)
+	return 0
+}
+
+// Load returns the configuration of the phase from the flags in args, then from lookuper,
+// and last from the migration plan given by PLAN_FILE
+func (c *Command) Load(ctx context.Context, args []string, lookuper envconfig.Lookuper) (Configuration, error) {
+	cfg := c.newConfig()
+
+	flags := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	values := make(map[string]string)
+	for _, f := range fieldsOf(cfg) {
+		flags.Var(&flagValue{env: f.env, isBool: f.isBool(), values: values}, f.flagName(), f.help)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	lookupers := []envconfig.Lookuper{envconfig.MapLookuper(values), lookuper}
+	planFile, found := values[planFileEnv]
+	if !found {
+		planFile, _ = lookuper.Lookup(planFileEnv)
+	}
+	var plan *config.Plan
+	if planFile != "" {
+		var err error
+		plan, err = config.LoadPlan(planFile)
+		if err != nil {
+			return nil, err
+		}
+		lookupers = append(lookupers, envconfig.MapLookuper(plan.Env()))
+	}
+
+	err := envconfig.ProcessWith(ctx, &envconfig.Config{
+		Target:   cfg,
+		Lookuper: envconfig.MultiLookuper(lookupers...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil {
+		cfg.Common().Hooks = plan.Hooks
+	}
+	return cfg, nil
+}
+
+// Usage writes the help text of the subcommand to w
+func (c *Command) Usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s %s [flags]\n\n%s.\n\n", binaryName, c.Name, c.Summary)
+	fmt.Fprintf(w, "Every flag can also be set with the environment variable shown, flags take precedence.\n")
+
+	table := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(table, 0, 4, 2, ' ', 0)
+	group := "\x00"
+	for _, f := range fieldsOf(c.newConfig()) {
+		if f.group != group {
+			group = f.group
+			heading := group
+			if heading == "" {
+				heading = "Flags"
+			}
+			// Headings are written as cells, so the columns are aligned across groups
+			fmt.Fprintf(tw, "\t\t\n%s:\t\t\n", heading)
+		}
+		fmt.Fprintf(tw, "  --%s %s\t%s\t%s\n", f.flagName(), f.typeName(), f.env, f.description())
+	}
+	_ = tw.Flush()
+
+	// Drop the padding of the heading cells
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
+
+// Usage writes the help text of the binary to w
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\n", binaryName)
+	fmt.Fprintf(w, "Migrates the Cloud SQL instance of a NAIS application to a new instance.\n\nCommands:\n")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range Commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(tw, "  help\tShow the flags of a command\n")
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\nRun '%s <command> --help' for the flags of a command.\n", binaryName)
+}
+
+type flagValue struct {
+	env    string
+	isBool bool
+	values map[string]string
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(value string) error {
+	v.values[v.env] = value
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
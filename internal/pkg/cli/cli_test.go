@@ -0,0 +1,143 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/cli"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sethvargo/go-envconfig"
+)
+
+var _ = Describe("Cli", func() {
+	env := envconfig.MapLookuper(map[string]string{
+		"APP_NAME":             "myapp",
+		"NAMESPACE":            "mynamespace",
+		"TARGET_INSTANCE_NAME": "myinstance",
+		"SOURCE_INSTANCE_NAME": "oldinstance",
+	})
+
+	It("has a command for every phase", func() {
+		for _, name := range []string{"plan", "setup", "promote", "finalize", "rollback"} {
+			Expect(cli.Lookup(name)).NotTo(BeNil(), name)
+		}
+		Expect(cli.Lookup("unknown")).To(BeNil())
+	})
+
+	It("reads the configuration from the environment", func() {
+		cfg, err := cli.Lookup("setup").Load(context.Background(), nil, env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Common().ApplicationName).To(Equal("myapp"))
+		Expect(cfg.Common().TargetInstance.Name).To(Equal("myinstance"))
+	})
+
+	It("prefers flags to the environment", func() {
+		args := []string{"--app-name", "otherapp", "--target-instance-tier=db-custom-1-3840", "--development-mode-skip-backup", "--interactive=false"}
+		cfg, err := cli.Lookup("setup").Load(context.Background(), args, env)
+		Expect(err).NotTo(HaveOccurred())
+		common := cfg.Common()
+		Expect(common.ApplicationName).To(Equal("otherapp"))
+		Expect(common.Namespace).To(Equal("mynamespace"))
+		Expect(common.TargetInstance.Tier).To(Equal("db-custom-1-3840"))
+		Expect(common.Development.SkipBackup).To(BeTrue())
+		Expect(common.Logging.Interactive).To(HaveValue(BeFalse()))
+	})
+
+	It("reads flags of the phase specific configuration", func() {
+		cfg, err := cli.Lookup("finalize").Load(context.Background(), []string{"--source-instance-name", "flaginstance"}, env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).To(BeAssignableToTypeOf(&config.FinalizeConfig{}))
+		Expect(cfg.(*config.FinalizeConfig).SourceInstanceName).To(Equal("flaginstance"))
+		Expect(cfg.Common().ApplicationName).To(Equal("myapp"))
+
+		cfg, err = cli.Lookup("rollback").Load(context.Background(), []string{"--source-instance-tier", "db-f1-micro"}, env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.(*config.RollbackConfig).SourceInstance.Tier).To(Equal("db-f1-micro"))
+	})
+
+	It("fails on missing required values, unknown flags and arguments", func() {
+		_, err := cli.Lookup("setup").Load(context.Background(), nil, envconfig.MapLookuper(map[string]string{}))
+		Expect(err).To(MatchError(ContainSubstring("APP_NAME")))
+
+		_, err = cli.Lookup("setup").Load(context.Background(), []string{"--no-such-flag"}, env)
+		Expect(err).To(HaveOccurred())
+
+		_, err = cli.Lookup("setup").Load(context.Background(), []string{"extra"}, env)
+		Expect(err).To(MatchError(ContainSubstring("unexpected argument")))
+	})
+
+	It("reads the migration plan given by the plan file, with lower precedence than the environment", func() {
+		planFile := filepath.Join(GinkgoT().TempDir(), "plan.yaml")
+		Expect(os.WriteFile(planFile, []byte(`
+application: planapp
+namespace: plannamespace
+target:
+  name: planinstance
+  tier: db-custom-2-7680
+lag:
+  timeout: 20m
+hooks:
+  - phase: promote
+    when: after
+    command: ["notify"]
+`), 0o600)).To(Succeed())
+
+		cfg, err := cli.Lookup("promote").Load(context.Background(), []string{"--plan-file", planFile, "--namespace", "flagnamespace"}, env)
+		Expect(err).NotTo(HaveOccurred())
+		common := cfg.Common()
+		Expect(common.ApplicationName).To(Equal("myapp"))
+		Expect(common.Namespace).To(Equal("flagnamespace"))
+		Expect(common.TargetInstance.Tier).To(Equal("db-custom-2-7680"))
+		Expect(common.Lag.Timeout).To(Equal(20 * time.Minute))
+		Expect(common.Hooks).To(HaveLen(1))
+
+		_, err = cli.Lookup("promote").Load(context.Background(), []string{"--plan-file", filepath.Join(filepath.Dir(planFile), "missing.yaml")}, env)
+		Expect(err).To(MatchError(ContainSubstring("failed to read migration plan")))
+	})
+
+	It("reads database flags and lists", func() {
+		args := []string{"--target-instance-flags", "max_connections:200;pgaudit.log:read,write", "--target-instance-remove-flags", "work_mem,temp_file_limit", "--target-instance-maintenance-day", "2"}
+		cfg, err := cli.Lookup("setup").Load(context.Background(), args, env)
+		Expect(err).NotTo(HaveOccurred())
+		target := cfg.Common().TargetInstance
+		Expect(target.Flags).To(Equal(map[string]string{"max_connections": "200", "pgaudit.log": "read,write"}))
+		Expect(target.RemoveFlags).To(Equal([]string{"work_mem", "temp_file_limit"}))
+		Expect(target.MaintenanceDay).To(HaveValue(Equal(2)))
+		Expect(target.MaintenanceHour).To(BeNil())
+	})
+
+	It("reads the output format of the plan command", func() {
+		cfg, err := cli.Lookup("plan").Load(context.Background(), nil, env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.(*config.PlanCommandConfig).Output).To(Equal(config.OutputText))
+		Expect(cli.Lookup("plan").Report).To(BeTrue())
+
+		cfg, err = cli.Lookup("plan").Load(context.Background(), []string{"--output", "json"}, env)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.(*config.PlanCommandConfig).Output).To(Equal(config.OutputJSON))
+	})
+
+	It("asks for help", func() {
+		_, err := cli.Lookup("promote").Load(context.Background(), []string{"--help"}, env)
+		Expect(errors.Is(err, flag.ErrHelp)).To(BeTrue())
+	})
+
+	It("generates help text from the configuration", func() {
+		out := &bytes.Buffer{}
+		cli.Lookup("rollback").Usage(out)
+		Expect(out.String()).To(ContainSubstring("Usage: cloudsql-migrator rollback [flags]"))
+		Expect(out.String()).To(MatchRegexp(`--app-name string\s+APP_NAME\s+Name of the application \(required\)`))
+		Expect(out.String()).To(MatchRegexp(`--log-level level\s+LOG_LEVEL\s+.* \(default INFO\)`))
+		Expect(out.String()).To(ContainSubstring("Source instance:"))
+		Expect(out.String()).To(MatchRegexp(`--source-instance-disk-autoresize\s+SOURCE_INSTANCE_DISK_AUTORESIZE`))
+		Expect(out.String()).To(MatchRegexp(`--source-instance-flags name:value;\.\.\.\s+SOURCE_INSTANCE_FLAGS`))
+		Expect(out.String()).To(ContainSubstring("Development mode:"))
+	})
+})
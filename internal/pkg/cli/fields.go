@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"encoding"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// field is a configuration value set by an environment variable
+type field struct {
+	env       string
+	help      string
+	group     string
+	typ       reflect.Type
+	required  bool
+	fallback  string
+	delimiter string
+}
+
+// fieldsOf returns the fields of a configuration struct, walking nested structs like envconfig does
+func fieldsOf(cfg any) []field {
+	return structFields(reflect.TypeOf(cfg).Elem(), "", "")
+}
+
+func structFields(t reflect.Type, prefix, group string) []field {
+	var fields []field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		key, opts := parseTag(sf.Tag.Get("env"))
+		typ := sf.Type
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+
+		if typ.Kind() == reflect.Struct && !reflect.PointerTo(typ).Implements(textUnmarshaler) {
+			// Structs with a help tag are shown as a group of their own, like the target instance settings
+			nested := group
+			if help := sf.Tag.Get("help"); help != "" {
+				nested = help
+			}
+			fields = append(fields, structFields(typ, prefix+opts.prefix, nested)...)
+			continue
+		}
+		if key == "" {
+			continue
+		}
+
+		fields = append(fields, field{
+			env:       prefix + key,
+			help:      sf.Tag.Get("help"),
+			group:     group,
+			typ:       typ,
+			required:  opts.required,
+			fallback:  opts.fallback,
+			delimiter: opts.delimiter,
+		})
+	}
+	return fields
+}
+
+type tagOptions struct {
+	prefix    string
+	required  bool
+	fallback  string
+	delimiter string
+}
+
+func parseTag(tag string) (string, tagOptions) {
+	opts := tagOptions{delimiter: ","}
+	key, rest, _ := strings.Cut(tag, ",")
+	for rest != "" {
+		var option string
+		option, rest, _ = strings.Cut(rest, ",")
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "required":
+			opts.required = true
+		case strings.HasPrefix(option, "prefix="):
+			opts.prefix = strings.TrimPrefix(option, "prefix=")
+		case strings.HasPrefix(option, "delimiter="):
+			opts.delimiter = strings.TrimPrefix(option, "delimiter=")
+		case strings.HasPrefix(option, "default="):
+			// The default consumes the rest of the tag, commas included
+			opts.fallback = strings.TrimPrefix(option, "default=")
+			if rest != "" {
+				opts.fallback += "," + rest
+			}
+			rest = ""
+		}
+	}
+	return strings.TrimSpace(key), opts
+}
+
+func (f field) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(f.env, "_", "-"))
+}
+
+func (f field) isBool() bool {
+	return f.typ.Kind() == reflect.Bool
+}
+
+func (f field) typeName() string {
+	if f.isBool() {
+		return ""
+	}
+	switch f.typ {
+	case reflect.TypeFor[slog.Level]():
+		return "level"
+	case reflect.TypeFor[time.Duration]():
+		return "duration"
+	}
+	switch f.typ.Kind() {
+	case reflect.Map:
+		return "name:value" + f.delimiter + "..."
+	case reflect.Slice:
+		return "name" + f.delimiter + "..."
+	}
+	return f.typ.Kind().String()
+}
+
+func (f field) description() string {
+	switch {
+	case f.required:
+		return f.help + " (required)"
+	case f.fallback != "":
+		return f.help + " (default " + f.fallback + ")"
+	default:
+		return f.help
+	}
+}
@@ -4,36 +4,86 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"time"
 
 	dms "cloud.google.com/go/clouddms/apiv1"
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/connector"
+	"github.com/nais/cloudsql-migrator/internal/pkg/dryrun"
+	"github.com/nais/cloudsql-migrator/internal/pkg/egress"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
 	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
+	"github.com/nais/cloudsql-migrator/internal/pkg/progress"
 	naisv1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
 	"github.com/nais/liberator/pkg/namegen"
 	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/option"
 	"google.golang.org/api/sqladmin/v1"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+const httpTimeout = 15 * time.Second
+
 type Manager struct {
 	Logger *slog.Logger
 
-	AppClient            k8s.AppClient
-	SqlInstanceClient    k8s.SqlInstanceClient
-	SqlSslCertClient     k8s.SqlSslCertClient
-	SqlDatabaseClient    k8s.SqlDatabaseClient
-	SqlUserClient        k8s.SqlUserClient
-	SqlAdminService      *sqladmin.Service
-	DatamigrationService *datamigration.Service
-	DBMigrationClient    *dms.DataMigrationClient
-	K8sClient            kubernetes.Interface
+	AppClient         k8s.AppClient
+	SqlInstanceClient k8s.SqlInstanceClient
+	SqlSslCertClient  k8s.SqlSslCertClient
+	SqlDatabaseClient k8s.SqlDatabaseClient
+	SqlUserClient     k8s.SqlUserClient
+	K8sClient         kubernetes.Interface
+
+	SqlAdmin      gcp.SqlAdmin
+	Datamigration gcp.Datamigration
+	Monitoring    gcp.Monitoring
+
+	// HttpClient is used for plain HTTP requests outside the Kubernetes and GCP APIs
+	HttpClient *http.Client
+	// Egress finds the outgoing ips of the migrator, with the strategy in the configuration
+	Egress egress.Resolver
+	// DatabaseDriver is the database/sql driver used to connect to the instances
+	DatabaseDriver string
+	// Connector dials the instances by their connection name when DATABASE_CONNECTION=CONNECTOR, nil otherwise.
+	// DatabaseDriver is then the driver of the connector.
+	Connector *connector.Connector
+	// Connectivity is how the instances are reached, config.ConnectivityStaticIp or config.ConnectivityPrivateIp
+	Connectivity string
+	// BeforeDone is called by Done when the phase has made its last change, while it still holds the migration lock.
+	// It ends the phase with Fail if what it runs fails.
+	BeforeDone func()
+	// BeforeExit is called by Fail before the process exits, to release what the phase holds, like the migration lock,
+	// as deferred calls do not run when the process exits
+	BeforeExit func()
+	// Exit ends the process when a phase fails, os.Exit unless set. It must not return, as the phases do not expect Fail to
+	Exit func(code int)
+
+	Progress *progress.Reporter
+	// DryRun records the changes made through the clients instead of making them, nil unless DRY_RUN is set
+	DryRun *dryrun.Recorder
 }
 
 func Main(ctx context.Context, cfg *config.Config, phase any, logger *slog.Logger) (*Manager, error) {
-	clientset, dynamicClient, err := newK8sClient()
+	reporter, err := progress.Open(cfg, fmt.Sprint(phase))
+	if err != nil {
+		return nil, err
+	}
+
+	var recorder *dryrun.Recorder
+	if cfg.DryRun {
+		recorder = dryrun.NewRecorder()
+	}
+
+	clientset, dynamicClient, err := newK8sClient(recorder)
 	if err != nil {
 		return nil, err
 	}
@@ -44,21 +94,80 @@ func Main(ctx context.Context, cfg *config.Config, phase any, logger *slog.Logge
 	sqlDatabaseClient := k8s.New[*v1beta1.SQLDatabase](dynamicClient, cfg.Namespace, v1beta1.SchemeGroupVersion.WithResource("sqldatabases"))
 	sqlUserClient := k8s.New[*v1beta1.SQLUser](dynamicClient, cfg.Namespace, v1beta1.SchemeGroupVersion.WithResource("sqlusers"))
 
-	sqlAdminService, err := sqladmin.NewService(ctx)
+	sqlAdminOptions, err := restOptions(ctx, recorder, dryrun.SqlAdmin)
+	if err != nil {
+		return nil, err
+	}
+	sqlAdminService, err := sqladmin.NewService(ctx, sqlAdminOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SqlAdminService: %w", err)
 	}
 
-	datamigrationService, err := datamigration.NewService(ctx)
+	datamigrationOptions, err := restOptions(ctx, recorder, dryrun.Datamigration)
+	if err != nil {
+		return nil, err
+	}
+	datamigrationService, err := datamigration.NewService(ctx, datamigrationOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create DataMigrationService: %w", err)
 	}
 
-	dbMigrationclient, err := dms.NewDataMigrationClient(ctx)
+	var dmsOptions []option.ClientOption
+	if recorder != nil {
+		dmsOptions = append(dmsOptions, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(recorder.UnaryClientInterceptor())))
+	}
+	dbMigrationclient, err := dms.NewDataMigrationClient(ctx, dmsOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dbMigrationclient: %w", err)
 	}
 
+	metricClient, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric client: %w", err)
+	}
+
+	sqlAdmin := gcp.NewSqlAdmin(sqlAdminService)
+	httpClient := &http.Client{Timeout: httpTimeout}
+	databaseDriver := config.DatabaseDriver
+	var databaseConnector *connector.Connector
+	var egressResolver egress.Resolver
+	switch cfg.DatabaseConnection {
+	case config.DatabaseConnectionAuthorizedNetwork:
+		egressResolver, err = egress.New(cfg.Egress, httpClient)
+		if err != nil {
+			return nil, err
+		}
+	case config.DatabaseConnectionConnector:
+		ipType := connector.IpTypePublic
+		if cfg.Connectivity == config.ConnectivityPrivateIp {
+			ipType = connector.IpTypePrivate
+		}
+		databaseConnector, err = connector.New(ctx, ipType)
+		if err != nil {
+			return nil, err
+		}
+		databaseDriver = databaseConnector.Driver
+		// Connections through the connector are authorized by IAM, so the migrator has no outgoing ips to authorize
+		egressResolver, err = egress.Static()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown database connection %q, expected %s or %s", cfg.DatabaseConnection, config.DatabaseConnectionAuthorizedNetwork, config.DatabaseConnectionConnector)
+	}
+
+	switch cfg.Connectivity {
+	case config.ConnectivityStaticIp:
+	case config.ConnectivityPrivateIp:
+		// The private ips of the instances are reached from the VPC, so the migrator has no outgoing ips to authorize
+		egressResolver, err = egress.Static()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown connectivity %q, expected %s or %s", cfg.Connectivity, config.ConnectivityStaticIp, config.ConnectivityPrivateIp)
+	}
+
 	logger = logger.With(
 		"migrationApp", cfg.ApplicationName,
 		"migrationTarget", cfg.TargetInstance.Name,
@@ -66,20 +175,40 @@ func Main(ctx context.Context, cfg *config.Config, phase any, logger *slog.Logge
 	)
 
 	return &Manager{
-		Logger:               logger,
-		AppClient:            appClient,
-		SqlInstanceClient:    sqlInstanceClient,
-		SqlSslCertClient:     sqlSslCertClient,
-		SqlDatabaseClient:    sqlDatabaseClient,
-		SqlUserClient:        sqlUserClient,
-		SqlAdminService:      sqlAdminService,
-		DatamigrationService: datamigrationService,
-		DBMigrationClient:    dbMigrationclient,
-		K8sClient:            clientset,
+		Logger:            logger,
+		AppClient:         appClient,
+		SqlInstanceClient: sqlInstanceClient,
+		SqlSslCertClient:  sqlSslCertClient,
+		SqlDatabaseClient: sqlDatabaseClient,
+		SqlUserClient:     sqlUserClient,
+		K8sClient:         clientset,
+		SqlAdmin:          sqlAdmin,
+		Datamigration:     gcp.NewDatamigration(datamigrationService, dbMigrationclient),
+		Monitoring:        gcp.NewMonitoring(metricClient),
+		HttpClient:        httpClient,
+		Egress:            egressResolver,
+		DatabaseDriver:    databaseDriver,
+		Connector:         databaseConnector,
+		Connectivity:      cfg.Connectivity,
+		Progress:          reporter,
+		DryRun:            recorder,
 	}, nil
 }
 
-func newK8sClient() (kubernetes.Interface, dynamic.Interface, error) {
+// restOptions returns the options for a GCP REST service, with an http client recording mutations in a dry run
+func restOptions(ctx context.Context, recorder *dryrun.Recorder, service string) ([]option.ClientOption, error) {
+	if recorder == nil {
+		return nil, nil
+	}
+	client, _, err := htransport.NewClient(ctx, option.WithScopes(sqladmin.CloudPlatformScope))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client for %s: %w", service, err)
+	}
+	client.Transport = recorder.Transport(service, client.Transport)
+	return []option.ClientOption{option.WithHTTPClient(client)}, nil
+}
+
+func newK8sClient(recorder *dryrun.Recorder) (kubernetes.Interface, dynamic.Interface, error) {
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	configOverrides := &clientcmd.ConfigOverrides{}
 	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
@@ -88,6 +217,11 @@ func newK8sClient() (kubernetes.Interface, dynamic.Interface, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get cluster config: %w", err)
 	}
+	if recorder != nil {
+		clusterConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return recorder.Transport(dryrun.Kubernetes, rt)
+		})
+	}
 
 	clientset, err := kubernetes.NewForConfig(clusterConfig)
 	if err != nil {
@@ -113,3 +247,18 @@ func HelperName(basename string) (string, error) {
 
 	return helperName, nil
 }
+
+// Identity identifies who is running the migrator, as user@host
+func Identity() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		u = &user.User{Username: "unknown"}
+	}
+
+	h, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s@%s", u.Username, h), nil
+}
@@ -0,0 +1,95 @@
+package common_main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/dryrun"
+)
+
+// Started logs and reports the start of the phase.
+// migrationStepsTotal is still logged, for versions of nais-cli that read progress from the log.
+func (m *Manager) Started(stepsTotal int, msg string, args ...any) {
+	m.Logger.Info(msg, append(args, "migrationStepsTotal", stepsTotal)...)
+	m.Progress.Started(stepsTotal)
+}
+
+// Step logs and reports the start of a numbered step
+func (m *Manager) Step(step int, msg string, args ...any) {
+	m.Logger.Info(msg, append(args, "migrationStep", step)...)
+	m.Progress.Step(step, msg)
+}
+
+// Status logs and reports what the current step is waiting for, args are key-value pairs like for the logger
+func (m *Manager) Status(msg string, args ...any) {
+	m.Logger.Info(msg, args...)
+	m.Progress.Status(msg, args...)
+}
+
+// Skip logs and reports that the steps from and to (inclusive) are skipped
+func (m *Manager) Skip(from, to int, msg string, args ...any) {
+	m.Logger.Info(msg, args...)
+	m.Progress.Skip(from, to, msg)
+}
+
+// Warn logs and reports a warning the user must act on
+func (m *Manager) Warn(msg string, args ...any) {
+	m.Logger.Warn(msg, args...)
+	m.Progress.Warning(msg)
+}
+
+// Done logs and reports the final step, and that the phase completed successfully. A dry run prints the recorded changes.
+func (m *Manager) Done(step int, msg string, args ...any) {
+	if m.BeforeDone != nil {
+		m.BeforeDone()
+	}
+	m.Step(step, msg, args...)
+	m.Progress.Done()
+	if m.DryRun != nil {
+		m.WriteDryRun()
+	}
+}
+
+// Fail logs and reports a failure, and exits the process with exitCode.
+// The error is taken from the "error" attribute in args.
+// A dry run stopped by a wait is not a failure, the changes recorded up to that step are printed and the process exits with 0.
+func (m *Manager) Fail(exitCode int, msg string, args ...any) {
+	var err error
+	for i := 0; i+1 < len(args); i += 2 {
+		if key, ok := args[i].(string); ok && key == "error" {
+			err, _ = args[i+1].(error)
+		}
+	}
+
+	if m.DryRun != nil && errors.Is(err, dryrun.ErrWait) {
+		m.Logger.Info("dry run stopped, the remaining steps depend on changes that were not made", "step", msg, "error", err)
+		m.Progress.Done()
+		m.WriteDryRun()
+		m.exit(0)
+	}
+
+	m.Logger.Error(msg, args...)
+	m.Progress.Fail(msg, err, exitCode)
+	if m.DryRun != nil {
+		m.WriteDryRun()
+	}
+	m.exit(exitCode)
+}
+
+func (m *Manager) exit(code int) {
+	if m.BeforeExit != nil {
+		m.BeforeExit()
+	}
+	if m.Exit != nil {
+		m.Exit(code)
+		return
+	}
+	os.Exit(code)
+}
+
+// WriteDryRun prints the changes recorded in a dry run
+func (m *Manager) WriteDryRun() {
+	if err := m.DryRun.Write(os.Stdout); err != nil {
+		m.Logger.Error("failed to write the changes recorded in the dry run", "error", err)
+	}
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	PostgresDatabaseName = "postgres"
 	PostgresDatabaseUser = "postgres"
@@ -7,25 +9,126 @@ const (
 	DatabaseDriver       = "postgres"
 )
 
+const (
+	// DatabaseConnectionAuthorizedNetwork connects to the public ip of the instances, from outgoing ips authorized on them
+	DatabaseConnectionAuthorizedNetwork = "AUTHORIZED_NETWORK"
+	// DatabaseConnectionConnector connects through the Cloud SQL connector, with ephemeral certificates authorized by IAM
+	DatabaseConnectionConnector = "CONNECTOR"
+)
+
+const (
+	// ConnectivityStaticIp reaches the instances on their public ip, authorizing who connects to them
+	ConnectivityStaticIp = "STATIC_IP"
+	// ConnectivityPrivateIp reaches the instances on their private ip, with VPC peering for the migration job
+	ConnectivityPrivateIp = "PRIVATE_IP"
+)
+
+// InstanceSettings override the settings copied from the sql instance being migrated from.
+// Settings that are not set keep the value of the copied instance.
 type InstanceSettings struct {
-	Name           string `env:"NAME, required"`
-	Type           string `env:"TYPE"`
-	Tier           string `env:"TIER"`
-	DiskSize       int    `env:"DISK_SIZE"`
-	DiskAutoresize *bool  `env:"DISK_AUTORESIZE, noinit"`
+	Name                string `env:"NAME, required" help:"Name of the sql instance"`
+	Type                string `env:"TYPE" help:"Type of the sql instance, like POSTGRES_16"`
+	Tier                string `env:"TIER" help:"Tier of the sql instance, like db-custom-1-3840"`
+	DiskSize            int    `env:"DISK_SIZE" help:"Disk size of the sql instance in GB"`
+	DiskAutoresize      *bool  `env:"DISK_AUTORESIZE, noinit" help:"Let the disk of the sql instance grow automatically"`
+	PreserveEnvVarNames bool   `env:"PRESERVE_ENV_VAR_NAMES" help:"Keep the database environment variable names the application uses today"`
+
+	HighAvailability    *bool  `env:"HIGH_AVAILABILITY, noinit" help:"Run the sql instance with a standby in another zone"`
+	PointInTimeRecovery *bool  `env:"POINT_IN_TIME_RECOVERY, noinit" help:"Keep transaction logs for point-in-time recovery"`
+	MaintenanceDay      *int   `env:"MAINTENANCE_DAY, noinit" help:"Day of the maintenance window, 1 is Monday"`
+	MaintenanceHour     *int   `env:"MAINTENANCE_HOUR, noinit" help:"Hour (UTC) the maintenance window starts"`
+	InsightsEnabled     *bool  `env:"INSIGHTS_ENABLED, noinit" help:"Enable Query Insights"`
+	RetainedBackups     *int   `env:"RETAINED_BACKUPS, noinit" help:"Number of daily backups to keep"`
+	AutoBackupHour      *int   `env:"AUTO_BACKUP_HOUR, noinit" help:"Hour (UTC) the daily backup starts"`
+	Collation           string `env:"COLLATION" help:"Default collation of the databases, like en_US.UTF8"`
+
+	// Flags are set after RemoveFlags are removed, so a flag in both is set
+	Flags        map[string]string `env:"FLAGS, delimiter=;" help:"Database flags to set, like max_connections:200;pgaudit.log:read,write"`
+	RemoveFlags  []string          `env:"REMOVE_FLAGS" help:"Names of database flags to remove"`
+	ReplaceFlags bool              `env:"REPLACE_FLAGS" help:"Use only the database flags in FLAGS, instead of adding them to the flags of the copied instance"`
 }
 
 type Config struct {
 	// The name of the application
-	ApplicationName string `env:"APP_NAME, required"`
+	ApplicationName string `env:"APP_NAME, required" help:"Name of the application"`
 	// The namespace to work in
-	Namespace string `env:"NAMESPACE, required"`
+	Namespace string `env:"NAMESPACE, required" help:"Namespace of the application"`
+	// Migration plan the configuration was read from, if any
+	PlanFile string `env:"PLAN_FILE" help:"Migration plan file (YAML or JSON), flags and environment variables override its settings"`
+	// Record the changes instead of making them
+	DryRun bool `env:"DRY_RUN" help:"Record the changes the phase would make, and print them instead of making them"`
 	// New instance configuration
-	TargetInstance InstanceSettings `env:", prefix=TARGET_INSTANCE_"`
+	TargetInstance InstanceSettings `env:", prefix=TARGET_INSTANCE_" help:"Target instance"`
+
+	// When replication lag is low enough to promote
+	Lag Lag `env:", prefix=LAG_" help:"Replication lag policy"`
+
+	// Checks made during the migration
+	Verification Verification `env:", prefix=VERIFY_" help:"Verification"`
+
+	// How the temporary passwords of the postgres user are made
+	Password PasswordPolicy `env:", prefix=PASSWORD_" help:"Password policy"`
+
+	// How the migrator connects to the databases of the instances
+	DatabaseConnection string `env:"DATABASE_CONNECTION, default=AUTHORIZED_NETWORK" help:"How the migrator connects to the databases: AUTHORIZED_NETWORK or CONNECTOR"`
+
+	// How Database Migration Service and the migrator reach the instances
+	Connectivity string `env:"CONNECTIVITY, default=STATIC_IP" help:"How the instances are reached: STATIC_IP on their public ip, or PRIVATE_IP with VPC peering"`
+
+	// Where the Database Migration Service resources are, which must be the region of the instances
+	Location string `env:"LOCATION" help:"Region of the migration job and connection profiles, like europe-north1, defaults to the region of the instances"`
+
+	// How the migrator finds its outgoing ip addresses, when connecting over authorized networks
+	Egress Egress `env:", prefix=EGRESS_" help:"Egress"`
+
+	// Commands to run before and after phases, only configurable in the migration plan
+	Hooks []Hook
 
 	// Logging configuration
-	Logging
+	Logging `help:"Logging"`
+
+	// Progress event stream
+	Events Events `help:"Progress events"`
 
 	// Development mode config
-	Development Development `env:", prefix=DEVELOPMENT_MODE_"`
+	Development Development `env:", prefix=DEVELOPMENT_MODE_" help:"Development mode"`
+}
+
+type Lag struct {
+	AcceptableBytes int64         `env:"ACCEPTABLE_BYTES, default=16777216" help:"Replication lag in bytes low enough to stop the application before promoting"`
+	ZeroPoints      int           `env:"ZERO_POINTS, default=3" help:"Number of consecutive measurements of zero lag required to promote"`
+	Timeout         time.Duration `env:"TIMEOUT, default=10m" help:"How long to wait for the replication lag to become low enough"`
+}
+
+type Verification struct {
+	// Only relevant with PreserveEnvVarNames
+	SecretKeys bool `env:"SECRET_KEYS, default=true" help:"Check before and after the switch that the database secret keys match those recorded by setup, when preserving env var names"`
+	// Changes to the sql instances of the application during a migration are normally refused by promote
+	AllowInstanceChanges bool `env:"ALLOW_INSTANCE_CHANGES" help:"Promote even if the sql instances or replicas of the application were changed after setup"`
+}
+
+// MinPasswordLength is the shortest temporary password allowed by the password policy
+const MinPasswordLength = 16
+
+// PasswordPolicy is how the passwords the migrator sets on the postgres user during the migration are made.
+// The passwords are rotated to unknown values when the migrator is done with them.
+type PasswordPolicy struct {
+	Length int `env:"LENGTH, default=32" help:"Length of the temporary passwords of the postgres user, at least 16"`
+	// Instances with a password validation policy may require symbols
+	Symbols bool `env:"SYMBOLS" help:"Include symbols in the temporary passwords of the postgres user"`
+}
+
+// Egress is how the migrator finds the outgoing ip addresses it connects to the instances from, see the egress package
+type Egress struct {
+	Strategy string   `env:"STRATEGY, default=ECHO" help:"How to find the outgoing ip of the migrator: IP, NAT or ECHO"`
+	Ip       string   `env:"IP" help:"Outgoing ip of the migrator, for the IP strategy"`
+	NatIps   []string `env:"NAT_IPS" help:"NAT ips of the cluster, all authorized for the NAT strategy"`
+	EchoUrl  string   `env:"ECHO_URL, default=https://api.ipify.org" help:"Endpoint answering with the ip of the caller, for the ECHO strategy"`
+	// The network policy of the migration job allows the echo endpoint, at the addresses its host name has during setup unless set
+	EchoIps []string `env:"ECHO_IPS" help:"Ips of the echo endpoint to allow in the network policy, looked up when not set"`
+}
+
+// Common returns the configuration shared by all phases, also for the phase specific configurations embedding it
+func (c *Config) Common() *Config {
+	return c
 }
@@ -57,6 +57,20 @@ var _ = Describe("Common", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(cfg.TargetInstance.DiskAutoresize).To(BeNil())
 		})
+
+		It("should not preserve env var names", func() {
+			cfg := &config.Config{}
+			err := envconfig.ProcessWith(context.Background(), &envconfig.Config{
+				Target: cfg,
+				Lookuper: envconfig.MapLookuper(map[string]string{
+					"APP_NAME":             appName,
+					"NAMESPACE":            namespace,
+					"TARGET_INSTANCE_NAME": targetInstanceName,
+				}),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.TargetInstance.PreserveEnvVarNames).To(BeFalse())
+		})
 	})
 
 	When("all regular environment variables are set", func() {
@@ -65,13 +79,14 @@ var _ = Describe("Common", func() {
 			err := envconfig.ProcessWith(context.Background(), &envconfig.Config{
 				Target: cfg,
 				Lookuper: envconfig.MapLookuper(map[string]string{
-					"APP_NAME":                        appName,
-					"NAMESPACE":                       namespace,
-					"TARGET_INSTANCE_NAME":            targetInstanceName,
-					"TARGET_INSTANCE_TIER":            "db-f1-micro",
-					"TARGET_INSTANCE_DISK_SIZE":       "10",
-					"TARGET_INSTANCE_TYPE":            "POSTGRES_16",
-					"TARGET_INSTANCE_DISK_AUTORESIZE": "true",
+					"APP_NAME":                               appName,
+					"NAMESPACE":                              namespace,
+					"TARGET_INSTANCE_NAME":                   targetInstanceName,
+					"TARGET_INSTANCE_TIER":                   "db-f1-micro",
+					"TARGET_INSTANCE_DISK_SIZE":              "10",
+					"TARGET_INSTANCE_TYPE":                   "POSTGRES_16",
+					"TARGET_INSTANCE_DISK_AUTORESIZE":        "true",
+					"TARGET_INSTANCE_PRESERVE_ENV_VAR_NAMES": "true",
 				}),
 			})
 			Expect(err).ToNot(HaveOccurred())
@@ -82,6 +97,7 @@ var _ = Describe("Common", func() {
 			Expect(cfg.TargetInstance.DiskSize).To(Equal(10))
 			Expect(cfg.TargetInstance.Type).To(Equal("POSTGRES_16"))
 			Expect(cfg.TargetInstance.DiskAutoresize).To(Equal(ptr.To(true)))
+			Expect(cfg.TargetInstance.PreserveEnvVarNames).To(BeTrue())
 		})
 	})
 
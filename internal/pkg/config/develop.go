@@ -2,8 +2,8 @@ package config
 
 type Development struct {
 	// Skips taking backups
-	SkipBackup bool `env:"SKIP_BACKUP"`
+	SkipBackup bool `env:"SKIP_BACKUP" help:"Skip taking a backup of the source instance (development only)"`
 
 	// Sets an unsafe, pre-defined password for postgres user
-	UnsafePassword bool `env:"UNSAFE_PASSWORD"`
+	UnsafePassword bool `env:"UNSAFE_PASSWORD" help:"Use an unsafe, pre-defined password for the postgres user (development only)"`
 }
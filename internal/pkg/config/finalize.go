@@ -4,5 +4,5 @@ type FinalizeConfig struct {
 	Config
 
 	// Source instance name
-	SourceInstanceName string `env:"SOURCE_INSTANCE_NAME, required"`
+	SourceInstanceName string `env:"SOURCE_INSTANCE_NAME, required" help:"Name of the source sql instance to remove"`
 }
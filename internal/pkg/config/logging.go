@@ -1,28 +1,82 @@
 package config
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+
+	"golang.org/x/term"
 )
 
 type Logging struct {
-	Level  slog.Level `env:"LOG_LEVEL, default=INFO"`
-	Format string     `env:"LOG_FORMAT, default=TEXT"`
+	Level  slog.Level `env:"LOG_LEVEL, default=INFO" help:"Log level, one of DEBUG, INFO, WARN or ERROR"`
+	Format string     `env:"LOG_FORMAT, default=TEXT" help:"Log format, TEXT or JSON"`
+	// Render progress in the terminal and write logs to File, detected from stdout when not set
+	Interactive *bool `env:"INTERACTIVE, noinit" help:"Render progress in the terminal and write logs to the log file, detected from stdout when not set"`
+	// File logs are appended to in interactive mode, defaults to a file per application in the temp directory
+	File string `env:"LOG_FILE" help:"File logs are appended to in interactive mode"`
+	// Output is where logs are written when not in interactive mode, stdout when nil
+	Output io.Writer
+}
+
+// IsInteractive reports whether progress should be rendered in the terminal instead of logging to stdout
+func (l *Logging) IsInteractive() bool {
+	if l.Interactive != nil {
+		return *l.Interactive
+	}
+	return term.IsTerminal(int(os.Stdout.Fd()))
 }
 
+// Events configures where machine-readable progress events are written, see the progress package
+type Events struct {
+	// File to append events to
+	File string `env:"EVENTS_FILE" help:"File to append progress events to, as JSON lines"`
+	// File descriptor to write events to, inherited from the parent process
+	FD int `env:"EVENTS_FD" help:"File descriptor to write progress events to, as JSON lines"`
+}
+
+// SetupLogging sets up the default logger, masking secrets in what is logged, see RedactHandler
 func SetupLogging(conf *Config) *slog.Logger {
 	opts := &slog.HandlerOptions{
 		Level:     conf.Logging.Level,
 		AddSource: true,
 	}
+	out := logOutput(conf)
 	var handler slog.Handler
 	if conf.Logging.Format == "JSON" {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(out, opts)
 	} else {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+		handler = slog.NewTextHandler(out, opts)
 	}
-	logger := slog.New(handler)
+	logger := slog.New(NewRedactHandler(handler))
 	slog.SetDefault(logger)
 
 	return logger
 }
+
+// logOutput opens the log file in interactive mode, and falls back to logging to stdout if it can't be opened
+func logOutput(conf *Config) io.Writer {
+	if !conf.Logging.IsInteractive() {
+		return conf.Logging.stdout()
+	}
+	if conf.Logging.File == "" {
+		conf.Logging.File = filepath.Join(os.TempDir(), fmt.Sprintf("cloudsql-migrator-%s.log", conf.ApplicationName))
+	}
+	f, err := os.OpenFile(conf.Logging.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open log file, disabling interactive mode: %v\n", err)
+		interactive := false
+		conf.Logging.Interactive = &interactive
+		return conf.Logging.stdout()
+	}
+	return f
+}
+
+func (l *Logging) stdout() io.Writer {
+	if l.Output != nil {
+		return l.Output
+	}
+	return os.Stdout
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed plan.schema.json
+var planSchemaJSON []byte
+
+var planSchema = sync.OnceValue(func() *spec.Schema {
+	schema := &spec.Schema{}
+	if err := json.Unmarshal(planSchemaJSON, schema); err != nil {
+		panic(fmt.Sprintf("invalid migration plan schema: %v", err))
+	}
+	return schema
+})
+
+// Plan is a declarative description of a migration, accepted by every phase.
+// The settings in the plan are overridden by environment variables and flags.
+type Plan struct {
+	Application        string           `json:"application"`
+	Namespace          string           `json:"namespace"`
+	Target             PlanInstance     `json:"target"`
+	Source             PlanInstance     `json:"source"`
+	Lag                PlanLag          `json:"lag"`
+	Verification       PlanVerification `json:"verification"`
+	Password           PlanPassword     `json:"password"`
+	DatabaseConnection string           `json:"databaseConnection"`
+	Connectivity       string           `json:"connectivity"`
+	Location           string           `json:"location"`
+	Egress             PlanEgress       `json:"egress"`
+	Hooks              []Hook           `json:"hooks"`
+}
+
+type PlanInstance struct {
+	Name                string             `json:"name"`
+	Type                string             `json:"type"`
+	Tier                string             `json:"tier"`
+	DiskSize            int                `json:"diskSize"`
+	DiskAutoresize      *bool              `json:"diskAutoresize"`
+	PreserveEnvVarNames *bool              `json:"preserveEnvVarNames"`
+	HighAvailability    *bool              `json:"highAvailability"`
+	PointInTimeRecovery *bool              `json:"pointInTimeRecovery"`
+	Maintenance         PlanMaintenance    `json:"maintenance"`
+	Insights            PlanInsights       `json:"insights"`
+	RetainedBackups     *int               `json:"retainedBackups"`
+	AutoBackupHour      *int               `json:"autoBackupHour"`
+	Collation           string             `json:"collation"`
+	Flags               []PlanDatabaseFlag `json:"flags"`
+	RemoveFlags         []string           `json:"removeFlags"`
+	ReplaceFlags        *bool              `json:"replaceFlags"`
+}
+
+type PlanMaintenance struct {
+	Day  *int `json:"day"`
+	Hour *int `json:"hour"`
+}
+
+type PlanInsights struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type PlanDatabaseFlag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PlanLag struct {
+	AcceptableBytes *int64 `json:"acceptableBytes"`
+	ZeroPoints      *int   `json:"zeroPoints"`
+	Timeout         string `json:"timeout"`
+}
+
+type PlanVerification struct {
+	SecretKeys           *bool `json:"secretKeys"`
+	AllowInstanceChanges *bool `json:"allowInstanceChanges"`
+}
+
+type PlanPassword struct {
+	Length  *int  `json:"length"`
+	Symbols *bool `json:"symbols"`
+}
+
+type PlanEgress struct {
+	Strategy string   `json:"strategy"`
+	Ip       string   `json:"ip"`
+	NatIps   []string `json:"natIps"`
+	EchoUrl  string   `json:"echoUrl"`
+	EchoIps  []string `json:"echoIps"`
+}
+
+const (
+	HookBefore = "before"
+	HookAfter  = "after"
+)
+
+// Hook is a command run before or after a phase
+type Hook struct {
+	// Phase is the name of the phase, like promote
+	Phase string `json:"phase"`
+	// When is HookBefore or HookAfter
+	When string `json:"when"`
+	// Command is the command and its arguments, run without a shell
+	Command []string `json:"command"`
+}
+
+// LoadPlan reads and validates the migration plan in path
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration plan: %w", err)
+	}
+	plan, err := ParsePlan(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plan, nil
+}
+
+// ParsePlan parses a migration plan in YAML or JSON, and validates it against the plan schema
+func ParsePlan(data []byte) (*Plan, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse migration plan: %w", err)
+	}
+
+	var document any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse migration plan: %w", err)
+	}
+	if err := validate.AgainstSchema(planSchema(), document, strfmt.Default); err != nil {
+		return nil, fmt.Errorf("invalid migration plan: %w", err)
+	}
+
+	plan := &Plan{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(plan); err != nil {
+		return nil, fmt.Errorf("failed to decode migration plan: %w", err)
+	}
+	return plan, nil
+}
+
+// Env returns the settings in the plan as the environment variables they correspond to
+func (p *Plan) Env() map[string]string {
+	env := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	setBool := func(key string, value *bool) {
+		if value != nil {
+			set(key, strconv.FormatBool(*value))
+		}
+	}
+	setInt := func(key string, value *int) {
+		if value != nil {
+			set(key, strconv.Itoa(*value))
+		}
+	}
+
+	set("APP_NAME", p.Application)
+	set("NAMESPACE", p.Namespace)
+
+	for prefix, instance := range map[string]PlanInstance{"TARGET_INSTANCE_": p.Target, "SOURCE_INSTANCE_": p.Source} {
+		set(prefix+"NAME", instance.Name)
+		set(prefix+"TYPE", instance.Type)
+		set(prefix+"TIER", instance.Tier)
+		if instance.DiskSize > 0 {
+			set(prefix+"DISK_SIZE", strconv.Itoa(instance.DiskSize))
+		}
+		setBool(prefix+"DISK_AUTORESIZE", instance.DiskAutoresize)
+		setBool(prefix+"PRESERVE_ENV_VAR_NAMES", instance.PreserveEnvVarNames)
+		setBool(prefix+"HIGH_AVAILABILITY", instance.HighAvailability)
+		setBool(prefix+"POINT_IN_TIME_RECOVERY", instance.PointInTimeRecovery)
+		setInt(prefix+"MAINTENANCE_DAY", instance.Maintenance.Day)
+		setInt(prefix+"MAINTENANCE_HOUR", instance.Maintenance.Hour)
+		setBool(prefix+"INSIGHTS_ENABLED", instance.Insights.Enabled)
+		setInt(prefix+"RETAINED_BACKUPS", instance.RetainedBackups)
+		setInt(prefix+"AUTO_BACKUP_HOUR", instance.AutoBackupHour)
+		set(prefix+"COLLATION", instance.Collation)
+		flags := make([]string, 0, len(instance.Flags))
+		for _, flag := range instance.Flags {
+			flags = append(flags, flag.Name+":"+flag.Value)
+		}
+		set(prefix+"FLAGS", strings.Join(flags, ";"))
+		set(prefix+"REMOVE_FLAGS", strings.Join(instance.RemoveFlags, ","))
+		setBool(prefix+"REPLACE_FLAGS", instance.ReplaceFlags)
+	}
+
+	if p.Lag.AcceptableBytes != nil {
+		set("LAG_ACCEPTABLE_BYTES", strconv.FormatInt(*p.Lag.AcceptableBytes, 10))
+	}
+	if p.Lag.ZeroPoints != nil {
+		set("LAG_ZERO_POINTS", strconv.Itoa(*p.Lag.ZeroPoints))
+	}
+	set("LAG_TIMEOUT", p.Lag.Timeout)
+
+	setBool("VERIFY_SECRET_KEYS", p.Verification.SecretKeys)
+	setBool("VERIFY_ALLOW_INSTANCE_CHANGES", p.Verification.AllowInstanceChanges)
+
+	setInt("PASSWORD_LENGTH", p.Password.Length)
+	setBool("PASSWORD_SYMBOLS", p.Password.Symbols)
+
+	set("DATABASE_CONNECTION", p.DatabaseConnection)
+	set("CONNECTIVITY", p.Connectivity)
+	set("LOCATION", p.Location)
+
+	set("EGRESS_STRATEGY", p.Egress.Strategy)
+	set("EGRESS_IP", p.Egress.Ip)
+	set("EGRESS_NAT_IPS", strings.Join(p.Egress.NatIps, ","))
+	set("EGRESS_ECHO_URL", p.Egress.EchoUrl)
+	set("EGRESS_ECHO_IPS", strings.Join(p.Egress.EchoIps, ","))
+
+	return env
+}
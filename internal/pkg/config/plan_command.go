@@ -0,0 +1,13 @@
+package config
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+type PlanCommandConfig struct {
+	Config
+
+	// Format of the plan written to stdout
+	Output string `env:"OUTPUT, default=text" help:"Output format, text or json"`
+}
@@ -0,0 +1,127 @@
+package config_test
+
+import (
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plan", func() {
+	It("parses a plan in YAML", func() {
+		plan, err := config.ParsePlan([]byte(`
+application: myapp
+namespace: mynamespace
+target:
+  name: myinstance
+  tier: db-custom-1-3840
+  diskAutoresize: true
+lag:
+  acceptableBytes: 1024
+  timeout: 20m
+verification:
+  secretKeys: false
+password:
+  length: 40
+hooks:
+  - phase: promote
+    when: before
+    command: ["notify", "promoting"]
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Hooks).To(Equal([]config.Hook{{Phase: "promote", When: config.HookBefore, Command: []string{"notify", "promoting"}}}))
+		Expect(plan.Env()).To(Equal(map[string]string{
+			"APP_NAME":                        appName,
+			"NAMESPACE":                       namespace,
+			"TARGET_INSTANCE_NAME":            targetInstanceName,
+			"TARGET_INSTANCE_TIER":            "db-custom-1-3840",
+			"TARGET_INSTANCE_DISK_AUTORESIZE": "true",
+			"LAG_ACCEPTABLE_BYTES":            "1024",
+			"LAG_TIMEOUT":                     "20m",
+			"VERIFY_SECRET_KEYS":              "false",
+			"PASSWORD_LENGTH":                 "40",
+		}))
+	})
+
+	It("maps instance settings to environment variables", func() {
+		plan, err := config.ParsePlan([]byte(`
+application: myapp
+namespace: mynamespace
+target:
+  name: myinstance
+  highAvailability: true
+  maintenance:
+    day: 1
+  insights:
+    enabled: false
+  retainedBackups: 14
+  flags:
+    - name: max_connections
+      value: "200"
+    - name: pgaudit.log
+      value: read,write
+  removeFlags: [work_mem, temp_file_limit]
+`))
+		Expect(err).NotTo(HaveOccurred())
+		env := plan.Env()
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_HIGH_AVAILABILITY", "true"))
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_MAINTENANCE_DAY", "1"))
+		Expect(env).NotTo(HaveKey("TARGET_INSTANCE_MAINTENANCE_HOUR"))
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_INSIGHTS_ENABLED", "false"))
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_RETAINED_BACKUPS", "14"))
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_FLAGS", "max_connections:200;pgaudit.log:read,write"))
+		Expect(env).To(HaveKeyWithValue("TARGET_INSTANCE_REMOVE_FLAGS", "work_mem,temp_file_limit"))
+	})
+
+	It("maps connection settings to environment variables", func() {
+		plan, err := config.ParsePlan([]byte(`
+application: myapp
+namespace: mynamespace
+target:
+  name: myinstance
+databaseConnection: CONNECTOR
+connectivity: PRIVATE_IP
+location: europe-north1
+egress:
+  strategy: NAT
+  natIps: [192.0.2.1, 192.0.2.2]
+  echoUrl: https://echo.example.com
+  echoIps: [198.51.100.1]
+`))
+		Expect(err).NotTo(HaveOccurred())
+		env := plan.Env()
+		Expect(env).To(HaveKeyWithValue("DATABASE_CONNECTION", "CONNECTOR"))
+		Expect(env).To(HaveKeyWithValue("CONNECTIVITY", "PRIVATE_IP"))
+		Expect(env).To(HaveKeyWithValue("LOCATION", "europe-north1"))
+		Expect(env).To(HaveKeyWithValue("EGRESS_STRATEGY", "NAT"))
+		Expect(env).NotTo(HaveKey("EGRESS_IP"))
+		Expect(env).To(HaveKeyWithValue("EGRESS_NAT_IPS", "192.0.2.1,192.0.2.2"))
+		Expect(env).To(HaveKeyWithValue("EGRESS_ECHO_URL", "https://echo.example.com"))
+		Expect(env).To(HaveKeyWithValue("EGRESS_ECHO_IPS", "198.51.100.1"))
+	})
+
+	It("parses a plan in JSON", func() {
+		plan, err := config.ParsePlan([]byte(`{"application": "myapp", "namespace": "mynamespace", "target": {"name": "myinstance"}, "source": {"name": "oldinstance", "diskSize": 20}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.Env()).To(HaveKeyWithValue("SOURCE_INSTANCE_NAME", "oldinstance"))
+		Expect(plan.Env()).To(HaveKeyWithValue("SOURCE_INSTANCE_DISK_SIZE", "20"))
+	})
+
+	DescribeTable("rejects invalid plans", func(plan string) {
+		_, err := config.ParsePlan([]byte(plan))
+		Expect(err).To(MatchError(ContainSubstring("invalid migration plan")))
+	},
+		Entry("missing target name", `{application: myapp, namespace: mynamespace, target: {}}`),
+		Entry("unknown field", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, unknown: true}`),
+		Entry("unknown hook phase", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, hooks: [{phase: deploy, when: before, command: [true]}]}`),
+		Entry("empty hook command", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, hooks: [{phase: setup, when: after, command: []}]}`),
+		Entry("maintenance day out of range", `{application: myapp, namespace: mynamespace, target: {name: myinstance, maintenance: {day: 8}}}`),
+		Entry("flag value with a semicolon", `{application: myapp, namespace: mynamespace, target: {name: myinstance, flags: [{name: a, value: "b;c"}]}}`),
+		Entry("short password", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, password: {length: 8}}`),
+		Entry("malformed timeout", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, lag: {timeout: soon}}`),
+		Entry("unknown database connection", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, databaseConnection: PROXY}`),
+		Entry("unknown connectivity", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, connectivity: VPN}`),
+		Entry("malformed location", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, location: Europe}`),
+		Entry("unknown egress strategy", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, egress: {strategy: GUESS}}`),
+		Entry("egress ip that is not IPv4", `{application: myapp, namespace: mynamespace, target: {name: myinstance}, egress: {strategy: IP, ip: "2001:db8::1"}}`),
+	)
+})
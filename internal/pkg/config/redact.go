@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in logs
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of attribute keys whose values are secrets, compared in lower case
+var sensitiveKeys = []string{"password", "secret", "token", "privatekey", "private_key", "sslclientkey", "credential"}
+
+var (
+	privateKeyPattern = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----\n?`)
+	// password=secret in a libpq connection string, quoted or not
+	dsnPasswordPattern = regexp.MustCompile(`(?i)\bpassword\s*=\s*('(?:[^'\\]|\\.)*'|[^\s']+)`)
+	// user:secret@ in a URL
+	urlPasswordPattern = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://[^:/@\s]*):[^@\s]+@`)
+	// "password": "secret" in JSON, also for keys like "postgresPassword"
+	jsonPasswordPattern = regexp.MustCompile(`(?i)("[a-z_]*password"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// PostgresPassword:secret in structs formatted with %+v
+	fieldPasswordPattern = regexp.MustCompile(`\b(\w*(?:Password|PrivateKey|SslClientKey)):([^\s{}][^\s}]*)`)
+)
+
+// RedactString masks the secrets found in s: private keys, and passwords in connection strings, URLs, JSON and formatted structs
+func RedactString(s string) string {
+	if s == "" {
+		return s
+	}
+	s = privateKeyPattern.ReplaceAllString(s, Redacted)
+	s = dsnPasswordPattern.ReplaceAllString(s, "password="+Redacted)
+	s = urlPasswordPattern.ReplaceAllString(s, "$1:"+Redacted+"@")
+	s = jsonPasswordPattern.ReplaceAllString(s, `$1"`+Redacted+`"`)
+	s = fieldPasswordPattern.ReplaceAllStringFunc(s, func(field string) string {
+		name, value, _ := strings.Cut(field, ":")
+		if value == "true" || value == "false" || value == Redacted {
+			return field
+		}
+		return name + ":" + Redacted
+	})
+	return s
+}
+
+// RedactValue returns Redacted in place of a secret that is set, and nothing in place of one that is not
+func RedactValue(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// RedactHandler masks secrets in the records it passes on: the values of attributes with keys naming a secret,
+// and secrets found in messages, strings, errors and other values, see RedactString.
+// Types holding secrets implement slog.LogValuer, so they are logged without them in the first place.
+type RedactHandler struct {
+	handler slog.Handler
+}
+
+func NewRedactHandler(handler slog.Handler) *RedactHandler {
+	return &RedactHandler{handler: handler}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, RedactString(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, redactAttr(attr))
+	}
+	return &RedactHandler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{handler: h.handler.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+
+	if value.Kind() == slog.KindGroup {
+		attrs := value.Group()
+		redacted := make([]slog.Attr, 0, len(attrs))
+		for _, a := range attrs {
+			redacted = append(redacted, redactAttr(a))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	if isSensitiveKey(attr.Key) {
+		if value.Kind() == slog.KindString && value.String() == "" {
+			return slog.Attr{Key: attr.Key, Value: value}
+		}
+		return slog.String(attr.Key, Redacted)
+	}
+
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, RedactString(value.String()))
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, RedactString(err.Error()))
+		}
+		// Values are only replaced when they hold a secret, so they keep their form in the output otherwise
+		formatted := fmt.Sprintf("%+v", value.Any())
+		if redacted := RedactString(formatted); redacted != formatted {
+			return slog.String(attr.Key, redacted)
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,5 +4,5 @@ type RollbackConfig struct {
 	Config
 
 	// Source instance configuration
-	SourceInstance InstanceSettings `env:", prefix=SOURCE_INSTANCE_"`
+	SourceInstance InstanceSettings `env:", prefix=SOURCE_INSTANCE_" help:"Source instance"`
 }
@@ -0,0 +1,134 @@
+// Package connector connects to the databases of Cloud SQL instances through the Cloud SQL Go connector.
+//
+// Instead of connecting to the postgres port from an authorized network, the connector has the Cloud SQL Admin API
+// sign an ephemeral client certificate, which is authorized by the IAM permissions of the caller, and dials the
+// server side proxy of the instance over TLS with it. Connections are made with the database/sql driver registered
+// by New, which is lib/pq dialing through the connector, where the host is the connection name of the instance,
+// like my-project:europe-north1:my-instance.
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/lib/pq"
+)
+
+// ProxyPort is the port of the server side proxy of Cloud SQL instances
+const ProxyPort = 3307
+
+const (
+	// IpTypePublic dials the public ip of an instance, or its private ip if it has no public ip
+	IpTypePublic = "PRIMARY"
+	// IpTypePrivate dials the private ip of an instance, in its VPC
+	IpTypePrivate = "PRIVATE"
+)
+
+var drivers atomic.Int32
+
+// Connector dials the server side proxy of instances, by their connection name
+type Connector struct {
+	// Driver is the name of the database/sql driver dialing through the connector.
+	// The host in its connection strings is the connection name of the instance, and sslmode is disable,
+	// as the connector makes the TLS connection.
+	Driver string
+
+	dialer *cloudsqlconn.Dialer
+}
+
+// New returns a Connector dialing the ip addresses of the type, and registers its driver.
+// The options configure the dialer, like how it authenticates to the Cloud SQL Admin API.
+func New(ctx context.Context, ipType string, opts ...cloudsqlconn.Option) (*Connector, error) {
+	var dialOption cloudsqlconn.DialOption
+	switch ipType {
+	case IpTypePublic:
+		dialOption = cloudsqlconn.WithAutoIP()
+	case IpTypePrivate:
+		dialOption = cloudsqlconn.WithPrivateIP()
+	default:
+		return nil, fmt.Errorf("unknown ip type %q, expected %s or %s", ipType, IpTypePublic, IpTypePrivate)
+	}
+
+	dialer, err := cloudsqlconn.NewDialer(ctx, append(opts, cloudsqlconn.WithDefaultDialOptions(dialOption))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud SQL connector: %w", err)
+	}
+
+	c := &Connector{
+		Driver: fmt.Sprintf("cloudsql-postgres-%d", drivers.Add(1)),
+		dialer: dialer,
+	}
+	sql.Register(c.Driver, &pgDriver{connector: c})
+	return c, nil
+}
+
+// ConnectionName is how the connector names an instance
+func ConnectionName(project, region, instanceName string) string {
+	return project + ":" + region + ":" + instanceName
+}
+
+// Dial returns a TLS connection to the server side proxy of the instance, authenticated with an ephemeral certificate
+func (c *Connector) Dial(ctx context.Context, connectionName string) (net.Conn, error) {
+	conn, err := c.dialer.Dial(ctx, connectionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", connectionName, err)
+	}
+	return conn, nil
+}
+
+// Close stops refreshing the certificates of the instances dialed
+func (c *Connector) Close() error {
+	return c.dialer.Close()
+}
+
+// pgDriver is lib/pq, dialing through the connector
+type pgDriver struct {
+	connector *Connector
+}
+
+func (d *pgDriver) Open(name string) (driver.Conn, error) {
+	connector, err := d.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(context.Background())
+}
+
+func (d *pgDriver) OpenConnector(name string) (driver.Connector, error) {
+	cfg, err := pq.NewConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(&dialer{connector: d.connector, connectionName: cfg.Host})
+	return connector, nil
+}
+
+// dialer dials the instance of the connection string, whatever address lib/pq asks for
+type dialer struct {
+	connector      *Connector
+	connectionName string
+}
+
+func (d *dialer) Dial(_, _ string) (net.Conn, error) {
+	return d.connector.Dial(context.Background(), d.connectionName)
+}
+
+func (d *dialer) DialTimeout(_, _ string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.connector.Dial(ctx, d.connectionName)
+}
+
+func (d *dialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return d.connector.Dial(ctx, d.connectionName)
+}
@@ -0,0 +1,291 @@
+package connector_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/nais/cloudsql-migrator/internal/pkg/connector"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/sqladmin/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const connectionName = "my-project:europe-north1:my-instance"
+
+// ca signs the certificates of the server side proxy and the ephemeral client certificates, as Cloud SQL does
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newCA() *ca {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Google Cloud SQL Server CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &ca{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (c *ca) sign(commonName string, dnsNames []string, publicKey any, usage x509.ExtKeyUsage) []byte {
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, c.cert, publicKey, c.key)
+	Expect(err).NotTo(HaveOccurred())
+	return der
+}
+
+// serve runs a server side proxy with a certificate for the common name and DNS names, requiring a client certificate
+// signed by the CA. It returns its address, and the client certificates of the connections made to it.
+func (c *ca) serve(commonName string, dnsNames ...string) (string, <-chan *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{c.sign(commonName, dnsNames, &key.PublicKey, x509.ExtKeyUsageServerAuth)}, PrivateKey: key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(listener.Close)
+
+	clients := make(chan *x509.Certificate, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0]
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String(), clients
+}
+
+// adminAPI serves the connect settings of an instance and signs its ephemeral certificates, as the Cloud SQL Admin API does
+type adminAPI struct {
+	mu       sync.Mutex
+	ca       *ca
+	settings *sqladmin.ConnectSettings
+	// certs is the number of ephemeral certificates signed
+	certs int
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	const instance = "/sql/v1beta4/projects/my-project/instances/my-instance"
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == instance+"/connectSettings":
+		_ = json.NewEncoder(w).Encode(a.settings)
+	case r.Method == http.MethodPost && r.URL.Path == instance+":generateEphemeralCert":
+		request := &sqladmin.GenerateEphemeralCertRequest{}
+		Expect(json.NewDecoder(r.Body).Decode(request)).To(Succeed())
+		block, _ := pem.Decode([]byte(request.PublicKey))
+		Expect(block).NotTo(BeNil())
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		Expect(err).NotTo(HaveOccurred())
+		a.certs++
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.ca.sign("ephemeral", nil, key, x509.ExtKeyUsageClientAuth)})
+		_ = json.NewEncoder(w).Encode(&sqladmin.GenerateEphemeralCertResponse{EphemeralCert: &sqladmin.SslCert{Cert: string(cert)}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "not found"}}`))
+	}
+}
+
+func (a *adminAPI) signed() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.certs
+}
+
+var _ = Describe("Connector", func() {
+	ctx := context.Background()
+
+	var (
+		authority *ca
+		api       *adminAPI
+		proxy     string
+		clients   <-chan *x509.Certificate
+		dialed    chan string
+	)
+
+	newConnector := func(ipType string) *connector.Connector {
+		server := httptest.NewServer(api)
+		DeferCleanup(server.Close)
+		c, err := connector.New(ctx, ipType,
+			cloudsqlconn.WithAdminAPIEndpoint(server.URL+"/"),
+			cloudsqlconn.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})),
+			// The instance is dialed on the proxy of the test, whatever ip of the instance the connector asks for
+			cloudsqlconn.WithDialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed <- addr
+				return (&net.Dialer{}).DialContext(ctx, network, proxy)
+			}),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(c.Close)
+		return c
+	}
+
+	BeforeEach(func() {
+		authority = newCA()
+		api = &adminAPI{ca: authority, settings: &sqladmin.ConnectSettings{
+			BackendType:     "SECOND_GEN",
+			Region:          "europe-north1",
+			DatabaseVersion: "POSTGRES_17",
+			IpAddresses:     []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "192.0.2.1"}, {Type: "PRIVATE", IpAddress: "10.0.0.1"}},
+			ServerCaCert:    &sqladmin.SslCert{Cert: authority.pem},
+		}}
+		proxy, clients = authority.serve("my-project:my-instance")
+		dialed = make(chan string, 10)
+	})
+
+	It("connects to the instance with an ephemeral certificate", func() {
+		conn, err := newConnector(connector.IpTypePublic).Dial(ctx, connectionName)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		Eventually(clients).Should(Receive(WithTransform(func(cert *x509.Certificate) string {
+			return cert.Subject.CommonName
+		}, Equal("ephemeral"))))
+	})
+
+	It("uses the certificate until it is about to expire", func() {
+		c := newConnector(connector.IpTypePublic)
+		for range 3 {
+			conn, err := c.Dial(ctx, connectionName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+		}
+
+		Expect(api.signed()).To(Equal(1))
+	})
+
+	It("refuses a server certificate for another instance", func() {
+		proxy, _ = authority.serve("my-project:other-instance")
+
+		_, err := newConnector(connector.IpTypePublic).Dial(ctx, connectionName)
+		Expect(err).To(MatchError(ContainSubstring(`certificate had CN "my-project:other-instance"`)))
+	})
+
+	It("refuses a server certificate signed by another CA", func() {
+		proxy, _ = newCA().serve("my-project:my-instance")
+
+		_, err := newConnector(connector.IpTypePublic).Dial(ctx, connectionName)
+		Expect(err).To(MatchError(ContainSubstring("failed to verify certificate")))
+	})
+
+	When("the server certificate of the instance is issued by a CA service", func() {
+		const dnsName = "1a2b3c4d5e6f.1a2b3c4d5e6f.europe-north1.sql.goog"
+
+		BeforeEach(func() {
+			api.settings.ServerCaMode = "GOOGLE_MANAGED_CAS_CA"
+			api.settings.DnsName = dnsName
+		})
+
+		It("connects to the instance named by the certificate", func() {
+			proxy, clients = authority.serve("", dnsName)
+
+			conn, err := newConnector(connector.IpTypePublic).Dial(ctx, connectionName)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			Eventually(clients).Should(Receive())
+		})
+
+		It("refuses a server certificate for another instance", func() {
+			proxy, _ = authority.serve("", "6f5e4d3c2b1a.6f5e4d3c2b1a.europe-north1.sql.goog")
+
+			_, err := newConnector(connector.IpTypePublic).Dial(ctx, connectionName)
+			Expect(err).To(MatchError(ContainSubstring("certificate is valid for 6f5e4d3c2b1a.6f5e4d3c2b1a.europe-north1.sql.goog")))
+		})
+	})
+
+	DescribeTable("dials the ip of the type",
+		func(ipType string, ipAddresses []*sqladmin.IpMapping, expected string) {
+			api.settings.IpAddresses = ipAddresses
+
+			conn, err := newConnector(ipType).Dial(ctx, connectionName)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			Expect(dialed).To(Receive(Equal(expected)))
+		},
+		Entry("public", connector.IpTypePublic, []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "192.0.2.1"}, {Type: "PRIVATE", IpAddress: "10.0.0.1"}}, "192.0.2.1:3307"),
+		Entry("public without a public ip", connector.IpTypePublic, []*sqladmin.IpMapping{{Type: "PRIVATE", IpAddress: "10.0.0.1"}}, "10.0.0.1:3307"),
+		Entry("private", connector.IpTypePrivate, []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "192.0.2.1"}, {Type: "PRIVATE", IpAddress: "10.0.0.1"}}, "10.0.0.1:3307"),
+	)
+
+	DescribeTable("fails before dialing",
+		func(ipType string, update func(*sqladmin.ConnectSettings), message string) {
+			update(api.settings)
+
+			_, err := newConnector(ipType).Dial(ctx, connectionName)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+			Expect(dialed).NotTo(Receive())
+		},
+		Entry("with an instance in another region", connector.IpTypePublic, func(s *sqladmin.ConnectSettings) { s.Region = "europe-west1" }, "provided region was mismatched"),
+		Entry("with an instance without a private ip", connector.IpTypePrivate, func(s *sqladmin.ConnectSettings) {
+			s.IpAddresses = []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "192.0.2.1"}}
+		}, "does not have IP of type"),
+	)
+
+	It("refuses an unknown ip type", func() {
+		_, err := connector.New(ctx, "PSC")
+		Expect(err).To(MatchError(ContainSubstring(`unknown ip type "PSC"`)))
+	})
+
+	It("dials through the connector with its driver", func() {
+		c := newConnector(connector.IpTypePublic)
+		db, err := sql.Open(c.Driver, "host="+connectionName+" port=3307 user=postgres dbname=postgres sslmode=disable connect_timeout=5")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(db.Close)
+
+		// The proxy of the test closes the connection after the handshake, so there is no database to talk to
+		Expect(db.PingContext(ctx)).NotTo(Succeed())
+		Eventually(clients).Should(Receive())
+		Expect(dialed).To(Receive(Equal("192.0.2.1:3307")))
+		Expect(api.signed()).To(Equal(1))
+	})
+})
@@ -3,43 +3,37 @@ package database
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"log/slog"
-	"net/http"
-	"strconv"
 	"time"
 
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/connector"
 	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/operation"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
 	"github.com/sethvargo/go-retry"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/sqladmin/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/rand"
 )
 
-func PrepareSourceDatabase(ctx context.Context, cfg *config.Config, source *resolved.Instance, databaseName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*instance.CertPaths, error) {
-	databasePassword := makePassword(cfg, mgr.Logger)
-	err := SetDatabasePassword(ctx, source.Name, config.PostgresDatabaseUser, databasePassword, gcpProject, mgr)
-	if err != nil {
-		return nil, err
-	}
-	source.PostgresPassword = databasePassword
+const operationTimeout = 5 * time.Minute
 
-	certPaths, err := instance.CreateSslCert(ctx, cfg, source.Name, &source.SslCert, gcpProject, mgr)
+func PrepareSourceDatabase(ctx context.Context, cfg *config.Config, source *resolved.Instance, databaseName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	databasePassword, err := setPostgresPassword(ctx, cfg, source.Name, gcpProject, mgr)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	source.PostgresPassword = databasePassword
 
-	err = installExtension(ctx, mgr, source, databaseName, certPaths)
+	err = instance.CreateSslCert(ctx, cfg, source.Name, &source.SslCert, gcpProject, mgr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return certPaths, nil
+	return installExtension(ctx, mgr, source, databaseName)
 }
 
 // DropPgAuditExtension removes all pgaudit artifacts from the source databases
@@ -47,9 +41,13 @@ func PrepareSourceDatabase(ctx context.Context, cfg *config.Config, source *reso
 // This includes: the extension itself, and per-user pgaudit.log settings
 // (set by 'nais postgres enable-audit') which would cause pg_restore to fail
 // with "role does not exist" on the target.
-func DropPgAuditExtension(ctx context.Context, source *resolved.Instance, databaseName string, certPaths *instance.CertPaths, mgr *common_main.Manager) error {
+func DropPgAuditExtension(ctx context.Context, source *resolved.Instance, databaseName string, mgr *common_main.Manager) error {
 	logger := mgr.Logger.With("instance", source.Name)
 	logger.Info("removing pgaudit artifacts from source databases before migration")
+	if mgr.DryRun != nil {
+		mgr.DryRun.Record("sql", source.Name, "DROP EXTENSION IF EXISTS pgaudit")
+		return nil
+	}
 
 	dbInfos := []struct {
 		DatabaseName string
@@ -69,16 +67,7 @@ func DropPgAuditExtension(ctx context.Context, source *resolved.Instance, databa
 	}
 
 	for _, dbInfo := range dbInfos {
-		dbConn, err := createConnection(
-			source.PrimaryIp,
-			dbInfo.Username,
-			dbInfo.Password,
-			dbInfo.DatabaseName,
-			certPaths.RootCertPath,
-			certPaths.KeyPath,
-			certPaths.CertPath,
-			logger,
-		)
+		dbConn, err := connect(ctx, mgr, source, dbInfo.Username, dbInfo.Password, dbInfo.DatabaseName, logger)
 		if err != nil {
 			return fmt.Errorf("unable to connect to %s for pgaudit cleanup: %w", dbInfo.DatabaseName, err)
 		}
@@ -87,20 +76,16 @@ func DropPgAuditExtension(ctx context.Context, source *resolved.Instance, databa
 		// Reset per-user pgaudit.log setting that 'nais postgres enable-audit' adds.
 		// This is dumped as ALTER ROLE ... IN DATABASE ... SET pgaudit.log which fails
 		// on the target because the source role doesn't exist there.
-		resetSQL := fmt.Sprintf(
-			`ALTER ROLE "%s" IN DATABASE "%s" RESET "pgaudit.log"`,
-			source.AppUsername, dbInfo.DatabaseName,
-		)
-		_, err = dbConn.ExecContext(ctx, resetSQL)
+		err = ResetPgAuditLog(ctx, dbConn, source.AppUsername, dbInfo.DatabaseName)
 		if err != nil {
 			logger.Warn("failed to reset pgaudit.log for user, continuing", "database", dbInfo.DatabaseName, "error", err)
 		} else {
 			logger.Info("reset pgaudit.log per-user setting", "database", dbInfo.DatabaseName, "user", source.AppUsername)
 		}
 
-		_, err = dbConn.ExecContext(ctx, "DROP EXTENSION IF EXISTS pgaudit")
+		err = DropPgAudit(ctx, dbConn)
 		if err != nil {
-			return fmt.Errorf("failed to drop pgaudit extension from %s: %w", dbInfo.DatabaseName, err)
+			return fmt.Errorf("%s: %w", dbInfo.DatabaseName, err)
 		}
 		logger.Info("dropped pgaudit extension", "database", dbInfo.DatabaseName)
 	}
@@ -124,30 +109,39 @@ func DeleteHelperTargetDatabase(ctx context.Context, cfg *config.Config, target
 
 	mgr.Logger.Info("deleting database in target instance")
 
+	operationKey := fmt.Sprintf("delete-database/%s/%s", target.Name, databaseName)
+	op, err := operation.ResumeSqlAdmin(ctx, cfg, operationKey, gcpProject, mgr)
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		return operation.WaitSqlAdmin(ctx, "delete database", op, operationTimeout, gcpProject, mgr, operation.Tracked(cfg, operationKey))
+	}
+
 	b := retry.NewConstant(3 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
-	op, err := retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.Operation, error) {
-		op, err := mgr.SqlAdminService.Databases.Delete(gcpProject.Id, target.Name, databaseName).Context(ctx).Do()
+	op, err = retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.Operation, error) {
+		op, err := mgr.SqlAdmin.Databases.Delete(ctx, gcpProject.Id, target.Name, databaseName)
 		if err != nil {
-			return nil, retry.RetryableError(fmt.Errorf("failed to delete database from target instance, retrying: %w", err))
+			if classify.Is(err, classify.NotFound) {
+				mgr.Logger.Info("database not found in target instance, nothing to delete")
+				return nil, nil
+			}
+			mgr.Logger.Warn("failed to delete database from target instance", "error", err)
+			return nil, classify.Retry(fmt.Errorf("failed to delete database from target instance: %w", err))
 		}
 		return op, nil
 	})
 	if err != nil {
 		return err
 	}
-
-	mgr.Logger.Info("waiting for database deletion in target instance to complete")
-	for op.Status != "DONE" {
-		time.Sleep(3 * time.Second)
-		op, err = mgr.SqlAdminService.Operations.Get(gcpProject.Id, op.Name).Context(ctx).Do()
-		if err != nil {
-			return fmt.Errorf("failed to get delete operation status: %w", err)
-		}
+	if op == nil {
+		return nil
 	}
 
-	return nil
+	mgr.Logger.Info("waiting for database deletion in target instance to complete")
+	return operation.WaitSqlAdmin(ctx, "delete database", op, operationTimeout, gcpProject, mgr, operation.Tracked(cfg, operationKey))
 }
 
 func DeleteTargetDatabaseResource(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) error {
@@ -162,34 +156,20 @@ func DeleteTargetDatabaseResource(ctx context.Context, cfg *config.Config, mgr *
 	return nil
 }
 
-func PrepareTargetDatabase(ctx context.Context, cfg *config.Config, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*instance.CertPaths, error) {
-	databasePassword := makePassword(cfg, mgr.Logger)
-	err := SetDatabasePassword(ctx, cfg.TargetInstance.Name, config.PostgresDatabaseUser, databasePassword, gcpProject, mgr)
+func PrepareTargetDatabase(ctx context.Context, cfg *config.Config, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	databasePassword, err := setPostgresPassword(ctx, cfg, cfg.TargetInstance.Name, gcpProject, mgr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	target.PostgresPassword = databasePassword
 
-	certPaths, err := instance.CreateSslCert(ctx, cfg, cfg.TargetInstance.Name, &target.SslCert, gcpProject, mgr)
-	if err != nil {
-		return nil, err
-	}
-
-	return certPaths, nil
-}
-
-func makePassword(cfg *config.Config, logger *slog.Logger) string {
-	if cfg.Development.UnsafePassword {
-		logger.Warn("using unsafe password for database user because of development mode setting")
-		return "testpassword"
-	}
-	return rand.String(14)
+	return instance.CreateSslCert(ctx, cfg, cfg.TargetInstance.Name, &target.SslCert, gcpProject, mgr)
 }
 
 func SetDatabasePassword(ctx context.Context, instance string, userName string, password string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
 	mgr.Logger.Info("updating Cloud SQL user password", "instance", instance, "user", userName)
 
-	usersService := mgr.SqlAdminService.Users
+	usersService := mgr.SqlAdmin.Users
 
 	b := retry.NewConstant(3 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
@@ -205,14 +185,12 @@ func SetDatabasePassword(ctx context.Context, instance string, userName string,
 		// The API returns roles in GET but rejects them in Update
 		user.DatabaseRoles = nil
 
-		op, err := usersService.Update(gcpProject.Id, instance, user).Name(user.Name).Host(user.Host).Context(ctx).Do()
+		op, err := usersService.Update(ctx, gcpProject.Id, instance, user)
 		if err != nil {
-			var ae *googleapi.Error
-			if errors.As(err, &ae) && ae.Code == http.StatusConflict {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("conflict while updating user, retrying", "user", user.Name)
-				return nil, retry.RetryableError(err)
 			}
-			return nil, fmt.Errorf("failed to update Cloud SQL user password: %w", err)
+			return nil, classify.Retry(fmt.Errorf("failed to update Cloud SQL user password: %w", err))
 		}
 
 		return op, nil
@@ -222,13 +200,9 @@ func SetDatabasePassword(ctx context.Context, instance string, userName string,
 		return err
 	}
 
-	operationsService := mgr.SqlAdminService.Operations
-	for op.Status != "DONE" {
-		time.Sleep(1 * time.Second)
-		op, err = operationsService.Get(gcpProject.Id, op.Name).Context(ctx).Do()
-		if err != nil {
-			return fmt.Errorf("failed to get update operation status: %w", err)
-		}
+	err = operation.WaitSqlAdmin(ctx, "update user password", op, operationTimeout, gcpProject, mgr)
+	if err != nil {
+		return err
 	}
 
 	mgr.Logger.Info("updated Cloud SQL user password", "user", userName)
@@ -237,20 +211,19 @@ func SetDatabasePassword(ctx context.Context, instance string, userName string,
 }
 
 func getSqlUser(ctx context.Context, instance string, userName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*sqladmin.User, error) {
-	usersService := mgr.SqlAdminService.Users
+	usersService := mgr.SqlAdmin.Users
 
 	b := retry.NewConstant(3 * time.Second)
 	b = retry.WithMaxDuration(2*time.Minute, b)
 
 	user, err := retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.User, error) {
-		user, err := usersService.Get(gcpProject.Id, instance, userName).Context(ctx).Do()
+		user, err := usersService.Get(ctx, gcpProject.Id, instance, userName)
 		if err != nil {
-			var ae *googleapi.Error
-			if errors.As(err, &ae) && ae.Code == http.StatusNotFound {
+			if classify.Is(err, classify.NotFound) {
 				mgr.Logger.Warn("user not found, retrying", "user", userName)
 				return nil, retry.RetryableError(err)
 			}
-			return nil, err
+			return nil, classify.Retry(err)
 		}
 		return user, nil
 	})
@@ -260,9 +233,13 @@ func getSqlUser(ctx context.Context, instance string, userName string, gcpProjec
 	return user, err
 }
 
-func installExtension(ctx context.Context, mgr *common_main.Manager, source *resolved.Instance, databaseName string, certPaths *instance.CertPaths) error {
+func installExtension(ctx context.Context, mgr *common_main.Manager, source *resolved.Instance, databaseName string) error {
 	logger := mgr.Logger.With("instance", source.Name)
 	logger.Info("installing pglogical extension and adding grants")
+	if mgr.DryRun != nil {
+		mgr.DryRun.Record("sql", source.Name, "CREATE EXTENSION IF NOT EXISTS pglogical, and grants to postgres")
+		return nil
+	}
 
 	dbInfos := []struct {
 		DatabaseName string
@@ -287,16 +264,7 @@ func installExtension(ctx context.Context, mgr *common_main.Manager, source *res
 
 		err := retry.Do(ctx, b, func(ctx context.Context) error {
 			logger.Info("connecting to database", "database", dbInfo.DatabaseName, "user", dbInfo.Username)
-			dbConn, err := createConnection(
-				source.PrimaryIp,
-				dbInfo.Username,
-				dbInfo.Password,
-				dbInfo.DatabaseName,
-				certPaths.RootCertPath,
-				certPaths.KeyPath,
-				certPaths.CertPath,
-				logger,
-			)
+			dbConn, err := connect(ctx, mgr, source, dbInfo.Username, dbInfo.Password, dbInfo.DatabaseName, logger)
 			if err != nil {
 				mgr.Logger.Warn("unable to create connection, retrying", "error", err, "database", dbInfo.DatabaseName, "user", dbInfo.Username)
 				return retry.RetryableError(fmt.Errorf("unable to create connection: %w", err))
@@ -305,17 +273,10 @@ func installExtension(ctx context.Context, mgr *common_main.Manager, source *res
 
 			logger.Info("installing extension and granting permissions to postgres user", "database", dbInfo.DatabaseName)
 
-			_, err = dbConn.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS pglogical; "+
-				"GRANT USAGE on SCHEMA pglogical to \"postgres\";"+
-				"GRANT SELECT on ALL TABLES in SCHEMA pglogical to \"postgres\";"+
-				"GRANT SELECT on ALL SEQUENCES in SCHEMA pglogical to \"postgres\";"+
-				"GRANT USAGE on SCHEMA public to \"postgres\";"+
-				"GRANT SELECT on ALL TABLES in SCHEMA public to \"postgres\";"+
-				"GRANT SELECT on ALL SEQUENCES in SCHEMA public to \"postgres\";"+
-				"ALTER USER \"postgres\" with REPLICATION;")
+			err = InstallPglogical(ctx, dbConn)
 			if err != nil {
 				mgr.Logger.Warn("failed to install extension and grant permissions, retrying", "error", err, "database", dbInfo.DatabaseName, "user", dbInfo.Username)
-				return retry.RetryableError(fmt.Errorf("failed to install extension and grant permissions: %w", err))
+				return retry.RetryableError(err)
 			}
 
 			return nil
@@ -328,19 +289,14 @@ func installExtension(ctx context.Context, mgr *common_main.Manager, source *res
 	return nil
 }
 
-func ChangeOwnership(ctx context.Context, mgr *common_main.Manager, target *resolved.Instance, databaseName string, certPaths *instance.CertPaths) error {
+func ChangeOwnership(ctx context.Context, mgr *common_main.Manager, target *resolved.Instance, databaseName string) error {
 	logger := mgr.Logger
+	if mgr.DryRun != nil {
+		mgr.DryRun.Record("sql", target.Name, "REASSIGN OWNED BY cloudsqlexternalsync to cloudsqlsuperuser")
+		return nil
+	}
 
-	dbConn, err := createConnection(
-		target.PrimaryIp,
-		config.PostgresDatabaseUser,
-		target.PostgresPassword,
-		databaseName,
-		certPaths.RootCertPath,
-		certPaths.KeyPath,
-		certPaths.CertPath,
-		logger,
-	)
+	dbConn, err := connect(ctx, mgr, target, config.PostgresDatabaseUser, target.PostgresPassword, databaseName, logger)
 	if err != nil {
 		return err
 	}
@@ -348,37 +304,38 @@ func ChangeOwnership(ctx context.Context, mgr *common_main.Manager, target *reso
 
 	logger.Info("reassigning ownership from cloudsqlexternalsync to cloudsqlsuperuser", "database", databaseName, "user", target.AppUsername)
 
-	_, err = dbConn.ExecContext(ctx, "REASSIGN OWNED BY cloudsqlexternalsync to cloudsqlsuperuser;")
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return ReassignOwned(ctx, dbConn)
 }
 
-func createConnection(instanceIp, username, password, databaseName, rootCertPath, keyPath, certPath string, logger *slog.Logger) (*sql.DB, error) {
-	connection := fmt.Sprint(
-		" host="+instanceIp,
-		" port="+strconv.Itoa(config.DatabasePort),
-		" user="+username,
-		" password="+password,
-		" dbname="+databaseName,
-		" sslmode=verify-ca",
-		" sslrootcert="+rootCertPath,
-		" sslkey="+keyPath,
-		" sslcert="+certPath,
-	)
-
-	dbConn, err := sql.Open(config.DatabaseDriver, connection)
-	if err != nil {
-		return nil, err
+// connect connects to a database on a Cloud SQL instance, with the certificate created for the migrator,
+// or through the connector when there is one
+func connect(ctx context.Context, mgr *common_main.Manager, instance *resolved.Instance, username, password, databaseName string, logger *slog.Logger) (*sql.DB, error) {
+	c := Connection{
+		Host:     instance.Ip(mgr.Connectivity),
+		Port:     config.DatabasePort,
+		User:     username,
+		Password: password,
+		Database: databaseName,
+		SslCert:  instance.SslCert,
+	}
+	if mgr.Connector != nil {
+		if instance.ConnectionName == "" {
+			return nil, fmt.Errorf("sql instance %s does not have a connection name", instance.Name)
+		}
+		c = Connection{
+			Host:      instance.ConnectionName,
+			Port:      connector.ProxyPort,
+			User:      username,
+			Password:  password,
+			Database:  databaseName,
+			Connector: true,
+		}
 	}
 
-	err = dbConn.Ping()
+	dbConn, err := Connect(ctx, mgr.DatabaseDriver, c)
 	if err != nil {
 		logger.Error("failed to connect to database", "error", err)
-		_ = dbConn.Close()
 		return nil, err
 	}
-	return dbConn, err
+	return dbConn, nil
 }
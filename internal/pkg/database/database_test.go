@@ -0,0 +1,47 @@
+package database_test
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp/fake"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"google.golang.org/api/sqladmin/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetDatabasePassword", func() {
+	const userKey = "my-project/my-app-pg16/postgres"
+
+	var ctx context.Context
+	var backend *fake.Backend
+	var mgr *common_main.Manager
+	gcpProject := &resolved.GcpProject{Id: "my-project", Location: "europe-north1"}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(cancel)
+
+		backend = fake.New()
+		mgr = &common_main.Manager{
+			Logger:   slog.New(slog.DiscardHandler),
+			SqlAdmin: backend.SqlAdmin(),
+		}
+	})
+
+	It("updates the password, without the database roles the API rejects", func() {
+		backend.Users[userKey] = &sqladmin.User{Name: "postgres", Password: "old", DatabaseRoles: []string{"cloudsqlsuperuser"}}
+
+		Expect(database.SetDatabasePassword(ctx, "my-app-pg16", "postgres", "new", gcpProject, mgr)).To(Succeed())
+
+		Expect(backend.Users[userKey].Password).To(Equal("new"))
+		Expect(backend.Users[userKey].DatabaseRoles).To(BeNil())
+		Expect(backend.Calls).To(Equal([]string{"SqlUsers.Update " + userKey}))
+	})
+})
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+)
+
+// The characters of the passwords, where a password has at least one character of each class in the policy.
+// The symbols need no quoting in connection strings.
+var (
+	passwordClasses = []string{"abcdefghijklmnopqrstuvwxyz", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "0123456789"}
+	passwordSymbols = "-_.~+=^%"
+)
+
+// GeneratePassword returns a random password following the policy
+func GeneratePassword(policy config.PasswordPolicy) (string, error) {
+	if policy.Length < config.MinPasswordLength {
+		return "", fmt.Errorf("password length %d is shorter than %d", policy.Length, config.MinPasswordLength)
+	}
+
+	classes := passwordClasses
+	if policy.Symbols {
+		classes = append(slices.Clone(classes), passwordSymbols)
+	}
+	alphabet := strings.Join(classes, "")
+	size := big.NewInt(int64(len(alphabet)))
+
+	password := make([]byte, policy.Length)
+	for {
+		for i := range password {
+			n, err := rand.Int(rand.Reader, size)
+			if err != nil {
+				return "", fmt.Errorf("failed to generate password: %w", err)
+			}
+			password[i] = alphabet[n.Int64()]
+		}
+
+		if !slices.ContainsFunc(classes, func(class string) bool {
+			return !strings.ContainsAny(string(password), class)
+		}) {
+			return string(password), nil
+		}
+	}
+}
+
+// setPostgresPassword sets a new password on the postgres user of the instance, and returns it.
+// The instance is recorded in the migration state before the password is set, so the password is rotated by
+// RotatePostgresPasswords even if the migrator stops right after setting it.
+func setPostgresPassword(ctx context.Context, cfg *config.Config, instanceName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (string, error) {
+	password, err := GeneratePassword(cfg.Password)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Development.UnsafePassword {
+		mgr.Logger.Warn("using unsafe password for database user because of development mode setting")
+		password = "testpassword"
+	}
+
+	err = state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		if !slices.Contains(st.KnownPasswords, instanceName) {
+			st.KnownPasswords = append(st.KnownPasswords, instanceName)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = SetDatabasePassword(ctx, instanceName, config.PostgresDatabaseUser, password, gcpProject, mgr)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// KnownPasswords returns the instances where the postgres user has a password set by the migrator, that has not been rotated
+func KnownPasswords(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) ([]string, error) {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return nil, err
+	}
+	return st.KnownPasswords, nil
+}
+
+// RotatePostgresPasswords sets the password of the postgres user to a new password nobody knows, on every instance
+// where the migrator has set a password. Instances that have been deleted are skipped.
+func RotatePostgresPasswords(ctx context.Context, cfg *config.Config, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	instanceNames, err := KnownPasswords(ctx, cfg, mgr)
+	if err != nil {
+		return err
+	}
+
+	for _, instanceName := range instanceNames {
+		err = rotatePostgresPassword(ctx, cfg, instanceName, gcpProject, mgr)
+		if err != nil {
+			return err
+		}
+
+		err = state.Update(ctx, cfg, mgr, func(st *state.State) error {
+			st.KnownPasswords = slices.DeleteFunc(st.KnownPasswords, func(name string) bool {
+				return name == instanceName
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rotatePostgresPassword(ctx context.Context, cfg *config.Config, instanceName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	_, err := mgr.SqlAdmin.Instances.Get(ctx, gcpProject.Id, instanceName)
+	if err != nil {
+		if classify.Is(err, classify.NotFound) {
+			mgr.Logger.Info("instance has been deleted, no password to rotate", "instance", instanceName)
+			return nil
+		}
+		return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+
+	password, err := GeneratePassword(cfg.Password)
+	if err != nil {
+		return err
+	}
+
+	mgr.Logger.Info("rotating postgres password to an unknown value", "instance", instanceName)
+	return SetDatabasePassword(ctx, instanceName, config.PostgresDatabaseUser, password, gcpProject, mgr)
+}
@@ -0,0 +1,41 @@
+package database_test
+
+import (
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GeneratePassword", func() {
+	It("makes passwords of the length in the policy, with letters and digits", func() {
+		password, err := database.GeneratePassword(config.PasswordPolicy{Length: 32})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(password).To(HaveLen(32))
+		Expect(password).To(MatchRegexp(`^[a-zA-Z0-9]+$`))
+		Expect(password).To(MatchRegexp(`[a-z]`))
+		Expect(password).To(MatchRegexp(`[A-Z]`))
+		Expect(password).To(MatchRegexp(`[0-9]`))
+	})
+
+	It("includes symbols when the policy requires them", func() {
+		password, err := database.GeneratePassword(config.PasswordPolicy{Length: 16, Symbols: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(password).To(HaveLen(16))
+		Expect(password).To(MatchRegexp(`[-_.~+=^%]`))
+	})
+
+	It("makes a new password every time", func() {
+		first, err := database.GeneratePassword(config.PasswordPolicy{Length: 32})
+		Expect(err).NotTo(HaveOccurred())
+		second, err := database.GeneratePassword(config.PasswordPolicy{Length: 32})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first).NotTo(Equal(second))
+	})
+
+	It("refuses passwords shorter than the minimum", func() {
+		_, err := database.GeneratePassword(config.PasswordPolicy{Length: 8})
+		Expect(err).To(MatchError(ContainSubstring("shorter than 16")))
+	})
+})
@@ -0,0 +1,175 @@
+package database_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const superuserPassword = "superuser-password"
+
+// postgres is a local postgres server requiring SSL and a client certificate signed by its CA, like Cloud SQL does
+type postgres struct {
+	port int
+	// dir holds the data directory and the certificates
+	dir string
+	ca  *authority
+}
+
+// startPostgres starts a local postgres server, and skips the spec if there is no postgres to start
+func startPostgres() *postgres {
+	bin := postgresBin()
+	if bin == "" {
+		Skip("postgres is not installed")
+	}
+	if os.Geteuid() == 0 {
+		Skip("postgres refuses to run as root")
+	}
+
+	dir := GinkgoT().TempDir()
+	ca := newAuthority("postgres-ca")
+	p := &postgres{port: freePort(), dir: dir, ca: ca}
+
+	data := filepath.Join(dir, "data")
+	pwfile := p.write("pwfile", []byte(superuserPassword))
+	postgresCmd(bin, "initdb", "-D", data, "-U", "postgres", "--auth=scram-sha-256", "--pwfile="+pwfile)
+
+	serverCert, serverKey := ca.issue("127.0.0.1")
+	conf := fmt.Sprintf(`
+listen_addresses = '127.0.0.1'
+port = %d
+unix_socket_directories = '%s'
+ssl = on
+ssl_cert_file = '%s'
+ssl_key_file = '%s'
+ssl_ca_file = '%s'
+`, p.port, dir, p.write("server.crt", serverCert), p.write("server.key", serverKey), p.write("root.crt", ca.cert))
+	appendFile(filepath.Join(data, "postgresql.conf"), conf)
+	Expect(os.WriteFile(filepath.Join(data, "pg_hba.conf"), []byte("hostssl all all 127.0.0.1/32 scram-sha-256 clientcert=verify-ca\n"), 0o600)).To(Succeed())
+
+	postgresCmd(bin, "pg_ctl", "-D", data, "-l", filepath.Join(dir, "postgres.log"), "-w", "start")
+	DeferCleanup(func() {
+		postgresCmd(bin, "pg_ctl", "-D", data, "-m", "immediate", "-w", "stop")
+	})
+	return p
+}
+
+// connection returns a connection to the database as the user, with a client certificate signed by the CA of the server
+func (p *postgres) connection(user, password, databaseName string) database.Connection {
+	clientCert, clientKey := p.ca.issue(user)
+	return database.Connection{
+		Host:     "127.0.0.1",
+		Port:     p.port,
+		User:     user,
+		Password: password,
+		Database: databaseName,
+		SslCert: resolved.SslCert{
+			SslCaCert:     string(p.ca.cert),
+			SslClientCert: string(clientCert),
+			SslClientKey:  string(clientKey),
+		},
+	}
+}
+
+func (p *postgres) write(name string, data []byte) string {
+	path := filepath.Join(p.dir, name)
+	Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+	return path
+}
+
+// postgresBin returns the directory of the postgres binaries, from PATH or where Debian puts them
+func postgresBin() string {
+	if path, err := exec.LookPath("pg_ctl"); err == nil {
+		return filepath.Dir(path)
+	}
+	dirs, _ := filepath.Glob("/usr/lib/postgresql/*/bin")
+	if len(dirs) == 0 {
+		return ""
+	}
+	return dirs[len(dirs)-1]
+}
+
+func postgresCmd(bin, name string, args ...string) {
+	out, err := exec.Command(filepath.Join(bin, name), args...).CombinedOutput()
+	Expect(err).NotTo(HaveOccurred(), string(out))
+}
+
+func freePort() int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func appendFile(path, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+	_, err = f.WriteString(data)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+// authority is a certificate authority issuing certificates for the test
+type authority struct {
+	cert []byte
+	x509 *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newAuthority(name string) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := certificateTemplate(name)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &authority{cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), x509: cert, key: key}
+}
+
+// issue returns a certificate and key, for the ip address if name is one
+func (a *authority) issue(name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := certificateTemplate(name)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.x509, &key.PublicKey, a.key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func certificateTemplate(name string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	Expect(err).NotTo(HaveOccurred())
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+)
+
+// The roles Cloud SQL and DMS use for the objects in a migrated database
+const (
+	externalSyncRole = "cloudsqlexternalsync"
+	superuserRole    = "cloudsqlsuperuser"
+)
+
+// Connection is where and as whom to connect to a database, verifying the server certificate with the CA certificate
+// and authenticating with the client certificate of the SslCert. The certificates are only kept in memory.
+type Connection struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	SslCert  resolved.SslCert
+	// Connector is set when the driver dials the instance through the Cloud SQL connector, which makes the TLS
+	// connection with a certificate of its own. The host is then the connection name of the instance.
+	Connector bool
+}
+
+// LogValue logs the connection without the password and private key
+func (c Connection) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("Host", c.Host),
+		slog.Int("Port", c.Port),
+		slog.String("User", c.User),
+		slog.String("Password", config.RedactValue(c.Password)),
+		slog.String("Database", c.Database),
+		slog.Any("SslCert", c.SslCert),
+		slog.Bool("Connector", c.Connector),
+	)
+}
+
+// DataSourceName returns the libpq connection string for the connection
+func (c Connection) DataSourceName() string {
+	sslMode := "pqgo-" + tlsConfigName(c.SslCert)
+	if c.Connector {
+		sslMode = "disable"
+	}
+	params := []struct {
+		key   string
+		value string
+	}{
+		{"host", c.Host},
+		{"port", strconv.Itoa(c.Port)},
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Database},
+		{"sslmode", sslMode},
+	}
+
+	fields := make([]string, 0, len(params))
+	for _, param := range params {
+		fields = append(fields, param.key+"="+quote(param.value))
+	}
+	return strings.Join(fields, " ")
+}
+
+// quote quotes a value in a libpq connection string, if it has to be
+func quote(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// tlsConfigName names the tls.Config of the certificate, when registered with lib/pq
+func tlsConfigName(sslCert resolved.SslCert) string {
+	hash := sha256.Sum256([]byte(sslCert.SslCaCert + sslCert.SslClientCert + sslCert.SslClientKey))
+	return "migrator-" + hex.EncodeToString(hash[:8])
+}
+
+// TLSConfig returns a tls.Config authenticating with the client certificate, and verifying that the server certificate
+// is signed by the CA certificate, like sslmode=verify-ca. Cloud SQL server certificates do not name the ip address
+// connected to, so the host name is not verified.
+func TLSConfig(sslCert resolved.SslCert) (*tls.Config, error) {
+	clientCert, err := tls.X509KeyPair([]byte(sslCert.SslClientCert), []byte(sslCert.SslClientKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(sslCert.SslCaCert)) {
+		return nil, errors.New("failed to parse server CA certificate")
+	}
+
+	return &tls.Config{
+		// The server certificate is verified against the CA without the host name, in VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("failed to parse server certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+// Connect opens the database with the driver, and makes sure it can be connected to.
+// The tls.Config of the connection is registered with lib/pq, and used by connections named by its data source name,
+// unless the connection is made through the connector.
+func Connect(ctx context.Context, driverName string, c Connection) (*sql.DB, error) {
+	if !c.Connector {
+		tlsConfig, err := TLSConfig(c.SslCert)
+		if err != nil {
+			return nil, err
+		}
+		err = pq.RegisterTLSConfig(tlsConfigName(c.SslCert), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(driverName, c.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// InstallPglogical installs the pglogical extension, and grants the postgres user what DMS needs to replicate the database.
+// Nothing is changed if the extension is not available.
+func InstallPglogical(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS pglogical; "+
+		"GRANT USAGE on SCHEMA pglogical to \"postgres\";"+
+		"GRANT SELECT on ALL TABLES in SCHEMA pglogical to \"postgres\";"+
+		"GRANT SELECT on ALL SEQUENCES in SCHEMA pglogical to \"postgres\";"+
+		"GRANT USAGE on SCHEMA public to \"postgres\";"+
+		"GRANT SELECT on ALL TABLES in SCHEMA public to \"postgres\";"+
+		"GRANT SELECT on ALL SEQUENCES in SCHEMA public to \"postgres\";"+
+		"ALTER USER \"postgres\" with REPLICATION;")
+	if err != nil {
+		return fmt.Errorf("failed to install extension and grant permissions: %w", err)
+	}
+	return nil
+}
+
+// ResetPgAuditLog removes the pgaudit.log setting of the user in the database, added by 'nais postgres enable-audit'
+func ResetPgAuditLog(ctx context.Context, db *sql.DB, username, databaseName string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER ROLE %s IN DATABASE %s RESET "pgaudit.log"`, pq.QuoteIdentifier(username), pq.QuoteIdentifier(databaseName)))
+	if err != nil {
+		return fmt.Errorf("failed to reset pgaudit.log for %s in %s: %w", username, databaseName, err)
+	}
+	return nil
+}
+
+// DropPgAudit drops the pgaudit extension, if it is installed
+func DropPgAudit(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "DROP EXTENSION IF EXISTS pgaudit")
+	if err != nil {
+		return fmt.Errorf("failed to drop pgaudit extension: %w", err)
+	}
+	return nil
+}
+
+// ReassignOwned gives the objects DMS created as cloudsqlexternalsync to cloudsqlsuperuser
+func ReassignOwned(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("REASSIGN OWNED BY %s to %s;", externalSyncRole, superuserRole))
+	if err != nil {
+		return fmt.Errorf("failed to reassign ownership from %s to %s: %w", externalSyncRole, superuserRole, err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package database_test
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/pem"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	appUser     = "my-app"
+	appPassword = "app-password"
+	appDatabase = "my-app"
+)
+
+var _ = Describe("Connection", func() {
+	It("builds a connection string using the tls config of the certificate", func() {
+		c := database.Connection{
+			Host:     "10.0.0.1",
+			Port:     5432,
+			User:     "postgres",
+			Password: `it's a \secret`,
+			Database: "my-app",
+			SslCert:  resolved.SslCert{SslCaCert: "ca", SslClientCert: "cert", SslClientKey: "key"},
+		}
+
+		Expect(c.DataSourceName()).To(MatchRegexp(`^host=10\.0\.0\.1 port=5432 user=postgres password='it\\'s a \\\\secret' dbname=my-app sslmode=pqgo-migrator-[0-9a-f]{16}$`))
+		Expect(c.DataSourceName()).NotTo(ContainSubstring("key"))
+	})
+})
+
+var _ = Describe("TLSConfig", func() {
+	It("verifies the server certificate with the CA, but not the host name", func() {
+		ca := newAuthority("server-ca")
+		clientCert, clientKey := ca.issue("migrator")
+		serverCert, _ := ca.issue("not-the-host")
+		other, _ := newAuthority("other-ca").issue("not-the-host")
+		block, _ := pem.Decode(serverCert)
+		otherBlock, _ := pem.Decode(other)
+
+		tlsConfig, err := database.TLSConfig(resolved.SslCert{SslCaCert: string(ca.cert), SslClientCert: string(clientCert), SslClientKey: string(clientKey)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tlsConfig.VerifyPeerCertificate([][]byte{block.Bytes}, nil)).To(Succeed())
+		Expect(tlsConfig.VerifyPeerCertificate([][]byte{otherBlock.Bytes}, nil)).NotTo(Succeed())
+
+		cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Leaf.Subject.CommonName).To(Equal("migrator"))
+	})
+
+	It("fails for a certificate that can not be parsed", func() {
+		_, err := database.TLSConfig(resolved.SslCert{SslCaCert: "ca", SslClientCert: "cert", SslClientKey: "key"})
+		Expect(err).To(MatchError(ContainSubstring("failed to parse client certificate")))
+	})
+})
+
+var _ = Describe("SQL against a local postgres", Ordered, func() {
+	var ctx context.Context
+	var server *postgres
+	var superuser *sql.DB
+	var appDb *sql.DB
+
+	connect := func(user, password, databaseName string) *sql.DB {
+		db, err := database.Connect(ctx, "postgres", server.connection(user, password, databaseName))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(db.Close)
+		return db
+	}
+	exec := func(db *sql.DB, query string) {
+		_, err := db.ExecContext(ctx, query)
+		Expect(err).NotTo(HaveOccurred(), query)
+	}
+	queryRow := func(db *sql.DB, query string, dest any) {
+		Expect(db.QueryRowContext(ctx, query).Scan(dest)).To(Succeed(), query)
+	}
+
+	BeforeAll(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 2*time.Minute)
+		DeferCleanup(cancel)
+
+		server = startPostgres()
+		superuser = connect("postgres", superuserPassword, "postgres")
+		exec(superuser, `CREATE ROLE cloudsqlsuperuser`)
+		exec(superuser, `CREATE ROLE "`+appUser+`" LOGIN PASSWORD '`+appPassword+`'`)
+		exec(superuser, `CREATE DATABASE "`+appDatabase+`" OWNER "`+appUser+`"`)
+		appDb = connect("postgres", superuserPassword, appDatabase)
+	})
+
+	Describe("Connect", func() {
+		It("connects over SSL with the client certificate", func() {
+			db := connect(appUser, appPassword, appDatabase)
+
+			var clientDn string
+			queryRow(db, `SELECT client_dn FROM pg_stat_ssl WHERE pid = pg_backend_pid() AND ssl`, &clientDn)
+			Expect(clientDn).To(Equal("/CN=" + appUser))
+		})
+
+		It("refuses a server certificate not signed by the root certificate", func() {
+			c := server.connection(appUser, appPassword, appDatabase)
+			c.SslCert.SslCaCert = string(newAuthority("other-ca").cert)
+
+			_, err := database.Connect(ctx, "postgres", c)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails with the wrong password", func() {
+			_, err := database.Connect(ctx, "postgres", server.connection(appUser, "wrong", appDatabase))
+			Expect(err).To(MatchError(ContainSubstring("password authentication failed")))
+		})
+	})
+
+	Describe("InstallPglogical", func() {
+		It("installs the extension if available, and changes nothing if not", func() {
+			var available bool
+			queryRow(appDb, `SELECT count(*) > 0 FROM pg_available_extensions WHERE name = 'pglogical'`, &available)
+
+			err := database.InstallPglogical(ctx, appDb)
+
+			var installed bool
+			queryRow(appDb, `SELECT count(*) > 0 FROM pg_extension WHERE extname = 'pglogical'`, &installed)
+			if available {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(installed).To(BeTrue())
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring("pglogical")))
+			Expect(installed).To(BeFalse())
+		})
+	})
+
+	Describe("ResetPgAuditLog", func() {
+		It("removes the pgaudit.log setting of the user in the database", func() {
+			exec(superuser, `ALTER ROLE "`+appUser+`" IN DATABASE "`+appDatabase+`" SET "pgaudit.log" = 'all'`)
+
+			Expect(database.ResetPgAuditLog(ctx, superuser, appUser, appDatabase)).To(Succeed())
+
+			var settings int
+			queryRow(superuser, `SELECT count(*) FROM pg_db_role_setting s JOIN pg_roles r ON r.oid = s.setrole
+				WHERE r.rolname = '`+appUser+`' AND array_to_string(s.setconfig, ',') LIKE '%pgaudit.log%'`, &settings)
+			Expect(settings).To(BeZero())
+		})
+
+		It("succeeds when there is nothing to reset", func() {
+			Expect(database.ResetPgAuditLog(ctx, superuser, appUser, appDatabase)).To(Succeed())
+		})
+
+		It("fails for a missing role", func() {
+			err := database.ResetPgAuditLog(ctx, superuser, "missing", appDatabase)
+			Expect(err).To(MatchError(ContainSubstring(`role "missing" does not exist`)))
+		})
+	})
+
+	Describe("DropPgAudit", func() {
+		It("succeeds when the extension is not installed", func() {
+			Expect(database.DropPgAudit(ctx, appDb)).To(Succeed())
+		})
+	})
+
+	Describe("ReassignOwned", Ordered, func() {
+		BeforeAll(func() {
+			exec(superuser, `CREATE ROLE cloudsqlexternalsync`)
+			exec(appDb, `CREATE TABLE migrated (id int)`)
+			exec(appDb, `ALTER TABLE migrated OWNER TO cloudsqlexternalsync`)
+			DeferCleanup(func() {
+				exec(appDb, `DROP TABLE IF EXISTS migrated`)
+			})
+		})
+
+		It("gives the objects owned by cloudsqlexternalsync to cloudsqlsuperuser", func() {
+			Expect(database.ReassignOwned(ctx, appDb)).To(Succeed())
+
+			var owner string
+			queryRow(appDb, `SELECT tableowner FROM pg_tables WHERE tablename = 'migrated'`, &owner)
+			Expect(owner).To(Equal("cloudsqlsuperuser"))
+		})
+
+		It("fails when cloudsqlexternalsync does not exist", func() {
+			exec(superuser, `DROP ROLE cloudsqlexternalsync`)
+
+			err := database.ReassignOwned(ctx, appDb)
+			Expect(err).To(MatchError(ContainSubstring(`role "cloudsqlexternalsync" does not exist`)))
+		})
+	})
+})
@@ -0,0 +1,130 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Change describes a single difference between two JSON documents.
+// Old or New is nil when the path is missing on that side.
+type Change struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, format(c.Old), format(c.New))
+}
+
+// Compare returns the changes between the JSON representation of a and b, sorted by path.
+// Paths use dots for object keys and brackets for list indices, e.g. "gcp.sqlInstances[0].tier".
+func Compare(a, b any) ([]Change, error) {
+	left, err := normalize(a)
+	if err != nil {
+		return nil, err
+	}
+	right, err := normalize(b)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0)
+	walk("", left, right, &changes)
+	slices.SortFunc(changes, func(x, y Change) int {
+		return strings.Compare(x.Path, y.Path)
+	})
+	return changes, nil
+}
+
+func normalize(v any) (any, error) {
+	var data []byte
+	switch raw := v.(type) {
+	case json.RawMessage:
+		data = raw
+	case []byte:
+		data = raw
+	default:
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal value for comparison: %w", err)
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var out any
+	err := json.Unmarshal(data, &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal value for comparison: %w", err)
+	}
+	return out, nil
+}
+
+func walk(path string, left, right any, changes *[]Change) {
+	switch l := left.(type) {
+	case map[string]any:
+		r, ok := right.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(l)+len(r))
+		for k := range l {
+			keys = append(keys, k)
+		}
+		for k := range r {
+			if _, found := l[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			walk(join(path, k), l[k], r[k], changes)
+		}
+		return
+	case []any:
+		r, ok := right.([]any)
+		if !ok {
+			break
+		}
+		for i := range max(len(l), len(r)) {
+			var lv, rv any
+			if i < len(l) {
+				lv = l[i]
+			}
+			if i < len(r) {
+				rv = r[i]
+			}
+			walk(fmt.Sprintf("%s[%d]", path, i), lv, rv, changes)
+		}
+		return
+	}
+
+	lj, _ := json.Marshal(left)
+	rj, _ := json.Marshal(right)
+	if string(lj) != string(rj) {
+		*changes = append(*changes, Change{Path: path, Old: left, New: right})
+	}
+}
+
+func join(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func format(v any) string {
+	if v == nil {
+		return "<unset>"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,74 @@
+package diff_test
+
+import (
+	"encoding/json"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/diff"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type instance struct {
+	Name            string   `json:"name"`
+	Tier            string   `json:"tier,omitempty"`
+	CascadingDelete bool     `json:"cascadingDelete,omitempty"`
+	Flags           []string `json:"flags,omitempty"`
+}
+
+type spec struct {
+	Image     string     `json:"image"`
+	Instances []instance `json:"instances"`
+}
+
+var _ = Describe("Diff", func() {
+	var old spec
+
+	BeforeEach(func() {
+		old = spec{
+			Image: "my-image:1",
+			Instances: []instance{
+				{Name: "my-instance", Tier: "db-f1-micro", Flags: []string{"a"}},
+			},
+		}
+	})
+
+	It("should return no changes for equal values", func() {
+		changes, err := diff.Compare(old, old)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changes).To(BeEmpty())
+	})
+
+	It("should return changed leaf values with their paths, sorted", func() {
+		changed := old
+		changed.Image = "my-image:2"
+		changed.Instances = []instance{{Name: "my-instance", Tier: "db-custom-1-3840", Flags: []string{"a"}}}
+
+		changes, err := diff.Compare(old, changed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changes).To(HaveLen(2))
+		Expect(changes[0].Path).To(Equal("image"))
+		Expect(changes[1].Path).To(Equal("instances[0].tier"))
+		Expect(changes[1].String()).To(Equal(`instances[0].tier: "db-f1-micro" -> "db-custom-1-3840"`))
+	})
+
+	It("should report added and removed values as unset", func() {
+		changed := old
+		changed.Instances = []instance{{Name: "my-instance", CascadingDelete: true}}
+
+		changes, err := diff.Compare(old, changed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changes).To(HaveLen(3))
+		Expect(changes[0].String()).To(Equal("instances[0].cascadingDelete: <unset> -> true"))
+		Expect(changes[1].String()).To(Equal(`instances[0].flags: ["a"] -> <unset>`))
+		Expect(changes[2].String()).To(Equal(`instances[0].tier: "db-f1-micro" -> <unset>`))
+	})
+
+	It("should accept raw JSON", func() {
+		data, err := json.Marshal(old)
+		Expect(err).ToNot(HaveOccurred())
+
+		changes, err := diff.Compare(json.RawMessage(data), old)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changes).To(BeEmpty())
+	})
+})
@@ -0,0 +1,142 @@
+// Package dryrun records the changes a phase would make, instead of making them.
+//
+// In a dry run the clients of the Manager are built on transports that pass reads through to the real APIs,
+// and record every mutating call in a Recorder instead of sending it.
+// Mutating calls are answered as if they succeeded: Kubernetes objects are echoed back, and GCP calls return
+// operations that are already done. Objects created, updated or deleted by the phase are remembered, so that
+// later reads in the same run see them, but the phase can not wait for anything the real system would do in
+// response, like naiserator rolling out an application. A wait that is not already satisfied stops the dry run
+// with ErrWait, and the recorded changes are the ones made up to that step.
+package dryrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+)
+
+// ErrWait is returned by waits in a dry run, when the condition depends on changes that were not made
+var ErrWait = errors.New("dry run can not wait for changes that were not made")
+
+// Mutation is a change the phase would have made
+type Mutation struct {
+	// Service is the API receiving the call, like kubernetes or sqladmin
+	Service string `json:"service"`
+	// Action is the verb of the call, like create or POST
+	Action string `json:"action"`
+	// Resource is the path or name of what is changed
+	Resource string `json:"resource"`
+}
+
+func (m Mutation) String() string {
+	return fmt.Sprintf("%s %s %s", m.Service, m.Action, m.Resource)
+}
+
+// Recorder collects the mutations of a dry run, in the order they were made
+type Recorder struct {
+	mu         sync.Mutex
+	mutations  []Mutation
+	objects    map[string][]byte
+	deleted    map[string]bool
+	operations int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		objects: make(map[string][]byte),
+		deleted: make(map[string]bool),
+	}
+}
+
+// Record adds a mutation to the recorder
+func (r *Recorder) Record(service, action, resource string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mutations = append(r.mutations, Mutation{Service: service, Action: action, Resource: resource})
+}
+
+// Mutations returns the recorded mutations, in the order they were made
+func (r *Recorder) Mutations() []Mutation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Mutation(nil), r.mutations...)
+}
+
+// Write writes the recorded mutations as a numbered list, where repeats of the same mutation are counted
+func (r *Recorder) Write(w io.Writer) error {
+	mutations := r.Mutations()
+	if len(mutations) == 0 {
+		_, err := fmt.Fprintln(w, "Dry run, no changes would be made.")
+		return err
+	}
+
+	fmt.Fprintln(w, "Dry run, these changes would be made:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	n := 0
+	for i := 0; i < len(mutations); {
+		repeats := 1
+		for i+repeats < len(mutations) && mutations[i+repeats] == mutations[i] {
+			repeats++
+		}
+		n++
+		m := mutations[i]
+		if repeats > 1 {
+			fmt.Fprintf(tw, "  %3d.\t%s\t%s\t%s (%d times)\n", n, m.Service, m.Action, m.Resource, repeats)
+		} else {
+			fmt.Fprintf(tw, "  %3d.\t%s\t%s\t%s\n", n, m.Service, m.Action, m.Resource)
+		}
+		i += repeats
+	}
+	return tw.Flush()
+}
+
+// nextOperation returns a number for a fake operation
+func (r *Recorder) nextOperation() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations++
+	return r.operations
+}
+
+func (r *Recorder) object(key string) ([]byte, bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, ok := r.objects[key]
+	return body, ok, r.deleted[key]
+}
+
+func (r *Recorder) store(key string, body []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.objects[key] = body
+	delete(r.deleted, key)
+}
+
+func (r *Recorder) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.objects, key)
+	r.deleted[key] = true
+}
+
+func (r *Recorder) isDeleted(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleted[key]
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the recorder, marking everything run with it as a dry run
+func NewContext(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the recorder of a dry run, or nil if ctx is not a dry run
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(contextKey{}).(*Recorder)
+	return r
+}
@@ -0,0 +1,13 @@
+package dryrun_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDryrun(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dryrun Suite")
+}
@@ -0,0 +1,169 @@
+package dryrun_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/dryrun"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recorder", func() {
+	var recorder *dryrun.Recorder
+	var server *httptest.Server
+	var received []string
+
+	BeforeEach(func() {
+		recorder = dryrun.NewRecorder()
+		received = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = append(received, r.Method+" "+r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/apis/nais.io/v1alpha1/namespaces/team/applications":
+				_, _ = io.WriteString(w, `{"kind":"ApplicationList","items":[{"metadata":{"name":"app"}},{"metadata":{"name":"other"}}]}`)
+			default:
+				_, _ = io.WriteString(w, `{"metadata":{"name":"app","resourceVersion":"1"}}`)
+			}
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	do := func(client *http.Client, method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp.StatusCode, string(data)
+	}
+
+	Context("kubernetes", func() {
+		var client *http.Client
+
+		BeforeEach(func() {
+			client = &http.Client{Transport: recorder.Transport(dryrun.Kubernetes, http.DefaultTransport)}
+		})
+
+		It("passes reads through and records changes instead of sending them", func() {
+			status, _ := do(client, http.MethodGet, "/apis/nais.io/v1alpha1/namespaces/team/applications/app", "")
+			Expect(status).To(Equal(http.StatusOK))
+
+			status, body := do(client, http.MethodPost, "/apis/nais.io/v1alpha1/namespaces/team/applications", `{"metadata":{"name":"helper"}}`)
+			Expect(status).To(Equal(http.StatusCreated))
+			Expect(body).To(Equal(`{"metadata":{"name":"helper"}}`))
+
+			do(client, http.MethodPut, "/apis/nais.io/v1alpha1/namespaces/team/applications/app/status", `{"metadata":{"name":"app"},"status":{}}`)
+			do(client, http.MethodDelete, "/apis/nais.io/v1alpha1/namespaces/team/applications/other", "")
+
+			Expect(received).To(Equal([]string{"GET /apis/nais.io/v1alpha1/namespaces/team/applications/app"}))
+			Expect(recorder.Mutations()).To(Equal([]dryrun.Mutation{
+				{Service: "kubernetes", Action: "create", Resource: "applications/helper"},
+				{Service: "kubernetes", Action: "update", Resource: "applications/app/status"},
+				{Service: "kubernetes", Action: "delete", Resource: "applications/other"},
+			}))
+		})
+
+		It("reads the objects changed in the dry run", func() {
+			do(client, http.MethodPost, "/apis/nais.io/v1alpha1/namespaces/team/applications", `{"metadata":{"name":"helper"}}`)
+			do(client, http.MethodDelete, "/apis/nais.io/v1alpha1/namespaces/team/applications/other", "")
+
+			status, body := do(client, http.MethodGet, "/apis/nais.io/v1alpha1/namespaces/team/applications/helper", "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(`{"metadata":{"name":"helper"}}`))
+
+			status, body = do(client, http.MethodGet, "/apis/nais.io/v1alpha1/namespaces/team/applications/other", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+			Expect(body).To(ContainSubstring(`"reason":"NotFound"`))
+
+			_, body = do(client, http.MethodGet, "/apis/nais.io/v1alpha1/namespaces/team/applications", "")
+			Expect(body).To(ContainSubstring(`"name":"app"`))
+			Expect(body).ToNot(ContainSubstring(`"name":"other"`))
+		})
+	})
+
+	Context("sqladmin", func() {
+		It("answers changes with operations that are done", func() {
+			client := &http.Client{Transport: recorder.Transport(dryrun.SqlAdmin, http.DefaultTransport)}
+
+			status, body := do(client, http.MethodPost, "/v1/projects/p/instances/source/promoteReplica", "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(`{"kind":"sql#operation","name":"dry-run-1","status":"DONE"}`))
+
+			_, body = do(client, http.MethodGet, "/v1/projects/p/operations/dry-run-1", "")
+			Expect(body).To(ContainSubstring(`"status":"DONE"`))
+
+			do(client, http.MethodDelete, "/v1/projects/p/instances/source", "")
+			status, _ = do(client, http.MethodGet, "/v1/projects/p/instances/source", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+
+			Expect(received).To(BeEmpty())
+			Expect(recorder.Mutations()).To(Equal([]dryrun.Mutation{
+				{Service: "sqladmin", Action: "POST", Resource: "projects/p/instances/source/promoteReplica"},
+				{Service: "sqladmin", Action: "DELETE", Resource: "projects/p/instances/source"},
+			}))
+		})
+	})
+
+	Context("datamigration", func() {
+		It("names operations after the location", func() {
+			client := &http.Client{Transport: recorder.Transport(dryrun.Datamigration, http.DefaultTransport)}
+			_, body := do(client, http.MethodPost, "/v1/projects/p/locations/europe-north1/migrationJobs/job:promote", "")
+			Expect(body).To(Equal(`{"name":"projects/p/locations/europe-north1/operations/dry-run-1","done":true,"response":{}}`))
+		})
+	})
+
+	Context("grpc", func() {
+		It("records changes and answers them with operations that are done", func() {
+			interceptor := recorder.UnaryClientInterceptor()
+			invoked := 0
+			invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				invoked++
+				return nil
+			}
+
+			err := interceptor(context.Background(), "/google.cloud.clouddms.v1.DataMigrationService/GetConnectionProfile",
+				&clouddmspb.GetConnectionProfileRequest{Name: "projects/p/locations/l/connectionProfiles/source"}, &clouddmspb.ConnectionProfile{}, nil, invoker)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(invoked).To(Equal(1))
+
+			op := &longrunningpb.Operation{}
+			err = interceptor(context.Background(), "/google.cloud.clouddms.v1.DataMigrationService/CreateConnectionProfile",
+				&clouddmspb.CreateConnectionProfileRequest{Parent: "projects/p/locations/l", ConnectionProfileId: "target"}, op, nil, invoker)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(invoked).To(Equal(1))
+			Expect(op.GetDone()).To(BeTrue())
+
+			profile := &clouddmspb.ConnectionProfile{}
+			Expect(op.GetResponse().UnmarshalTo(profile)).To(Succeed())
+			Expect(profile.GetName()).To(Equal("projects/p/locations/l/connectionProfiles/target"))
+
+			Expect(recorder.Mutations()).To(Equal([]dryrun.Mutation{
+				{Service: "datamigration", Action: "CreateConnectionProfile", Resource: "projects/p/locations/l/connectionProfiles/target"},
+			}))
+		})
+	})
+
+	It("writes the mutations as a numbered list, counting repeats", func() {
+		recorder.Record("kubernetes", "update", "configmaps/state")
+		recorder.Record("kubernetes", "update", "configmaps/state")
+		recorder.Record("sqladmin", "POST", "projects/p/instances/source/backupRuns")
+
+		out := &bytes.Buffer{}
+		Expect(recorder.Write(out)).To(Succeed())
+		Expect(out.String()).To(Equal("Dry run, these changes would be made:\n" +
+			"    1.  kubernetes  update  configmaps/state (2 times)\n" +
+			"    2.  sqladmin    POST    projects/p/instances/source/backupRuns\n"))
+	})
+})
@@ -0,0 +1,83 @@
+package dryrun
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// UnaryClientInterceptor records mutating calls to the Database Migration gRPC API instead of invoking them.
+// Mutating calls are answered with an operation that is already done.
+func (r *Recorder) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		name := path.Base(method)
+		if strings.HasPrefix(name, "Get") || strings.HasPrefix(name, "List") || strings.HasPrefix(name, "Describe") {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		resource := grpcResource(req)
+		r.Record(Datamigration, name, resource)
+
+		op, ok := reply.(*longrunningpb.Operation)
+		if !ok {
+			return nil
+		}
+		response, err := anypb.New(grpcResponse(name, resource, req))
+		if err != nil {
+			return fmt.Errorf("dry run of %s: %w", name, err)
+		}
+		op.Name = fmt.Sprintf("dry-run-%d", r.nextOperation())
+		op.Done = true
+		op.Result = &longrunningpb.Operation_Response{Response: response}
+		return nil
+	}
+}
+
+// grpcResource returns the name of the resource a request changes
+func grpcResource(req any) string {
+	switch req := req.(type) {
+	case *clouddmspb.CreateConnectionProfileRequest:
+		return req.GetParent() + "/connectionProfiles/" + req.GetConnectionProfileId()
+	case *clouddmspb.CreateMigrationJobRequest:
+		return req.GetParent() + "/migrationJobs/" + req.GetMigrationJobId()
+	case interface{ GetName() string }:
+		return req.GetName()
+	}
+	return ""
+}
+
+// grpcResponse returns what a done operation for the request would contain
+func grpcResponse(method, resource string, req any) proto.Message {
+	switch req := req.(type) {
+	case interface {
+		GetConnectionProfile() *clouddmspb.ConnectionProfile
+	}:
+		profile := &clouddmspb.ConnectionProfile{}
+		if p := req.GetConnectionProfile(); p != nil {
+			profile = proto.Clone(p).(*clouddmspb.ConnectionProfile)
+		}
+		profile.Name = resource
+		return profile
+	case interface {
+		GetMigrationJob() *clouddmspb.MigrationJob
+	}:
+		job := &clouddmspb.MigrationJob{}
+		if j := req.GetMigrationJob(); j != nil {
+			job = proto.Clone(j).(*clouddmspb.MigrationJob)
+		}
+		job.Name = resource
+		return job
+	}
+	if strings.HasSuffix(method, "MigrationJob") && !strings.HasPrefix(method, "Delete") {
+		return &clouddmspb.MigrationJob{Name: resource}
+	}
+	return &emptypb.Empty{}
+}
@@ -0,0 +1,227 @@
+package dryrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Services recorded by Transport
+const (
+	Kubernetes    = "kubernetes"
+	SqlAdmin      = "sqladmin"
+	Datamigration = "datamigration"
+)
+
+// Transport returns a transport for the REST API of service, recording mutating requests instead of sending them to base
+func (r *Recorder) Transport(service string, base http.RoundTripper) http.RoundTripper {
+	if service == Kubernetes {
+		return &kubernetesTransport{recorder: r, base: base}
+	}
+	return &googleTransport{recorder: r, service: service, base: base}
+}
+
+type kubernetesTransport struct {
+	recorder *Recorder
+	base     http.RoundTripper
+}
+
+func (t *kubernetesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := strings.TrimSuffix(req.URL.Path, "/status")
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if req.URL.Query().Get("watch") == "true" {
+			return t.base.RoundTrip(req)
+		}
+		return t.get(req, key)
+
+	case http.MethodPost:
+		body, err := readBody(req)
+		if err != nil {
+			return nil, err
+		}
+		var obj struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if json.Unmarshal(body, &obj) == nil && obj.Metadata.Name != "" {
+			key = req.URL.Path + "/" + obj.Metadata.Name
+		}
+		t.recorder.Record(Kubernetes, "create", kubernetesResource(key))
+		t.recorder.store(key, body)
+		return respond(req, http.StatusCreated, body), nil
+
+	case http.MethodPut:
+		body, err := readBody(req)
+		if err != nil {
+			return nil, err
+		}
+		t.recorder.Record(Kubernetes, "update", kubernetesResource(req.URL.Path))
+		t.recorder.store(key, body)
+		return respond(req, http.StatusOK, body), nil
+
+	case http.MethodPatch:
+		// The patch is not applied, the object is returned as it was
+		t.recorder.Record(Kubernetes, "patch", kubernetesResource(req.URL.Path))
+		get := req.Clone(req.Context())
+		get.Method = http.MethodGet
+		get.Body = nil
+		get.ContentLength = 0
+		return t.get(get, key)
+
+	case http.MethodDelete:
+		resource := kubernetesResource(req.URL.Path)
+		if selector := req.URL.Query().Get("labelSelector"); selector != "" {
+			resource += "?labelSelector=" + selector
+		}
+		t.recorder.Record(Kubernetes, "delete", resource)
+		t.recorder.remove(key)
+		return respond(req, http.StatusOK, []byte(`{"kind":"Status","apiVersion":"v1","status":"Success","code":200}`)), nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+// get reads through the objects changed in the dry run, and leaves out deleted objects from lists
+func (t *kubernetesTransport) get(req *http.Request, key string) (*http.Response, error) {
+	body, found, deleted := t.recorder.object(key)
+	if deleted {
+		status := fmt.Sprintf(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404,"message":%q}`, key+" is deleted in the dry run")
+		return respond(req, http.StatusNotFound, []byte(status)), nil
+	}
+	if found {
+		return respond(req, http.StatusOK, body), nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return resp, err
+	}
+	body, err = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(t.withoutDeleted(req.URL.Path, body)))
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+func (t *kubernetesTransport) withoutDeleted(path string, body []byte) []byte {
+	var list map[string]json.RawMessage
+	if json.Unmarshal(body, &list) != nil || list["items"] == nil {
+		return body
+	}
+	var items []json.RawMessage
+	if json.Unmarshal(list["items"], &items) != nil {
+		return body
+	}
+
+	kept := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		var obj struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if json.Unmarshal(item, &obj) == nil && t.recorder.isDeleted(path+"/"+obj.Metadata.Name) {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	if len(kept) == len(items) {
+		return body
+	}
+
+	list["items"], _ = json.Marshal(kept)
+	filtered, err := json.Marshal(list)
+	if err != nil {
+		return body
+	}
+	return filtered
+}
+
+// kubernetesResource shortens an API path to the resource and name, the namespace is the same for the whole run
+func kubernetesResource(path string) string {
+	if _, rest, found := strings.Cut(path, "/namespaces/"); found {
+		if _, resource, found := strings.Cut(rest, "/"); found {
+			return resource
+		}
+	}
+	return path
+}
+
+type googleTransport struct {
+	recorder *Recorder
+	service  string
+	base     http.RoundTripper
+}
+
+func (t *googleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		if strings.Contains(path, "/operations/dry-run-") {
+			return respond(req, http.StatusOK, t.operation(path)), nil
+		}
+		if t.recorder.isDeleted(path) {
+			status := fmt.Sprintf(`{"error":{"code":404,"status":"NOT_FOUND","message":%q}}`, path+" is deleted in the dry run")
+			return respond(req, http.StatusNotFound, []byte(status)), nil
+		}
+		return t.base.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	t.recorder.Record(t.service, req.Method, strings.TrimPrefix(path, "/v1/"))
+	if req.Method == http.MethodDelete {
+		t.recorder.remove(path)
+	}
+	return respond(req, http.StatusOK, t.operation(path)), nil
+}
+
+// operation returns an operation that is already done, named like the operations of the service
+func (t *googleTransport) operation(path string) []byte {
+	name := fmt.Sprintf("dry-run-%d", t.recorder.nextOperation())
+	if t.service == SqlAdmin {
+		return fmt.Appendf(nil, `{"kind":"sql#operation","name":%q,"status":"DONE"}`, name)
+	}
+
+	// Datamigration operations are named after the location, projects/<project>/locations/<location>/operations/<name>
+	parent := strings.TrimPrefix(path, "/v1/")
+	if parts := strings.SplitN(parent, "/", 5); len(parts) >= 4 {
+		parent = strings.Join(parts[:4], "/")
+	}
+	return fmt.Appendf(nil, `{"name":%q,"done":true,"response":{}}`, parent+"/operations/"+name)
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	return body, nil
+}
+
+func respond(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,627 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/k8s/v1alpha1"
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/google/uuid"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp/fake"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	"google.golang.org/api/sqladmin/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+// Region is the region of the instances in a cluster, unless it is configured with another
+const Region = "europe-north1"
+
+var (
+	applications = nais_io_v1alpha1.GroupVersion.WithResource("applications")
+	sqlInstances = v1beta1.SchemeGroupVersion.WithResource("sqlinstances")
+	sqlSslCerts  = v1beta1.SchemeGroupVersion.WithResource("sqlsslcerts")
+	sqlDatabases = v1beta1.SchemeGroupVersion.WithResource("sqldatabases")
+	sqlUsers     = v1beta1.SchemeGroupVersion.WithResource("sqlusers")
+	deployments  = appsv1.SchemeGroupVersion.WithResource("deployments")
+	secrets      = corev1.SchemeGroupVersion.WithResource("secrets")
+	leases       = coordinationv1.SchemeGroupVersion.WithResource("leases")
+
+	kinds = map[schema.GroupVersionResource]string{
+		applications: "Application",
+		sqlInstances: "SQLInstance",
+		sqlSslCerts:  "SQLSSLCert",
+		sqlDatabases: "SQLDatabase",
+		sqlUsers:     "SQLUser",
+	}
+)
+
+// Cluster is a fake Kubernetes cluster where naiserator and Config Connector do their work as soon as a resource changes.
+//
+// An Application that is created or updated gets its Deployment, SQLInstance, SQLUser and SQLDatabase resources and
+// its database secret, and its rollout completes at once. The instance, its users and databases are created in the
+// backend. Deleting an Application deletes the resources it owns, but leaves the instance in the backend, as the
+// migrator always disables cascading delete first. A SQLSSLCert gets its certificate when it is created.
+//
+// The controllers change resources through the object trackers instead of the clients, as the reactors run while the
+// fake clients are locked, and so their changes are not mistaken for changes made by the migrator.
+type Cluster struct {
+	Namespace string
+	Project   string
+	// Region is the region the instances are created in, and the region label of the nodes
+	Region string
+	// UnknownRegion leaves the nodes without a region label
+	UnknownRegion bool
+	// PrivateNetwork is the VPC network the instances get a private ip in, none unless set
+	PrivateNetwork string
+
+	Dynamic   *dynamicfake.FakeDynamicClient
+	Clientset *k8sfake.Clientset
+
+	backend *fake.Backend
+
+	mu          sync.Mutex
+	ips         map[string]int
+	authorities map[string]*authority
+}
+
+func newCluster(backend *fake.Backend, namespace, project string) *Cluster {
+	listKinds := make(map[schema.GroupVersionResource]string, len(kinds))
+	for gvr, kind := range kinds {
+		listKinds[gvr] = kind + "List"
+	}
+
+	c := &Cluster{
+		Namespace: namespace,
+		Project:   project,
+		Region:    Region,
+		Dynamic:   dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds),
+		Clientset: k8sfake.NewClientset(&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        namespace,
+				Annotations: map[string]string{"cnrm.cloud.google.com/project-id": project},
+			},
+		}),
+		backend:     backend,
+		ips:         make(map[string]int),
+		authorities: make(map[string]*authority),
+	}
+
+	c.Dynamic.PrependReactor("create", "applications", c.reconcileApplication)
+	c.Dynamic.PrependReactor("update", "applications", c.reconcileApplication)
+	c.Dynamic.PrependReactor("delete", "applications", c.deleteApplication)
+	c.Dynamic.PrependReactor("create", "sqlsslcerts", c.issueSslCert)
+	c.Dynamic.PrependReactor("delete-collection", "*", c.deleteCollection)
+	c.Clientset.PrependReactor("update", "deployments", c.scaleDeployment)
+	c.Clientset.PrependReactor("list", "nodes", c.listNodes)
+
+	return c
+}
+
+// Deploy creates the application like a deploy would, with a new correlation ID
+func (c *Cluster) Deploy(ctx context.Context, app *nais_io_v1alpha1.Application) error {
+	app = app.DeepCopy()
+	app.TypeMeta = metav1.TypeMeta{APIVersion: nais_io_v1alpha1.GroupVersion.String(), Kind: kinds[applications]}
+	app.Namespace = c.Namespace
+	if app.Annotations == nil {
+		app.Annotations = make(map[string]string)
+	}
+	app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] = uuid.New().String()
+
+	obj, err := toUnstructured(app)
+	if err != nil {
+		return err
+	}
+	_, err = c.Dynamic.Resource(applications).Namespace(c.Namespace).Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to deploy application %s: %w", app.Name, err)
+	}
+	return nil
+}
+
+// PublicIp returns the public ip address of the instance, the same for every incarnation of its SQLInstance
+func (c *Cluster) PublicIp(instanceName string) string {
+	return c.ip(instanceName, 0)
+}
+
+// OutgoingIp returns the outgoing ip address of the instance
+func (c *Cluster) OutgoingIp(instanceName string) string {
+	return c.ip(instanceName, 1)
+}
+
+// PrivateIp returns the private ip address of the instance, when the cluster has a private network
+func (c *Cluster) PrivateIp(instanceName string) string {
+	return fmt.Sprintf("10.0.0.%d", c.index(instanceName)+1)
+}
+
+// ip returns an address from the documentation range, two for each instance in the order they are first seen
+func (c *Cluster) ip(instanceName string, offset int) string {
+	return fmt.Sprintf("198.51.100.%d", 2*c.index(instanceName)+offset+1)
+}
+
+// index numbers the instances in the order they are first seen
+func (c *Cluster) index(instanceName string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.ips[instanceName]
+	if !ok {
+		n = len(c.ips)
+		c.ips[instanceName] = n
+	}
+	return n
+}
+
+// authority returns the server CA of the instance, the same for every incarnation of its SQLInstance
+func (c *Cluster) authority(instanceName string) (*authority, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.authorities[instanceName]
+	if ok {
+		return a, nil
+	}
+	a, err := newAuthority(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	c.authorities[instanceName] = a
+	return a, nil
+}
+
+func (c *Cluster) reconcileApplication(action k8stesting.Action) (bool, runtime.Object, error) {
+	obj, ok := action.(interface{ GetObject() runtime.Object }).GetObject().(*unstructured.Unstructured)
+	if !ok {
+		return false, nil, nil
+	}
+	app := &nais_io_v1alpha1.Application{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, app)
+	if err != nil {
+		return true, nil, err
+	}
+
+	app.Status.CorrelationID = app.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation]
+	app.Status.SynchronizationState = "RolloutComplete"
+	app.Status.SynchronizationHash = app.Status.CorrelationID
+
+	err = c.naiserator(app)
+	if err != nil {
+		return true, nil, err
+	}
+
+	reconciled, err := toUnstructured(app)
+	if err != nil {
+		return true, nil, err
+	}
+	obj.Object = reconciled.Object
+	return false, nil, nil
+}
+
+// naiserator creates the resources of the application, and Config Connector the instance they describe
+func (c *Cluster) naiserator(app *nais_io_v1alpha1.Application) error {
+	err := c.applyDeployment(app)
+	if err != nil {
+		return err
+	}
+	if app.Spec.GCP == nil || len(app.Spec.GCP.SqlInstances) == 0 {
+		return nil
+	}
+
+	sqlInstance := app.Spec.GCP.SqlInstances[0]
+	instanceName := sqlInstance.Name
+	if instanceName == "" {
+		instanceName = app.Name
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: nais_io_v1alpha1.GroupVersion.String(),
+		Kind:       kinds[applications],
+		Name:       app.Name,
+		UID:        app.UID,
+	}
+	objectMeta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       app.Namespace,
+			Labels:          map[string]string{"app": app.Name},
+			OwnerReferences: []metav1.OwnerReference{owner},
+		}
+	}
+	ready := []v1alpha1.Condition{{Type: "Ready", Status: "True", Reason: "UpToDate"}}
+
+	existing := &v1beta1.SQLInstance{}
+	found, err := c.get(sqlInstances, instanceName, existing)
+	if err != nil {
+		return err
+	}
+	if found {
+		// Config Connector acquires an existing instance, naiserator only takes ownership
+		existing.ObjectMeta.Labels = map[string]string{"app": app.Name}
+		existing.OwnerReferences = []metav1.OwnerReference{owner}
+		err = c.apply(sqlInstances, existing)
+	} else {
+		err = c.apply(sqlInstances, c.sqlInstance(objectMeta(instanceName), sqlInstance, ready))
+	}
+	if err != nil {
+		return err
+	}
+
+	userMeta := objectMeta(instanceName)
+	userMeta.Annotations = map[string]string{nais_io_v1.DeploymentCorrelationIDAnnotation: app.Status.CorrelationID}
+	err = c.apply(sqlUsers, &v1beta1.SQLUser{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1beta1.SchemeGroupVersion.String(), Kind: kinds[sqlUsers]},
+		ObjectMeta: userMeta,
+		Spec:       v1beta1.SQLUserSpec{InstanceRef: v1alpha1.ResourceRef{Name: instanceName}},
+		Status:     v1beta1.SQLUserStatus{Conditions: ready},
+	})
+	if err != nil {
+		return err
+	}
+
+	databaseName := app.Name
+	envVarPrefix := ""
+	if len(sqlInstance.Databases) > 0 {
+		databaseName = sqlInstance.Databases[0].Name
+		envVarPrefix = sqlInstance.Databases[0].EnvVarPrefix
+	}
+	if envVarPrefix == "" {
+		envVarPrefix = instance.DefaultEnvVarPrefix(instanceName, databaseName)
+	}
+	err = c.apply(sqlDatabases, &v1beta1.SQLDatabase{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1beta1.SchemeGroupVersion.String(), Kind: kinds[sqlDatabases]},
+		ObjectMeta: objectMeta(instanceName + "-" + databaseName),
+		Spec:       v1beta1.SQLDatabaseSpec{InstanceRef: v1alpha1.ResourceRef{Name: instanceName}},
+		Status:     v1beta1.SQLDatabaseStatus{Conditions: ready},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.applySecret(app, envVarPrefix, instanceName, databaseName)
+	if err != nil {
+		return err
+	}
+
+	key := c.Project + "/" + instanceName
+	c.backend.Update(func() {
+		if _, ok := c.backend.Instances[key]; !ok {
+			databaseInstance := &sqladmin.DatabaseInstance{
+				Name:            instanceName,
+				Project:         c.Project,
+				Region:          c.Region,
+				DatabaseVersion: string(sqlInstance.Type),
+				InstanceType:    "CLOUD_SQL_INSTANCE",
+				Settings: &sqladmin.Settings{
+					Tier:            sqlInstance.Tier,
+					IpConfiguration: &sqladmin.IpConfiguration{Ipv4Enabled: true},
+				},
+				IpAddresses: []*sqladmin.IpMapping{
+					{Type: "PRIMARY", IpAddress: c.PublicIp(instanceName)},
+					{Type: "OUTGOING", IpAddress: c.OutgoingIp(instanceName)},
+				},
+			}
+			if c.PrivateNetwork != "" {
+				databaseInstance.Settings.IpConfiguration.PrivateNetwork = c.PrivateNetwork
+				databaseInstance.IpAddresses = append(databaseInstance.IpAddresses, &sqladmin.IpMapping{Type: "PRIVATE", IpAddress: c.PrivateIp(instanceName)})
+			}
+			c.backend.Instances[key] = databaseInstance
+		}
+		for _, username := range []string{"postgres", instanceName} {
+			if _, ok := c.backend.Users[key+"/"+username]; !ok {
+				c.backend.Users[key+"/"+username] = &sqladmin.User{Name: username, Instance: instanceName, Project: c.Project}
+			}
+		}
+		if _, ok := c.backend.Databases[key+"/"+databaseName]; !ok {
+			c.backend.Databases[key+"/"+databaseName] = &sqladmin.Database{Name: databaseName, Instance: instanceName, Project: c.Project}
+		}
+	})
+	return nil
+}
+
+func (c *Cluster) sqlInstance(objectMeta metav1.ObjectMeta, sqlInstance nais_io_v1.CloudSqlInstance, ready []v1alpha1.Condition) *v1beta1.SQLInstance {
+	availabilityType := "ZONAL"
+	if sqlInstance.HighAvailability {
+		availabilityType = "REGIONAL"
+	}
+	flags := make([]v1beta1.InstanceDatabaseFlags, 0, len(sqlInstance.Flags))
+	for _, flag := range sqlInstance.Flags {
+		flags = append(flags, v1beta1.InstanceDatabaseFlags{Name: flag.Name, Value: flag.Value})
+	}
+
+	status := v1beta1.SQLInstanceStatus{
+		Conditions:      ready,
+		ConnectionName:  ptr.To(fmt.Sprintf("%s:%s:%s", c.Project, c.Region, objectMeta.Name)),
+		PublicIpAddress: ptr.To(c.PublicIp(objectMeta.Name)),
+		IpAddress: []v1beta1.InstanceIpAddressStatus{
+			{Type: ptr.To("PRIMARY"), IpAddress: ptr.To(c.PublicIp(objectMeta.Name))},
+			{Type: ptr.To("OUTGOING"), IpAddress: ptr.To(c.OutgoingIp(objectMeta.Name))},
+		},
+	}
+	if c.PrivateNetwork != "" {
+		status.PrivateIpAddress = ptr.To(c.PrivateIp(objectMeta.Name))
+		status.IpAddress = append(status.IpAddress, v1beta1.InstanceIpAddressStatus{Type: ptr.To("PRIVATE"), IpAddress: ptr.To(c.PrivateIp(objectMeta.Name))})
+	}
+
+	return &v1beta1.SQLInstance{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1beta1.SchemeGroupVersion.String(), Kind: kinds[sqlInstances]},
+		ObjectMeta: objectMeta,
+		Spec: v1beta1.SQLInstanceSpec{
+			DatabaseVersion: ptr.To(string(sqlInstance.Type)),
+			Region:          ptr.To(c.Region),
+			Settings: v1beta1.InstanceSettings{
+				AvailabilityType: ptr.To(availabilityType),
+				BackupConfiguration: &v1beta1.InstanceBackupConfiguration{
+					Enabled:                    ptr.To(true),
+					PointInTimeRecoveryEnabled: ptr.To(sqlInstance.PointInTimeRecovery),
+				},
+				DatabaseFlags: flags,
+				IpConfiguration: &v1beta1.InstanceIpConfiguration{
+					Ipv4Enabled: ptr.To(true),
+					RequireSsl:  ptr.To(true),
+				},
+				Tier: sqlInstance.Tier,
+			},
+		},
+		Status: status,
+	}
+}
+
+func (c *Cluster) applyDeployment(app *nais_io_v1alpha1.Application) error {
+	replicas := int32(1)
+	if app.Spec.Replicas != nil && app.Spec.Replicas.Min != nil {
+		replicas = int32(*app.Spec.Replicas.Min)
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: app.Name, Namespace: app.Namespace, Labels: map[string]string{"app": app.Name}},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(replicas)},
+	}
+
+	// Every rollout applies the replicas of the application, undoing any scaling
+	err := store(c.Clientset.Tracker(), deployments, app.Namespace, deployment)
+	if err != nil {
+		return fmt.Errorf("failed to apply deployment %s: %w", app.Name, err)
+	}
+	return nil
+}
+
+func (c *Cluster) applySecret(app *nais_io_v1alpha1.Application, envVarPrefix, username, databaseName string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "google-sql-" + app.Name,
+			Namespace:   app.Namespace,
+			Labels:      map[string]string{"app": app.Name},
+			Annotations: map[string]string{nais_io_v1.DeploymentCorrelationIDAnnotation: app.Status.CorrelationID},
+		},
+		Data: map[string][]byte{
+			envVarPrefix + "_USERNAME": []byte(username),
+			envVarPrefix + "_PASSWORD": []byte(username + "-password"),
+			envVarPrefix + "_DATABASE": []byte(databaseName),
+			envVarPrefix + "_HOST":     []byte(c.PublicIp(username)),
+		},
+	}
+
+	err := store(c.Clientset.Tracker(), secrets, app.Namespace, secret)
+	if err != nil {
+		return fmt.Errorf("failed to apply secret %s: %w", secret.Name, err)
+	}
+	return nil
+}
+
+// deleteApplication collects the garbage of the application, then lets the application be deleted
+func (c *Cluster) deleteApplication(action k8stesting.Action) (bool, runtime.Object, error) {
+	name := action.(k8stesting.DeleteAction).GetName()
+	namespace := action.GetNamespace()
+
+	for _, gvr := range []schema.GroupVersionResource{sqlInstances, sqlUsers, sqlDatabases} {
+		err := c.deleteWhere(gvr, namespace, func(obj *unstructured.Unstructured) bool {
+			return slices.ContainsFunc(obj.GetOwnerReferences(), func(ref metav1.OwnerReference) bool {
+				return ref.Kind == kinds[applications] && ref.Name == name
+			})
+		})
+		if err != nil {
+			return true, nil, err
+		}
+	}
+
+	tracker := c.Clientset.Tracker()
+	err := tracker.Delete(secrets, namespace, "google-sql-"+name)
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		return true, nil, err
+	}
+	err = tracker.Delete(deployments, namespace, name)
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		return true, nil, err
+	}
+	return false, nil, nil
+}
+
+// issueSslCert is Config Connector creating the certificate of a new SQLSSLCert
+func (c *Cluster) issueSslCert(action k8stesting.Action) (bool, runtime.Object, error) {
+	obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+	sslCert := &v1beta1.SQLSSLCert{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, sslCert)
+	if err != nil {
+		return true, nil, err
+	}
+
+	serverCa, err := c.authority(sslCert.Spec.InstanceRef.Name)
+	if err != nil {
+		return true, nil, err
+	}
+	cert, privateKey, err := serverCa.issue(sslCert.Spec.CommonName)
+	if err != nil {
+		return true, nil, err
+	}
+
+	fingerprint := fmt.Sprintf("%x", uuid.New())
+	sslCert.Status = v1beta1.SQLSSLCertStatus{
+		Conditions:      []v1alpha1.Condition{{Type: "Ready", Status: "True", Reason: "UpToDate"}},
+		Cert:            ptr.To(cert),
+		PrivateKey:      ptr.To(privateKey),
+		ServerCaCert:    ptr.To(serverCa.pem),
+		Sha1Fingerprint: ptr.To(fingerprint),
+	}
+
+	key := c.Project + "/" + sslCert.Spec.InstanceRef.Name
+	c.backend.Update(func() {
+		c.backend.SslCerts[key] = append(c.backend.SslCerts[key], &sqladmin.SslCert{
+			CommonName:      sslCert.Spec.CommonName,
+			Instance:        sslCert.Spec.InstanceRef.Name,
+			Sha1Fingerprint: fingerprint,
+		})
+	})
+
+	issued, err := toUnstructured(sslCert)
+	if err != nil {
+		return true, nil, err
+	}
+	obj.Object = issued.Object
+	return false, nil, nil
+}
+
+// deleteCollection deletes the resources matching the label selector, and Config Connector the certificates of deleted SQLSSLCerts
+func (c *Cluster) deleteCollection(action k8stesting.Action) (bool, runtime.Object, error) {
+	gvr := action.GetResource()
+	if _, ok := kinds[gvr]; !ok {
+		return false, nil, nil
+	}
+	selector := action.(k8stesting.DeleteCollectionAction).GetListRestrictions().Labels
+
+	err := c.deleteWhere(gvr, action.GetNamespace(), func(obj *unstructured.Unstructured) bool {
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			return false
+		}
+		if gvr == sqlSslCerts {
+			c.revokeSslCert(obj)
+		}
+		return true
+	})
+	return true, nil, err
+}
+
+func (c *Cluster) revokeSslCert(obj *unstructured.Unstructured) {
+	instanceName, _, _ := unstructured.NestedString(obj.Object, "spec", "instanceRef", "name")
+	commonName, _, _ := unstructured.NestedString(obj.Object, "spec", "commonName")
+	key := c.Project + "/" + instanceName
+	c.backend.Update(func() {
+		c.backend.SslCerts[key] = slices.DeleteFunc(c.backend.SslCerts[key], func(cert *sqladmin.SslCert) bool {
+			return cert.CommonName == commonName
+		})
+	})
+}
+
+// scaleDeployment handles the scale subresource, which the fake clientset does not
+func (c *Cluster) scaleDeployment(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "scale" {
+		return false, nil, nil
+	}
+	scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+
+	tracker := c.Clientset.Tracker()
+	obj, err := tracker.Get(deployments, action.GetNamespace(), scale.Name)
+	if err != nil {
+		return true, nil, err
+	}
+	deployment := obj.(*appsv1.Deployment).DeepCopy()
+	deployment.Spec.Replicas = ptr.To(scale.Spec.Replicas)
+	err = tracker.Update(deployments, deployment, action.GetNamespace())
+	if err != nil {
+		return true, nil, err
+	}
+	return true, scale, nil
+}
+
+// listNodes lists a node of the cluster, labelled with the region of the cluster
+func (c *Cluster) listNodes(k8stesting.Action) (bool, runtime.Object, error) {
+	node := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{}}}
+	if !c.UnknownRegion {
+		node.Labels[corev1.LabelTopologyRegion] = c.Region
+	}
+	return true, &corev1.NodeList{Items: []corev1.Node{node}}, nil
+}
+
+func (c *Cluster) get(gvr schema.GroupVersionResource, name string, into any) (bool, error) {
+	obj, err := c.Dynamic.Tracker().Get(gvr, c.Namespace, name)
+	if k8s_errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, into)
+}
+
+func (c *Cluster) apply(gvr schema.GroupVersionResource, obj runtime.Object) error {
+	u, err := toUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	return store(c.Dynamic.Tracker(), gvr, c.Namespace, u)
+}
+
+func (c *Cluster) deleteWhere(gvr schema.GroupVersionResource, namespace string, matches func(*unstructured.Unstructured) bool) error {
+	tracker := c.Dynamic.Tracker()
+	return c.each(gvr, func(obj *unstructured.Unstructured) error {
+		if !matches(obj) {
+			return nil
+		}
+		return tracker.Delete(gvr, namespace, obj.GetName())
+	})
+}
+
+// each calls f with every resource of the kind in the namespace, f may delete the resource
+func (c *Cluster) each(gvr schema.GroupVersionResource, f func(*unstructured.Unstructured) error) error {
+	list, err := c.Dynamic.Tracker().List(gvr, gvr.GroupVersion().WithKind(kinds[gvr]), c.Namespace)
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		err = f(item.(*unstructured.Unstructured))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store creates or updates the object, bypassing the reactors like a controller making its own changes
+func store(tracker k8stesting.ObjectTracker, gvr schema.GroupVersionResource, namespace string, obj runtime.Object) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	_, err = tracker.Get(gvr, namespace, accessor.GetName())
+	if k8s_errors.IsNotFound(err) {
+		return tracker.Create(gvr, obj, namespace)
+	}
+	if err != nil {
+		return err
+	}
+	return tracker.Update(gvr, obj, namespace)
+}
+
+func toUnstructured(obj any) (*unstructured.Unstructured, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: data}, nil
+}
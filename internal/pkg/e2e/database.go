@@ -0,0 +1,96 @@
+package e2e
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var drivers atomic.Int32
+
+// Statement is a statement executed on an instance
+type Statement struct {
+	// Host is the ip address connected to
+	Host     string
+	User     string
+	Password string
+	Database string
+	Query    string
+}
+
+// Database is a database/sql driver where every statement succeeds, recording the statements executed.
+// Queries returning rows are not supported, as the migrator only executes statements.
+type Database struct {
+	// Driver is the name the driver is registered with
+	Driver string
+
+	faults *faults
+
+	mu         sync.Mutex
+	statements []Statement
+}
+
+func newDatabase(faults *faults) *Database {
+	d := &Database{Driver: fmt.Sprintf("e2e-%d", drivers.Add(1)), faults: faults}
+	sql.Register(d.Driver, d)
+	return d
+}
+
+// Statements returns the statements executed so far
+func (d *Database) Statements() []Statement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Statement(nil), d.statements...)
+}
+
+// Open parses the libpq connection string the migrator connects with
+func (d *Database) Open(name string) (driver.Conn, error) {
+	params := make(map[string]string)
+	for _, field := range strings.Fields(name) {
+		key, value, _ := strings.Cut(field, "=")
+		params[key] = value
+	}
+	return &conn{database: d, host: params["host"], user: params["user"], password: params["password"], dbname: params["dbname"]}, nil
+}
+
+type conn struct {
+	database *Database
+	host     string
+	user     string
+	password string
+	dbname   string
+}
+
+func (c *conn) Ping(context.Context) error {
+	return c.database.faults.call("connect "+c.host, false)
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	defer c.database.faults.settle()
+	err := c.database.faults.call("exec "+query, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.database.mu.Lock()
+	defer c.database.mu.Unlock()
+	c.database.statements = append(c.database.statements, Statement{Host: c.host, User: c.user, Password: c.password, Database: c.dbname, Query: query})
+	return driver.RowsAffected(0), nil
+}
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
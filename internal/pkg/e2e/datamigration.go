@@ -0,0 +1,117 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// datamigrationHandler serves the parts of the Database Migration REST API the migrator uses
+func datamigrationHandler(api gcp.Datamigration) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		switch {
+		case strings.HasSuffix(name, "/operations"):
+			operations, err := api.Operations.List(r.Context(), strings.TrimSuffix(name, "/operations"))
+			respond(w)(map[string]any{"operations": operations}, err)
+		case strings.Contains(name, "/operations/"):
+			respond(w)(api.Operations.Get(r.Context(), name))
+		default:
+			respond(w)(api.MigrationJobs.Get(r.Context(), name))
+		}
+	})
+	mux.HandleFunc("POST /v1/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		name, method, _ := strings.Cut(r.PathValue("name"), ":")
+		switch method {
+		case "promote":
+			respond(w)(api.MigrationJobs.Promote(r.Context(), name))
+		case "demoteDestination":
+			respond(w)(api.MigrationJobs.DemoteDestination(r.Context(), name))
+		default:
+			respond(w)(nil, &googleapi.Error{Code: http.StatusNotImplemented, Message: "method " + method + " is not served"})
+		}
+	})
+
+	return mux
+}
+
+// datamigrationServer serves the parts of the Database Migration gRPC API the migrator uses.
+// Operations are done when they are returned, like the gcp package expects of the API.
+type datamigrationServer struct {
+	clouddmspb.UnimplementedDataMigrationServiceServer
+
+	api        gcp.Datamigration
+	operations atomic.Int64
+}
+
+func (s *datamigrationServer) CreateMigrationJob(ctx context.Context, req *clouddmspb.CreateMigrationJobRequest) (*longrunningpb.Operation, error) {
+	job, err := s.api.MigrationJobs.Create(ctx, req.GetParent(), req.GetMigrationJobId(), req.GetMigrationJob())
+	if err != nil {
+		return nil, err
+	}
+	return s.done(req.GetParent(), job)
+}
+
+func (s *datamigrationServer) StartMigrationJob(ctx context.Context, req *clouddmspb.StartMigrationJobRequest) (*longrunningpb.Operation, error) {
+	err := s.api.MigrationJobs.Start(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return s.done(req.GetName(), &clouddmspb.MigrationJob{Name: req.GetName()})
+}
+
+func (s *datamigrationServer) DeleteMigrationJob(ctx context.Context, req *clouddmspb.DeleteMigrationJobRequest) (*longrunningpb.Operation, error) {
+	err := s.api.MigrationJobs.Delete(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return s.done(req.GetName(), &emptypb.Empty{})
+}
+
+func (s *datamigrationServer) GetConnectionProfile(ctx context.Context, req *clouddmspb.GetConnectionProfileRequest) (*clouddmspb.ConnectionProfile, error) {
+	return s.api.ConnectionProfiles.Get(ctx, req.GetName())
+}
+
+func (s *datamigrationServer) CreateConnectionProfile(ctx context.Context, req *clouddmspb.CreateConnectionProfileRequest) (*longrunningpb.Operation, error) {
+	profile, err := s.api.ConnectionProfiles.Create(ctx, req.GetParent(), req.GetConnectionProfileId(), req.GetConnectionProfile())
+	if err != nil {
+		return nil, err
+	}
+	return s.done(req.GetParent(), profile)
+}
+
+func (s *datamigrationServer) DeleteConnectionProfile(ctx context.Context, req *clouddmspb.DeleteConnectionProfileRequest) (*longrunningpb.Operation, error) {
+	err := s.api.ConnectionProfiles.Delete(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return s.done(req.GetName(), &emptypb.Empty{})
+}
+
+// done returns an operation in the location of the resource, done with the response
+func (s *datamigrationServer) done(resource string, response proto.Message) (*longrunningpb.Operation, error) {
+	result, err := anypb.New(response)
+	if err != nil {
+		return nil, err
+	}
+	// Resources are named projects/<project>/locations/<location>/...
+	parts := strings.Split(resource, "/")
+	location := strings.Join(parts[:min(4, len(parts))], "/")
+	return &longrunningpb.Operation{
+		Name:   fmt.Sprintf("%s/operations/grpc-%d", location, s.operations.Add(1)),
+		Done:   true,
+		Result: &longrunningpb.Operation_Response{Response: result},
+	}, nil
+}
@@ -0,0 +1,269 @@
+// Package e2e runs the phases of the migrator in-process, against fake GCP APIs and a fake Kubernetes cluster.
+//
+// The Cloud SQL Admin and Database Migration REST APIs are served by httptest servers, and the Database Migration
+// and Cloud Monitoring gRPC APIs by a gRPC server on an in-memory listener, all backed by a fake.Backend. The phases
+// use the same gcp clients as in production, so requests and errors go through the real client libraries. Tests script
+// the migration through the backend, like the phases a migration job goes through, and inspect the result there
+// and in the Cluster. Nothing leaves the process: the outgoing ip of the migrator is answered without a request,
+// and statements are recorded by a database driver instead of being executed.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	dms "cloud.google.com/go/clouddms/apiv1"
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/egress"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp/fake"
+	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sqladmin/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	Namespace = "my-team"
+	Project   = "my-project"
+	// MigratorIp is the outgoing ip of the migrator
+	MigratorIp = "203.0.113.10"
+	// EchoUrl is the endpoint the migrator asks for its outgoing ip, answered without a request
+	EchoUrl = "https://echo.example.com"
+)
+
+// Harness is a migrator Manager wired to fake GCP APIs and a fake cluster
+type Harness struct {
+	Backend  *fake.Backend
+	Cluster  *Cluster
+	Database *Database
+	Manager  *common_main.Manager
+
+	faults  *faults
+	logs    *logBuffer
+	closers []func()
+}
+
+// logBuffer keeps what the phases log, as they may log from more than one goroutine
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// exit is what the Manager panics with instead of ending the process
+type exit int
+
+// New starts the fake APIs, and returns a harness where the phases log to the writer
+func New(ctx context.Context, logWriter io.Writer) (*Harness, error) {
+	backend := fake.New()
+	faults := &faults{}
+	h := &Harness{
+		Backend:  backend,
+		Cluster:  newCluster(backend, Namespace, Project),
+		Database: newDatabase(faults),
+		faults:   faults,
+		logs:     &logBuffer{},
+	}
+	// Prepended last, so the faults see the calls before the controllers do
+	h.Cluster.Dynamic.PrependReactor("*", "*", faults.react)
+	h.Cluster.Dynamic.PrependWatchReactor("*", faults.reactWatch)
+	h.Cluster.Clientset.PrependReactor("*", "*", faults.react)
+	h.Cluster.Clientset.PrependWatchReactor("*", faults.reactWatch)
+
+	sqlAdminServer := httptest.NewServer(sqlAdminHandler(backend.SqlAdmin()))
+	h.closers = append(h.closers, sqlAdminServer.Close)
+	sqlAdminService, err := sqladmin.NewService(ctx, h.restOptions(sqlAdminServer)...)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to create SqlAdmin service: %w", err)
+	}
+
+	datamigrationServer := httptest.NewServer(datamigrationHandler(backend.Datamigration()))
+	h.closers = append(h.closers, datamigrationServer.Close)
+	datamigrationService, err := datamigration.NewService(ctx, h.restOptions(datamigrationServer)...)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to create Datamigration service: %w", err)
+	}
+
+	conn, err := h.startGrpcServer(backend)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	dmsClient, err := dms.NewDataMigrationClient(ctx, option.WithGRPCConn(conn))
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to create DataMigrationClient: %w", err)
+	}
+	metricClient, err := monitoring.NewMetricClient(ctx, option.WithGRPCConn(conn))
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to create MetricClient: %w", err)
+	}
+
+	httpClient := &http.Client{Transport: &transport{faults: faults, base: echo(MigratorIp)}}
+	egressResolver, err := egress.Echo(httpClient, EchoUrl, nil)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	dynamicClient := h.Cluster.Dynamic
+	h.Manager = &common_main.Manager{
+		Logger: slog.New(&stepHandler{
+			Handler: config.NewRedactHandler(slog.NewTextHandler(io.MultiWriter(logWriter, h.logs), &slog.HandlerOptions{Level: slog.LevelDebug})),
+			faults:  faults,
+		}),
+
+		AppClient:         k8s.New[*nais_io_v1alpha1.Application](dynamicClient, Namespace, applications),
+		SqlInstanceClient: k8s.New[*v1beta1.SQLInstance](dynamicClient, Namespace, sqlInstances),
+		SqlSslCertClient:  k8s.New[*v1beta1.SQLSSLCert](dynamicClient, Namespace, sqlSslCerts),
+		SqlDatabaseClient: k8s.New[*v1beta1.SQLDatabase](dynamicClient, Namespace, sqlDatabases),
+		SqlUserClient:     k8s.New[*v1beta1.SQLUser](dynamicClient, Namespace, sqlUsers),
+		K8sClient:         h.Cluster.Clientset,
+
+		SqlAdmin:      gcp.NewSqlAdmin(sqlAdminService),
+		Datamigration: gcp.NewDatamigration(datamigrationService, dmsClient),
+		Monitoring:    gcp.NewMonitoring(metricClient),
+
+		HttpClient:     httpClient,
+		Egress:         egressResolver,
+		DatabaseDriver: h.Database.Driver,
+		Connectivity:   config.ConnectivityStaticIp,
+		Exit: func(code int) {
+			panic(exit(code))
+		},
+	}
+	return h, nil
+}
+
+// Inject makes the next run fail or be killed at a change
+func (h *Harness) Inject(fault Fault) {
+	h.faults.inject(fault)
+}
+
+// Run runs a phase, and returns the exit code the phase ended the process with, 0 if it returned, or Killed.
+// A killed run makes no calls after the change it was killed at, and its context is cancelled so it ends quickly.
+// The lease it leaves behind is expired, as it would be by the time the phase is run again.
+func (h *Harness) Run(ctx context.Context, phase func(ctx context.Context)) (code int) {
+	ctx, cancel := context.WithCancel(ctx)
+	h.faults.start(cancel)
+	defer func() {
+		cancel()
+		killed := h.faults.stop()
+		if killed {
+			code = Killed
+			if err := h.expireLeases(); err != nil {
+				panic(err)
+			}
+		}
+
+		r := recover()
+		if r == nil {
+			return
+		}
+		e, ok := r.(exit)
+		if !ok {
+			panic(r)
+		}
+		if !killed {
+			code = int(e)
+		}
+	}()
+	phase(ctx)
+	return 0
+}
+
+// Changes returns the changes made by the last run, in the order they were made
+func (h *Harness) Changes() []Change {
+	return h.faults.recorded()
+}
+
+// Logs returns what the phases have logged
+func (h *Harness) Logs() string {
+	return h.logs.String()
+}
+
+// Close stops the fake APIs
+func (h *Harness) Close() {
+	for i := len(h.closers) - 1; i >= 0; i-- {
+		h.closers[i]()
+	}
+	h.closers = nil
+}
+
+func (h *Harness) startGrpcServer(backend *fake.Backend) (*grpc.ClientConn, error) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	clouddmspb.RegisterDataMigrationServiceServer(server, &datamigrationServer{api: backend.Datamigration()})
+	monpb.RegisterMetricServiceServer(server, &monitoringServer{api: backend.Monitoring()})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	h.closers = append(h.closers, server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///e2e",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(h.faults.unaryClientInterceptor()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to gRPC server: %w", err)
+	}
+	h.closers = append(h.closers, func() {
+		_ = conn.Close()
+	})
+	return conn, nil
+}
+
+func (h *Harness) restOptions(server *httptest.Server) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(server.URL + "/"),
+		option.WithHTTPClient(&http.Client{Transport: &transport{faults: h.faults, base: server.Client().Transport}}),
+	}
+}
+
+// echo answers every request with the ip address, like the endpoint the migrator asks for its outgoing ip
+type echo string
+
+func (e echo) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader(string(e))),
+		Request:    req,
+	}, nil
+}
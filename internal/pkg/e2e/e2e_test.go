@@ -0,0 +1,471 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/connector"
+	"github.com/nais/cloudsql-migrator/internal/pkg/e2e"
+	"github.com/nais/cloudsql-migrator/internal/pkg/egress"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	migrator "github.com/nais/cloudsql-migrator/internal/pkg/phase"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	"golang.org/x/oauth2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	source  = "my-app"
+	target  = "my-app-pg17"
+	jobName = "projects/my-project/locations/europe-north1/migrationJobs/my-app-my-app-pg17"
+)
+
+// phase runs a phase of the migration configured by cfg
+type phase func(ctx context.Context, cfg config.Config, h *e2e.Harness)
+
+func setup(ctx context.Context, cfg config.Config, h *e2e.Harness) {
+	migrator.Setup(ctx, &cfg, h.Manager)
+}
+
+func promote(ctx context.Context, cfg config.Config, h *e2e.Harness) {
+	migrator.Promote(ctx, &cfg, h.Manager)
+}
+
+func finalize(ctx context.Context, cfg config.Config, h *e2e.Harness) {
+	migrator.Finalize(ctx, &config.FinalizeConfig{Config: cfg, SourceInstanceName: source}, h.Manager)
+}
+
+func rollback(ctx context.Context, cfg config.Config, h *e2e.Harness) {
+	migrator.Rollback(ctx, &config.RollbackConfig{Config: cfg, SourceInstance: config.InstanceSettings{Name: source}}, h.Manager)
+}
+
+// run runs the phase in the harness, and returns the exit code
+func run(ctx context.Context, h *e2e.Harness, cfg config.Config, p phase) int {
+	return h.Run(ctx, func(ctx context.Context) {
+		p(ctx, cfg, h)
+	})
+}
+
+// start returns a harness where the application is deployed, with the configuration of a migration to POSTGRES_17.
+// The cluster is configured before the application is deployed.
+func start(ctx context.Context, configure ...func(*e2e.Cluster)) (*e2e.Harness, config.Config) {
+	h, err := e2e.New(ctx, GinkgoWriter)
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(h.Close)
+	for _, f := range configure {
+		f(h.Cluster)
+	}
+
+	err = h.Cluster.Deploy(ctx, &nais_io_v1alpha1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: source},
+		Spec: nais_io_v1alpha1.ApplicationSpec{
+			Image:    "my-app:1",
+			Replicas: &nais_io_v1.Replicas{Min: ptr.To(2), Max: ptr.To(4)},
+			GCP: &nais_io_v1.GCP{SqlInstances: []nais_io_v1.CloudSqlInstance{{
+				Type:      "POSTGRES_16",
+				Tier:      "db-custom-1-3840",
+				Databases: []nais_io_v1.CloudSqlDatabase{{Name: source}},
+			}}},
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	h.Backend.TimeSeries = zeroLag()
+
+	return h, config.Config{
+		ApplicationName: source,
+		Namespace:       e2e.Namespace,
+		TargetInstance:  config.InstanceSettings{Name: target, Type: "POSTGRES_17"},
+		Lag:             config.Lag{AcceptableBytes: 1024, ZeroPoints: 3, Timeout: time.Minute},
+		Verification:    config.Verification{SecretKeys: true},
+		Password:        config.PasswordPolicy{Length: 32},
+	}
+}
+
+func zeroLag() []*monpb.TimeSeries {
+	points := make([]*monpb.Point, 3)
+	for i := range points {
+		points[i] = &monpb.Point{Value: &monpb.TypedValue{Value: &monpb.TypedValue_Int64Value{Int64Value: 0}}}
+	}
+	return []*monpb.TimeSeries{{Points: points}}
+}
+
+var _ = Describe("Migration", func() {
+	var ctx context.Context
+	var h *e2e.Harness
+	var cfg config.Config
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		DeferCleanup(cancel)
+
+		h, cfg = start(ctx)
+	})
+
+	appInstance := func() string {
+		app, err := h.Manager.AppClient.Get(ctx, source)
+		Expect(err).NotTo(HaveOccurred())
+		name, err := resolved.ResolveInstanceName(app)
+		Expect(err).NotTo(HaveOccurred())
+		return name
+	}
+	replicas := func() int32 {
+		deployment, err := h.Cluster.Clientset.AppsV1().Deployments(e2e.Namespace).Get(ctx, source, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return *deployment.Spec.Replicas
+	}
+	// postgresPasswords returns the passwords of the postgres users the migrator has connected as, and the current ones
+	postgresPasswords := func() ([]string, []string) {
+		var connected, current []string
+		for _, statement := range h.Database.Statements() {
+			if statement.User == "postgres" {
+				connected = append(connected, statement.Password)
+			}
+		}
+		h.Backend.Update(func() {
+			for key, user := range h.Backend.Users {
+				if strings.HasSuffix(key, "/postgres") {
+					current = append(current, user.Password)
+				}
+			}
+		})
+		return connected, current
+	}
+	queries := func(host string) []string {
+		var queries []string
+		for _, statement := range h.Database.Statements() {
+			if statement.Host == host {
+				queries = append(queries, statement.Query)
+			}
+		}
+		return queries
+	}
+
+	It("sets up, promotes and finalizes a migration", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("State", "RUNNING")))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + target))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + target + "-master"))
+		Expect(h.Backend.BackupRuns).To(HaveKey(e2e.Project + "/" + source))
+		Expect(queries(h.Cluster.PublicIp(source))).To(ContainElement(ContainSubstring("CREATE EXTENSION IF NOT EXISTS pglogical")))
+		Expect(appInstance()).To(Equal(source))
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("State", "COMPLETED")))
+		Expect(appInstance()).To(Equal(target))
+		Expect(replicas()).To(Equal(int32(2)))
+		connected, current := postgresPasswords()
+		Expect(connected).NotTo(BeEmpty())
+		Expect(current).To(HaveLen(2))
+		Expect(current).NotTo(ContainElements(connected))
+		Expect(queries(h.Cluster.PublicIp(target))).To(ContainElement(ContainSubstring("REASSIGN OWNED BY cloudsqlexternalsync")))
+		Expect(h.Backend.BackupRuns).To(HaveKey(e2e.Project + "/" + target))
+		secret, err := h.Cluster.Clientset.CoreV1().Secrets(e2e.Namespace).Get(ctx, "google-sql-"+source, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Data).To(HaveKeyWithValue("NAIS_DATABASE_MY_APP_PG17_MY_APP_USERNAME", []byte(target)))
+
+		Expect(run(ctx, h, cfg, finalize)).To(Equal(0))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + target))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + source))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target + "-master"))
+		Expect(h.Backend.MigrationJobs).To(BeEmpty())
+		Expect(h.Backend.ConnectionProfiles).To(BeEmpty())
+		Expect(h.Backend.SslCerts[e2e.Project+"/"+target]).To(BeEmpty())
+		configMaps, err := h.Cluster.Clientset.CoreV1().ConfigMaps(e2e.Namespace).List(ctx, metav1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMaps.Items).To(BeEmpty())
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state["sqlInstances"]).NotTo(ContainElement(ContainSubstring("migrator:")))
+
+		logs := h.Logs()
+		Expect(logs).NotTo(ContainSubstring("PRIVATE KEY"))
+		for _, password := range append(connected, current...) {
+			Expect(logs).NotTo(ContainSubstring(password))
+		}
+	})
+
+	It("authorizes all the outgoing ips of the migrator on both instances", func() {
+		var err error
+		h.Manager.Egress, err = egress.Static("198.51.100.1", "198.51.100.2")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		for _, instanceName := range []string{source, target} {
+			Expect(state["sqlInstances"]).To(ContainElement(SatisfyAll(
+				HavePrefix(instanceName+" "),
+				MatchRegexp(`migrator:[^=]+=198\.51\.100\.1/32`),
+				MatchRegexp(`migrator:[^=]+-1=198\.51\.100\.2/32`),
+			)))
+		}
+	})
+
+	It("connects to the databases through the connector without authorizing the migrator", func() {
+		var err error
+		h.Manager.Connector, err = connector.New(ctx, connector.IpTypePublic, cloudsqlconn.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})))
+		Expect(err).NotTo(HaveOccurred())
+		h.Manager.Egress, err = egress.Static()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(queries(connector.ConnectionName(e2e.Project, e2e.Region, source))).NotTo(BeEmpty())
+		Expect(queries(connector.ConnectionName(e2e.Project, e2e.Region, target))).NotTo(BeEmpty())
+		for _, statement := range h.Database.Statements() {
+			Expect(statement.Host).To(HavePrefix(e2e.Project + ":" + e2e.Region + ":"))
+		}
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		// Only the target is authorized on the source, for the migration job
+		Expect(state["sqlInstances"]).To(ConsistOf(
+			source+" authorizedNetworks="+instance.TargetAuthNetworkName(target, 0)+"="+h.Cluster.OutgoingIp(target)+"/32",
+			target+" authorizedNetworks=",
+		))
+	})
+
+	It("promotes when rerun after the migration job has finished the full dump", func() {
+		h.Backend.Phases = []string{"FULL_DUMP", "CDC"}
+		h.Backend.PromotePolls = 2
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(run(ctx, h, cfg, promote)).To(Equal(9))
+		Expect(appInstance()).To(Equal(source))
+		Expect(replicas()).To(Equal(int32(2)))
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("State", "COMPLETED")))
+		Expect(appInstance()).To(Equal(target))
+	})
+
+	It("sets up and rolls back a migration", func() {
+		cfg.Development.SkipBackup = true
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(h.Backend.BackupRuns).To(BeEmpty())
+
+		Expect(run(ctx, h, cfg, rollback)).To(Equal(0))
+		connected, current := postgresPasswords()
+		Expect(current).To(HaveLen(1))
+		Expect(current).NotTo(ContainElements(connected))
+		Expect(appInstance()).To(Equal(source))
+		Expect(replicas()).To(Equal(int32(2)))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + source))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target + "-master"))
+		Expect(h.Backend.MigrationJobs).To(BeEmpty())
+		Expect(h.Backend.ConnectionProfiles).To(BeEmpty())
+		_, err := h.Manager.AppClient.Get(ctx, "migrator-"+source)
+		Expect(err).To(HaveOccurred())
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state["sqlInstances"]).To(ContainElement(source + " authorizedNetworks="))
+	})
+
+	It("removes only the authorized networks it added", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		sqlInstance, err := h.Manager.SqlInstanceClient.Get(ctx, source)
+		Expect(err).NotTo(HaveOccurred())
+		sqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = append(sqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks,
+			v1beta1.InstanceAuthorizedNetworks{Name: ptr.To("office"), Value: "192.0.2.1/32"})
+		_, err = h.Manager.SqlInstanceClient.Update(ctx, sqlInstance)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(run(ctx, h, cfg, rollback)).To(Equal(0))
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state["sqlInstances"]).To(ContainElement(source + " authorizedNetworks=office=192.0.2.1/32"))
+	})
+
+	It("refuses to promote an application whose replicas were changed after setup", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		app, err := h.Manager.AppClient.Get(ctx, source)
+		Expect(err).NotTo(HaveOccurred())
+		app.Spec.Replicas.Min = ptr.To(3)
+		_, err = h.Manager.AppClient.Update(ctx, app)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(25))
+		Expect(appInstance()).To(Equal(source))
+
+		cfg.Verification.AllowInstanceChanges = true
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(appInstance()).To(Equal(target))
+	})
+
+	It("refuses to switch the application when the database secret keys would change", func() {
+		cfg.TargetInstance.PreserveEnvVarNames = true
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(state.Update(ctx, &cfg, h.Manager, func(st *state.State) error {
+			st.SecretKeys = append(st.SecretKeys, "NAIS_DATABASE_MY_APP_OTHER_HOST")
+			return nil
+		})).To(Succeed())
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(24))
+		Expect(appInstance()).To(Equal(source))
+	})
+
+	It("compares the database secret keys with those recorded by setup when promote is rerun after the switch", func() {
+		cfg.TargetInstance.PreserveEnvVarNames = true
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		st, err := state.Load(ctx, &cfg, h.Manager)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.SecretKeys).To(HaveLen(4))
+
+		// A promote that switches the application without preserving the names, and stops before checking them
+		renaming := cfg
+		renaming.TargetInstance.PreserveEnvVarNames = false
+		h.Inject(e2e.Fault{Step: 18, Kill: true})
+		Expect(run(ctx, h, renaming, promote)).To(Equal(e2e.Killed))
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(24))
+	})
+
+	It("removes the authorized networks of a migration started before they were recorded", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(state.Update(ctx, &cfg, h.Manager, func(st *state.State) error {
+			st.AuthorizedNetworks = nil
+			return nil
+		})).To(Succeed())
+
+		Expect(run(ctx, h, cfg, rollback)).To(Equal(0))
+		st, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st["sqlInstances"]).To(ContainElement(source + " authorizedNetworks="))
+	})
+
+	It("fails the phase while it holds the lock when what runs before it is done fails", func() {
+		h.Manager.BeforeDone = func() {
+			leases, err := h.Cluster.Clientset.CoordinationV1().Leases(e2e.Namespace).List(ctx, metav1.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leases.Items).To(HaveLen(1))
+			h.Manager.Fail(100, "failed to run hook after setup", "error", errors.New("hook failed"))
+		}
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(100))
+	})
+})
+
+var _ = Describe("Migration over private ips", func() {
+	const network = "projects/nais-vpc-project/global/networks/nais-vpc"
+
+	var ctx context.Context
+	var h *e2e.Harness
+	var cfg config.Config
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		DeferCleanup(cancel)
+
+		h, cfg = start(ctx, func(c *e2e.Cluster) {
+			c.PrivateNetwork = network
+		})
+		h.Manager.Connectivity = config.ConnectivityPrivateIp
+		var err error
+		h.Manager.Egress, err = egress.Static()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("peers the migration job with the network of the instances, and authorizes no networks", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("VpcPeeringConnectivity.Vpc", network)))
+		profile := h.Backend.ConnectionProfiles["projects/"+e2e.Project+"/locations/europe-north1/connectionProfiles/source-"+source]
+		Expect(profile.GetPostgresql().GetHost()).To(Equal(h.Cluster.PrivateIp(source)))
+		state, err := h.State()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state["sqlInstances"]).To(ContainElement(source + " authorizedNetworks="))
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("State", "COMPLETED")))
+		for _, statement := range h.Database.Statements() {
+			Expect(statement.Host).To(BeElementOf(h.Cluster.PrivateIp(source), h.Cluster.PrivateIp(target)))
+		}
+	})
+
+	It("refuses a source instance that is not on a private network", func() {
+		h.Backend.Update(func() {
+			h.Backend.Instances[e2e.Project+"/"+source].Settings.IpConfiguration.PrivateNetwork = ""
+		})
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(8))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target))
+	})
+})
+
+var _ = Describe("Migration in another region", func() {
+	const region = "us-central1"
+	const parent = "projects/" + e2e.Project + "/locations/" + region
+
+	var ctx context.Context
+	var h *e2e.Harness
+	var cfg config.Config
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		DeferCleanup(cancel)
+
+		h, cfg = start(ctx, func(c *e2e.Cluster) {
+			c.Region = region
+		})
+	})
+
+	It("creates the migration job and connection profiles in the region of the instances", func() {
+		Expect(run(ctx, h, cfg, setup)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKey(parent + "/migrationJobs/" + source + "-" + target))
+		Expect(h.Backend.ConnectionProfiles).To(HaveKey(parent + "/connectionProfiles/source-" + source))
+		Expect(h.Backend.ConnectionProfiles).To(HaveKey(parent + "/connectionProfiles/target-" + source))
+
+		Expect(run(ctx, h, cfg, promote)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(HaveKeyWithValue(parent+"/migrationJobs/"+source+"-"+target, HaveField("State", "COMPLETED")))
+
+		Expect(run(ctx, h, cfg, finalize)).To(Equal(0))
+		Expect(h.Backend.MigrationJobs).To(BeEmpty())
+		Expect(h.Backend.ConnectionProfiles).To(BeEmpty())
+	})
+
+	It("refuses a cluster in another region than the source before creating the target", func() {
+		h.Cluster.Region = e2e.Region
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(29))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target))
+
+		Expect(run(ctx, h, cfg, rollback)).To(Equal(0))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + source))
+	})
+
+	It("rolls back a target created in another region than the source", func() {
+		h.Cluster.Region = e2e.Region
+		h.Cluster.UnknownRegion = true
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(26))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + target))
+		Expect(h.Backend.MigrationJobs).To(BeEmpty())
+
+		Expect(run(ctx, h, cfg, rollback)).To(Equal(0))
+		Expect(h.Backend.Instances).To(HaveKey(e2e.Project + "/" + source))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target))
+	})
+
+	It("refuses a configured location that is not the region of the instances", func() {
+		cfg.Location = e2e.Region
+
+		Expect(run(ctx, h, cfg, setup)).To(Equal(26))
+		Expect(h.Backend.Instances).NotTo(HaveKey(e2e.Project + "/" + target))
+		Expect(h.Backend.MigrationJobs).To(BeEmpty())
+	})
+})
@@ -0,0 +1,256 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Killed is the exit code Run returns for a run killed by a fault
+const Killed = -1
+
+var (
+	errInjected = errors.New("injected fault")
+	errKilled   = errors.New("the migrator has been killed")
+)
+
+// Change is a call made by the migrator that changes something: a Kubernetes resource, a GCP resource or a database
+type Change struct {
+	// Step is the step of the phase the change is made in, 0 before the first step
+	Step int
+	// Call numbers the changes made in the step, from 0
+	Call int
+	// Description is the verb and resource of the call, like "create sqlsslcerts migrator-my-app"
+	Description string
+}
+
+// Fault fails or kills the next run at a change
+type Fault struct {
+	Step int
+	Call int
+	// Kill lets the change through and kills the migrator right after, so it makes no more calls.
+	// Otherwise the change fails, and the run goes on as the migrator handles the error.
+	Kill bool
+}
+
+// faults sees every call the migrator makes through the Manager, records the changes and injects the fault.
+// The step of a call is taken from the migrationStep attribute logged by mgr.Step, like nais-cli reads it.
+// Calls are failed with errors the migrator does not retry, so a failing run ends quickly.
+type faults struct {
+	mu      sync.Mutex
+	step    int
+	calls   int
+	changes []Change
+	fault   *Fault
+	killed  bool
+	kill    context.CancelFunc
+}
+
+// start prepares for a run, where kill cancels the context of the run
+func (f *faults) start(kill context.CancelFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.step = 0
+	f.calls = 0
+	f.changes = nil
+	f.killed = false
+	f.kill = kill
+}
+
+// stop ends a run, and reports whether it was killed. A fault that was not injected is dropped.
+func (f *faults) stop() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = nil
+	f.kill = nil
+	return f.killed
+}
+
+func (f *faults) inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = &fault
+}
+
+func (f *faults) recorded() []Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Change(nil), f.changes...)
+}
+
+func (f *faults) enterStep(step int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.step = step
+	f.calls = 0
+}
+
+// call decides the fate of a call before it is made, an error fails it
+func (f *faults) call(description string, changes bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.killed {
+		return errKilled
+	}
+	if !changes {
+		return nil
+	}
+
+	change := Change{Step: f.step, Call: f.calls, Description: description}
+	f.calls++
+	f.changes = append(f.changes, change)
+	if f.fault == nil || f.fault.Step != change.Step || f.fault.Call != change.Call {
+		return nil
+	}
+
+	kill := f.fault.Kill
+	f.fault = nil
+	if kill {
+		f.killed = true
+		return nil
+	}
+	return errInjected
+}
+
+// settle is called when a call is done, and ends the run if the migrator was killed during the call
+func (f *faults) settle() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.killed && f.kill != nil {
+		f.kill()
+	}
+}
+
+// react is a reactor for the fake Kubernetes clients, failing calls with Forbidden
+func (f *faults) react(action k8stesting.Action) (bool, runtime.Object, error) {
+	defer f.settle()
+	err := f.call(describe(action), changes(action))
+	if err != nil {
+		resource := action.GetResource()
+		return true, nil, k8s_errors.NewForbidden(resource.GroupResource(), "", err)
+	}
+	return false, nil, nil
+}
+
+func (f *faults) reactWatch(action k8stesting.Action) (bool, watch.Interface, error) {
+	err := f.call(describe(action), false)
+	if err != nil {
+		return true, nil, k8s_errors.NewForbidden(action.GetResource().GroupResource(), "", err)
+	}
+	return false, nil, nil
+}
+
+func changes(action k8stesting.Action) bool {
+	// The lease is renewed in the background, at no particular step
+	if action.GetResource().Resource == leases.Resource {
+		return false
+	}
+	switch action.GetVerb() {
+	case "create", "update", "patch", "delete", "delete-collection":
+		return true
+	}
+	return false
+}
+
+func describe(action k8stesting.Action) string {
+	description := action.GetVerb() + " " + action.GetResource().Resource
+	if subresource := action.GetSubresource(); subresource != "" {
+		description += "/" + subresource
+	}
+	name := ""
+	switch a := action.(type) {
+	case k8stesting.GetAction:
+		name = a.GetName()
+	case k8stesting.DeleteAction:
+		name = a.GetName()
+	case k8stesting.PatchAction:
+		name = a.GetName()
+	case k8stesting.CreateAction:
+		if accessor, err := meta.Accessor(a.GetObject()); err == nil {
+			name = accessor.GetName()
+		}
+	case k8stesting.UpdateAction:
+		if accessor, err := meta.Accessor(a.GetObject()); err == nil {
+			name = accessor.GetName()
+		}
+	}
+	if name != "" {
+		description += " " + name
+	}
+	return description
+}
+
+// transport fails calls to the REST APIs with Forbidden
+type transport struct {
+	faults *faults
+	base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer t.faults.settle()
+	err := t.faults.call(req.Method+" "+req.URL.Path, req.Method != http.MethodGet)
+	if err != nil {
+		body := fmt.Sprintf(`{"error":{"code":%d,"message":%q}}`, http.StatusForbidden, err.Error())
+		return &http.Response{
+			Status:     http.StatusText(http.StatusForbidden),
+			StatusCode: http.StatusForbidden,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+// unaryClientInterceptor fails calls to the gRPC APIs with PermissionDenied
+func (f *faults) unaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		defer f.settle()
+		name := path.Base(method)
+		err := f.call(name, !strings.HasPrefix(name, "Get") && !strings.HasPrefix(name, "List"))
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// stepHandler tells the faults about the steps of the phase
+type stepHandler struct {
+	slog.Handler
+	faults *faults
+}
+
+func (h *stepHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "migrationStep" && attr.Value.Kind() == slog.KindInt64 {
+			h.faults.enterStep(int(attr.Value.Int64()))
+			return false
+		}
+		return true
+	})
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *stepHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stepHandler{Handler: h.Handler.WithAttrs(attrs), faults: h.faults}
+}
+
+func (h *stepHandler) WithGroup(name string) slog.Handler {
+	return &stepHandler{Handler: h.Handler.WithGroup(name), faults: h.faults}
+}
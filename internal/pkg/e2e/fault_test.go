@@ -0,0 +1,68 @@
+package e2e_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/e2e"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rerunning a phase after a fault", func() {
+	// Every change the phase makes in an undisturbed run is a point to fail or kill it at. After the fault the phase
+	// is rerun until it completes, and must leave the same state as the undisturbed run.
+	DescribeTable("converges to the state of an undisturbed run",
+		func(before []phase, p phase, kill bool) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			DeferCleanup(cancel)
+
+			prepare := func() (*e2e.Harness, config.Config) {
+				h, cfg := start(ctx)
+				for _, b := range before {
+					Expect(run(ctx, h, cfg, b)).To(Equal(0))
+				}
+				return h, cfg
+			}
+
+			h, cfg := prepare()
+			Expect(run(ctx, h, cfg, p)).To(Equal(0))
+			want, err := h.State()
+			Expect(err).NotTo(HaveOccurred())
+			changes := h.Changes()
+			Expect(changes).NotTo(BeEmpty())
+
+			for _, change := range changes {
+				// Statements are retried until they succeed, so failing one only delays the phase
+				if !kill && strings.HasPrefix(change.Description, "exec ") {
+					continue
+				}
+				fault := fmt.Sprintf("fault at step %d, change %d: %s", change.Step, change.Call, change.Description)
+
+				h, cfg := prepare()
+				h.Inject(e2e.Fault{Step: change.Step, Call: change.Call, Kill: kill})
+				code := run(ctx, h, cfg, p)
+				if kill {
+					Expect(code).To(Equal(e2e.Killed), fault)
+				}
+				for reruns := 0; code != 0 && reruns < 2; reruns++ {
+					code = run(ctx, h, cfg, p)
+				}
+				Expect(code).To(Equal(0), fault)
+				Expect(h.State()).To(Equal(want), fault)
+			}
+		},
+		Entry("setup, failed", nil, phase(setup), false),
+		Entry("setup, killed", nil, phase(setup), true),
+		Entry("promote, failed", []phase{setup}, phase(promote), false),
+		Entry("promote, killed", []phase{setup}, phase(promote), true),
+		Entry("finalize, failed", []phase{setup, promote}, phase(finalize), false),
+		Entry("finalize, killed", []phase{setup, promote}, phase(finalize), true),
+		Entry("rollback, failed", []phase{setup}, phase(rollback), false),
+		Entry("rollback, killed", []phase{setup}, phase(rollback), true),
+	)
+})
@@ -0,0 +1,23 @@
+package e2e
+
+import (
+	"context"
+
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+)
+
+// monitoringServer serves the time series of the Cloud Monitoring gRPC API, in a single page
+type monitoringServer struct {
+	monpb.UnimplementedMetricServiceServer
+
+	api gcp.Monitoring
+}
+
+func (s *monitoringServer) ListTimeSeries(ctx context.Context, req *monpb.ListTimeSeriesRequest) (*monpb.ListTimeSeriesResponse, error) {
+	series, err := s.api.ListTimeSeries(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &monpb.ListTimeSeriesResponse{TimeSeries: series}, nil
+}
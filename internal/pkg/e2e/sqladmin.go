@@ -0,0 +1,84 @@
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// sqlAdminHandler serves the parts of the Cloud SQL Admin REST API the migrator uses
+func sqlAdminHandler(api gcp.SqlAdmin) http.Handler {
+	mux := http.NewServeMux()
+	const instance = "/v1/projects/{project}/instances/{instance}"
+
+	mux.HandleFunc("GET "+instance, func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.Instances.Get(r.Context(), r.PathValue("project"), r.PathValue("instance")))
+	})
+	mux.HandleFunc("DELETE "+instance, func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.Instances.Delete(r.Context(), r.PathValue("project"), r.PathValue("instance")))
+	})
+	mux.HandleFunc("GET "+instance+"/users/{name}", func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.Users.Get(r.Context(), r.PathValue("project"), r.PathValue("instance"), r.PathValue("name")))
+	})
+	mux.HandleFunc("PUT "+instance+"/users", func(w http.ResponseWriter, r *http.Request) {
+		user := &sqladmin.User{}
+		if !decode(w, r, user) {
+			return
+		}
+		user.Name = r.URL.Query().Get("name")
+		user.Host = r.URL.Query().Get("host")
+		respond(w)(api.Users.Update(r.Context(), r.PathValue("project"), r.PathValue("instance"), user))
+	})
+	mux.HandleFunc("GET "+instance+"/sslCerts", func(w http.ResponseWriter, r *http.Request) {
+		certs, err := api.SslCerts.List(r.Context(), r.PathValue("project"), r.PathValue("instance"))
+		respond(w)(&sqladmin.SslCertsListResponse{Items: certs}, err)
+	})
+	mux.HandleFunc("DELETE "+instance+"/sslCerts/{fingerprint}", func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.SslCerts.Delete(r.Context(), r.PathValue("project"), r.PathValue("instance"), r.PathValue("fingerprint")))
+	})
+	mux.HandleFunc("POST "+instance+"/backupRuns", func(w http.ResponseWriter, r *http.Request) {
+		backupRun := &sqladmin.BackupRun{}
+		if !decode(w, r, backupRun) {
+			return
+		}
+		respond(w)(api.BackupRuns.Insert(r.Context(), r.PathValue("project"), r.PathValue("instance"), backupRun))
+	})
+	mux.HandleFunc("DELETE "+instance+"/databases/{database}", func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.Databases.Delete(r.Context(), r.PathValue("project"), r.PathValue("instance"), r.PathValue("database")))
+	})
+	mux.HandleFunc("GET /v1/projects/{project}/operations/{operation}", func(w http.ResponseWriter, r *http.Request) {
+		respond(w)(api.Operations.Get(r.Context(), r.PathValue("project"), r.PathValue("operation")))
+	})
+
+	return mux
+}
+
+// respond writes the result of a call as the REST APIs do, with errors in the body and their code as the status
+func respond(w http.ResponseWriter) func(any, error) {
+	return func(v any, err error) {
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			code := http.StatusInternalServerError
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) {
+				code = apiErr.Code
+			}
+			w.WriteHeader(code)
+			v = map[string]any{"error": map[string]any{"code": code, "message": err.Error()}}
+		}
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		respond(w)(nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+		return false
+	}
+	return true
+}
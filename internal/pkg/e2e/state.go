@@ -0,0 +1,159 @@
+package e2e
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+)
+
+// State is what the runs have left in the backend and the cluster, as sorted descriptions of the resources by kind.
+// Descriptions leave out what differs between runs of the same phase, like passwords and correlation IDs,
+// so the states of two runs that did the same are equal.
+type State map[string][]string
+
+// State returns the state of the backend and the cluster
+func (h *Harness) State() (State, error) {
+	state := State{}
+	add := func(kind, format string, args ...any) {
+		state[kind] = append(state[kind], fmt.Sprintf(format, args...))
+	}
+
+	b := h.Backend
+	b.Update(func() {
+		for key := range b.Instances {
+			add("instances", "%s", key)
+		}
+		for key, certs := range b.SslCerts {
+			for _, cert := range certs {
+				add("sslCerts", "%s %s", key, cert.CommonName)
+			}
+		}
+		for key := range b.Users {
+			add("users", "%s", key)
+		}
+		for key := range b.Databases {
+			add("databases", "%s", key)
+		}
+		for name, job := range b.MigrationJobs {
+			add("migrationJobs", "%s %s", name, job.State)
+		}
+		for name := range b.ConnectionProfiles {
+			add("connectionProfiles", "%s", name)
+		}
+	})
+
+	err := h.Cluster.each(applications, func(obj *unstructured.Unstructured) error {
+		app := &nais_io_v1alpha1.Application{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, app)
+		if err != nil {
+			return err
+		}
+		instanceName, err := resolved.ResolveInstanceName(app)
+		if err != nil {
+			return err
+		}
+		add("applications", "%s instance=%s", app.Name, instanceName)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.Cluster.each(sqlInstances, func(obj *unstructured.Unstructured) error {
+		sqlInstance := &v1beta1.SQLInstance{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, sqlInstance)
+		if err != nil {
+			return err
+		}
+		var networks []string
+		if ipConfiguration := sqlInstance.Spec.Settings.IpConfiguration; ipConfiguration != nil {
+			for _, network := range ipConfiguration.AuthorizedNetworks {
+				networks = append(networks, ptr.Deref(network.Name, "")+"="+network.Value)
+			}
+		}
+		slices.Sort(networks)
+		add("sqlInstances", "%s authorizedNetworks=%s", sqlInstance.Name, strings.Join(networks, ","))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, gvr := range map[string]schema.GroupVersionResource{"sqlSslCerts": sqlSslCerts, "sqlUsers": sqlUsers, "sqlDatabases": sqlDatabases} {
+		err = h.Cluster.each(gvr, func(obj *unstructured.Unstructured) error {
+			add(kind, "%s", obj.GetName())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tracker := h.Cluster.Clientset.Tracker()
+	for _, gvk := range []schema.GroupVersionKind{
+		appsv1.SchemeGroupVersion.WithKind("Deployment"),
+		corev1.SchemeGroupVersion.WithKind("Secret"),
+		corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+		coordinationv1.SchemeGroupVersion.WithKind("Lease"),
+		networkingv1.SchemeGroupVersion.WithKind("NetworkPolicy"),
+	} {
+		gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+		list, err := tracker.List(gvr, gvk, h.Cluster.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			accessor, err := meta.Accessor(item)
+			if err != nil {
+				return nil, err
+			}
+			if deployment, ok := item.(*appsv1.Deployment); ok {
+				add(gvr.Resource, "%s replicas=%d", deployment.Name, ptr.Deref(deployment.Spec.Replicas, 1))
+				continue
+			}
+			add(gvr.Resource, "%s", accessor.GetName())
+		}
+	}
+
+	for _, descriptions := range state {
+		slices.Sort(descriptions)
+	}
+	return state, nil
+}
+
+// expireLeases makes the leases of earlier runs expire, as if their lease duration has passed
+func (h *Harness) expireLeases() error {
+	tracker := h.Cluster.Clientset.Tracker()
+	list, err := tracker.List(leases, leases.GroupVersion().WithKind("Lease"), h.Cluster.Namespace)
+	if err != nil {
+		return err
+	}
+	for _, lease := range list.(*coordinationv1.LeaseList).Items {
+		duration := time.Duration(ptr.Deref(lease.Spec.LeaseDurationSeconds, 0)) * time.Second
+		lease.Spec.RenewTime = ptr.To(metav1.NewMicroTime(time.Now().Add(-duration - time.Second)))
+		err = tracker.Update(leases, &lease, h.Cluster.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
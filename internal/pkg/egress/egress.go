@@ -0,0 +1,152 @@
+// Package egress finds the outgoing ip addresses of the migrator, which are authorized to connect to the sql instances.
+//
+// How they are found is configured by a strategy: an ip given in the configuration, the NAT ips of the cluster,
+// or asking an echo endpoint. The network policy of the migration job allows the destinations of the strategy,
+// so nothing is allowed beyond the instances unless the strategy has to make a request.
+package egress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+)
+
+const (
+	// StrategyIp uses the outgoing ip given in the configuration
+	StrategyIp = "IP"
+	// StrategyNat uses all the NAT ips of the cluster, as the migrator may connect from any of them
+	StrategyNat = "NAT"
+	// StrategyEcho asks an endpoint answering with the ip address of the caller
+	StrategyEcho = "ECHO"
+)
+
+// maxEchoResponse is more than enough for an ip address, and keeps a misconfigured endpoint from being read in full
+const maxEchoResponse = 256
+
+// Resolver finds the outgoing ip addresses of the migrator
+type Resolver interface {
+	// OutgoingIps returns the IPv4 addresses the migrator may connect to the instances from
+	OutgoingIps(ctx context.Context) ([]string, error)
+	// Destinations returns the ip addresses the migrator has to reach to find its outgoing ips
+	Destinations(ctx context.Context) ([]string, error)
+}
+
+// New returns the Resolver for the strategy in the configuration
+func New(cfg config.Egress, httpClient *http.Client) (Resolver, error) {
+	switch cfg.Strategy {
+	case StrategyIp:
+		if cfg.Ip == "" {
+			return nil, fmt.Errorf("the %s egress strategy requires EGRESS_IP", StrategyIp)
+		}
+		return Static(cfg.Ip)
+	case StrategyNat:
+		if len(cfg.NatIps) == 0 {
+			return nil, fmt.Errorf("the %s egress strategy requires EGRESS_NAT_IPS", StrategyNat)
+		}
+		return Static(cfg.NatIps...)
+	case StrategyEcho:
+		return Echo(httpClient, cfg.EchoUrl, cfg.EchoIps)
+	default:
+		return nil, fmt.Errorf("unknown egress strategy %q, expected %s, %s or %s", cfg.Strategy, StrategyIp, StrategyNat, StrategyEcho)
+	}
+}
+
+type static []string
+
+// Static returns a Resolver with outgoing ips known in advance, which has no destinations
+func Static(ips ...string) (Resolver, error) {
+	for _, ip := range ips {
+		if err := validateIPv4(ip); err != nil {
+			return nil, err
+		}
+	}
+	return static(ips), nil
+}
+
+func (s static) OutgoingIps(context.Context) ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+func (s static) Destinations(context.Context) ([]string, error) {
+	return nil, nil
+}
+
+type echo struct {
+	httpClient *http.Client
+	url        *url.URL
+	ips        []string
+}
+
+// Echo returns a Resolver asking the endpoint for the outgoing ip. Its destinations are the ips given, or the addresses
+// of the host name of the endpoint when there are none.
+func Echo(httpClient *http.Client, endpoint string, ips []string) (Resolver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid echo endpoint: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid echo endpoint %q, expected an http or https url", endpoint)
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip %q of the echo endpoint", ip)
+		}
+	}
+	return &echo{httpClient: httpClient, url: u, ips: ips}, nil
+}
+
+func (e *echo) OutgoingIps(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask %s for the outgoing ip: %w", e.url.Host, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxEchoResponse))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the outgoing ip from %s: %w", e.url.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s when asked for the outgoing ip", e.url.Host, resp.Status)
+	}
+
+	ip := strings.TrimSpace(string(data))
+	if err := validateIPv4(ip); err != nil {
+		return nil, fmt.Errorf("%s did not answer with the outgoing ip: %w", e.url.Host, err)
+	}
+	return []string{ip}, nil
+}
+
+func (e *echo) Destinations(ctx context.Context) ([]string, error) {
+	if len(e.ips) > 0 {
+		return append([]string(nil), e.ips...), nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, e.url.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the echo endpoint %s: %w", e.url.Hostname(), err)
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips, nil
+}
+
+// validateIPv4 makes sure the ip can be authorized on a sql instance, which only takes IPv4 networks
+func validateIPv4(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() == nil {
+		return fmt.Errorf("%q is not an IPv4 address", ip)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package egress_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/egress"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Egress", func() {
+	ctx := context.Background()
+
+	// echoServer answers every request with the status and body
+	echoServer := func(status int, body string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}))
+		DeferCleanup(server.Close)
+		return server
+	}
+
+	Describe("New", func() {
+		DescribeTable("refuses an incomplete configuration",
+			func(cfg config.Egress, message string) {
+				_, err := egress.New(cfg, http.DefaultClient)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("IP without an ip", config.Egress{Strategy: egress.StrategyIp}, "requires EGRESS_IP"),
+			Entry("IP with an IPv6 address", config.Egress{Strategy: egress.StrategyIp, Ip: "2001:db8::1"}, "not an IPv4 address"),
+			Entry("NAT without ips", config.Egress{Strategy: egress.StrategyNat}, "requires EGRESS_NAT_IPS"),
+			Entry("NAT with a host name", config.Egress{Strategy: egress.StrategyNat, NatIps: []string{"198.51.100.1", "nat.example.com"}}, "not an IPv4 address"),
+			Entry("ECHO with a relative url", config.Egress{Strategy: egress.StrategyEcho, EchoUrl: "/ip"}, "invalid echo endpoint"),
+			Entry("ECHO with an invalid ip", config.Egress{Strategy: egress.StrategyEcho, EchoUrl: "https://echo.example.com", EchoIps: []string{"echo"}}, "invalid ip"),
+			Entry("an unknown strategy", config.Egress{Strategy: "GUESS"}, `unknown egress strategy "GUESS"`),
+		)
+
+		It("uses the configured ip, and reaches nothing to find it", func() {
+			resolver, err := egress.New(config.Egress{Strategy: egress.StrategyIp, Ip: "198.51.100.1"}, http.DefaultClient)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resolver.OutgoingIps(ctx)).To(Equal([]string{"198.51.100.1"}))
+			Expect(resolver.Destinations(ctx)).To(BeEmpty())
+		})
+
+		It("uses all NAT ips of the cluster", func() {
+			resolver, err := egress.New(config.Egress{Strategy: egress.StrategyNat, NatIps: []string{"198.51.100.1", "198.51.100.2"}}, http.DefaultClient)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resolver.OutgoingIps(ctx)).To(Equal([]string{"198.51.100.1", "198.51.100.2"}))
+			Expect(resolver.Destinations(ctx)).To(BeEmpty())
+		})
+	})
+
+	Describe("Echo", func() {
+		It("asks the endpoint for the outgoing ip, and reaches the endpoint at its address", func() {
+			server := echoServer(http.StatusOK, "203.0.113.10\n")
+			resolver, err := egress.Echo(server.Client(), server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resolver.OutgoingIps(ctx)).To(Equal([]string{"203.0.113.10"}))
+			Expect(resolver.Destinations(ctx)).To(Equal([]string{"127.0.0.1"}))
+		})
+
+		It("reaches the endpoint at the configured ips", func() {
+			resolver, err := egress.Echo(http.DefaultClient, "https://echo.example.com", []string{"192.0.2.1", "2001:db8::1"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resolver.Destinations(ctx)).To(Equal([]string{"192.0.2.1", "2001:db8::1"}))
+		})
+
+		It("fails when the endpoint does not answer with an ip", func() {
+			server := echoServer(http.StatusOK, "<html>blocked</html>")
+			resolver, err := egress.Echo(server.Client(), server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = resolver.OutgoingIps(ctx)
+			Expect(err).To(MatchError(ContainSubstring("did not answer with the outgoing ip")))
+		})
+
+		It("fails when the endpoint answers with an error", func() {
+			server := echoServer(http.StatusServiceUnavailable, "203.0.113.10")
+			resolver, err := egress.Echo(server.Client(), server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = resolver.OutgoingIps(ctx)
+			Expect(err).To(MatchError(ContainSubstring("503")))
+		})
+	})
+})
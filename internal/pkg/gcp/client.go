@@ -0,0 +1,267 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	dms "cloud.google.com/go/clouddms/apiv1"
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const (
+	pollInitialInterval = 1 * time.Second
+	pollMaxInterval     = 15 * time.Second
+)
+
+var errNotDone = errors.New("not done")
+
+// NewSqlAdmin returns the Cloud SQL Admin API backed by service
+func NewSqlAdmin(service *sqladmin.Service) SqlAdmin {
+	return SqlAdmin{
+		Instances:  &sqlInstances{service.Instances},
+		Users:      &sqlUsers{service.Users},
+		SslCerts:   &sqlSslCerts{service.SslCerts},
+		BackupRuns: &sqlBackupRuns{service.BackupRuns},
+		Databases:  &sqlDatabases{service.Databases},
+		Operations: &sqlOperations{service.Operations},
+	}
+}
+
+// NewDatamigration returns the Database Migration API backed by the REST service and the gRPC client
+func NewDatamigration(service *datamigration.Service, client *dms.DataMigrationClient) Datamigration {
+	return Datamigration{
+		MigrationJobs:      &migrationJobs{service: service.Projects.Locations.MigrationJobs, client: client},
+		ConnectionProfiles: &connectionProfiles{client},
+		Operations:         &datamigrationOperations{service.Projects.Locations.Operations},
+	}
+}
+
+// NewMonitoring returns the Cloud Monitoring API backed by client
+func NewMonitoring(client *monitoring.MetricClient) Monitoring {
+	return &metrics{client}
+}
+
+type sqlInstances struct {
+	service *sqladmin.InstancesService
+}
+
+func (s *sqlInstances) Get(ctx context.Context, project, instance string) (*sqladmin.DatabaseInstance, error) {
+	return s.service.Get(project, instance).Context(ctx).Do()
+}
+
+func (s *sqlInstances) Delete(ctx context.Context, project, instance string) (*sqladmin.Operation, error) {
+	return s.service.Delete(project, instance).Context(ctx).Do()
+}
+
+type sqlUsers struct {
+	service *sqladmin.UsersService
+}
+
+func (s *sqlUsers) Get(ctx context.Context, project, instance, name string) (*sqladmin.User, error) {
+	return s.service.Get(project, instance, name).Context(ctx).Do()
+}
+
+func (s *sqlUsers) Update(ctx context.Context, project, instance string, user *sqladmin.User) (*sqladmin.Operation, error) {
+	return s.service.Update(project, instance, user).Name(user.Name).Host(user.Host).Context(ctx).Do()
+}
+
+type sqlSslCerts struct {
+	service *sqladmin.SslCertsService
+}
+
+func (s *sqlSslCerts) List(ctx context.Context, project, instance string) ([]*sqladmin.SslCert, error) {
+	response, err := s.service.List(project, instance).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return response.Items, nil
+}
+
+func (s *sqlSslCerts) Delete(ctx context.Context, project, instance, sha1Fingerprint string) (*sqladmin.Operation, error) {
+	return s.service.Delete(project, instance, sha1Fingerprint).Context(ctx).Do()
+}
+
+type sqlBackupRuns struct {
+	service *sqladmin.BackupRunsService
+}
+
+func (s *sqlBackupRuns) Insert(ctx context.Context, project, instance string, backupRun *sqladmin.BackupRun) (*sqladmin.Operation, error) {
+	return s.service.Insert(project, instance, backupRun).Context(ctx).Do()
+}
+
+type sqlDatabases struct {
+	service *sqladmin.DatabasesService
+}
+
+func (s *sqlDatabases) Delete(ctx context.Context, project, instance, database string) (*sqladmin.Operation, error) {
+	return s.service.Delete(project, instance, database).Context(ctx).Do()
+}
+
+type sqlOperations struct {
+	service *sqladmin.OperationsService
+}
+
+func (s *sqlOperations) Get(ctx context.Context, project, name string) (*sqladmin.Operation, error) {
+	return s.service.Get(project, name).Context(ctx).Do()
+}
+
+type migrationJobs struct {
+	service *datamigration.ProjectsLocationsMigrationJobsService
+	client  *dms.DataMigrationClient
+}
+
+func (m *migrationJobs) Get(ctx context.Context, name string) (*datamigration.MigrationJob, error) {
+	return m.service.Get(name).Context(ctx).Do()
+}
+
+func (m *migrationJobs) Create(ctx context.Context, parent, id string, job *clouddmspb.MigrationJob) (*clouddmspb.MigrationJob, error) {
+	op, err := m.client.CreateMigrationJob(ctx, &clouddmspb.CreateMigrationJobRequest{
+		Parent:         parent,
+		MigrationJobId: id,
+		MigrationJob:   job,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = waitOperation(ctx, op.Name(), func(ctx context.Context) (err error) {
+		job, err = op.Poll(ctx)
+		return err
+	}, op.Done)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (m *migrationJobs) Start(ctx context.Context, name string) error {
+	op, err := m.client.StartMigrationJob(ctx, &clouddmspb.StartMigrationJobRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	return waitOperation(ctx, op.Name(), func(ctx context.Context) error {
+		_, err := op.Poll(ctx)
+		return err
+	}, op.Done)
+}
+
+func (m *migrationJobs) Delete(ctx context.Context, name string) error {
+	op, err := m.client.DeleteMigrationJob(ctx, &clouddmspb.DeleteMigrationJobRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	return waitOperation(ctx, op.Name(), func(ctx context.Context) error {
+		return op.Poll(ctx)
+	}, op.Done)
+}
+
+func (m *migrationJobs) Promote(ctx context.Context, name string) (*datamigration.Operation, error) {
+	return m.service.Promote(name, &datamigration.PromoteMigrationJobRequest{}).Context(ctx).Do()
+}
+
+func (m *migrationJobs) DemoteDestination(ctx context.Context, name string) (*datamigration.Operation, error) {
+	return m.service.DemoteDestination(name, &datamigration.DemoteDestinationRequest{}).Context(ctx).Do()
+}
+
+type connectionProfiles struct {
+	client *dms.DataMigrationClient
+}
+
+func (c *connectionProfiles) Get(ctx context.Context, name string) (*clouddmspb.ConnectionProfile, error) {
+	return c.client.GetConnectionProfile(ctx, &clouddmspb.GetConnectionProfileRequest{Name: name})
+}
+
+func (c *connectionProfiles) Create(ctx context.Context, parent, id string, profile *clouddmspb.ConnectionProfile) (*clouddmspb.ConnectionProfile, error) {
+	op, err := c.client.CreateConnectionProfile(ctx, &clouddmspb.CreateConnectionProfileRequest{
+		Parent:              parent,
+		ConnectionProfileId: id,
+		ConnectionProfile:   profile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = waitOperation(ctx, op.Name(), func(ctx context.Context) (err error) {
+		profile, err = op.Poll(ctx)
+		return err
+	}, op.Done)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (c *connectionProfiles) Delete(ctx context.Context, name string) error {
+	op, err := c.client.DeleteConnectionProfile(ctx, &clouddmspb.DeleteConnectionProfileRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	return waitOperation(ctx, op.Name(), func(ctx context.Context) error {
+		return op.Poll(ctx)
+	}, op.Done)
+}
+
+// waitOperation polls an operation of the gRPC API until it is done, and returns the error it finished with.
+// Unlike the Wait method of the operation, it keeps polling when a poll fails with an error classify retries.
+func waitOperation(ctx context.Context, name string, poll func(ctx context.Context) error, done func() bool) error {
+	b := retry.NewExponential(pollInitialInterval)
+	b = retry.WithCappedDuration(pollMaxInterval, b)
+
+	err := retry.Do(ctx, b, func(ctx context.Context) error {
+		err := poll(ctx)
+		if done() {
+			return err
+		}
+		if err != nil {
+			return classify.Retry(err)
+		}
+		return retry.RetryableError(errNotDone)
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for operation %s: %w", name, err)
+	}
+	return nil
+}
+
+type datamigrationOperations struct {
+	service *datamigration.ProjectsLocationsOperationsService
+}
+
+func (d *datamigrationOperations) Get(ctx context.Context, name string) (*datamigration.Operation, error) {
+	return d.service.Get(name).Context(ctx).Do()
+}
+
+func (d *datamigrationOperations) List(ctx context.Context, name string) ([]*datamigration.Operation, error) {
+	var operations []*datamigration.Operation
+	err := d.service.List(name).Pages(ctx, func(response *datamigration.ListOperationsResponse) error {
+		operations = append(operations, response.Operations...)
+		return nil
+	})
+	return operations, err
+}
+
+type metrics struct {
+	client *monitoring.MetricClient
+}
+
+func (m *metrics) ListTimeSeries(ctx context.Context, req *monpb.ListTimeSeriesRequest) ([]*monpb.TimeSeries, error) {
+	var series []*monpb.TimeSeries
+	it := m.client.ListTimeSeries(ctx, req)
+	for {
+		ts, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return series, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts)
+	}
+}
@@ -0,0 +1,474 @@
+// Package fake is an in-memory implementation of the GCP APIs in the gcp package, for tests.
+//
+// A Backend holds the state of the APIs, which tests set up and inspect directly through its exported fields.
+// Long-running operations are done when they are returned, except promotions when PromotePolls is set.
+// Resources that do not exist are reported with the same errors as the real APIs, so classify.NotFound and the gRPC
+// status codes work as in production.
+//
+// A started migration job goes through Phases, one phase further every time it is read, so tests can script
+// the progression of a migration from the full dump to change data capture.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Backend is the state of the fake APIs.
+// Keys of the Cloud SQL maps are project/instance, with /name appended for users and databases.
+// Keys of the Database Migration maps are the full resource names.
+type Backend struct {
+	mu sync.Mutex
+
+	Instances  map[string]*sqladmin.DatabaseInstance
+	Users      map[string]*sqladmin.User
+	SslCerts   map[string][]*sqladmin.SslCert
+	BackupRuns map[string][]*sqladmin.BackupRun
+	Databases  map[string]*sqladmin.Database
+	// SqlOperations are keyed by project/name
+	SqlOperations map[string]*sqladmin.Operation
+
+	MigrationJobs           map[string]*datamigration.MigrationJob
+	ConnectionProfiles      map[string]*clouddmspb.ConnectionProfile
+	DatamigrationOperations map[string]*datamigration.Operation
+
+	// Phases are the phases of a started migration job, which advances to the next phase every time it is read
+	// and stays in the last phase until it is promoted. A started job goes straight to CDC if there are no phases.
+	Phases []string
+	// PromotePolls is the number of times a promote operation is read before it is done.
+	// Meanwhile the migration job is in PROMOTE_IN_PROGRESS.
+	PromotePolls int
+
+	// TimeSeries is returned for every time series request
+	TimeSeries []*monpb.TimeSeries
+
+	// Calls are the mutating calls made, like "SqlUsers.Update my-project/instance/postgres"
+	Calls []string
+
+	operations int
+	// remainingPhases are the phases a started migration job has yet to go through, by job name
+	remainingPhases map[string][]string
+	// promotions are the migration jobs being promoted and the polls left, by operation name
+	promotions map[string]*promotion
+}
+
+type promotion struct {
+	job   string
+	polls int
+}
+
+func New() *Backend {
+	return &Backend{
+		Instances:               make(map[string]*sqladmin.DatabaseInstance),
+		Users:                   make(map[string]*sqladmin.User),
+		SslCerts:                make(map[string][]*sqladmin.SslCert),
+		BackupRuns:              make(map[string][]*sqladmin.BackupRun),
+		Databases:               make(map[string]*sqladmin.Database),
+		SqlOperations:           make(map[string]*sqladmin.Operation),
+		MigrationJobs:           make(map[string]*datamigration.MigrationJob),
+		ConnectionProfiles:      make(map[string]*clouddmspb.ConnectionProfile),
+		DatamigrationOperations: make(map[string]*datamigration.Operation),
+		remainingPhases:         make(map[string][]string),
+		promotions:              make(map[string]*promotion),
+	}
+}
+
+// SqlAdmin returns the Cloud SQL Admin API of the backend
+func (b *Backend) SqlAdmin() gcp.SqlAdmin {
+	return gcp.SqlAdmin{
+		Instances:  &sqlInstances{b},
+		Users:      &sqlUsers{b},
+		SslCerts:   &sqlSslCerts{b},
+		BackupRuns: &sqlBackupRuns{b},
+		Databases:  &sqlDatabases{b},
+		Operations: &sqlOperations{b},
+	}
+}
+
+// Datamigration returns the Database Migration API of the backend
+func (b *Backend) Datamigration() gcp.Datamigration {
+	return gcp.Datamigration{
+		MigrationJobs:      &migrationJobs{b},
+		ConnectionProfiles: &connectionProfiles{b},
+		Operations:         &datamigrationOperations{b},
+	}
+}
+
+// Monitoring returns the Cloud Monitoring API of the backend
+func (b *Backend) Monitoring() gcp.Monitoring {
+	return &monitoring{b}
+}
+
+// Update runs f with the backend locked, for changes made while the APIs are in use
+func (b *Backend) Update(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f()
+}
+
+// call records a mutating call, the caller holds the lock
+func (b *Backend) call(method, resource string) {
+	b.Calls = append(b.Calls, method+" "+resource)
+}
+
+// sqlOperation returns a new operation that is done, the caller holds the lock
+func (b *Backend) sqlOperation(project, operationType, target string) *sqladmin.Operation {
+	b.operations++
+	op := &sqladmin.Operation{
+		Name:          fmt.Sprintf("op-%d", b.operations),
+		OperationType: operationType,
+		Status:        "DONE",
+		TargetId:      target,
+		TargetProject: project,
+	}
+	b.SqlOperations[project+"/"+op.Name] = op
+	return op
+}
+
+// datamigrationOperation returns a new operation that is done, the caller holds the lock
+func (b *Backend) datamigrationOperation(resource string) *datamigration.Operation {
+	b.operations++
+	// Operations belong to the location of the resource, projects/<project>/locations/<location>
+	location := path.Dir(path.Dir(resource))
+	op := &datamigration.Operation{
+		Name: fmt.Sprintf("%s/operations/op-%d", location, b.operations),
+		Done: true,
+	}
+	b.DatamigrationOperations[op.Name] = op
+	return op
+}
+
+func notFound(resource string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: resource + " not found"}
+}
+
+type sqlInstances struct{ b *Backend }
+
+func (s *sqlInstances) Get(_ context.Context, project, instance string) (*sqladmin.DatabaseInstance, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	i, ok := s.b.Instances[project+"/"+instance]
+	if !ok {
+		return nil, notFound(instance)
+	}
+	return i, nil
+}
+
+func (s *sqlInstances) Delete(_ context.Context, project, instance string) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	key := project + "/" + instance
+	if _, ok := s.b.Instances[key]; !ok {
+		return nil, notFound(instance)
+	}
+	s.b.call("SqlInstances.Delete", key)
+	delete(s.b.Instances, key)
+	// The users, databases and certificates of the instance go with it
+	delete(s.b.SslCerts, key)
+	maps.DeleteFunc(s.b.Users, func(userKey string, _ *sqladmin.User) bool {
+		return strings.HasPrefix(userKey, key+"/")
+	})
+	maps.DeleteFunc(s.b.Databases, func(databaseKey string, _ *sqladmin.Database) bool {
+		return strings.HasPrefix(databaseKey, key+"/")
+	})
+	return s.b.sqlOperation(project, "DELETE", instance), nil
+}
+
+type sqlUsers struct{ b *Backend }
+
+func (s *sqlUsers) Get(_ context.Context, project, instance, name string) (*sqladmin.User, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	u, ok := s.b.Users[project+"/"+instance+"/"+name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (s *sqlUsers) Update(_ context.Context, project, instance string, user *sqladmin.User) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	key := project + "/" + instance + "/" + user.Name
+	if _, ok := s.b.Users[key]; !ok {
+		return nil, notFound(user.Name)
+	}
+	s.b.call("SqlUsers.Update", key)
+	updated := *user
+	s.b.Users[key] = &updated
+	return s.b.sqlOperation(project, "UPDATE_USER", instance), nil
+}
+
+type sqlSslCerts struct{ b *Backend }
+
+func (s *sqlSslCerts) List(_ context.Context, project, instance string) ([]*sqladmin.SslCert, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return append([]*sqladmin.SslCert(nil), s.b.SslCerts[project+"/"+instance]...), nil
+}
+
+func (s *sqlSslCerts) Delete(_ context.Context, project, instance, sha1Fingerprint string) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	key := project + "/" + instance
+	certs := s.b.SslCerts[key]
+	for i, cert := range certs {
+		if cert.Sha1Fingerprint == sha1Fingerprint {
+			s.b.call("SqlSslCerts.Delete", key+"/"+sha1Fingerprint)
+			s.b.SslCerts[key] = append(certs[:i:i], certs[i+1:]...)
+			return s.b.sqlOperation(project, "DELETE_SSL_CERT", instance), nil
+		}
+	}
+	return nil, notFound(sha1Fingerprint)
+}
+
+type sqlBackupRuns struct{ b *Backend }
+
+func (s *sqlBackupRuns) Insert(_ context.Context, project, instance string, backupRun *sqladmin.BackupRun) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	key := project + "/" + instance
+	if _, ok := s.b.Instances[key]; !ok {
+		return nil, notFound(instance)
+	}
+	s.b.call("SqlBackupRuns.Insert", key)
+	s.b.BackupRuns[key] = append(s.b.BackupRuns[key], backupRun)
+	return s.b.sqlOperation(project, "BACKUP_VOLUME", instance), nil
+}
+
+type sqlDatabases struct{ b *Backend }
+
+func (s *sqlDatabases) Delete(_ context.Context, project, instance, database string) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	key := project + "/" + instance + "/" + database
+	if _, ok := s.b.Databases[key]; !ok {
+		return nil, notFound(database)
+	}
+	s.b.call("SqlDatabases.Delete", key)
+	delete(s.b.Databases, key)
+	return s.b.sqlOperation(project, "DELETE_DATABASE", instance), nil
+}
+
+type sqlOperations struct{ b *Backend }
+
+func (s *sqlOperations) Get(_ context.Context, project, name string) (*sqladmin.Operation, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	op, ok := s.b.SqlOperations[project+"/"+name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return op, nil
+}
+
+type migrationJobs struct{ b *Backend }
+
+func (m *migrationJobs) Get(_ context.Context, name string) (*datamigration.MigrationJob, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	job, ok := m.b.MigrationJobs[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	copied := *job
+	if phases := m.b.remainingPhases[name]; len(phases) > 0 {
+		job.Phase = phases[0]
+		m.b.remainingPhases[name] = phases[1:]
+	}
+	return &copied, nil
+}
+
+func (m *migrationJobs) Create(_ context.Context, parent, id string, job *clouddmspb.MigrationJob) (*clouddmspb.MigrationJob, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	name := parent + "/migrationJobs/" + id
+	if _, ok := m.b.MigrationJobs[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", name)
+	}
+	m.b.call("MigrationJobs.Create", name)
+	stored := &datamigration.MigrationJob{
+		Name:        name,
+		DisplayName: job.GetDisplayName(),
+		Labels:      job.GetLabels(),
+		Type:        job.GetType().String(),
+		Source:      job.GetSource(),
+		Destination: job.GetDestination(),
+		State:       "NOT_STARTED",
+	}
+	switch connectivity := job.GetConnectivity().(type) {
+	case *clouddmspb.MigrationJob_StaticIpConnectivity:
+		stored.StaticIpConnectivity = &datamigration.StaticIpConnectivity{}
+	case *clouddmspb.MigrationJob_VpcPeeringConnectivity:
+		stored.VpcPeeringConnectivity = &datamigration.VpcPeeringConnectivity{Vpc: connectivity.VpcPeeringConnectivity.GetVpc()}
+	}
+	m.b.MigrationJobs[name] = stored
+	created := proto.Clone(job).(*clouddmspb.MigrationJob)
+	created.Name = name
+	return created, nil
+}
+
+func (m *migrationJobs) Start(_ context.Context, name string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	job, ok := m.b.MigrationJobs[name]
+	if !ok {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	m.b.call("MigrationJobs.Start", name)
+	phases := m.b.Phases
+	if len(phases) == 0 {
+		phases = []string{"CDC"}
+	}
+	job.State = "RUNNING"
+	job.Phase = phases[0]
+	m.b.remainingPhases[name] = phases[1:]
+	return nil
+}
+
+func (m *migrationJobs) Delete(_ context.Context, name string) error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	if _, ok := m.b.MigrationJobs[name]; !ok {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	m.b.call("MigrationJobs.Delete", name)
+	delete(m.b.MigrationJobs, name)
+	return nil
+}
+
+func (m *migrationJobs) Promote(_ context.Context, name string) (*datamigration.Operation, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	job, ok := m.b.MigrationJobs[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	m.b.call("MigrationJobs.Promote", name)
+	delete(m.b.remainingPhases, name)
+	op := m.b.datamigrationOperation(name)
+	if m.b.PromotePolls > 0 {
+		job.Phase = "PROMOTE_IN_PROGRESS"
+		op.Done = false
+		m.b.promotions[op.Name] = &promotion{job: name, polls: m.b.PromotePolls}
+		return op, nil
+	}
+	job.State = "COMPLETED"
+	job.Phase = ""
+	return op, nil
+}
+
+func (m *migrationJobs) DemoteDestination(_ context.Context, name string) (*datamigration.Operation, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	job, ok := m.b.MigrationJobs[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	m.b.call("MigrationJobs.DemoteDestination", name)
+	// The destination becomes a replica of an instance representing the source, named after the destination
+	if destination, ok := m.b.ConnectionProfiles[job.Destination]; ok {
+		project := strings.Split(name, "/")[1]
+		master := destination.GetPostgresql().GetCloudSqlId() + "-master"
+		m.b.Instances[project+"/"+master] = &sqladmin.DatabaseInstance{Name: master, Project: project, InstanceType: "ON_PREMISES_INSTANCE"}
+	}
+	return m.b.datamigrationOperation(name), nil
+}
+
+type connectionProfiles struct{ b *Backend }
+
+func (c *connectionProfiles) Get(_ context.Context, name string) (*clouddmspb.ConnectionProfile, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	profile, ok := c.b.ConnectionProfiles[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return proto.Clone(profile).(*clouddmspb.ConnectionProfile), nil
+}
+
+func (c *connectionProfiles) Create(_ context.Context, parent, id string, profile *clouddmspb.ConnectionProfile) (*clouddmspb.ConnectionProfile, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	name := parent + "/connectionProfiles/" + id
+	if _, ok := c.b.ConnectionProfiles[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", name)
+	}
+	c.b.call("ConnectionProfiles.Create", name)
+	created := proto.Clone(profile).(*clouddmspb.ConnectionProfile)
+	created.Name = name
+	c.b.ConnectionProfiles[name] = created
+	return proto.Clone(created).(*clouddmspb.ConnectionProfile), nil
+}
+
+func (c *connectionProfiles) Delete(_ context.Context, name string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if _, ok := c.b.ConnectionProfiles[name]; !ok {
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	c.b.call("ConnectionProfiles.Delete", name)
+	delete(c.b.ConnectionProfiles, name)
+	return nil
+}
+
+type datamigrationOperations struct{ b *Backend }
+
+func (d *datamigrationOperations) Get(_ context.Context, name string) (*datamigration.Operation, error) {
+	d.b.mu.Lock()
+	defer d.b.mu.Unlock()
+	op, ok := d.b.DatamigrationOperations[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	if p, ok := d.b.promotions[name]; ok {
+		p.polls--
+		if p.polls <= 0 {
+			delete(d.b.promotions, name)
+			op.Done = true
+			if job, ok := d.b.MigrationJobs[p.job]; ok {
+				job.State = "COMPLETED"
+				job.Phase = ""
+			}
+		}
+	}
+	copied := *op
+	return &copied, nil
+}
+
+// List returns the operations that are not done, like promotions that have not been polled PromotePolls times
+func (d *datamigrationOperations) List(_ context.Context, _ string) ([]*datamigration.Operation, error) {
+	d.b.mu.Lock()
+	defer d.b.mu.Unlock()
+	var operations []*datamigration.Operation
+	for _, op := range d.b.DatamigrationOperations {
+		if !op.Done {
+			operations = append(operations, op)
+		}
+	}
+	return operations, nil
+}
+
+type monitoring struct{ b *Backend }
+
+func (m *monitoring) ListTimeSeries(_ context.Context, _ *monpb.ListTimeSeriesRequest) ([]*monpb.TimeSeries, error) {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	return m.b.TimeSeries, nil
+}
@@ -0,0 +1,92 @@
+// Package gcp has narrow interfaces for the parts of the GCP APIs the migrator uses, so they can be replaced by fakes.
+//
+// The interfaces are grouped like the services of the APIs, so mgr.SqlAdmin.Users is the users of the Cloud SQL
+// Admin API. Calls that start a long-running operation in the Cloud SQL Admin API and the Database Migration REST API
+// return the operation, and are waited for with the operation package. Calls in the Database Migration gRPC API wait
+// for their operation before returning.
+package gcp
+
+import (
+	"context"
+
+	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// SqlAdmin is the Cloud SQL Admin API
+type SqlAdmin struct {
+	Instances  SqlInstances
+	Users      SqlUsers
+	SslCerts   SqlSslCerts
+	BackupRuns SqlBackupRuns
+	Databases  SqlDatabases
+	Operations SqlOperations
+}
+
+type SqlInstances interface {
+	Get(ctx context.Context, project, instance string) (*sqladmin.DatabaseInstance, error)
+	Delete(ctx context.Context, project, instance string) (*sqladmin.Operation, error)
+}
+
+type SqlUsers interface {
+	Get(ctx context.Context, project, instance, name string) (*sqladmin.User, error)
+	// Update updates the user with the name and host of user
+	Update(ctx context.Context, project, instance string, user *sqladmin.User) (*sqladmin.Operation, error)
+}
+
+type SqlSslCerts interface {
+	List(ctx context.Context, project, instance string) ([]*sqladmin.SslCert, error)
+	Delete(ctx context.Context, project, instance, sha1Fingerprint string) (*sqladmin.Operation, error)
+}
+
+type SqlBackupRuns interface {
+	Insert(ctx context.Context, project, instance string, backupRun *sqladmin.BackupRun) (*sqladmin.Operation, error)
+}
+
+type SqlDatabases interface {
+	Delete(ctx context.Context, project, instance, database string) (*sqladmin.Operation, error)
+}
+
+type SqlOperations interface {
+	Get(ctx context.Context, project, name string) (*sqladmin.Operation, error)
+}
+
+// Datamigration is the Database Migration API
+type Datamigration struct {
+	MigrationJobs      MigrationJobs
+	ConnectionProfiles ConnectionProfiles
+	Operations         DatamigrationOperations
+}
+
+type MigrationJobs interface {
+	Get(ctx context.Context, name string) (*datamigration.MigrationJob, error)
+	// Create creates the migration job, and waits until it is created
+	Create(ctx context.Context, parent, id string, job *clouddmspb.MigrationJob) (*clouddmspb.MigrationJob, error)
+	// Start starts the migration job, and waits until it is started
+	Start(ctx context.Context, name string) error
+	// Delete deletes the migration job, and waits until it is deleted
+	Delete(ctx context.Context, name string) error
+	Promote(ctx context.Context, name string) (*datamigration.Operation, error)
+	DemoteDestination(ctx context.Context, name string) (*datamigration.Operation, error)
+}
+
+type ConnectionProfiles interface {
+	Get(ctx context.Context, name string) (*clouddmspb.ConnectionProfile, error)
+	// Create creates the connection profile, and waits until it is created
+	Create(ctx context.Context, parent, id string, profile *clouddmspb.ConnectionProfile) (*clouddmspb.ConnectionProfile, error)
+	// Delete deletes the connection profile, and waits until it is deleted
+	Delete(ctx context.Context, name string) error
+}
+
+type DatamigrationOperations interface {
+	Get(ctx context.Context, name string) (*datamigration.Operation, error)
+	// List lists the operations under name, like the operations of a migration job
+	List(ctx context.Context, name string) ([]*datamigration.Operation, error)
+}
+
+// Monitoring is the Cloud Monitoring API
+type Monitoring interface {
+	ListTimeSeries(ctx context.Context, req *monpb.ListTimeSeriesRequest) ([]*monpb.TimeSeries, error)
+}
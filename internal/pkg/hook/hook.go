@@ -0,0 +1,49 @@
+// Package hook runs the commands configured in the migration plan before and after a phase.
+package hook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+)
+
+// ExitCode is the exit code of a phase when one of its hooks fails
+const ExitCode = 100
+
+// Run runs the hooks for phase at when, in the order they are listed in the plan, and stops at the first that fails.
+// In a dry run the hooks are recorded instead of run.
+// Hooks get the environment of the migrator, and MIGRATION_PHASE and MIGRATION_HOOK naming the phase and when it runs.
+func Run(ctx context.Context, cfg *config.Config, phase, when string, mgr *common_main.Manager) error {
+	for _, h := range cfg.Hooks {
+		if h.Phase != phase || h.When != when {
+			continue
+		}
+
+		command := strings.Join(h.Command, " ")
+		if mgr.DryRun != nil {
+			mgr.DryRun.Record("hook", phase+" "+when, command)
+			continue
+		}
+		mgr.Logger.Info("running hook", "phase", phase, "when", when, "command", command)
+
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"MIGRATION_PHASE="+phase,
+			"MIGRATION_HOOK="+when,
+			"APP_NAME="+cfg.ApplicationName,
+			"NAMESPACE="+cfg.Namespace,
+			"TARGET_INSTANCE_NAME="+cfg.TargetInstance.Name,
+		)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("hook %q failed: %w: %s", command, err, strings.TrimSpace(string(output)))
+		}
+		mgr.Logger.Info("hook completed", "command", command, "output", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	"github.com/sethvargo/go-retry"
+	"k8s.io/utils/ptr"
+)
+
+// recordAuthNetworks records the authorized networks in the migration state before they are added to the instance,
+// so they are removed by RemoveAuthNetworks even if the migrator stops right after adding them
+func recordAuthNetworks(ctx context.Context, cfg *config.Config, instanceName string, authNetworks []v1beta1.InstanceAuthorizedNetworks, mgr *common_main.Manager) error {
+	if len(authNetworks) == 0 {
+		return nil
+	}
+	return state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		for _, authNetwork := range authNetworks {
+			recorded := state.AuthorizedNetwork{Instance: instanceName, Name: ptr.Deref(authNetwork.Name, ""), Value: authNetwork.Value}
+			if !slices.Contains(st.AuthorizedNetworks, recorded) {
+				st.AuthorizedNetworks = append(st.AuthorizedNetworks, recorded)
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveAuthNetworks removes the authorized networks recorded in the migration state from their instances, leaving
+// networks with the same name or value that the migrator did not add. Instances that have been deleted are skipped.
+// A migration started before the networks were recorded has none in its state, so the networks named like the
+// migrator names them are removed from the instances instead.
+func RemoveAuthNetworks(ctx context.Context, cfg *config.Config, instanceNames []string, mgr *common_main.Manager) error {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return err
+	}
+
+	if len(st.AuthorizedNetworks) == 0 {
+		for _, instanceName := range instanceNames {
+			err = removeAuthNetworks(ctx, instanceName, isMigratorAuthNetwork, mgr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var recordedInstanceNames []string
+	for _, recorded := range st.AuthorizedNetworks {
+		if !slices.Contains(recordedInstanceNames, recorded.Instance) {
+			recordedInstanceNames = append(recordedInstanceNames, recorded.Instance)
+		}
+	}
+
+	for _, instanceName := range recordedInstanceNames {
+		err = removeAuthNetworks(ctx, instanceName, func(network v1beta1.InstanceAuthorizedNetworks) bool {
+			return slices.Contains(st.AuthorizedNetworks, state.AuthorizedNetwork{Instance: instanceName, Name: ptr.Deref(network.Name, ""), Value: network.Value})
+		}, mgr)
+		if err != nil {
+			return err
+		}
+
+		err = state.Update(ctx, cfg, mgr, func(st *state.State) error {
+			st.AuthorizedNetworks = slices.DeleteFunc(st.AuthorizedNetworks, func(network state.AuthorizedNetwork) bool {
+				return network.Instance == instanceName
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAuthNetworks removes the authorized networks of the instance that remove returns true for
+func removeAuthNetworks(ctx context.Context, instanceName string, remove func(v1beta1.InstanceAuthorizedNetworks) bool, mgr *common_main.Manager) error {
+	logger := mgr.Logger.With("instance", instanceName)
+	logger.Info("removing authorized networks added by the migrator")
+
+	b := retry.NewConstant(1 * time.Second)
+	b = retry.WithMaxDuration(5*time.Minute, b)
+
+	err := retry.Do(ctx, b, func(ctx context.Context) error {
+		sqlInstance, err := mgr.SqlInstanceClient.Get(ctx, instanceName)
+		if err != nil {
+			if classify.Is(err, classify.NotFound) {
+				logger.Info("instance has been deleted, no authorized networks to remove")
+				return nil
+			}
+			return classify.Retry(fmt.Errorf("failed to get instance %s: %w", instanceName, err))
+		}
+		ipConfiguration := sqlInstance.Spec.Settings.IpConfiguration
+		if ipConfiguration == nil {
+			return nil
+		}
+
+		kept := slices.DeleteFunc(slices.Clone(ipConfiguration.AuthorizedNetworks), remove)
+		if len(kept) == len(ipConfiguration.AuthorizedNetworks) {
+			logger.Info("authorized networks are already removed")
+			return nil
+		}
+		ipConfiguration.AuthorizedNetworks = kept
+
+		_, err = mgr.SqlInstanceClient.Update(ctx, sqlInstance)
+		if err != nil {
+			if classify.Is(err, classify.Conflict) {
+				logger.Warn("retrying update of instance", "error", err)
+			}
+			return classify.Retry(err)
+		}
+
+		logger.Info("authorized networks removed")
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to remove authorized networks", "error", err)
+	}
+	return err
+}
+
+// VerifyAuthNetworks makes sure none of the instances has an authorized network named like the migrator names them.
+// Instances that have been deleted have none.
+func VerifyAuthNetworks(ctx context.Context, instanceNames []string, mgr *common_main.Manager) error {
+	for _, instanceName := range instanceNames {
+		sqlInstance, err := mgr.SqlInstanceClient.Get(ctx, instanceName)
+		if err != nil {
+			if classify.Is(err, classify.NotFound) {
+				continue
+			}
+			return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+		}
+		if sqlInstance.Spec.Settings.IpConfiguration == nil {
+			continue
+		}
+
+		var remaining []string
+		for _, network := range sqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks {
+			if isMigratorAuthNetwork(network) {
+				remaining = append(remaining, ptr.Deref(network.Name, "")+"="+network.Value)
+			}
+		}
+		if len(remaining) > 0 {
+			return fmt.Errorf("authorized networks of the migrator remain on instance %s: %s", instanceName, strings.Join(remaining, ", "))
+		}
+	}
+	return nil
+}
+
+// isMigratorAuthNetwork is true for an authorized network named like the migrator names them
+func isMigratorAuthNetwork(network v1beta1.InstanceAuthorizedNetworks) bool {
+	return strings.HasPrefix(ptr.Deref(network.Name, ""), migrationAuthNetworkPrefix)
+}
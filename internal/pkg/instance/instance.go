@@ -4,10 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
+	"log/slog"
+	"maps"
 	"net/http"
-	"os"
-	"os/user"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,21 +17,30 @@ import (
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	_ "github.com/lib/pq"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/wait"
 	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
 	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/googleapi"
 	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/utils/ptr"
 )
 
 const (
 	dummyAppImage              = "europe-north1-docker.pkg.dev/nais-io/nais/images/kafka-debug:latest"
 	migrationAuthNetworkPrefix = "migrator:"
+
+	helperRolloutTimeout = 30 * time.Minute
+	instanceReadyTimeout = 15 * time.Minute
+	resourceGoneTimeout  = 5 * time.Minute
 )
 
 func CreateInstance(ctx context.Context, cfg *config.Config, source *resolved.Instance, gcpProject *resolved.GcpProject, databaseName string, mgr *common_main.Manager) (*resolved.Instance, error) {
@@ -112,18 +121,18 @@ func CreateInstance(ctx context.Context, cfg *config.Config, source *resolved.In
 		return nil, fmt.Errorf("missing correlation ID in dummy app %s", helperName)
 	}
 	mgr.Logger.Info("started creation of target instance", "helperApp", helperName)
-	for dummyApp.Status.CorrelationID != correlationID || dummyApp.Status.SynchronizationState != "RolloutComplete" {
-		mgr.Logger.Info("waiting for dummy app rollout")
-		time.Sleep(5 * time.Second)
-		dummyApp, err = mgr.AppClient.Get(ctx, helperName)
-		if err != nil {
-			return nil, err
-		}
+	dummyApp, err = wait.ApplicationRollout(ctx, helperName, correlationID, helperRolloutTimeout, mgr, "RolloutComplete")
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for dummy app rollout: %w", err)
 	}
 
 	return resolved.ResolveInstance(ctx, dummyApp, mgr)
 }
 
+// DefineInstance returns the sql instance to create for the application, a copy of its current sql instance with
+// the name and settings of instanceSettings. Settings that are set replace the copied value, and settings that are
+// not set keep it. Database flags are copied unless ReplaceFlags is set, then RemoveFlags are removed and Flags are
+// set, replacing a copied flag with the same name. With disk autoresize enabled, the disk size is left to autoresize.
 func DefineInstance(instanceSettings *config.InstanceSettings, app *nais_io_v1alpha1.Application) *nais_io_v1.CloudSqlInstance {
 	sourceInstance := app.Spec.GCP.SqlInstances[0]
 	instance := sourceInstance.DeepCopy()
@@ -145,28 +154,136 @@ func DefineInstance(instanceSettings *config.InstanceSettings, app *nais_io_v1al
 	if instanceSettings.Type != "" {
 		instance.Type = nais_io_v1.CloudSqlInstanceType(instanceSettings.Type)
 	}
+	if instanceSettings.HighAvailability != nil {
+		instance.HighAvailability = *instanceSettings.HighAvailability
+	}
+	if instanceSettings.PointInTimeRecovery != nil {
+		instance.PointInTimeRecovery = *instanceSettings.PointInTimeRecovery
+	}
+	if instanceSettings.MaintenanceDay != nil || instanceSettings.MaintenanceHour != nil {
+		maintenance := &nais_io_v1.Maintenance{}
+		if instance.Maintenance != nil {
+			maintenance = instance.Maintenance.DeepCopy()
+		}
+		if instanceSettings.MaintenanceDay != nil {
+			maintenance.Day = *instanceSettings.MaintenanceDay
+		}
+		if instanceSettings.MaintenanceHour != nil {
+			maintenance.Hour = ptr.To(*instanceSettings.MaintenanceHour)
+		}
+		instance.Maintenance = maintenance
+	}
+	if instanceSettings.InsightsEnabled != nil {
+		insights := &nais_io_v1.InsightsConfiguration{}
+		if instance.Insights != nil {
+			insights = instance.Insights.DeepCopy()
+		}
+		insights.Enabled = ptr.To(*instanceSettings.InsightsEnabled)
+		instance.Insights = insights
+	}
+	if instanceSettings.RetainedBackups != nil {
+		instance.RetainedBackups = ptr.To(*instanceSettings.RetainedBackups)
+	}
+	if instanceSettings.AutoBackupHour != nil {
+		instance.AutoBackupHour = ptr.To(*instanceSettings.AutoBackupHour)
+	}
+	if instanceSettings.Collation != "" {
+		instance.Collation = instanceSettings.Collation
+	}
+	instance.Flags = defineFlags(instanceSettings, sourceInstance.Flags)
+	if instanceSettings.PreserveEnvVarNames {
+		preserveEnvVarNames(instance, &sourceInstance, app)
+	}
 
 	return instance
 }
 
-func PrepareSourceInstance(ctx context.Context, source *resolved.Instance, mgr *common_main.Manager) error {
+// defineFlags returns the database flags of the new instance, keeping the order of the copied flags
+func defineFlags(instanceSettings *config.InstanceSettings, sourceFlags []nais_io_v1.CloudSqlFlag) []nais_io_v1.CloudSqlFlag {
+	if len(instanceSettings.Flags) == 0 && len(instanceSettings.RemoveFlags) == 0 && !instanceSettings.ReplaceFlags {
+		return slices.Clone(sourceFlags)
+	}
+
+	flags := make([]nais_io_v1.CloudSqlFlag, 0, len(sourceFlags)+len(instanceSettings.Flags))
+	if !instanceSettings.ReplaceFlags {
+		for _, flag := range sourceFlags {
+			if slices.Contains(instanceSettings.RemoveFlags, flag.Name) {
+				continue
+			}
+			if value, ok := instanceSettings.Flags[flag.Name]; ok {
+				flag.Value = value
+			}
+			flags = append(flags, flag)
+		}
+	}
+
+	// Flags not already on the copied instance are added sorted by name, so the spec is the same every time
+	for _, name := range slices.Sorted(maps.Keys(instanceSettings.Flags)) {
+		if !slices.ContainsFunc(flags, func(flag nais_io_v1.CloudSqlFlag) bool { return flag.Name == name }) {
+			flags = append(flags, nais_io_v1.CloudSqlFlag{Name: name, Value: instanceSettings.Flags[name]})
+		}
+	}
+	return flags
+}
+
+// preserveEnvVarNames sets an explicit EnvVarPrefix on every database of the new instance,
+// so that naiserator generates the same environment variable names as it does for the source instance.
+// Databases that already have an EnvVarPrefix keep it, as their names do not depend on the instance name.
+func preserveEnvVarNames(instance, sourceInstance *nais_io_v1.CloudSqlInstance, app *nais_io_v1alpha1.Application) {
+	sourceName := sourceInstance.Name
+	if len(sourceName) == 0 {
+		sourceName = app.Name
+	}
+	for i := range instance.Databases {
+		database := &instance.Databases[i]
+		if len(database.EnvVarPrefix) > 0 {
+			continue
+		}
+		databaseName := database.Name
+		if len(databaseName) == 0 {
+			databaseName = app.Name
+		}
+		database.EnvVarPrefix = DefaultEnvVarPrefix(sourceName, databaseName)
+	}
+}
+
+// DefaultEnvVarPrefix returns the prefix naiserator uses for database environment variables
+// when no explicit envVarPrefix is configured for the database.
+// This mirrors the naming in naiserator (pkg/resourcecreator/google/sql).
+// If a functional change is made there, it should be made here as well.
+func DefaultEnvVarPrefix(instanceName, databaseName string) string {
+	return fmt.Sprintf("NAIS_DATABASE_%s_%s", envVarName(instanceName), envVarName(databaseName))
+}
+
+func envVarName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func PrepareSourceInstance(ctx context.Context, cfg *config.Config, source *resolved.Instance, mgr *common_main.Manager) error {
 	mgr.Logger.Info("preparing source instance for migration")
 
+	authNetworks, err := MigratorAuthNetworks(ctx, mgr)
+	if err != nil {
+		return err
+	}
+	err = recordAuthNetworks(ctx, cfg, source.Name, authNetworks, mgr)
+	if err != nil {
+		return err
+	}
+
 	b := retry.NewConstant(1 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
+	err = retry.Do(ctx, b, func(ctx context.Context) error {
 		sourceSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, source.Name)
 		if err != nil {
-			mgr.Logger.Warn("failed to get source instance, retrying", "error", err)
-			return retry.RetryableError(err)
+			mgr.Logger.Warn("failed to get source instance", "error", err)
+			return classify.Retry(err)
 		}
 
-		authNetwork, err := createMigratorAuthNetwork()
-		if err != nil {
-			return err
+		for _, authNetwork := range authNetworks {
+			sourceSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = appendAuthNetIfNotExists(sourceSqlInstance, authNetwork)
 		}
-		sourceSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = appendAuthNetIfNotExists(sourceSqlInstance, authNetwork)
 
 		setFlag(sourceSqlInstance, "cloudsql.enable_pglogical")
 		setFlag(sourceSqlInstance, "cloudsql.logical_decoding")
@@ -178,11 +295,10 @@ func PrepareSourceInstance(ctx context.Context, source *resolved.Instance, mgr *
 
 		_, err = mgr.SqlInstanceClient.Update(ctx, sourceSqlInstance)
 		if err != nil {
-			if k8s_errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("retrying update of source instance")
-				return retry.RetryableError(err)
 			}
-			return err
+			return classify.Retry(err)
 		}
 
 		mgr.Logger.Info("update of source instance applied")
@@ -194,53 +310,49 @@ func PrepareSourceInstance(ctx context.Context, source *resolved.Instance, mgr *
 		return err
 	}
 
-	time.Sleep(1 * time.Second)
-	updatedSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, source.Name)
+	_, err = wait.SqlInstanceReady(ctx, source.Name, instanceReadyTimeout, mgr)
 	if err != nil {
 		return err
 	}
-
-	for updatedSqlInstance.Status.Conditions[0].Status != "True" {
-		mgr.Logger.Info("waiting for source instance to be ready")
-		time.Sleep(3 * time.Second)
-		updatedSqlInstance, err = mgr.SqlInstanceClient.Get(ctx, source.Name)
-		if err != nil {
-			return err
-		}
-
-	}
 	mgr.Logger.Info("source instance prepared for migration")
 	return nil
 }
 
-func AddTargetOutgoingIpsToSourceAuthNetworks(ctx context.Context, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) error {
+func AddTargetOutgoingIpsToSourceAuthNetworks(ctx context.Context, cfg *config.Config, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) error {
 	mgr.Logger.Info("updating authorized networks for source instance")
 
+	authNetworks := make([]v1beta1.InstanceAuthorizedNetworks, 0, len(target.OutgoingIps))
+	for idx, ip := range target.OutgoingIps {
+		authNetworks = append(authNetworks, v1beta1.InstanceAuthorizedNetworks{
+			Name:  ptr.To(TargetAuthNetworkName(target.Name, idx)),
+			Value: fmt.Sprintf("%s/32", ip),
+		})
+	}
+	err := recordAuthNetworks(ctx, cfg, source.Name, authNetworks, mgr)
+	if err != nil {
+		return err
+	}
+
 	b := retry.NewConstant(1 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
+	err = retry.Do(ctx, b, func(ctx context.Context) error {
 		sourceSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, source.Name)
 		if err != nil {
-			mgr.Logger.Warn("failed to get source instance, retrying", "error", err)
-			return retry.RetryableError(err)
+			mgr.Logger.Warn("failed to get source instance", "error", err)
+			return classify.Retry(err)
 		}
 
-		for idx, ip := range target.OutgoingIps {
-			authNetwork := v1beta1.InstanceAuthorizedNetworks{
-				Name:  ptr.To(fmt.Sprintf("%s-%d", target.Name, idx)),
-				Value: fmt.Sprintf("%s/32", ip),
-			}
+		for _, authNetwork := range authNetworks {
 			sourceSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = appendAuthNetIfNotExists(sourceSqlInstance, authNetwork)
 		}
 
 		_, err = mgr.SqlInstanceClient.Update(ctx, sourceSqlInstance)
 		if err != nil {
-			if k8s_errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("retrying update of source instance")
-				return retry.RetryableError(err)
 			}
-			return err
+			return classify.Retry(err)
 		}
 
 		mgr.Logger.Info("update of source instance applied")
@@ -252,21 +364,10 @@ func AddTargetOutgoingIpsToSourceAuthNetworks(ctx context.Context, source *resol
 		return err
 	}
 
-	time.Sleep(1 * time.Second)
-	updatedSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, source.Name)
+	_, err = wait.SqlInstanceReady(ctx, source.Name, instanceReadyTimeout, mgr)
 	if err != nil {
 		return err
 	}
-
-	for updatedSqlInstance.Status.Conditions[0].Status != "True" {
-		mgr.Logger.Info("waiting for source instance to be ready")
-		time.Sleep(3 * time.Second)
-		updatedSqlInstance, err = mgr.SqlInstanceClient.Get(ctx, source.Name)
-		if err != nil {
-			return err
-		}
-
-	}
 	mgr.Logger.Info("completed update of authorized networks of source instance")
 	return nil
 }
@@ -274,103 +375,78 @@ func AddTargetOutgoingIpsToSourceAuthNetworks(ctx context.Context, source *resol
 func WaitForSQLDatabaseResourceToGoAway(ctx context.Context, appName string, mgr *common_main.Manager) error {
 	mgr.Logger.Info("waiting for SQLDatabase resource to go away...")
 
-	b := retry.NewConstant(5 * time.Second)
-	b = retry.WithMaxDuration(5*time.Minute, b)
-
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
-		exists, err := mgr.SqlDatabaseClient.ExistsByLabel(ctx, fmt.Sprintf("app=%s", appName))
-		if err != nil {
-			mgr.Logger.Warn("failed to list SQLDatabase resource, retrying...", "error", err.Error())
-			return retry.RetryableError(err)
-		}
-		if exists {
-			mgr.Logger.Info("waiting for SQLDatabase resource to go away...")
-			return retry.RetryableError(errors.New("resource still exists"))
-		}
-		mgr.Logger.Info("SQLDatabase resource has been deleted")
-		return nil
-	})
-	if err == nil {
-		mgr.Logger.Info("resource has been deleted")
+	err := wait.NoneWithLabel(ctx, mgr.SqlDatabaseClient, fmt.Sprintf("app=%s", appName), resourceGoneTimeout)
+	if err != nil {
+		return err
 	}
-	return err
+
+	mgr.Logger.Info("SQLDatabase resource has been deleted")
+	return nil
 }
 
 func WaitForCnrmResourcesToGoAway(ctx context.Context, instanceName, applicationName string, mgr *common_main.Manager) error {
 	logger := mgr.Logger.With("instance_name", instanceName)
 	logger.Info("waiting for relevant CNRM resources to go away...")
 
-	type resource struct {
-		kind   string
-		getter func() (metav1.Object, error)
-	}
-	resources := []resource{
-		{
-			"SQLInstance",
-			func() (metav1.Object, error) {
-				instance, err := mgr.SqlInstanceClient.Get(ctx, instanceName)
-				if err != nil {
-					return nil, err
-				}
-				return instance.GetObjectMeta(), nil
-			},
-		},
-		{
-			"SQLUser",
-			func() (metav1.Object, error) {
-				user, err := mgr.SqlUserClient.Get(ctx, instanceName)
-				if err != nil {
-					return nil, err
-				}
-				return user.GetObjectMeta(), nil
-			},
-		},
-	}
-
 	g, ctx := errgroup.WithContext(ctx)
 
-	for _, r := range resources {
-		g.Go(func() error {
-			b := retry.NewConstant(5 * time.Second)
-			b = retry.WithMaxDuration(5*time.Minute, b)
-
-			err := retry.Do(ctx, b, func(ctx context.Context) error {
-				obj, err := r.getter()
-				if err == nil {
-					for _, ref := range obj.GetOwnerReferences() {
-						if ref.Name == applicationName {
-							logger.Info("resource already transferred to target application", "kind", r.kind)
-							return nil
-						}
-					}
-
-					logger.Info("waiting for resource to go away...", "kind", r.kind)
-					return retry.RetryableError(errors.New("resource still exists"))
-				}
-				if k8s_errors.IsNotFound(err) {
-					mgr.Logger.Info("resource has been deleted", "kind", r.kind)
-					return nil
-				}
-				logger.Warn("failed to get resource, retrying...", "kind", r.kind, "error", err.Error())
-				return retry.RetryableError(err)
-			})
-			if err != nil {
-				logger.Error("resource refuses to go away", "kind", r.kind, "error", err.Error())
-			}
-			return err
-		})
-	}
+	g.Go(func() error {
+		return waitForGoneOrOwnedBy(ctx, mgr.SqlInstanceClient, "SQLInstance", instanceName, applicationName, logger)
+	})
+	g.Go(func() error {
+		return waitForGoneOrOwnedBy(ctx, mgr.SqlUserClient, "SQLUser", instanceName, applicationName, logger)
+	})
 
 	return g.Wait()
 }
 
-func PrepareTargetInstance(ctx context.Context, target *resolved.Instance, mgr *common_main.Manager) error {
+// waitForGoneOrOwnedBy waits until the named resource is deleted, or has been transferred to the given application
+func waitForGoneOrOwnedBy[T interface {
+	runtime.Object
+	*P
+}, P any](ctx context.Context, client k8s.GenericClient[T, P], kind, name, applicationName string, logger *slog.Logger) error {
+	_, err := wait.For[T, P](ctx, client, name, resourceGoneTimeout, func(obj *P) (bool, error) {
+		if obj == nil {
+			logger.Info("resource has been deleted", "kind", kind)
+			return true, nil
+		}
+
+		accessor, err := meta.Accessor(T(obj))
+		if err != nil {
+			return false, err
+		}
+		for _, ref := range accessor.GetOwnerReferences() {
+			if ref.Name == applicationName {
+				logger.Info("resource already transferred to target application", "kind", kind)
+				return true, nil
+			}
+		}
+
+		logger.Info("waiting for resource to go away...", "kind", kind)
+		return false, nil
+	})
+	if err != nil {
+		logger.Error("resource refuses to go away", "kind", kind, "error", err.Error())
+	}
+	return err
+}
+
+func PrepareTargetInstance(ctx context.Context, cfg *config.Config, target *resolved.Instance, mgr *common_main.Manager) error {
 	mgr.Logger.Info("preparing target instance for migration")
 
+	authNetworks, err := MigratorAuthNetworks(ctx, mgr)
+	if err != nil {
+		return err
+	}
+	err = recordAuthNetworks(ctx, cfg, target.Name, authNetworks, mgr)
+	if err != nil {
+		return err
+	}
+
 	b := retry.NewConstant(1 * time.Second)
 	b = retry.WithMaxDuration(15*time.Minute, b)
 
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
+	err = retry.Do(ctx, b, func(ctx context.Context) error {
 		targetSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, target.Name)
 		if err != nil {
 			// Target is assumed to exist, so any error here is fatal
@@ -382,22 +458,17 @@ func PrepareTargetInstance(ctx context.Context, target *resolved.Instance, mgr *
 		targetSqlInstance.Spec.Settings.AvailabilityType = ptr.To("ZONAL")
 		stripPgAuditDatabaseFlags(targetSqlInstance)
 
-		var authNetwork v1beta1.InstanceAuthorizedNetworks
-		authNetwork, err = createMigratorAuthNetwork()
-		if err != nil {
-			return err
+		for _, authNetwork := range authNetworks {
+			targetSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = appendAuthNetIfNotExists(targetSqlInstance, authNetwork)
 		}
 
-		targetSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = appendAuthNetIfNotExists(targetSqlInstance, authNetwork)
-
 		mgr.Logger.Info("updating target instance", "name", target.Name)
 		_, err = mgr.SqlInstanceClient.Update(ctx, targetSqlInstance)
 		if err != nil {
-			if k8s_errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("retrying update of target instance", "error", err)
-				return retry.RetryableError(err)
 			}
-			return err
+			return classify.Retry(err)
 		}
 
 		mgr.Logger.Info("update of target instance applied")
@@ -408,26 +479,16 @@ func PrepareTargetInstance(ctx context.Context, target *resolved.Instance, mgr *
 		return err
 	}
 
-	time.Sleep(1 * time.Second)
-	updatedSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, target.Name)
+	_, err = wait.SqlInstanceReady(ctx, target.Name, instanceReadyTimeout, mgr)
 	if err != nil {
 		return err
 	}
 
-	for updatedSqlInstance.Status.Conditions[0].Status != "True" {
-		mgr.Logger.Info("waiting for target instance to be ready")
-		time.Sleep(3 * time.Second)
-		updatedSqlInstance, err = mgr.SqlInstanceClient.Get(ctx, target.Name)
-		if err != nil {
-			return err
-		}
-	}
-
 	mgr.Logger.Info("target instance prepared for migration")
 	return nil
 }
 
-func UpdateTargetInstanceAfterPromotion(ctx context.Context, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) error {
+func UpdateTargetInstanceAfterPromotion(ctx context.Context, instanceSettings *config.InstanceSettings, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) error {
 	mgr.Logger.Info("updating target instance after promotion")
 
 	b := retry.NewConstant(1 * time.Second)
@@ -458,6 +519,17 @@ func UpdateTargetInstanceAfterPromotion(ctx context.Context, source *resolved.In
 			targetSqlInstance.Spec.Settings.BackupConfiguration.PointInTimeRecoveryEnabled = sourceSqlInstance.Spec.Settings.BackupConfiguration.PointInTimeRecoveryEnabled
 		}
 
+		// Configured settings take precedence over the source, like in DefineInstance
+		if instanceSettings.HighAvailability != nil {
+			targetSqlInstance.Spec.Settings.AvailabilityType = ptr.To(availabilityType(*instanceSettings.HighAvailability))
+		}
+		if instanceSettings.PointInTimeRecovery != nil {
+			if targetSqlInstance.Spec.Settings.BackupConfiguration == nil {
+				targetSqlInstance.Spec.Settings.BackupConfiguration = &v1beta1.InstanceBackupConfiguration{}
+			}
+			targetSqlInstance.Spec.Settings.BackupConfiguration.PointInTimeRecoveryEnabled = ptr.To(*instanceSettings.PointInTimeRecovery)
+		}
+
 		mgr.Logger.Info("restoring source instance settings on target",
 			"availabilityType", targetSqlInstance.Spec.Settings.AvailabilityType,
 			"backupEnabled", targetSqlInstance.Spec.Settings.BackupConfiguration.Enabled,
@@ -466,11 +538,10 @@ func UpdateTargetInstanceAfterPromotion(ctx context.Context, source *resolved.In
 
 		_, err = mgr.SqlInstanceClient.Update(ctx, targetSqlInstance)
 		if err != nil {
-			if k8s_errors.IsConflict(err) {
+			if classify.Is(err, classify.Conflict) {
 				mgr.Logger.Warn("retrying update of target instance", "error", err)
-				return retry.RetryableError(err)
 			}
-			return err
+			return classify.Retry(err)
 		}
 
 		mgr.Logger.Info("update of target instance applied")
@@ -481,49 +552,46 @@ func UpdateTargetInstanceAfterPromotion(ctx context.Context, source *resolved.In
 		return err
 	}
 
-	time.Sleep(5 * time.Second)
-	updatedSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, target.Name)
+	_, err = wait.SqlInstanceReady(ctx, target.Name, instanceReadyTimeout, mgr)
 	if err != nil {
 		return err
 	}
 
-	for updatedSqlInstance.Status.Conditions[0].Status != "True" {
-		mgr.Logger.Info("waiting for target instance to be ready")
-		time.Sleep(3 * time.Second)
-		updatedSqlInstance, err = mgr.SqlInstanceClient.Get(ctx, target.Name)
-		if err != nil {
-			return err
-		}
-	}
-
 	mgr.Logger.Info("target instance updated after promotion")
 	return nil
 }
 
+func availabilityType(highAvailability bool) string {
+	if highAvailability {
+		return "REGIONAL"
+	}
+	return "ZONAL"
+}
+
 func DeleteInstance(ctx context.Context, instanceName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	instancesService := mgr.SqlAdminService.Instances
+	instancesService := mgr.SqlAdmin.Instances
 
 	b := retry.NewConstant(10 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
 	err := retry.Do(ctx, b, func(ctx context.Context) error {
 		mgr.Logger.Info("checking for instance existence before deletion", "name", instanceName)
-		_, err := instancesService.Get(gcpProject.Id, instanceName).Context(ctx).Do()
+		_, err := instancesService.Get(ctx, gcpProject.Id, instanceName)
 		if err != nil {
 			var ae *googleapi.Error
 			if errors.As(err, &ae) && ae.Code == http.StatusNotFound {
 				mgr.Logger.Info("instance not found, skipping deletion")
 				return nil
 			}
-			mgr.Logger.Warn("failed to get instance, retrying", "error", err)
-			return retry.RetryableError(fmt.Errorf("failed to get instance: %w", err))
+			mgr.Logger.Warn("failed to get instance", "error", err)
+			return classify.Retry(fmt.Errorf("failed to get instance: %w", err))
 		}
 
 		mgr.Logger.Info("deleting instance", "name", instanceName)
-		_, err = instancesService.Delete(gcpProject.Id, instanceName).Context(ctx).Do()
+		_, err = instancesService.Delete(ctx, gcpProject.Id, instanceName)
 		if err != nil {
-			mgr.Logger.Warn("failed to delete instance, retrying", "error", err)
-			return retry.RetryableError(fmt.Errorf("failed to delete instance: %w", err))
+			mgr.Logger.Warn("failed to delete instance", "error", err)
+			return classify.Retry(fmt.Errorf("failed to delete instance: %w", err))
 		}
 		return nil
 	})
@@ -533,38 +601,6 @@ func DeleteInstance(ctx context.Context, instanceName string, gcpProject *resolv
 	return nil
 }
 
-func CleanupAuthNetworks(ctx context.Context, target *resolved.Instance, mgr *common_main.Manager) error {
-	mgr.Logger.Info("deleting authorized networks")
-
-	b := retry.NewConstant(1 * time.Second)
-	b = retry.WithMaxDuration(5*time.Minute, b)
-
-	err := retry.Do(ctx, b, func(ctx context.Context) error {
-		targetSqlInstance, err := mgr.SqlInstanceClient.Get(ctx, target.Name)
-		if err != nil {
-			return fmt.Errorf("failed to get target instance: %w", err)
-		}
-
-		targetSqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks = removeMigrationAuthNetwork(targetSqlInstance)
-
-		_, err = mgr.SqlInstanceClient.Update(ctx, targetSqlInstance)
-		if err != nil {
-			if k8s_errors.IsConflict(err) {
-				mgr.Logger.Warn("retrying update of target instance", "error", err)
-				return retry.RetryableError(err)
-			}
-			return err
-		}
-
-		mgr.Logger.Info("update of target instance applied")
-		return nil
-	})
-	if err != nil {
-		mgr.Logger.Error("failed to cleanup authorized networks", "error", err)
-	}
-	return err
-}
-
 func ValidateSourceInstance(ctx context.Context, cfg *config.Config, app *nais_io_v1alpha1.Application, source *resolved.Instance, project *resolved.GcpProject, mgr *common_main.Manager) error {
 	mgr.Logger.Info("validating source instance eligibility for migration")
 
@@ -572,10 +608,10 @@ func ValidateSourceInstance(ctx context.Context, cfg *config.Config, app *nais_i
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
 	instance, err := retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.DatabaseInstance, error) {
-		instance, err := mgr.SqlAdminService.Instances.Get(project.Id, source.Name).Context(ctx).Do()
+		instance, err := mgr.SqlAdmin.Instances.Get(ctx, project.Id, source.Name)
 		if err != nil {
-			mgr.Logger.Warn("retrying getting SQLInstance from GCP", "error", err)
-			return nil, retry.RetryableError(fmt.Errorf("failed to get source instance from GCP: %w", err))
+			mgr.Logger.Warn("failed to get SQLInstance from GCP", "error", err)
+			return nil, classify.Retry(fmt.Errorf("failed to get source instance from GCP: %w", err))
 		}
 		return instance, nil
 	})
@@ -593,14 +629,56 @@ func ValidateSourceInstance(ctx context.Context, cfg *config.Config, app *nais_i
 			}
 		}
 	}
+	if mgr.Connectivity == config.ConnectivityPrivateIp && privateNetwork(instance) == "" {
+		return fmt.Errorf("source instance %s is not on a private network, which %s connectivity requires", source.Name, config.ConnectivityPrivateIp)
+	}
 
 	notifyDatabaseConnectionChanges(cfg, app, mgr)
 
-	notifyMigrationIncompatibleFeatures(app, mgr)
+	notifyMigrationIncompatibleFeatures(cfg, app, mgr)
 
 	return nil
 }
 
+// PrivateNetwork returns the VPC network both instances have their private ip in, which the migration job is peered with.
+// The instances must be on the same network for the target to reach the source.
+func PrivateNetwork(ctx context.Context, gcpProject *resolved.GcpProject, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) (string, error) {
+	b := retry.NewConstant(30 * time.Second)
+	b = retry.WithMaxDuration(5*time.Minute, b)
+
+	networks := make([]string, 0, 2)
+	for _, instanceName := range []string{source.Name, target.Name} {
+		instance, err := retry.DoValue(ctx, b, func(ctx context.Context) (*sqladmin.DatabaseInstance, error) {
+			instance, err := mgr.SqlAdmin.Instances.Get(ctx, gcpProject.Id, instanceName)
+			if err != nil {
+				mgr.Logger.Warn("failed to get SQLInstance from GCP", "instance", instanceName, "error", err)
+				return nil, classify.Retry(fmt.Errorf("failed to get instance %s from GCP: %w", instanceName, err))
+			}
+			return instance, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		network := privateNetwork(instance)
+		if network == "" {
+			return "", fmt.Errorf("instance %s is not on a private network", instanceName)
+		}
+		networks = append(networks, network)
+	}
+
+	if networks[0] != networks[1] {
+		return "", fmt.Errorf("source instance %s is on private network %s, and target instance %s on %s", source.Name, networks[0], target.Name, networks[1])
+	}
+	return networks[0], nil
+}
+
+func privateNetwork(instance *sqladmin.DatabaseInstance) string {
+	if instance.Settings == nil || instance.Settings.IpConfiguration == nil {
+		return ""
+	}
+	return instance.Settings.IpConfiguration.PrivateNetwork
+}
+
 func notifyDatabaseConnectionChanges(cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) {
 	spec := app.Spec
 	if spec.GCP != nil {
@@ -609,89 +687,78 @@ func notifyDatabaseConnectionChanges(cfg *config.Config, app *nais_io_v1alpha1.A
 			instance := gcp.SqlInstances[0]
 			envVarPrefix := instance.Database().EnvVarPrefix
 			if len(envVarPrefix) == 0 {
-				mgr.Logger.Warn("the default environment variable for database connections will be changed")
-				mgr.Logger.Warn(fmt.Sprintf("update your code base to use the new instance name (NAIS_DATABASE_%s_%s_)", cfg.TargetInstance.Name, instance.Database().Name))
+				if cfg.TargetInstance.PreserveEnvVarNames {
+					target := DefineInstance(&cfg.TargetInstance, app)
+					mgr.Logger.Info("the current environment variable names for database connections will be preserved", "envVarPrefix", target.Database().EnvVarPrefix)
+					mgr.Warn(fmt.Sprintf("after promotion, add envVarPrefix: %s to the database in your application spec", target.Database().EnvVarPrefix))
+					return
+				}
+				mgr.Warn("the default environment variable for database connections will be changed")
+				mgr.Warn(fmt.Sprintf("update your code base to use the new instance name (%s_)", DefaultEnvVarPrefix(cfg.TargetInstance.Name, instance.Database().Name)))
 				return
 			}
 		}
 	}
 }
 
-func notifyMigrationIncompatibleFeatures(app *nais_io_v1alpha1.Application, mgr *common_main.Manager) {
+func notifyMigrationIncompatibleFeatures(cfg *config.Config, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) {
 	if app.Spec.GCP == nil || len(app.Spec.GCP.SqlInstances) == 0 {
 		return
 	}
 	source := app.Spec.GCP.SqlInstances[0]
-	if source.HighAvailability {
-		mgr.Logger.Warn("source instance has high availability enabled; this will be temporarily disabled on the target during migration and re-enabled after promotion")
+	target := DefineInstance(&cfg.TargetInstance, app)
+	if target.HighAvailability {
+		mgr.Warn("target instance has high availability enabled; this will be temporarily disabled during migration and enabled after promotion")
 	}
-	if source.PointInTimeRecovery {
-		mgr.Logger.Warn("source instance has point-in-time recovery enabled; this will be temporarily disabled on the target during migration and re-enabled after promotion")
+	if target.PointInTimeRecovery {
+		mgr.Warn("target instance has point-in-time recovery enabled; this will be temporarily disabled during migration and enabled after promotion")
 	}
 	if HasPgAuditFlags(source.Flags) {
-		mgr.Logger.Warn("source instance has pgaudit flags enabled; these will be removed from the target and the pgaudit extension will be dropped from the source during migration")
-		mgr.Logger.Warn("after migration, re-run 'nais postgres enable-audit' to re-enable audit logging")
+		mgr.Warn("source instance has pgaudit flags enabled; these will be removed from the target and the pgaudit extension will be dropped from the source during migration")
+		mgr.Warn("after migration, re-run 'nais postgres enable-audit' to re-enable audit logging")
 	}
 }
 
-func createMigratorAuthNetwork() (v1beta1.InstanceAuthorizedNetworks, error) {
-	outgoingIp, err := getOutgoingIp()
+// MigratorAuthNetworks are the authorized networks letting the migrator connect to the instances, one for each of its
+// outgoing ips, named after who runs it
+func MigratorAuthNetworks(ctx context.Context, mgr *common_main.Manager) ([]v1beta1.InstanceAuthorizedNetworks, error) {
+	outgoingIps, err := mgr.Egress.OutgoingIps(ctx)
 	if err != nil {
-		return v1beta1.InstanceAuthorizedNetworks{}, err
+		return nil, err
 	}
 	name, err := getNetworkName()
 	if err != nil {
-		return v1beta1.InstanceAuthorizedNetworks{}, err
+		return nil, err
 	}
 
-	authNetwork := v1beta1.InstanceAuthorizedNetworks{
-		Name:  &name,
-		Value: fmt.Sprintf("%s/32", outgoingIp),
+	authNetworks := make([]v1beta1.InstanceAuthorizedNetworks, 0, len(outgoingIps))
+	for i, outgoingIp := range outgoingIps {
+		// The first keeps the name of the single network of a migrator with one outgoing ip
+		networkName := name
+		if i > 0 {
+			networkName = fmt.Sprintf("%s-%d", name, i)
+		}
+		authNetworks = append(authNetworks, v1beta1.InstanceAuthorizedNetworks{
+			Name:  &networkName,
+			Value: fmt.Sprintf("%s/32", outgoingIp),
+		})
 	}
-	return authNetwork, nil
+	return authNetworks, nil
 }
 
 func getNetworkName() (string, error) {
-	u, err := user.Current()
-	if err != nil {
-		u = &user.User{Username: "unknown"}
-	}
-
-	h, err := os.Hostname()
-	if err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("%s%s@%s", migrationAuthNetworkPrefix, u.Username, h), nil
-}
-
-func getOutgoingIp() (string, error) {
-	httpClient := http.Client{
-		Timeout: 15 * time.Second,
-	}
-	resp, err := httpClient.Get("https://api.ipify.org")
+	identity, err := common_main.Identity()
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return string(data), nil
+	return migrationAuthNetworkPrefix + identity, nil
 }
 
-func removeMigrationAuthNetwork(sqlInstance *v1beta1.SQLInstance) []v1beta1.InstanceAuthorizedNetworks {
-	newAuthNetworks := make([]v1beta1.InstanceAuthorizedNetworks, 0)
-	for _, network := range sqlInstance.Spec.Settings.IpConfiguration.AuthorizedNetworks {
-		if strings.HasPrefix(migrationAuthNetworkPrefix, *network.Name) {
-			continue
-		}
-		newAuthNetworks = append(newAuthNetworks, network)
-	}
-	return newAuthNetworks
+// TargetAuthNetworkName is the name of the authorized network on the source instance for an outgoing ip of the target,
+// recognisable as added by the migrator
+func TargetAuthNetworkName(targetName string, idx int) string {
+	return fmt.Sprintf("%s%s-%d", migrationAuthNetworkPrefix, targetName, idx)
 }
 
 func appendAuthNetIfNotExists(sqlInstance *v1beta1.SQLInstance, authNetwork v1beta1.InstanceAuthorizedNetworks) []v1beta1.InstanceAuthorizedNetworks {
@@ -290,4 +290,196 @@ var _ = Describe("Instance", func() {
 			Expect(stripped).To(BeFalse())
 		})
 	})
+
+	When("source application has extended instance configuration", func() {
+		BeforeEach(func() {
+			app = &nais_io_v1alpha1.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "my-app-name",
+					Namespace: "mynamespace",
+				},
+				Spec: nais_io_v1alpha1.ApplicationSpec{
+					Image: "my-docker-image:latest",
+					GCP: &nais_io_v1.GCP{
+						SqlInstances: []nais_io_v1.CloudSqlInstance{
+							{
+								Name:                sourceInstanceName,
+								HighAvailability:    true,
+								PointInTimeRecovery: true,
+								Maintenance:         &nais_io_v1.Maintenance{Day: 3, Hour: ptr.To(4)},
+								Insights:            &nais_io_v1.InsightsConfiguration{Enabled: ptr.To(true), QueryStringLength: 4500},
+								RetainedBackups:     ptr.To(7),
+								AutoBackupHour:      ptr.To(2),
+								Collation:           "en_US.UTF8",
+								Flags: []nais_io_v1.CloudSqlFlag{
+									{Name: "max_connections", Value: "100"},
+									{Name: "work_mem", Value: "4096"},
+									{Name: "cloudsql.logical_decoding", Value: "on"},
+								},
+							},
+						},
+					},
+				},
+			}
+		})
+
+		It("should keep the source values when nothing is configured", func() {
+			target := instance.DefineInstance(&config.InstanceSettings{Name: targetInstanceName}, app)
+			Expect(target.HighAvailability).To(BeTrue())
+			Expect(target.PointInTimeRecovery).To(BeTrue())
+			Expect(target.Maintenance).To(Equal(&nais_io_v1.Maintenance{Day: 3, Hour: ptr.To(4)}))
+			Expect(target.Insights.Enabled).To(HaveValue(BeTrue()))
+			Expect(target.RetainedBackups).To(HaveValue(Equal(7)))
+			Expect(target.AutoBackupHour).To(HaveValue(Equal(2)))
+			Expect(target.Collation).To(Equal("en_US.UTF8"))
+			Expect(target.Flags).To(Equal(app.Spec.GCP.SqlInstances[0].Flags))
+		})
+
+		It("should prefer the configured values to the source values", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:                targetInstanceName,
+				HighAvailability:    ptr.To(false),
+				PointInTimeRecovery: ptr.To(false),
+				MaintenanceHour:     ptr.To(22),
+				InsightsEnabled:     ptr.To(false),
+				RetainedBackups:     ptr.To(14),
+				AutoBackupHour:      ptr.To(1),
+				Collation:           "nb_NO.UTF8",
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.HighAvailability).To(BeFalse())
+			Expect(target.PointInTimeRecovery).To(BeFalse())
+			Expect(target.Maintenance).To(Equal(&nais_io_v1.Maintenance{Day: 3, Hour: ptr.To(22)}))
+			Expect(target.Insights).To(Equal(&nais_io_v1.InsightsConfiguration{Enabled: ptr.To(false), QueryStringLength: 4500}))
+			Expect(target.RetainedBackups).To(HaveValue(Equal(14)))
+			Expect(target.AutoBackupHour).To(HaveValue(Equal(1)))
+			Expect(target.Collation).To(Equal("nb_NO.UTF8"))
+		})
+
+		It("should set the maintenance window when the source has none", func() {
+			app.Spec.GCP.SqlInstances[0].Maintenance = nil
+			target := instance.DefineInstance(&config.InstanceSettings{Name: targetInstanceName, MaintenanceDay: ptr.To(6)}, app)
+			Expect(target.Maintenance).To(Equal(&nais_io_v1.Maintenance{Day: 6}))
+		})
+
+		It("should add, change and remove flags", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:        targetInstanceName,
+				Flags:       map[string]string{"work_mem": "8192", "temp_file_limit": "1000", "autovacuum": "on"},
+				RemoveFlags: []string{"max_connections"},
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Flags).To(Equal([]nais_io_v1.CloudSqlFlag{
+				{Name: "work_mem", Value: "8192"},
+				{Name: "cloudsql.logical_decoding", Value: "on"},
+				{Name: "autovacuum", Value: "on"},
+				{Name: "temp_file_limit", Value: "1000"},
+			}))
+		})
+
+		It("should set a flag that is also removed", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:        targetInstanceName,
+				Flags:       map[string]string{"max_connections": "200"},
+				RemoveFlags: []string{"max_connections"},
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Flags).To(ContainElement(nais_io_v1.CloudSqlFlag{Name: "max_connections", Value: "200"}))
+		})
+
+		It("should only use the configured flags when replacing flags", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:         targetInstanceName,
+				Flags:        map[string]string{"work_mem": "8192"},
+				ReplaceFlags: true,
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Flags).To(Equal([]nais_io_v1.CloudSqlFlag{{Name: "work_mem", Value: "8192"}}))
+		})
+
+		It("should not modify the source instance", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:            targetInstanceName,
+				MaintenanceHour: ptr.To(22),
+				InsightsEnabled: ptr.To(false),
+				Flags:           map[string]string{"work_mem": "8192"},
+			}
+			instance.DefineInstance(instanceSettings, app)
+			source := app.Spec.GCP.SqlInstances[0]
+			Expect(*source.Maintenance.Hour).To(Equal(4))
+			Expect(*source.Insights.Enabled).To(BeTrue())
+			Expect(source.Flags[1].Value).To(Equal("4096"))
+		})
+	})
+
+	When("source application has databases", func() {
+		BeforeEach(func() {
+			app = &nais_io_v1alpha1.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "my-app-name",
+					Namespace: "mynamespace",
+				},
+				Spec: nais_io_v1alpha1.ApplicationSpec{
+					Image: "my-docker-image:latest",
+					GCP: &nais_io_v1.GCP{
+						SqlInstances: []nais_io_v1.CloudSqlInstance{
+							{
+								Name: sourceInstanceName,
+								Databases: []nais_io_v1.CloudSqlDatabase{
+									{Name: "my-database"},
+								},
+							},
+						},
+					},
+				},
+			}
+		})
+
+		It("should not set an env var prefix by default", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name: targetInstanceName,
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Databases[0].EnvVarPrefix).To(BeEmpty())
+		})
+
+		It("should set an env var prefix matching the source instance when preserving names", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:                targetInstanceName,
+				PreserveEnvVarNames: true,
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Databases[0].EnvVarPrefix).To(Equal("NAIS_DATABASE_MY_SOURCE_INSTANCE_NAME_MY_DATABASE"))
+		})
+
+		It("should use the application name for unnamed instances and databases when preserving names", func() {
+			app.Spec.GCP.SqlInstances[0].Name = ""
+			app.Spec.GCP.SqlInstances[0].Databases[0].Name = ""
+			instanceSettings := &config.InstanceSettings{
+				Name:                targetInstanceName,
+				PreserveEnvVarNames: true,
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Databases[0].EnvVarPrefix).To(Equal("NAIS_DATABASE_MY_APP_NAME_MY_APP_NAME"))
+		})
+
+		It("should keep an existing env var prefix when preserving names", func() {
+			app.Spec.GCP.SqlInstances[0].Databases[0].EnvVarPrefix = "DB"
+			instanceSettings := &config.InstanceSettings{
+				Name:                targetInstanceName,
+				PreserveEnvVarNames: true,
+			}
+			target := instance.DefineInstance(instanceSettings, app)
+			Expect(target.Databases[0].EnvVarPrefix).To(Equal("DB"))
+		})
+
+		It("should not modify the source instance", func() {
+			instanceSettings := &config.InstanceSettings{
+				Name:                targetInstanceName,
+				PreserveEnvVarNames: true,
+			}
+			instance.DefineInstance(instanceSettings, app)
+			Expect(app.Spec.GCP.SqlInstances[0].Databases[0].EnvVarPrefix).To(BeEmpty())
+		})
+	})
 })
@@ -3,20 +3,28 @@ package instance
 import (
 	"context"
 	"fmt"
-	"github.com/sethvargo/go-retry"
 	"time"
 
-	clouddms "cloud.google.com/go/clouddms/apiv1"
 	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/sethvargo/go-retry"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 func CreateConnectionProfiles(ctx context.Context, cfg *config.Config, gcpProject *resolved.GcpProject, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) error {
-	cps := getDmsConnectionProfiles(cfg, source, target)
+	// The migrator may reach an instance through the connector on another ip than the migration job does
+	for _, instance := range []*resolved.Instance{source, target} {
+		if instance.Ip(mgr.Connectivity) == "" {
+			return fmt.Errorf("sql instance %s does not have an ip address for the migration job with %s connectivity", instance.Name, mgr.Connectivity)
+		}
+	}
+
+	cps := getDmsConnectionProfiles(cfg, source, target, mgr.Connectivity)
 
 	err := deleteOldConnectionProfiles(ctx, cps, gcpProject, mgr)
 	if err != nil {
@@ -32,9 +40,9 @@ func CreateConnectionProfiles(ctx context.Context, cfg *config.Config, gcpProjec
 }
 
 func CleanupConnectionProfiles(ctx context.Context, cfg *config.Config, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	for _, prefix := range []string{"source", "target"} {
-		profileName := fmt.Sprintf("%s-%s", prefix, cfg.ApplicationName)
-		_, err := deleteConnectionProfile(ctx, profileName, gcpProject, mgr)
+	for _, role := range []string{"source", "target"} {
+		profileName := ConnectionProfileName(cfg, role)
+		err := deleteConnectionProfile(ctx, profileName, gcpProject, mgr)
 		if err != nil {
 			return err
 		}
@@ -43,83 +51,68 @@ func CleanupConnectionProfiles(ctx context.Context, cfg *config.Config, gcpProje
 	return nil
 }
 
+// ConnectionProfileName is the name of the DMS connection profile of the source or target instance
+func ConnectionProfileName(cfg *config.Config, role string) string {
+	return fmt.Sprintf("%s-%s", role, cfg.ApplicationName)
+}
+
+// createConnectionProfiles creates the connection profiles in parallel, and waits until they are created
 func createConnectionProfiles(ctx context.Context, cps map[string]*clouddmspb.ConnectionProfile, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	createOperations := make([]*clouddms.CreateConnectionProfileOperation, 0, 2)
+	g, ctx := errgroup.WithContext(ctx)
 	for i, cp := range cps {
 		profileName := fmt.Sprintf("%s-%s", i, cp.Name)
 
-		mgr.Logger.Info("creating connection profile", "name", profileName)
-		createOperation, err := mgr.DBMigrationClient.CreateConnectionProfile(ctx, &clouddmspb.CreateConnectionProfileRequest{
-			Parent:              gcpProject.GcpParentURI(),
-			ConnectionProfileId: profileName,
-			ConnectionProfile:   cp,
-		})
-
-		if st, ok := status.FromError(err); ok && st.Code() == codes.AlreadyExists {
-			mgr.Logger.Info("connection profile already exists, updating", "name", profileName)
-			continue
-		}
-
-		if err != nil {
-			mgr.Logger.Error("failed to create connection profile", "name", profileName, "error", err)
-			return err
-		}
-
-		createOperations = append(createOperations, createOperation)
-	}
+		g.Go(func() error {
+			mgr.Logger.Info("creating connection profile", "name", profileName)
+			created, err := mgr.Datamigration.ConnectionProfiles.Create(ctx, gcpProject.GcpParentURI(), profileName, cp)
+			if st, ok := status.FromError(err); ok && st.Code() == codes.AlreadyExists {
+				mgr.Logger.Info("connection profile already exists, updating", "name", profileName)
+				return nil
+			}
+			if err != nil {
+				mgr.Logger.Error("failed to create connection profile", "name", profileName, "error", err)
+				return fmt.Errorf("failed to create connection profile %s: %w", profileName, err)
+			}
 
-	for _, createOperation := range createOperations {
-		cp, err := createOperation.Wait(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to wait for connection profile creation: %w", err)
-		}
-		mgr.Logger.Info("connection profile created", "name", cp.Name)
+			mgr.Logger.Info("connection profile created", "name", created.Name)
+			return nil
+		})
 	}
-	return nil
+	return g.Wait()
 }
 
+// deleteOldConnectionProfiles deletes the connection profiles in parallel, and waits until they are deleted
 func deleteOldConnectionProfiles(ctx context.Context, cps map[string]*clouddmspb.ConnectionProfile, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	deleteOperations := make([]*clouddms.DeleteConnectionProfileOperation, 0, 2)
+	g, ctx := errgroup.WithContext(ctx)
 	for i, cp := range cps {
 		profileName := fmt.Sprintf("%s-%s", i, cp.Name)
 
-		deleteOperation, err := deleteConnectionProfile(ctx, profileName, gcpProject, mgr)
-		if err != nil {
-			return fmt.Errorf("failed to delete connection profile: %w", err)
-		}
-
-		if deleteOperation != nil {
-			deleteOperations = append(deleteOperations, deleteOperation)
-		}
-	}
-
-	for _, deleteOperation := range deleteOperations {
-		mgr.Logger.Info("waiting for connection profile deletion...", "name", deleteOperation.Name())
-		err := deleteOperation.Wait(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to wait for connection profile deletion: %w", err)
-		}
+		g.Go(func() error {
+			err := deleteConnectionProfile(ctx, profileName, gcpProject, mgr)
+			if err != nil {
+				return fmt.Errorf("failed to delete connection profile: %w", err)
+			}
+			return nil
+		})
 	}
-	return nil
+	return g.Wait()
 }
 
-func deleteConnectionProfile(ctx context.Context, profileName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*clouddms.DeleteConnectionProfileOperation, error) {
+func deleteConnectionProfile(ctx context.Context, profileName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
 	mgr.Logger.Info("deleting connection profile", "name", profileName)
 
 	b := retry.NewConstant(5 * time.Second)
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
-	deleteOperation, err := retry.DoValue(ctx, b, func(ctx context.Context) (*clouddms.DeleteConnectionProfileOperation, error) {
-		deleteOperation, err := mgr.DBMigrationClient.DeleteConnectionProfile(ctx, &clouddmspb.DeleteConnectionProfileRequest{
-			Name: gcpProject.GcpComponentURI("connectionProfiles", profileName),
-		})
+	err := retry.Do(ctx, b, func(ctx context.Context) error {
+		err := mgr.Datamigration.ConnectionProfiles.Delete(ctx, gcpProject.GcpComponentURI("connectionProfiles", profileName))
 		if err != nil {
 			if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
-				return nil, nil
+				return nil
 			}
-			return nil, retry.RetryableError(fmt.Errorf("unable to delete connection profile, retrying: %w", err))
+			return classify.Retry(fmt.Errorf("unable to delete connection profile: %w", err))
 		}
-		return deleteOperation, nil
+		return nil
 	})
 
 	if err != nil {
@@ -127,36 +120,40 @@ func deleteConnectionProfile(ctx context.Context, profileName string, gcpProject
 	} else {
 		mgr.Logger.Info("connection profile deleted", "name", profileName)
 	}
-	return deleteOperation, err
+	return err
 }
 
-func getDmsConnectionProfiles(cfg *config.Config, source *resolved.Instance, target *resolved.Instance) map[string]*clouddmspb.ConnectionProfile {
+func getDmsConnectionProfiles(cfg *config.Config, source *resolved.Instance, target *resolved.Instance, connectivity string) map[string]*clouddmspb.ConnectionProfile {
 	cps := make(map[string]*clouddmspb.ConnectionProfile, 2)
-	cps["source"] = connectionProfile(cfg, source)
-	cps["target"] = connectionProfile(cfg, target)
+	cps["source"] = connectionProfile(cfg, source, connectivity)
+	cps["target"] = connectionProfile(cfg, target, connectivity)
 
 	return cps
 }
 
-func connectionProfile(cfg *config.Config, instance *resolved.Instance) *clouddmspb.ConnectionProfile {
-	return &clouddmspb.ConnectionProfile{
-		Name: cfg.ApplicationName,
-		ConnectionProfile: &clouddmspb.ConnectionProfile_Postgresql{
-			Postgresql: &clouddmspb.PostgreSqlConnectionProfile{
-				Host:     instance.PrimaryIp,
-				Port:     config.DatabasePort,
-				Username: config.PostgresDatabaseUser,
-				Password: instance.PostgresPassword,
-				Ssl: &clouddmspb.SslConfig{
-					Type:              clouddmspb.SslConfig_SERVER_CLIENT,
-					ClientKey:         instance.SslCert.SslClientKey,
-					ClientCertificate: instance.SslCert.SslClientCert,
-					CaCertificate:     instance.SslCert.SslCaCert,
-				},
-				CloudSqlId:   instance.Name,
-				Connectivity: &clouddmspb.PostgreSqlConnectionProfile_StaticIpConnectivity{},
-			},
+// connectionProfile connects to the instance on its public ip, or on its private ip through the VPC peering of the
+// migration job with private connectivity
+func connectionProfile(cfg *config.Config, instance *resolved.Instance, connectivity string) *clouddmspb.ConnectionProfile {
+	profile := &clouddmspb.PostgreSqlConnectionProfile{
+		Host:     instance.Ip(connectivity),
+		Port:     config.DatabasePort,
+		Username: config.PostgresDatabaseUser,
+		Password: instance.PostgresPassword,
+		Ssl: &clouddmspb.SslConfig{
+			Type:              clouddmspb.SslConfig_SERVER_CLIENT,
+			ClientKey:         instance.SslCert.SslClientKey,
+			ClientCertificate: instance.SslCert.SslClientCert,
+			CaCertificate:     instance.SslCert.SslCaCert,
 		},
-		Provider: clouddmspb.DatabaseProvider_CLOUDSQL,
+		CloudSqlId: instance.Name,
+	}
+	if connectivity != config.ConnectivityPrivateIp {
+		profile.Connectivity = &clouddmspb.PostgreSqlConnectionProfile_StaticIpConnectivity{}
+	}
+
+	return &clouddmspb.ConnectionProfile{
+		Name:              cfg.ApplicationName,
+		ConnectionProfile: &clouddmspb.ConnectionProfile_Postgresql{Postgresql: profile},
+		Provider:          clouddmspb.DatabaseProvider_CLOUDSQL,
 	}
 }
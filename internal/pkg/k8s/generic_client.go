@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	naisv1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
@@ -10,6 +11,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/utils/ptr"
 )
@@ -33,6 +35,7 @@ type GenericClient[T interface {
 	UpdateStatus(ctx context.Context, obj *P) (*P, error)
 	Create(ctx context.Context, obj *P) (*P, error)
 	ExistsByLabel(ctx context.Context, label string) (bool, error)
+	Watch(ctx context.Context, listOptions metav1.ListOptions) (watch.Interface, error)
 }
 
 type AppClient GenericClient[*naisv1alpha1.Application, naisv1alpha1.Application]
@@ -173,3 +176,22 @@ func (g *genericClient[T, P]) ExistsByLabel(ctx context.Context, label string) (
 
 	return len(list.Items) > 0, nil
 }
+
+func (g *genericClient[T, P]) Watch(ctx context.Context, listOptions metav1.ListOptions) (watch.Interface, error) {
+	return g.client.Watch(ctx, listOptions)
+}
+
+// Convert converts an object received from a watch on the dynamic client to its typed representation
+func Convert[P any](obj runtime.Object) (*P, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	typed := new(P)
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed)
+	if err != nil {
+		return nil, err
+	}
+	return typed, nil
+}
@@ -0,0 +1,268 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/liberator/pkg/namegen"
+	"github.com/sethvargo/go-retry"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// Every phase holds a Lease named after the application while it runs, so that two runs
+// for the same application can not mutate the same resources at the same time.
+// The lease is renewed in the background, and expires shortly after a run exits without releasing it.
+
+const (
+	leaseDuration = 15 * time.Second
+	renewInterval = 5 * time.Second
+
+	phaseAnnotation = "migrator.nais.io/phase"
+	runIdAnnotation = "migrator.nais.io/run-id"
+)
+
+type Lock struct {
+	name      string
+	namespace string
+	identity  string
+	runId     string
+	mgr       *common_main.Manager
+	stop      context.CancelFunc
+	wg        sync.WaitGroup
+	release   sync.Once
+}
+
+// ContentionError is returned when another run holds the lock
+type ContentionError struct {
+	Holder     string
+	Phase      string
+	AcquiredAt time.Time
+}
+
+func (e *ContentionError) Error() string {
+	return fmt.Sprintf("migration is locked by %s running %s since %s", e.Holder, e.Phase, e.AcquiredAt.Format(time.RFC3339))
+}
+
+// Name returns the name of the Lease used to lock migrations of the application
+func Name(appName string) (string, error) {
+	return namegen.ShortName(fmt.Sprintf("migrator-%s-lock", appName), 63)
+}
+
+// Acquire takes the migration lock for the application, waiting for a lease left behind by an earlier run to expire.
+// The returned context is cancelled if the lock is lost while the phase runs.
+// The lock is also released by mgr.Fail, as a deferred Release does not run when a failing phase exits the process.
+func Acquire(ctx context.Context, cfg *config.Config, phase string, mgr *common_main.Manager) (context.Context, *Lock, error) {
+	name, err := Name(cfg.ApplicationName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identity, err := common_main.Identity()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to determine identity: %w", err)
+	}
+
+	l := &Lock{
+		name:      name,
+		namespace: cfg.Namespace,
+		identity:  identity,
+		runId:     uuid.NewString(),
+		mgr:       mgr,
+	}
+
+	if mgr.DryRun != nil {
+		// A dry run changes nothing, so it does not need the lock, and should not hold up a real run
+		mgr.Logger.Info("dry run, not taking the migration lock", "lease", name)
+		l.stop = func() {}
+		return ctx, l, nil
+	}
+
+	mgr.Logger.Info("acquiring migration lock", "lease", name, "identity", identity)
+
+	b := retry.NewConstant(renewInterval)
+	b = retry.WithMaxDuration(leaseDuration+renewInterval, b)
+
+	err = retry.Do(ctx, b, func(ctx context.Context) error {
+		err := l.tryAcquire(ctx, cfg, phase)
+		if err != nil {
+			var contention *ContentionError
+			if errors.As(err, &contention) {
+				mgr.Logger.Info("migration lock is held, waiting for it to be released or expire", "error", err)
+				return retry.RetryableError(err)
+			}
+			if k8s_errors.IsConflict(err) || k8s_errors.IsAlreadyExists(err) {
+				return retry.RetryableError(err)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mgr.Logger.Info("migration lock acquired", "lease", name)
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.stop = cancel
+	l.wg.Add(1)
+	go l.renew(ctx, cancel)
+	mgr.BeforeExit = l.Release
+
+	return ctx, l, nil
+}
+
+// Release stops renewing the lease and deletes it, if it is still held by this run. Only the first call has an effect.
+func (l *Lock) Release() {
+	l.release.Do(l.doRelease)
+}
+
+func (l *Lock) doRelease() {
+	l.stop()
+	l.wg.Wait()
+	if l.mgr.DryRun != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	leases := l.mgr.K8sClient.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		l.mgr.Logger.Warn("unable to get migration lock for release", "error", err)
+		return
+	}
+	if lease.Annotations[runIdAnnotation] != l.runId {
+		l.mgr.Logger.Warn("migration lock is no longer held by this run, not releasing it")
+		return
+	}
+
+	err = leases.Delete(ctx, l.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		l.mgr.Logger.Warn("unable to release migration lock", "error", err)
+		return
+	}
+	l.mgr.Logger.Info("migration lock released", "lease", l.name)
+}
+
+func (l *Lock) tryAcquire(ctx context.Context, cfg *config.Config, phase string) error {
+	leases := l.mgr.K8sClient.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+				Labels: map[string]string{
+					"app":                       cfg.ApplicationName,
+					"team":                      cfg.Namespace,
+					"migrator.nais.io/finalize": cfg.ApplicationName,
+				},
+				Annotations: map[string]string{
+					phaseAnnotation: phase,
+					runIdAnnotation: l.runId,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: ptr.To(int32(leaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get migration lock: %w", err)
+	}
+
+	if held(lease) {
+		return contentionError(lease)
+	}
+
+	if lease.Spec.HolderIdentity != nil && len(*lease.Spec.HolderIdentity) > 0 {
+		l.mgr.Logger.Warn("taking over expired migration lock", "previousHolder", *lease.Spec.HolderIdentity, "previousPhase", lease.Annotations[phaseAnnotation])
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string, 2)
+	}
+	lease.Annotations[phaseAnnotation] = phase
+	lease.Annotations[runIdAnnotation] = l.runId
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = ptr.To(int32(leaseDuration.Seconds()))
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = ptr.To(ptr.Deref(lease.Spec.LeaseTransitions, 0) + 1)
+
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (l *Lock) renew(ctx context.Context, lost context.CancelFunc) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	leases := l.mgr.K8sClient.CoordinationV1().Leases(l.namespace)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+		if err != nil {
+			l.mgr.Logger.Warn("unable to get migration lock for renewal", "error", err)
+			continue
+		}
+		if lease.Annotations[runIdAnnotation] != l.runId {
+			l.mgr.Logger.Error("migration lock has been taken by someone else, aborting", "error", contentionError(lease))
+			lost()
+			return
+		}
+
+		lease.Spec.RenewTime = ptr.To(metav1.NewMicroTime(time.Now()))
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		if err != nil {
+			l.mgr.Logger.Warn("unable to renew migration lock", "error", err)
+		}
+	}
+}
+
+func held(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 {
+		return false
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().Before(expiry)
+}
+
+func contentionError(lease *coordinationv1.Lease) *ContentionError {
+	e := &ContentionError{
+		Holder: ptr.Deref(lease.Spec.HolderIdentity, "unknown"),
+		Phase:  lease.Annotations[phaseAnnotation],
+	}
+	if lease.Spec.AcquireTime != nil {
+		e.AcquiredAt = lease.Spec.AcquireTime.Time
+	}
+	return e
+}
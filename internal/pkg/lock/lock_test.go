@@ -0,0 +1,142 @@
+package lock_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/lock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+const namespace = "my-team"
+
+var _ = Describe("Lock", func() {
+	var ctx context.Context
+	var mgr *common_main.Manager
+	var cfg *config.Config
+	var leaseName string
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		DeferCleanup(cancel)
+
+		mgr = &common_main.Manager{
+			Logger:    slog.New(slog.DiscardHandler),
+			K8sClient: fake.NewClientset(),
+		}
+		cfg = &config.Config{ApplicationName: "my-app", Namespace: namespace}
+
+		var err error
+		leaseName, err = lock.Name(cfg.ApplicationName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	getLease := func() (*coordinationv1.Lease, error) {
+		return mgr.K8sClient.CoordinationV1().Leases(namespace).Get(ctx, leaseName, metav1.GetOptions{})
+	}
+	// lease is a lease held by another run, last renewed at renewed
+	lease := func(renewed time.Time) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        leaseName,
+				Namespace:   namespace,
+				Annotations: map[string]string{"migrator.nais.io/phase": "setup", "migrator.nais.io/run-id": "other-run"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To("someone@elsewhere"),
+				LeaseDurationSeconds: ptr.To(int32(15)),
+				AcquireTime:          ptr.To(metav1.NewMicroTime(renewed)),
+				RenewTime:            ptr.To(metav1.NewMicroTime(renewed)),
+			},
+		}
+	}
+	// takeOver makes the lease look like another run has taken it
+	takeOver := func() {
+		current, err := getLease()
+		Expect(err).NotTo(HaveOccurred())
+		current.Annotations["migrator.nais.io/run-id"] = "other-run"
+		_, err = mgr.K8sClient.CoordinationV1().Leases(namespace).Update(ctx, current, metav1.UpdateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("holds a lease until it is released", func() {
+		_, l, err := lock.Acquire(ctx, cfg, "setup", mgr)
+		Expect(err).NotTo(HaveOccurred())
+		held, err := getLease()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(held.Annotations).To(HaveKeyWithValue("migrator.nais.io/phase", "setup"))
+
+		l.Release()
+		_, err = getLease()
+		Expect(k8s_errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("refuses a second run while the lease is held", func() {
+		_, err := mgr.K8sClient.CoordinationV1().Leases(namespace).Create(ctx, lease(time.Now().Add(time.Minute)), metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = lock.Acquire(ctx, cfg, "promote", mgr)
+		var contention *lock.ContentionError
+		Expect(errors.As(err, &contention)).To(BeTrue())
+		Expect(contention.Holder).To(Equal("someone@elsewhere"))
+		Expect(contention.Phase).To(Equal("setup"))
+	})
+
+	It("takes over an expired lease", func() {
+		_, err := mgr.K8sClient.CoordinationV1().Leases(namespace).Create(ctx, lease(time.Now().Add(-time.Minute)), metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, l, err := lock.Acquire(ctx, cfg, "promote", mgr)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(l.Release)
+		held, err := getLease()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(held.Annotations).To(HaveKeyWithValue("migrator.nais.io/phase", "promote"))
+		Expect(held.Annotations["migrator.nais.io/run-id"]).NotTo(Equal("other-run"))
+		Expect(*held.Spec.LeaseTransitions).To(Equal(int32(1)))
+	})
+
+	It("leaves a lease taken by another run when it is released", func() {
+		_, l, err := lock.Acquire(ctx, cfg, "setup", mgr)
+		Expect(err).NotTo(HaveOccurred())
+		takeOver()
+
+		l.Release()
+		held, err := getLease()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(held.Annotations).To(HaveKeyWithValue("migrator.nais.io/run-id", "other-run"))
+	})
+
+	It("cancels the context of the phase when the lease is lost", func() {
+		lockCtx, l, err := lock.Acquire(ctx, cfg, "setup", mgr)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(l.Release)
+		takeOver()
+
+		Eventually(lockCtx.Done()).WithTimeout(15 * time.Second).Should(BeClosed())
+		Expect(ctx.Err()).NotTo(HaveOccurred())
+	})
+
+	It("is released when the phase fails", func() {
+		exitCode := -1
+		mgr.Exit = func(code int) { exitCode = code }
+		_, _, err := lock.Acquire(ctx, cfg, "setup", mgr)
+		Expect(err).NotTo(HaveOccurred())
+
+		mgr.Fail(3, "failed", "error", errors.New("failed"))
+		Expect(exitCode).To(Equal(3))
+		_, err = getLease()
+		Expect(k8s_errors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -9,21 +9,34 @@ import (
 
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
 	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/operation"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
 
 	"cloud.google.com/go/clouddms/apiv1/clouddmspb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"google.golang.org/api/datamigration/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const demoteTimeout = 30 * time.Minute
+
 func PrepareMigrationJob(ctx context.Context, cfg *config.Config, gcpProject *resolved.GcpProject, source *resolved.Instance, target *resolved.Instance, mgr *common_main.Manager) (string, error) {
 	migrationName, err := resolved.MigrationName(source.Name, target.Name)
 	if err != nil {
 		return "", err
 	}
 
+	// With private connectivity the migration job is peered with the network of the instances
+	vpc := ""
+	if mgr.Connectivity == config.ConnectivityPrivateIp {
+		vpc, err = instance.PrivateNetwork(ctx, gcpProject, source, target, mgr)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	err = DeleteMigrationJob(ctx, migrationName, gcpProject, mgr)
 	if err != nil {
 		return "", err
@@ -34,13 +47,12 @@ func PrepareMigrationJob(ctx context.Context, cfg *config.Config, gcpProject *re
 		return "", err
 	}
 
-	migrationJob, err := createMigrationJob(ctx, migrationName, cfg, gcpProject, mgr)
+	migrationJobName, err := createMigrationJob(ctx, migrationName, vpc, cfg, gcpProject, mgr)
 	if err != nil {
 		return "", err
 	}
 
-	migrationJobName := migrationJob.Name
-	err = demoteTargetInstance(ctx, migrationJobName, mgr)
+	err = demoteTargetInstance(ctx, cfg, migrationJobName, mgr)
 	if err != nil {
 		return "", err
 	}
@@ -55,21 +67,13 @@ func DeleteMigrationJob(ctx context.Context, migrationName string, gcpProject *r
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
 	err := retry.Do(ctx, b, func(ctx context.Context) error {
-		op, err := mgr.DBMigrationClient.DeleteMigrationJob(ctx, &clouddmspb.DeleteMigrationJobRequest{
-			Name: gcpProject.GcpComponentURI("migrationJobs", migrationName),
-		})
+		err := mgr.Datamigration.MigrationJobs.Delete(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
 		if err != nil {
 			if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
 				return nil
 			}
-			mgr.Logger.Warn("failed to delete previous migration job, retrying", "error", err)
-			return retry.RetryableError(fmt.Errorf("unable to delete previous migration job: %w", err))
-		} else {
-			err = op.Wait(ctx)
-			if err != nil {
-				mgr.Logger.Warn("failed to wait for deletion of previous migration job, retrying", "error", err)
-				return retry.RetryableError(fmt.Errorf("failed to wait for migration job deletion: %w", err))
-			}
+			mgr.Logger.Warn("failed to delete previous migration job", "error", err)
+			return classify.Retry(fmt.Errorf("unable to delete previous migration job: %w", err))
 		}
 
 		mgr.Logger.Info("migration job deleted", "name", migrationName)
@@ -81,72 +85,62 @@ func DeleteMigrationJob(ctx context.Context, migrationName string, gcpProject *r
 	return nil
 }
 
-func demoteTargetInstance(ctx context.Context, migrationJobName string, mgr *common_main.Manager) error {
+func demoteTargetInstance(ctx context.Context, cfg *config.Config, migrationJobName string, mgr *common_main.Manager) error {
 	mgr.Logger.Info("demoting target instance")
 
-	op, err := mgr.DatamigrationService.Projects.Locations.MigrationJobs.DemoteDestination(migrationJobName, &datamigration.DemoteDestinationRequest{}).Context(ctx).Do()
+	operationKey := "demote/" + migrationJobName
+	op, err := operation.ResumeDatamigration(ctx, cfg, operationKey, mgr)
 	if err != nil {
-		return fmt.Errorf("failed to demote target instance: %w", err)
+		return err
 	}
-
-	for !op.Done {
-		time.Sleep(10 * time.Second)
-		mgr.Logger.Info("waiting for demote operation to complete")
-		op, err = mgr.DatamigrationService.Projects.Locations.Operations.Get(op.Name).Context(ctx).Do()
+	if op == nil {
+		op, err = mgr.Datamigration.MigrationJobs.DemoteDestination(ctx, migrationJobName)
 		if err != nil {
-			return fmt.Errorf("failed to get demote operation status: %w", err)
+			return fmt.Errorf("failed to demote target instance: %w", err)
 		}
 	}
 
-	return nil
+	return operation.WaitDatamigration(ctx, "demote", op, demoteTimeout, mgr, operation.Tracked(cfg, operationKey))
 }
 
-func createMigrationJob(ctx context.Context, migrationName string, cfg *config.Config, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*clouddmspb.MigrationJob, error) {
+// createMigrationJob creates the migration job unless it exists, and returns its full name.
+// The job is peered with the vpc when there is one, and reaches the source on its public ip otherwise.
+func createMigrationJob(ctx context.Context, migrationName, vpc string, cfg *config.Config, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (string, error) {
 	mgr.Logger.Info("looking for existing migration job", "name", migrationName)
-	migrationJob, err := mgr.DBMigrationClient.GetMigrationJob(ctx, &clouddmspb.GetMigrationJobRequest{
-		Name: gcpProject.GcpComponentURI("migrationJobs", migrationName),
-	})
-	if err != nil {
-		if st, ok := status.FromError(err); !ok || st.Code() != codes.NotFound {
-			return nil, fmt.Errorf("error while trying to look for existing migration job: %w", err)
-		}
+	existing, err := mgr.Datamigration.MigrationJobs.Get(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
+	if err != nil && !classify.Is(err, classify.NotFound) {
+		return "", fmt.Errorf("error while trying to look for existing migration job: %w", err)
 	}
 
-	if migrationJob != nil {
-		mgr.Logger.Info("migration job already exists", "name", migrationJob.Name)
-		return migrationJob, nil
-	}
-
-	req := &clouddmspb.CreateMigrationJobRequest{
-		Parent:         gcpProject.GcpParentURI(),
-		MigrationJobId: migrationName,
-		MigrationJob: &clouddmspb.MigrationJob{
-			DisplayName: migrationName,
-			Labels: map[string]string{
-				"app":  cfg.ApplicationName,
-				"team": cfg.Namespace,
-			},
-			Type:         clouddmspb.MigrationJob_CONTINUOUS,
-			Source:       gcpProject.GcpComponentURI("connectionProfiles", fmt.Sprintf("source-%s", cfg.ApplicationName)),
-			Destination:  gcpProject.GcpComponentURI("connectionProfiles", fmt.Sprintf("target-%s", cfg.ApplicationName)),
-			Connectivity: &clouddmspb.MigrationJob_StaticIpConnectivity{},
+	if err == nil {
+		mgr.Logger.Info("migration job already exists", "name", existing.Name)
+		return existing.Name, nil
+	}
+
+	migrationJob := &clouddmspb.MigrationJob{
+		DisplayName: migrationName,
+		Labels: map[string]string{
+			"app":  cfg.ApplicationName,
+			"team": cfg.Namespace,
 		},
-		RequestId: "",
+		Type:         clouddmspb.MigrationJob_CONTINUOUS,
+		Source:       gcpProject.GcpComponentURI("connectionProfiles", fmt.Sprintf("source-%s", cfg.ApplicationName)),
+		Destination:  gcpProject.GcpComponentURI("connectionProfiles", fmt.Sprintf("target-%s", cfg.ApplicationName)),
+		Connectivity: &clouddmspb.MigrationJob_StaticIpConnectivity{},
 	}
-	mgr.Logger.Info("creating new migration job", "name", migrationName)
-	createOperation, err := mgr.DBMigrationClient.CreateMigrationJob(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create new migration job: %w", err)
+	if vpc != "" {
+		migrationJob.Connectivity = &clouddmspb.MigrationJob_VpcPeeringConnectivity{
+			VpcPeeringConnectivity: &clouddmspb.VpcPeeringConnectivity{Vpc: vpc},
+		}
 	}
-
-	mgr.Logger.Info("waiting for migration job creation", "name", migrationName)
-	migrationJob, err = createOperation.Wait(ctx)
+	mgr.Logger.Info("creating new migration job", "name", migrationName)
+	created, err := mgr.Datamigration.MigrationJobs.Create(ctx, gcpProject.GcpParentURI(), migrationName, migrationJob)
 	if err != nil {
-		return nil, fmt.Errorf("failed waiting for migration job creation: %w", err)
+		return "", fmt.Errorf("unable to create new migration job: %w", err)
 	}
 
-	mgr.Logger.Info("migration job created", "name", migrationJob.Name)
-	return migrationJob, nil
+	mgr.Logger.Info("migration job created", "name", created.Name)
+	return created.Name, nil
 }
 
 func StartMigrationJob(ctx context.Context, migrationJobName string, mgr *common_main.Manager) error {
@@ -157,17 +151,10 @@ func StartMigrationJob(ctx context.Context, migrationJobName string, mgr *common
 	b = retry.WithMaxDuration(15*time.Minute, b)
 
 	err := retry.Do(ctx, b, func(ctx context.Context) error {
-		startOperation, err := mgr.DBMigrationClient.StartMigrationJob(ctx, &clouddmspb.StartMigrationJobRequest{
-			Name: migrationJobName,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to start migration job: %w", err)
-		}
-
-		logger.Info("waiting for migration job to start")
-		_, err = startOperation.Wait(ctx)
+		err := mgr.Datamigration.MigrationJobs.Start(ctx, migrationJobName)
 		if err != nil {
-			return retry.RetryableError(fmt.Errorf("failed waiting for migration job to start, retrying: %w", err))
+			logger.Warn("failed to start migration job", "error", err)
+			return classify.Retry(fmt.Errorf("failed to start migration job: %w", err))
 		}
 
 		return nil
@@ -185,12 +172,13 @@ func GetMigrationJob(ctx context.Context, migrationName string, gcpProject *reso
 	b = retry.WithMaxDuration(5*time.Minute, b)
 
 	migrationJob, err := retry.DoValue(ctx, b, func(ctx context.Context) (*datamigration.MigrationJob, error) {
-		migrationJob, err := mgr.DatamigrationService.Projects.Locations.MigrationJobs.Get(gcpProject.GcpComponentURI("migrationJobs", migrationName)).Context(ctx).Do()
+		migrationJob, err := mgr.Datamigration.MigrationJobs.Get(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
 		if err != nil {
-			return nil, retry.RetryableError(fmt.Errorf("failed to get migration job: %w", err))
+			mgr.Logger.Warn("failed to get migration job", "error", err)
+			return nil, classify.Retry(fmt.Errorf("failed to get migration job: %w", err))
 		}
 
-		mgr.Logger.Info("got migration job", "name", migrationJob.Name)
+		mgr.Status("got migration job", "state", migrationJob.State, "phase", migrationJob.Phase)
 		return migrationJob, err
 	})
 
@@ -0,0 +1,143 @@
+package migration_test
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp/fake"
+	"github.com/nais/cloudsql-migrator/internal/pkg/migration"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/sqladmin/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration job", func() {
+	const (
+		parent  = "projects/my-project/locations/europe-north1"
+		jobName = parent + "/migrationJobs/my-app-my-app-pg16"
+	)
+
+	var ctx context.Context
+	var backend *fake.Backend
+	var mgr *common_main.Manager
+	var cfg *config.Config
+	gcpProject := &resolved.GcpProject{Id: "my-project", Location: "europe-north1"}
+	source := &resolved.Instance{Name: "my-app", PrimaryIp: "10.0.0.1"}
+	target := &resolved.Instance{Name: "my-app-pg16", PrimaryIp: "10.0.0.2"}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(cancel)
+
+		backend = fake.New()
+		mgr = &common_main.Manager{
+			Logger:        slog.New(slog.DiscardHandler),
+			K8sClient:     k8sfake.NewClientset(),
+			SqlAdmin:      backend.SqlAdmin(),
+			Datamigration: backend.Datamigration(),
+		}
+		cfg = &config.Config{ApplicationName: "my-app", Namespace: "my-team"}
+	})
+
+	Describe("PrepareMigrationJob", func() {
+		It("replaces the previous migration job, creates connection profiles and demotes the target", func() {
+			backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "FAILED"}
+
+			name, err := migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal(jobName))
+
+			Expect(backend.MigrationJobs).To(HaveKeyWithValue(jobName, HaveField("State", "NOT_STARTED")))
+			Expect(backend.MigrationJobs[jobName].Source).To(Equal(parent + "/connectionProfiles/source-my-app"))
+			Expect(backend.MigrationJobs[jobName].StaticIpConnectivity).NotTo(BeNil())
+			Expect(backend.ConnectionProfiles).To(HaveKey(parent + "/connectionProfiles/source-my-app"))
+			Expect(backend.ConnectionProfiles).To(HaveKey(parent + "/connectionProfiles/target-my-app"))
+			Expect(backend.ConnectionProfiles[parent+"/connectionProfiles/target-my-app"].GetPostgresql().GetHost()).To(Equal("10.0.0.2"))
+			Expect(backend.Calls).To(ContainElements(
+				"MigrationJobs.Delete "+jobName,
+				"MigrationJobs.Create "+jobName,
+				"MigrationJobs.DemoteDestination "+jobName,
+			))
+		})
+
+		It("reuses connection profiles that already exist", func() {
+			_, err := migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.ConnectionProfiles).To(HaveLen(2))
+		})
+
+		Context("with private connectivity", func() {
+			const network = "projects/nais-vpc-project/global/networks/nais-vpc"
+			source := &resolved.Instance{Name: "my-app", PrivateIp: "10.1.0.1"}
+			target := &resolved.Instance{Name: "my-app-pg16", PrivateIp: "10.1.0.2"}
+
+			onNetwork := func(instanceName, network string) {
+				backend.Instances["my-project/"+instanceName] = &sqladmin.DatabaseInstance{
+					Name:     instanceName,
+					Settings: &sqladmin.Settings{IpConfiguration: &sqladmin.IpConfiguration{PrivateNetwork: network}},
+				}
+			}
+
+			BeforeEach(func() {
+				mgr.Connectivity = config.ConnectivityPrivateIp
+			})
+
+			It("peers the migration job with the network of the instances, which are reached on their private ips", func() {
+				onNetwork("my-app", network)
+				onNetwork("my-app-pg16", network)
+
+				_, err := migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(backend.MigrationJobs[jobName].VpcPeeringConnectivity).To(Equal(&datamigration.VpcPeeringConnectivity{Vpc: network}))
+				Expect(backend.MigrationJobs[jobName].StaticIpConnectivity).To(BeNil())
+				profile := backend.ConnectionProfiles[parent+"/connectionProfiles/source-my-app"].GetPostgresql()
+				Expect(profile.GetHost()).To(Equal("10.1.0.1"))
+				Expect(profile.GetConnectivity()).To(BeNil())
+			})
+
+			DescribeTable("refuses instances that are not on the same private network",
+				func(targetNetwork, message string) {
+					onNetwork("my-app", network)
+					onNetwork("my-app-pg16", targetNetwork)
+
+					_, err := migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+					Expect(err).To(MatchError(ContainSubstring(message)))
+					Expect(backend.Calls).To(BeEmpty())
+				},
+				Entry("without a private network", "", "instance my-app-pg16 is not on a private network"),
+				Entry("on another network", "projects/other/global/networks/other-vpc", "target instance my-app-pg16 on projects/other/global/networks/other-vpc"),
+			)
+		})
+	})
+
+	Describe("StartMigrationJob", func() {
+		It("starts the migration job", func() {
+			backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "NOT_STARTED"}
+
+			Expect(migration.StartMigrationJob(ctx, jobName, mgr)).To(Succeed())
+
+			job, err := migration.GetMigrationJob(ctx, "my-app-my-app-pg16", gcpProject, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.State).To(Equal("RUNNING"))
+		})
+	})
+
+	Describe("DeleteMigrationJob", func() {
+		It("succeeds when there is no migration job", func() {
+			Expect(migration.DeleteMigrationJob(ctx, "my-app-my-app-pg16", gcpProject, mgr)).To(Succeed())
+			Expect(backend.Calls).To(BeEmpty())
+		})
+	})
+})
@@ -3,6 +3,7 @@ package netpol
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/nais/liberator/pkg/namegen"
@@ -23,15 +24,27 @@ func CreateNetworkPolicy(ctx context.Context, cfg *config.Config, source *resolv
 		return nil
 	}
 
-	var err error
+	name, err := Name(cfg, target.Name)
+	if err != nil {
+		return err
+	}
 
-	name := fmt.Sprintf("migration-%s-%s", cfg.ApplicationName, target.Name)
-	maxlen := validation.DNS1123LabelMaxLength
-	if len(name) > maxlen {
-		name, err = namegen.ShortName(name, maxlen)
-		if err != nil {
-			return fmt.Errorf("BUG: generating netpol name: %w", err)
+	// The migrator reaches the instances, and whatever it asks for its outgoing ips
+	destinations, err := mgr.Egress.Destinations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find the egress destinations of the migrator: %w", err)
+	}
+	var peers []v1.NetworkPolicyPeer
+	for _, instance := range []*resolved.Instance{source, target} {
+		ip := instance.Ip(mgr.Connectivity)
+		if ip == "" && mgr.Connector != nil {
+			// The connector dials the private ip of an instance without a public ip
+			ip = instance.PrivateIp
 		}
+		peers = append(peers, makeIPBlock(ip))
+	}
+	for _, destination := range destinations {
+		peers = append(peers, makeIPBlock(destination))
 	}
 
 	netpol := &v1.NetworkPolicy{
@@ -52,14 +65,7 @@ func CreateNetworkPolicy(ctx context.Context, cfg *config.Config, source *resolv
 				},
 			},
 			Egress: []v1.NetworkPolicyEgressRule{{
-				To: []v1.NetworkPolicyPeer{
-					makeIPBlock(source.PrimaryIp),
-					makeIPBlock(target.PrimaryIp),
-					// IPs for api.ipify.org
-					makeIPBlock("104.26.13.205"),
-					makeIPBlock("104.26.12.205"),
-					makeIPBlock("172.67.74.152"),
-				},
+				To: peers,
 			}},
 			PolicyTypes: []v1.PolicyType{v1.PolicyTypeEgress},
 		},
@@ -82,10 +88,28 @@ func CreateNetworkPolicy(ctx context.Context, cfg *config.Config, source *resolv
 	return nil
 }
 
+// Name is the name of the network policy letting the migration job reach the instances
+func Name(cfg *config.Config, targetName string) (string, error) {
+	name := fmt.Sprintf("migration-%s-%s", cfg.ApplicationName, targetName)
+	maxlen := validation.DNS1123LabelMaxLength
+	if len(name) > maxlen {
+		var err error
+		name, err = namegen.ShortName(name, maxlen)
+		if err != nil {
+			return "", fmt.Errorf("BUG: generating netpol name: %w", err)
+		}
+	}
+	return name, nil
+}
+
 func makeIPBlock(ip string) v1.NetworkPolicyPeer {
+	cidr := fmt.Sprintf("%s/32", ip)
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		cidr = fmt.Sprintf("%s/128", ip)
+	}
 	return v1.NetworkPolicyPeer{
 		IPBlock: &v1.IPBlock{
-			CIDR: fmt.Sprintf("%s/32", ip),
+			CIDR: cidr,
 		},
 	}
 }
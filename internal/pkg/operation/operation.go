@@ -0,0 +1,228 @@
+// Package operation tracks long-running operations in the Cloud SQL Admin and Database Migration APIs.
+//
+// Operations can be recorded in the migration state while they are in flight,
+// so that a rerun of a phase can reattach to an operation started by a previous run instead of starting a new one.
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	"github.com/nais/cloudsql-migrator/internal/pkg/wait"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// Error is returned when an operation finishes unsuccessfully
+type Error struct {
+	// Description is what the operation was doing, as given by the caller
+	Description string
+	// Name is the name of the operation in the API
+	Name string
+	// Code is the error code reported by the API
+	Code string
+	// Message is the error message reported by the API
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s operation %s failed: %s: %s", e.Description, e.Name, e.Code, e.Message)
+}
+
+type options struct {
+	cfg *config.Config
+	key string
+}
+
+type Option func(*options)
+
+// Tracked records the operation in the migration state under key until it has finished
+func Tracked(cfg *config.Config, key string) Option {
+	return func(o *options) {
+		o.cfg = cfg
+		o.key = key
+	}
+}
+
+// WaitSqlAdmin waits for a Cloud SQL Admin operation to finish, and returns an *Error if it failed
+func WaitSqlAdmin(ctx context.Context, description string, op *sqladmin.Operation, timeout time.Duration, gcpProject *resolved.GcpProject, mgr *common_main.Manager, opts ...Option) error {
+	return track(ctx, description, op.Name, timeout, mgr, opts, func(ctx context.Context) (bool, error) {
+		if op.Status != "DONE" {
+			// The operation is kept when the status can not be read, to be polled again
+			current, err := mgr.SqlAdmin.Operations.Get(ctx, gcpProject.Id, op.Name)
+			if err != nil {
+				return false, classify.Retry(fmt.Errorf("failed to get status of %s operation: %w", description, err))
+			}
+			op = current
+		}
+		if op.Status != "DONE" {
+			mgr.Status("waiting for operation to complete", "operation", description, "status", op.Status)
+			return false, nil
+		}
+		return true, sqlAdminError(description, op)
+	})
+}
+
+// WaitDatamigration waits for a Database Migration operation to finish, and returns an *Error if it failed
+func WaitDatamigration(ctx context.Context, description string, op *datamigration.Operation, timeout time.Duration, mgr *common_main.Manager, opts ...Option) error {
+	return track(ctx, description, op.Name, timeout, mgr, opts, func(ctx context.Context) (bool, error) {
+		if !op.Done {
+			// The operation is kept when the status can not be read, to be polled again
+			current, err := mgr.Datamigration.Operations.Get(ctx, op.Name)
+			if err != nil {
+				return false, classify.Retry(fmt.Errorf("failed to get status of %s operation: %w", description, err))
+			}
+			op = current
+		}
+		if !op.Done {
+			mgr.Status("waiting for operation to complete", "operation", description)
+			return false, nil
+		}
+		return true, datamigrationError(description, op)
+	})
+}
+
+// ResumeSqlAdmin returns the Cloud SQL Admin operation recorded under key, if it is still in flight or has succeeded,
+// so waiting for it finishes what a previous run started. A failed operation is forgotten, to be started again.
+func ResumeSqlAdmin(ctx context.Context, cfg *config.Config, key string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*sqladmin.Operation, error) {
+	name, err := recorded(ctx, cfg, key, mgr)
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	op, err := mgr.SqlAdmin.Operations.Get(ctx, gcpProject.Id, name)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("failed to get recorded operation %s: %w", name, err)
+	}
+	if err != nil || (op.Status == "DONE" && sqlAdminError("", op) != nil) {
+		return nil, forget(ctx, cfg, key, mgr)
+	}
+
+	mgr.Logger.Info("reattaching to operation started by a previous run", "key", key, "name", name)
+	return op, nil
+}
+
+// ResumeDatamigration returns the Database Migration operation recorded under key, if it is still in flight or has
+// succeeded, so waiting for it finishes what a previous run started. A failed operation is forgotten, to be started again.
+func ResumeDatamigration(ctx context.Context, cfg *config.Config, key string, mgr *common_main.Manager) (*datamigration.Operation, error) {
+	name, err := recorded(ctx, cfg, key, mgr)
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	op, err := mgr.Datamigration.Operations.Get(ctx, name)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("failed to get recorded operation %s: %w", name, err)
+	}
+	if err != nil || (op.Done && datamigrationError("", op) != nil) {
+		return nil, forget(ctx, cfg, key, mgr)
+	}
+
+	mgr.Logger.Info("reattaching to operation started by a previous run", "key", key, "name", name)
+	return op, nil
+}
+
+func track(ctx context.Context, description, name string, timeout time.Duration, mgr *common_main.Manager, opts []Option, done func(ctx context.Context) (bool, error)) error {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.cfg != nil {
+		err := state.Update(ctx, o.cfg, mgr, func(st *state.State) error {
+			if st.Operations == nil {
+				st.Operations = make(map[string]string)
+			}
+			st.Operations[o.key] = name
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record %s operation: %w", description, err)
+		}
+	}
+
+	start := time.Now()
+	err := wait.Until(ctx, timeout, done)
+	if err != nil {
+		var opErr *Error
+		if !errors.As(err, &opErr) {
+			// The operation may still be running, keep it recorded so a rerun can reattach to it
+			return fmt.Errorf("failed waiting for %s operation %s: %w", description, name, err)
+		}
+	}
+	mgr.Logger.Info("operation finished", "operation", description, "name", name, "duration", time.Since(start).Round(time.Second), "failed", err != nil)
+
+	if o.cfg != nil {
+		forgetErr := forget(ctx, o.cfg, o.key, mgr)
+		if forgetErr != nil {
+			return errors.Join(err, forgetErr)
+		}
+	}
+	return err
+}
+
+func recorded(ctx context.Context, cfg *config.Config, key string, mgr *common_main.Manager) (string, error) {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return "", err
+	}
+	return st.Operations[key], nil
+}
+
+func forget(ctx context.Context, cfg *config.Config, key string, mgr *common_main.Manager) error {
+	err := state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		delete(st.Operations, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove recorded operation %s: %w", key, err)
+	}
+	return nil
+}
+
+func sqlAdminError(description string, op *sqladmin.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+
+	errorCodes := make([]string, 0, len(op.Error.Errors))
+	messages := make([]string, 0, len(op.Error.Errors))
+	for _, e := range op.Error.Errors {
+		errorCodes = append(errorCodes, e.Code)
+		messages = append(messages, e.Message)
+	}
+	return &Error{
+		Description: description,
+		Name:        op.Name,
+		Code:        strings.Join(errorCodes, ", "),
+		Message:     strings.Join(messages, "; "),
+	}
+}
+
+func datamigrationError(description string, op *datamigration.Operation) error {
+	if op.Error == nil {
+		return nil
+	}
+	return &Error{
+		Description: description,
+		Name:        op.Name,
+		Code:        codes.Code(op.Error.Code).String(),
+		Message:     op.Error.Message,
+	}
+}
+
+func isNotFound(err error) bool {
+	var ae *googleapi.Error
+	return errors.As(err, &ae) && ae.Code == http.StatusNotFound
+}
@@ -0,0 +1,239 @@
+package operation_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp"
+	"github.com/nais/cloudsql-migrator/internal/pkg/operation"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/datamigration/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sqladmin/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// apiError is a queued response failing with the status code
+type apiError int
+
+// fakeApi responds to each path with the queued responses in order, repeating the last one
+type fakeApi struct {
+	mu        sync.Mutex
+	responses map[string][]any
+}
+
+func (f *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	queue := f.responses[r.URL.Path]
+	if len(queue) == 0 {
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		return
+	}
+	response := queue[0]
+	if len(queue) > 1 {
+		f.responses[r.URL.Path] = queue[1:]
+	}
+	if code, ok := response.(apiError); ok {
+		http.Error(w, fmt.Sprintf(`{"error": {"code": %d, "message": "%s"}}`, code, http.StatusText(int(code))), int(code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+var _ = Describe("Operation", func() {
+	var ctx context.Context
+	var api *fakeApi
+	var mgr *common_main.Manager
+	var cfg *config.Config
+	gcpProject := &resolved.GcpProject{Id: "my-project", Location: "europe-north1"}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		DeferCleanup(cancel)
+
+		api = &fakeApi{responses: map[string][]any{}}
+		server := httptest.NewServer(api)
+		DeferCleanup(server.Close)
+
+		sqlAdminService, err := sqladmin.NewService(ctx, option.WithEndpoint(server.URL), option.WithoutAuthentication())
+		Expect(err).NotTo(HaveOccurred())
+		datamigrationService, err := datamigration.NewService(ctx, option.WithEndpoint(server.URL), option.WithoutAuthentication())
+		Expect(err).NotTo(HaveOccurred())
+
+		mgr = &common_main.Manager{
+			Logger:        slog.New(slog.DiscardHandler),
+			SqlAdmin:      gcp.NewSqlAdmin(sqlAdminService),
+			Datamigration: gcp.NewDatamigration(datamigrationService, nil),
+			K8sClient:     fake.NewClientset(),
+		}
+		cfg = &config.Config{ApplicationName: "my-app", Namespace: "my-team"}
+	})
+
+	Describe("WaitSqlAdmin", func() {
+		const path = "/v1/projects/my-project/operations/op-1"
+
+		It("waits until the operation is done", func() {
+			api.responses[path] = []any{
+				sqladmin.Operation{Name: "op-1", Status: "RUNNING"},
+				sqladmin.Operation{Name: "op-1", Status: "DONE"},
+			}
+
+			err := operation.WaitSqlAdmin(ctx, "backup", &sqladmin.Operation{Name: "op-1", Status: "PENDING"}, 10*time.Second, gcpProject, mgr)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns the error of a failed operation", func() {
+			api.responses[path] = []any{
+				sqladmin.Operation{Name: "op-1", Status: "DONE", Error: &sqladmin.OperationErrors{
+					Errors: []*sqladmin.OperationError{{Code: "INTERNAL_ERROR", Message: "backup failed"}},
+				}},
+			}
+
+			err := operation.WaitSqlAdmin(ctx, "backup", &sqladmin.Operation{Name: "op-1", Status: "PENDING"}, 10*time.Second, gcpProject, mgr)
+			var opErr *operation.Error
+			Expect(err).To(BeAssignableToTypeOf(opErr))
+			Expect(err.(*operation.Error).Code).To(Equal("INTERNAL_ERROR"))
+			Expect(err.(*operation.Error).Message).To(Equal("backup failed"))
+		})
+
+		It("polls again when getting the status fails with a transient error", func() {
+			api.responses[path] = []any{
+				apiError(http.StatusServiceUnavailable),
+				sqladmin.Operation{Name: "op-1", Status: "DONE"},
+			}
+
+			err := operation.WaitSqlAdmin(ctx, "backup", &sqladmin.Operation{Name: "op-1", Status: "PENDING"}, 10*time.Second, gcpProject, mgr)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fails at once when it is not allowed to get the status", func() {
+			api.responses[path] = []any{
+				apiError(http.StatusForbidden),
+				sqladmin.Operation{Name: "op-1", Status: "DONE"},
+			}
+
+			start := time.Now()
+			err := operation.WaitSqlAdmin(ctx, "backup", &sqladmin.Operation{Name: "op-1", Status: "PENDING"}, 10*time.Second, gcpProject, mgr)
+			Expect(classify.Is(err, classify.Forbidden)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+
+		It("records the operation until it has finished", func() {
+			api.responses[path] = []any{
+				sqladmin.Operation{Name: "op-1", Status: "RUNNING"},
+			}
+
+			shortCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer cancel()
+			err := operation.WaitSqlAdmin(shortCtx, "backup", &sqladmin.Operation{Name: "op-1", Status: "PENDING"}, 10*time.Second, gcpProject, mgr, operation.Tracked(cfg, "backup/my-instance"))
+			Expect(err).To(HaveOccurred())
+
+			op, err := operation.ResumeSqlAdmin(ctx, cfg, "backup/my-instance", gcpProject, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op).NotTo(BeNil())
+			Expect(op.Name).To(Equal("op-1"))
+
+			api.responses[path] = []any{
+				sqladmin.Operation{Name: "op-1", Status: "DONE"},
+			}
+			err = operation.WaitSqlAdmin(ctx, "backup", op, 10*time.Second, gcpProject, mgr, operation.Tracked(cfg, "backup/my-instance"))
+			Expect(err).NotTo(HaveOccurred())
+
+			st, err := state.Load(ctx, cfg, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.Operations).To(BeEmpty())
+		})
+	})
+
+	Describe("WaitDatamigration", func() {
+		const name = "projects/my-project/locations/europe-north1/operations/op-2"
+
+		It("returns the error of a failed operation", func() {
+			api.responses["/v1/"+name] = []any{
+				datamigration.Operation{Name: name, Done: true, Error: &datamigration.Status{Code: 9, Message: "not ready"}},
+			}
+
+			err := operation.WaitDatamigration(ctx, "promote", &datamigration.Operation{Name: name}, 10*time.Second, mgr)
+			var opErr *operation.Error
+			Expect(err).To(BeAssignableToTypeOf(opErr))
+			Expect(err.(*operation.Error).Code).To(Equal("FailedPrecondition"))
+		})
+
+		It("polls again when getting the status fails with a transient error", func() {
+			api.responses["/v1/"+name] = []any{
+				apiError(http.StatusTooManyRequests),
+				datamigration.Operation{Name: name, Done: true},
+			}
+
+			err := operation.WaitDatamigration(ctx, "promote", &datamigration.Operation{Name: name}, 10*time.Second, mgr)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("ResumeSqlAdmin", func() {
+		It("returns nothing when no operation is recorded", func() {
+			op, err := operation.ResumeSqlAdmin(ctx, cfg, "backup/my-instance", gcpProject, mgr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op).To(BeNil())
+		})
+
+		When("an operation is recorded", func() {
+			const path = "/v1/projects/my-project/operations/op-1"
+
+			BeforeEach(func() {
+				Expect(state.Update(ctx, cfg, mgr, func(st *state.State) error {
+					st.Operations = map[string]string{"backup/my-instance": "op-1"}
+					return nil
+				})).To(Succeed())
+			})
+
+			It("returns the operation when it has succeeded, so it is not started again", func() {
+				api.responses[path] = []any{
+					sqladmin.Operation{Name: "op-1", Status: "DONE"},
+				}
+
+				op, err := operation.ResumeSqlAdmin(ctx, cfg, "backup/my-instance", gcpProject, mgr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op).NotTo(BeNil())
+				err = operation.WaitSqlAdmin(ctx, "backup", op, 10*time.Second, gcpProject, mgr, operation.Tracked(cfg, "backup/my-instance"))
+				Expect(err).NotTo(HaveOccurred())
+
+				st, err := state.Load(ctx, cfg, mgr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(st.Operations).To(BeEmpty())
+			})
+
+			It("forgets the operation when it has failed, so it is started again", func() {
+				api.responses[path] = []any{
+					sqladmin.Operation{Name: "op-1", Status: "DONE", Error: &sqladmin.OperationErrors{
+						Errors: []*sqladmin.OperationError{{Code: "INTERNAL_ERROR", Message: "backup failed"}},
+					}},
+				}
+
+				op, err := operation.ResumeSqlAdmin(ctx, cfg, "backup/my-instance", gcpProject, mgr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op).To(BeNil())
+
+				st, err := state.Load(ctx, cfg, mgr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(st.Operations).To(BeEmpty())
+			})
+		})
+	})
+})
@@ -0,0 +1,146 @@
+package phase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/application"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/lock"
+	"github.com/nais/cloudsql-migrator/internal/pkg/migration"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Finalize removes the source instance and the other resources only needed during the migration.
+// A failing step exits the process with the exit code of that step.
+func Finalize(ctx context.Context, cfg *config.FinalizeConfig, mgr *common_main.Manager) {
+	ctx, migrationLock, err := lock.Acquire(ctx, &cfg.Config, "finalize", mgr)
+	if err != nil {
+		mgr.Fail(17, "Failed to acquire migration lock", "error", err)
+	}
+	defer migrationLock.Release()
+
+	// The migrationStepsTotal must be updated if the number of steps in the finalize process changes
+	// Used by nais-cli to show progressbar
+	mgr.Started(14, "Finalize started", "config", *cfg)
+
+	mgr.Step(1, "Resolving GCP project ID")
+	gcpProject, err := resolved.ResolveGcpProject(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(3, "Failed to resolve GCP project ID", "error", err)
+	}
+
+	mgr.Step(2, "Getting application", "name", cfg.ApplicationName)
+	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(4, "Failed to get application", "error", err)
+	}
+
+	mgr.Step(3, "Resolving target instance")
+	target, err := resolved.ResolveInstance(ctx, app, mgr)
+	if err != nil {
+		mgr.Fail(5, "Failed to resolve target", "error", err)
+	}
+
+	if target.Name == cfg.SourceInstanceName {
+		mgr.Fail(14, "Application is using the source instance, refusing to delete it", "instance", target.Name)
+	}
+
+	err = resolved.ResolveCleanupLocation(ctx, &cfg.Config, gcpProject, mgr, cfg.SourceInstanceName, target.Name)
+	if err != nil {
+		mgr.Fail(20, "Failed to resolve location of the migration", "error", err)
+	}
+
+	// The application spec is expected to have been updated by the team after promotion, so changes to the instance are allowed
+	_, err = application.ReconcileDrift(ctx, &cfg.Config, app, mgr, true)
+	if err != nil {
+		mgr.Fail(15, "Failed to check application for changes", "error", err)
+	}
+
+	migrationName, err := resolved.MigrationName(cfg.SourceInstanceName, target.Name)
+	if err != nil {
+		mgr.Fail(6, "Failed to resolve migration name", "error", err)
+	}
+
+	mgr.Step(4, "Deleting migration job")
+	err = migration.DeleteMigrationJob(ctx, migrationName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(7, "Failed to delete migration job", "error", err)
+	}
+
+	mgr.Step(5, "Cleaning up connection profiles")
+	err = instance.CleanupConnectionProfiles(ctx, &cfg.Config, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(8, "Failed to cleanup connection profiles", "error", err)
+	}
+
+	mgr.Step(6, "Deleting master instance")
+	masterInstanceName := fmt.Sprintf("%s-master", target.Name)
+	err = instance.DeleteInstance(ctx, masterInstanceName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(9, "Failed to delete master instance", "error", err)
+	}
+
+	mgr.Step(7, "Deleting source instance")
+	err = instance.DeleteInstance(ctx, cfg.SourceInstanceName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(10, "Failed to delete source instance", "error", err)
+	}
+
+	mgr.Step(8, "Removing authorized networks added by the migrator")
+	err = instance.RemoveAuthNetworks(ctx, &cfg.Config, []string{cfg.SourceInstanceName, target.Name}, mgr)
+	if err != nil {
+		mgr.Fail(11, "Failed to remove authorized networks", "error", err)
+	}
+
+	mgr.Step(9, "Verifying that no authorized networks of the migrator remain")
+	err = instance.VerifyAuthNetworks(ctx, []string{cfg.SourceInstanceName, target.Name}, mgr)
+	if err != nil {
+		mgr.Fail(19, "Authorized networks of the migrator remain", "error", err)
+	}
+
+	mgr.Step(10, "Deleting SQL SSL Certificates used during migration")
+	err = mgr.SqlSslCertClient.DeleteCollection(ctx, v1.ListOptions{
+		LabelSelector: "migrator.nais.io/finalize=" + cfg.ApplicationName,
+	})
+	if err != nil {
+		mgr.Fail(12, "Failed to delete SQL SSL Certificates", "error", err)
+	}
+
+	mgr.Step(11, "Deleting Network Policy used during migration")
+	err = mgr.K8sClient.NetworkingV1().NetworkPolicies(cfg.Namespace).DeleteCollection(ctx, v1.DeleteOptions{}, v1.ListOptions{
+		LabelSelector: "migrator.nais.io/finalize=" + cfg.ApplicationName,
+	})
+	if err != nil {
+		mgr.Fail(13, "Failed to delete Network Policy", "error", err)
+	}
+
+	// The migration state records the instances with a postgres password set by the migrator until it is rotated,
+	// not the passwords, so what is checked is that every password the migrator has set has been rotated
+	mgr.Step(12, "Rotating postgres passwords the migrator has set and not rotated")
+	knownPasswords, err := database.KnownPasswords(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(18, "Failed to read the postgres passwords the migrator has set from the migration state", "error", err)
+	}
+	if len(knownPasswords) > 0 {
+		// Promote rotates the passwords, unless it was stopped before it got that far
+		mgr.Logger.Warn("postgres passwords known by the migrator are still in use, rotating them", "instances", knownPasswords)
+		err = database.RotatePostgresPasswords(ctx, &cfg.Config, gcpProject, mgr)
+		if err != nil {
+			mgr.Fail(21, "Failed to rotate postgres passwords", "error", err)
+		}
+	}
+
+	mgr.Step(13, "Deleting migration state")
+	err = state.Delete(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(16, "Failed to delete migration state", "error", err)
+	}
+
+	mgr.Done(14, "Finalize completed")
+}
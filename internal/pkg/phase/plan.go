@@ -0,0 +1,31 @@
+package phase
+
+import (
+	"context"
+	"os"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/plan"
+)
+
+// Plan writes what setup will do to stdout, without changing anything
+func Plan(ctx context.Context, cfg *config.PlanCommandConfig, mgr *common_main.Manager) {
+	if cfg.Output != config.OutputText && cfg.Output != config.OutputJSON {
+		mgr.Fail(1, "unknown output format "+cfg.Output)
+	}
+
+	p, err := plan.Setup(ctx, &cfg.Config, SetupSteps(), mgr)
+	if err != nil {
+		mgr.Fail(1, "failed to make plan", "error", err)
+	}
+
+	if cfg.Output == config.OutputJSON {
+		err = p.WriteJSON(os.Stdout)
+	} else {
+		err = p.WriteText(os.Stdout)
+	}
+	if err != nil {
+		mgr.Fail(2, "failed to write plan", "error", err)
+	}
+}
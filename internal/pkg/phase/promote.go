@@ -0,0 +1,192 @@
+package phase
+
+import (
+	"context"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/application"
+	"github.com/nais/cloudsql-migrator/internal/pkg/backup"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/lock"
+	"github.com/nais/cloudsql-migrator/internal/pkg/promote"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Promote promotes the target instance and moves the application over to it.
+// A failing step exits the process with the exit code of that step.
+func Promote(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) {
+	ctx, migrationLock, err := lock.Acquire(ctx, cfg, "promote", mgr)
+	if err != nil {
+		mgr.Fail(26, "Failed to acquire migration lock", "error", err)
+	}
+	defer migrationLock.Release()
+
+	// The migrationStepsTotal must be updated if the number of steps in the promote process changes
+	// Used by nais-cli to show progressbar
+	mgr.Started(21, "Promote started", "config", cfg)
+
+	mgr.Step(1, "Resolving GCP project ID")
+	gcpProject, err := resolved.ResolveGcpProject(ctx, cfg, mgr)
+	if err != nil {
+		mgr.Fail(3, "Failed to resolve GCP project ID", "error", err)
+	}
+
+	mgr.Step(2, "Getting application", "name", cfg.ApplicationName)
+	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(4, "Failed to get application", "error", err)
+	}
+
+	app, err = application.ReconcileDrift(ctx, cfg, app, mgr, cfg.Verification.AllowInstanceChanges)
+	if err != nil {
+		mgr.Fail(25, "Application has changed since setup", "error", err)
+	}
+
+	helperName, err := common_main.HelperName(cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(5, "Failed to get helper name", "error", err)
+	}
+
+	mgr.Step(3, "Resolving source instance")
+	source, err := resolved.ResolveInstance(ctx, app, mgr)
+	if err != nil {
+		mgr.Fail(6, "Failed to resolve source", "error", err)
+	}
+
+	err = resolved.ResolveLocation(ctx, cfg, gcpProject, mgr, source.Name, cfg.TargetInstance.Name)
+	if err != nil {
+		mgr.Fail(28, "Failed to resolve location of the migration", "error", err)
+	}
+
+	mgr.Step(4, "Resolving database name")
+	databaseName, err := resolved.ResolveDatabaseName(app)
+	if err != nil {
+		mgr.Fail(7, "Failed to resolve database name", "error", err)
+	}
+
+	mgr.Step(5, "Getting helper application", "name", helperName)
+	helperApp, err := mgr.AppClient.Get(ctx, helperName)
+	if err == nil {
+		mgr.Step(6, "Resolving target instance")
+		target, err := resolved.ResolveInstance(ctx, helperApp, mgr)
+		if err != nil {
+			mgr.Fail(8, "Failed to resolve target", "error", err)
+		}
+
+		mgr.Step(7, "Checking if migration is ready for promotion")
+		err = promote.CheckReadyForPromotion(ctx, cfg, source, target, gcpProject, mgr)
+		if err != nil {
+			mgr.Fail(9, "Migration is not ready for promotion", "error", err)
+		}
+
+		mgr.Step(8, "Scaling down application")
+		err = application.ScaleApplication(ctx, cfg, mgr, 0)
+		if err != nil {
+			mgr.Fail(10, "Failed to scale application", "error", err)
+		}
+
+		mgr.Step(9, "Starting promote of target instance")
+		err = promote.Promote(ctx, cfg, source, target, gcpProject, mgr)
+		if err != nil {
+			mgr.Fail(11, "Failed to promote", "error", err)
+		}
+
+		mgr.Step(10, "Preparing target database")
+		err = database.PrepareTargetDatabase(ctx, cfg, target, gcpProject, mgr)
+		if err != nil {
+			mgr.Fail(12, "Failed to prepare target database", "error", err)
+		}
+
+		mgr.Step(11, "Changing ownership for postgres database")
+		err = database.ChangeOwnership(ctx, mgr, target, config.PostgresDatabaseName)
+		if err != nil {
+			mgr.Fail(13, "Failed to change ownership for database", "databaseName", config.PostgresDatabaseName, "error", err)
+		}
+
+		mgr.Step(12, "Changing ownership for application database")
+		err = database.ChangeOwnership(ctx, mgr, target, databaseName)
+		if err != nil {
+			mgr.Fail(14, "Failed to change ownership for database", "databaseName", databaseName, "error", err)
+		}
+
+		mgr.Step(13, "Deleting helper application")
+		err = application.DeleteHelperApplication(ctx, cfg, mgr)
+		if err != nil {
+			mgr.Fail(15, "Failed to delete helper application", "error", err)
+		}
+	} else if errors.IsNotFound(err) {
+		mgr.Skip(6, 13, "Helper application is gone, skipping previously completed steps")
+	} else {
+		mgr.Fail(16, "Failed to get helper application", "error", err)
+	}
+
+	mgr.Step(14, "Deleting target database resource")
+	err = database.DeleteTargetDatabaseResource(ctx, cfg, mgr)
+	if err != nil {
+		mgr.Fail(17, "Failed to delete target database resource", "error", err)
+	}
+
+	mgr.Step(15, "Waiting for cnrm resources to go away")
+	err = instance.WaitForCnrmResourcesToGoAway(ctx, cfg.TargetInstance.Name, cfg.ApplicationName, mgr)
+	if err != nil {
+		mgr.Fail(18, "Helper instance definition is stuck", "error", err)
+	}
+
+	verifySecretKeys := cfg.TargetInstance.PreserveEnvVarNames && cfg.Verification.SecretKeys
+	var previousSecretKeys []string
+	if verifySecretKeys {
+		previousSecretKeys, err = application.RecordedSecretKeys(ctx, cfg, app, mgr)
+		if err != nil {
+			mgr.Fail(23, "Failed to get recorded database secret keys", "error", err)
+		}
+
+		err = application.VerifySecretKeysWillBePreserved(previousSecretKeys, &cfg.TargetInstance, app, mgr)
+		if err != nil {
+			mgr.Fail(24, "Database environment variable names would not be preserved", "error", err)
+		}
+	}
+
+	mgr.Step(16, "Updating application")
+	app, err = application.UpdateApplicationInstance(ctx, cfg, &cfg.TargetInstance, mgr)
+	if err != nil {
+		mgr.Fail(19, "Failed to update application", "error", err)
+	}
+
+	mgr.Step(17, "Resolving updated target")
+	target, err := resolved.ResolveInstance(ctx, app, mgr)
+	if err != nil {
+		mgr.Fail(20, "Failed to resolve updated target", "error", err)
+	}
+
+	// Catches names changed by an earlier promote that moved the application and was stopped before this check
+	if verifySecretKeys {
+		mgr.Logger.Info("checking database secret keys after the switch")
+		err = application.VerifySecretKeysPreserved(ctx, previousSecretKeys, app, mgr)
+		if err != nil {
+			mgr.Fail(24, "Database environment variable names were not preserved", "error", err)
+		}
+	}
+
+	mgr.Step(18, "Updating application user")
+	err = application.UpdateApplicationUser(ctx, target, gcpProject, app, mgr)
+	if err != nil {
+		mgr.Fail(21, "Failed to update application user", "error", err)
+	}
+
+	mgr.Step(19, "Creating backup")
+	err = backup.CreateBackup(ctx, cfg, target.Name, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(22, "Failed to create backup", "error", err)
+	}
+
+	mgr.Step(20, "Rotating postgres passwords")
+	err = database.RotatePostgresPasswords(ctx, cfg, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(27, "Failed to rotate postgres passwords", "error", err)
+	}
+
+	mgr.Done(21, "Promote completed")
+}
@@ -0,0 +1,177 @@
+package phase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/application"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/lock"
+	"github.com/nais/cloudsql-migrator/internal/pkg/migration"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Rollback moves the application back to the source instance after a promotion.
+// A failing step exits the process with the exit code of that step.
+func Rollback(ctx context.Context, cfg *config.RollbackConfig, mgr *common_main.Manager) {
+	ctx, migrationLock, err := lock.Acquire(ctx, &cfg.Config, "rollback", mgr)
+	if err != nil {
+		mgr.Fail(22, "Failed to acquire migration lock", "error", err)
+	}
+	defer migrationLock.Release()
+
+	// The migrationStepsTotal must be updated if the number of steps in the rollback process changes
+	// Used by nais-cli to show progressbar
+	mgr.Started(21, "Rollback started", "config", *cfg)
+
+	mgr.Step(1, "Getting application", "name", cfg.ApplicationName)
+	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(3, "Failed to get application", "error", err)
+	}
+
+	// Rolling back restores the source instance regardless, so changes are reported but not refused
+	app, err = application.ReconcileDrift(ctx, &cfg.Config, app, mgr, true)
+	if err != nil {
+		mgr.Fail(20, "Failed to check application for changes", "error", err)
+	}
+
+	if app.Spec.GCP.SqlInstances[0].Name != cfg.SourceInstance.Name {
+		// We only need to scale down if we are making changes to the instance the application currently uses
+		mgr.Step(2, "Scaling down application")
+		err = application.ScaleApplication(ctx, &cfg.Config, mgr, 0)
+		if err != nil {
+			mgr.Fail(4, "Failed to scale application", "error", err)
+		}
+	}
+
+	mgr.Step(3, "Deleting helper application")
+	err = application.DeleteHelperApplication(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(5, "Failed to delete helper application", "error", err)
+	}
+
+	mgr.Step(4, "Resolving GCP project ID")
+	gcpProject, err := resolved.ResolveGcpProject(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(6, "Failed to resolve GCP project ID", "error", err)
+	}
+
+	err = resolved.ResolveCleanupLocation(ctx, &cfg.Config, gcpProject, mgr, cfg.SourceInstance.Name, cfg.TargetInstance.Name)
+	if err != nil {
+		mgr.Fail(26, "Failed to resolve location of the migration", "error", err)
+	}
+
+	migrationName, err := resolved.MigrationName(cfg.SourceInstance.Name, cfg.TargetInstance.Name)
+	if err != nil {
+		mgr.Fail(7, "Failed to resolve migration name", "error", err)
+	}
+
+	mgr.Step(5, "Deleting migration job")
+	err = migration.DeleteMigrationJob(ctx, migrationName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(8, "Failed to delete migration job", "error", err)
+	}
+
+	mgr.Step(6, "Cleaning up connection profiles")
+	err = instance.CleanupConnectionProfiles(ctx, &cfg.Config, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(9, "Failed to cleanup connection profiles", "error", err)
+	}
+
+	mgr.Step(7, "Deleting target instance")
+	err = instance.DeleteInstance(ctx, cfg.TargetInstance.Name, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(10, "Failed to delete target instance", "error", err)
+	}
+
+	mgr.Step(8, "Deleting master instance")
+	masterInstanceName := fmt.Sprintf("%s-master", cfg.TargetInstance.Name)
+	err = instance.DeleteInstance(ctx, masterInstanceName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(11, "Failed to delete master instance", "error", err)
+	}
+
+	mgr.Step(9, "Deleting target database resource")
+	err = database.DeleteTargetDatabaseResource(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(12, "Failed to delete target database resource", "error", err)
+	}
+
+	mgr.Step(10, "Deleting old ssl certificate")
+	err = instance.DeleteSslCertByCommonName(ctx, cfg.SourceInstance.Name, cfg.ApplicationName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(13, "Failed to delete old ssl certificate", "error", err)
+	}
+
+	mgr.Step(11, "Waiting for sqldatabase resource to go away")
+	err = instance.WaitForSQLDatabaseResourceToGoAway(ctx, cfg.ApplicationName, mgr)
+	if err != nil {
+		mgr.Fail(14, "Sqldatabase is stuck", "error", err)
+	}
+
+	mgr.Step(12, "Updating application")
+	app, err = application.UpdateApplicationInstance(ctx, &cfg.Config, &cfg.SourceInstance, mgr)
+	if err != nil {
+		mgr.Fail(15, "Failed to update application", "error", err)
+	}
+
+	mgr.Step(13, "Resolving updated target")
+	source, err := resolved.ResolveInstance(ctx, app, mgr)
+	if err != nil {
+		mgr.Fail(16, "Failed to resolve updated target", "error", err)
+	}
+
+	mgr.Step(14, "Updating application user")
+	err = application.UpdateApplicationUser(ctx, source, gcpProject, app, mgr)
+	if err != nil {
+		mgr.Fail(17, "Failed to update application user", "error", err)
+	}
+
+	mgr.Step(15, "Deleting SQL SSL Certificates used during migration")
+	err = mgr.SqlSslCertClient.DeleteCollection(ctx, v1.ListOptions{
+		LabelSelector: "migrator.nais.io/finalize=" + cfg.ApplicationName,
+	})
+	if err != nil {
+		mgr.Fail(18, "Failed to delete SQL SSL Certificates", "error", err)
+	}
+
+	mgr.Step(16, "Deleting Network Policy used during migration")
+	err = mgr.K8sClient.NetworkingV1().NetworkPolicies(cfg.Namespace).DeleteCollection(ctx, v1.DeleteOptions{}, v1.ListOptions{
+		LabelSelector: "migrator.nais.io/finalize=" + cfg.ApplicationName,
+	})
+	if err != nil {
+		mgr.Fail(19, "Failed to delete Network Policy", "error", err)
+	}
+
+	mgr.Step(17, "Removing authorized networks added by the migrator")
+	err = instance.RemoveAuthNetworks(ctx, &cfg.Config, []string{cfg.SourceInstance.Name, cfg.TargetInstance.Name}, mgr)
+	if err != nil {
+		mgr.Fail(24, "Failed to remove authorized networks", "error", err)
+	}
+
+	mgr.Step(18, "Verifying that no authorized networks of the migrator remain")
+	err = instance.VerifyAuthNetworks(ctx, []string{cfg.SourceInstance.Name, cfg.TargetInstance.Name}, mgr)
+	if err != nil {
+		mgr.Fail(25, "Authorized networks of the migrator remain", "error", err)
+	}
+
+	mgr.Step(19, "Rotating postgres passwords")
+	err = database.RotatePostgresPasswords(ctx, &cfg.Config, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(23, "Failed to rotate postgres passwords", "error", err)
+	}
+
+	mgr.Step(20, "Deleting migration state")
+	err = state.Delete(ctx, &cfg.Config, mgr)
+	if err != nil {
+		mgr.Fail(21, "Failed to delete migration state", "error", err)
+	}
+
+	mgr.Done(21, "Rollback completed")
+}
@@ -0,0 +1,241 @@
+package phase
+
+import (
+	"context"
+	"slices"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/application"
+	"github.com/nais/cloudsql-migrator/internal/pkg/backup"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/database"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/lock"
+	"github.com/nais/cloudsql-migrator/internal/pkg/migration"
+	"github.com/nais/cloudsql-migrator/internal/pkg/netpol"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+)
+
+// setupSteps describes the numbered steps of setup, also listed by the plan command
+var setupSteps = [...]string{
+	1:  "Resolving GCP project ID",
+	2:  "Getting application",
+	3:  "Resolving source instance",
+	4:  "Resolving database name",
+	5:  "Validating source instance eligibility",
+	6:  "Creating target instance",
+	7:  "Deleting database from intended target instance",
+	8:  "Creating backup",
+	9:  "Disabling cascading delete",
+	10: "Creating network policy",
+	11: "Preparing source instance",
+	12: "Preparing source database",
+	13: "Preparing target instance",
+	14: "Preparing target database",
+	15: "Setting up migration",
+	16: "Getting helper application",
+	17: "Resolving target instance after preparations",
+	18: "Updating authorized networks for source instance",
+	19: "Starting migration",
+	20: "Setup completed",
+}
+
+// SetupSteps returns the descriptions of the steps of setup, in order
+func SetupSteps() []string {
+	return slices.Clone(setupSteps[1:])
+}
+
+// Setup creates the target instance and starts replicating from the source instance.
+// A failing step exits the process with the exit code of that step.
+func Setup(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) {
+	ctx, migrationLock, err := lock.Acquire(ctx, cfg, "setup", mgr)
+	if err != nil {
+		mgr.Fail(25, "failed to acquire migration lock", "error", err)
+	}
+	defer migrationLock.Release()
+
+	// The number of steps is used by nais-cli to show progressbar
+	mgr.Started(len(setupSteps)-1, "Setup started", "config", cfg)
+
+	mgr.Step(1, setupSteps[1])
+	gcpProject, err := resolved.ResolveGcpProject(ctx, cfg, mgr)
+	if err != nil {
+		mgr.Fail(3, "failed to resolve GCP project ID", "error", err)
+	}
+
+	mgr.Step(2, setupSteps[2])
+	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(4, "failed to get application", "error", err)
+	}
+
+	mgr.Step(3, setupSteps[3])
+	source, err := resolved.ResolveInstance(ctx, app, mgr)
+	if err != nil {
+		mgr.Fail(5, "failed to resolve source", "error", err)
+	}
+
+	if source.Name == cfg.TargetInstance.Name {
+		mgr.Fail(6, "source and target instance cannot be the same")
+	}
+
+	err = resolved.ResolveLocation(ctx, cfg, gcpProject, mgr, source.Name, cfg.TargetInstance.Name)
+	if err != nil {
+		mgr.Fail(26, "failed to resolve location of the migration", "error", err)
+	}
+
+	// The target is created in the region of the cluster, so it is checked before the target is created
+	err = resolved.CheckClusterRegion(ctx, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(29, "cluster is not in the location of the migration", "error", err)
+	}
+
+	err = resolved.RecordLocation(ctx, cfg, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(27, "failed to record location of the migration", "error", err)
+	}
+
+	mgr.Step(4, setupSteps[4])
+	databaseName, err := resolved.ResolveDatabaseName(app)
+	if err != nil {
+		mgr.Fail(7, "failed to resolve database name", "error", err)
+	}
+
+	mgr.Step(5, setupSteps[5])
+	err = instance.ValidateSourceInstance(ctx, cfg, app, source, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(8, "source instance is not eligible for migration", "error", err)
+	}
+
+	mgr.Step(6, setupSteps[6])
+	target, err := instance.CreateInstance(ctx, cfg, source, gcpProject, databaseName, mgr)
+	if err != nil {
+		mgr.Fail(9, "failed to create target instance", "error", err)
+	}
+
+	// The region of the cluster is not always known, so the region of the target is checked once it exists
+	recordedLocation := gcpProject.Location
+	err = resolved.ResolveLocation(ctx, cfg, gcpProject, mgr, source.Name, target.Name)
+	if err != nil {
+		mgr.Fail(26, "failed to resolve location of the migration", "error", err)
+	}
+	if gcpProject.Location != recordedLocation {
+		mgr.Fail(26, "location of the migration changed when the target instance was created", "recorded", recordedLocation, "location", gcpProject.Location)
+	}
+
+	mgr.Step(7, setupSteps[7])
+	err = database.DeleteHelperTargetDatabase(ctx, cfg, target, databaseName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(10, "failed to delete database from intended target instance", "error", err)
+	}
+
+	mgr.Step(8, setupSteps[8])
+	err = backup.CreateBackup(ctx, cfg, source.Name, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(11, "Failed to create backup", "error", err)
+	}
+
+	mgr.Step(9, setupSteps[9])
+	app, err = application.DisableCascadingDelete(ctx, cfg, mgr)
+	if err != nil {
+		mgr.Fail(12, "failed to disable cascading delete", "error", err)
+	}
+
+	err = application.RecordFingerprint(ctx, cfg, app, mgr)
+	if err != nil {
+		mgr.Fail(24, "failed to record application fingerprint", "error", err)
+	}
+
+	if cfg.TargetInstance.PreserveEnvVarNames && cfg.Verification.SecretKeys {
+		err = application.RecordSecretKeys(ctx, cfg, app, mgr)
+		if err != nil {
+			mgr.Fail(28, "failed to record database secret keys", "error", err)
+		}
+	}
+
+	mgr.Step(10, setupSteps[10])
+	err = netpol.CreateNetworkPolicy(ctx, cfg, source, target, mgr)
+	if err != nil {
+		mgr.Fail(13, "failed to create network policy", "error", err)
+	}
+
+	mgr.Step(11, setupSteps[11])
+	err = instance.PrepareSourceInstance(ctx, cfg, source, mgr)
+	if err != nil {
+		mgr.Fail(14, "failed to prepare source instance", "error", err)
+	}
+
+	mgr.Step(12, setupSteps[12])
+	err = database.PrepareSourceDatabase(ctx, cfg, source, databaseName, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(15, "failed to prepare source database", "error", err)
+	}
+
+	if instance.HasPgAuditFlags(app.Spec.GCP.SqlInstances[0].Flags) {
+		mgr.Logger.Info("Dropping pgaudit extension from source", "migrationStep", "12b")
+		err = database.DropPgAuditExtension(ctx, source, databaseName, mgr)
+		if err != nil {
+			mgr.Fail(15, "failed to drop pgaudit extension from source", "error", err)
+		}
+	}
+
+	mgr.Step(13, setupSteps[13])
+	err = instance.PrepareTargetInstance(ctx, cfg, target, mgr)
+	if err != nil {
+		mgr.Fail(16, "failed to prepare target instance", "error", err)
+	}
+
+	mgr.Step(14, setupSteps[14])
+	err = database.PrepareTargetDatabase(ctx, cfg, target, gcpProject, mgr)
+	if err != nil {
+		mgr.Fail(17, "failed to prepare target database", "error", err)
+	}
+
+	mgr.Step(15, setupSteps[15])
+	migrationJobName, err := migration.PrepareMigrationJob(ctx, cfg, gcpProject, source, target, mgr)
+	if err != nil {
+		mgr.Fail(18, "failed to prepare migration", "error", err)
+	}
+
+	helperName, err := common_main.HelperName(cfg.ApplicationName)
+	if err != nil {
+		mgr.Fail(19, "Failed to get helper name", "error", err)
+	}
+
+	mgr.Step(16, setupSteps[16], "name", helperName)
+	helperApp, err := mgr.AppClient.Get(ctx, helperName)
+	if err != nil {
+		mgr.Fail(20, "Failed to get helper application", "error", err)
+	}
+
+	// With private connectivity the target reaches the source in their network, not from its outgoing ips
+	privateIp := mgr.Connectivity == config.ConnectivityPrivateIp
+	var required []resolved.Require
+	if !privateIp {
+		required = append(required, resolved.RequireOutgoingIp)
+	}
+
+	mgr.Step(17, setupSteps[17])
+	target, err = resolved.ResolveInstance(ctx, helperApp, mgr, required...)
+	if err != nil {
+		mgr.Fail(21, "Failed to resolve target", "error", err)
+	}
+
+	mgr.Step(18, setupSteps[18])
+	if privateIp {
+		mgr.Logger.Info("the instances are reached on their private ips, no authorized networks are needed")
+	} else {
+		err = instance.AddTargetOutgoingIpsToSourceAuthNetworks(ctx, cfg, source, target, mgr)
+		if err != nil {
+			mgr.Fail(22, "failed to prepare source instance", "error", err)
+		}
+	}
+
+	mgr.Step(19, setupSteps[19])
+	err = migration.StartMigrationJob(ctx, migrationJobName, mgr)
+	if err != nil {
+		mgr.Fail(23, "failed to start migration", "error", err)
+	}
+
+	mgr.Done(20, setupSteps[20])
+}
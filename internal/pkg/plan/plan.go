@@ -0,0 +1,308 @@
+// Package plan describes what setup will do for an application, without changing anything.
+//
+// The plan is made from read calls only: the application, the source instance and the resources setup would create
+// are looked up, and the target instance is defined the same way setup defines it.
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/diff"
+	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
+	"github.com/nais/cloudsql-migrator/internal/pkg/netpol"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Actions setup takes on a resource
+const (
+	Create  = "create"
+	Reuse   = "reuse"
+	Replace = "replace"
+	Update  = "update"
+	Skip    = "skip"
+)
+
+type Plan struct {
+	Application string `json:"application"`
+	Namespace   string `json:"namespace"`
+	Project     string `json:"project"`
+	Location    string `json:"location"`
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	Database    string `json:"database"`
+
+	// TargetSpec is the sql instance the application will use after promotion
+	TargetSpec *nais_io_v1.CloudSqlInstance `json:"targetSpec"`
+	// Changes are the differences between the sql instance of the application and TargetSpec
+	Changes []diff.Change `json:"changes"`
+	// Temporary are the settings of the target instance that are changed while replicating
+	Temporary []string `json:"temporary"`
+
+	Resources          []Resource          `json:"resources"`
+	AuthorizedNetworks []AuthorizedNetwork `json:"authorizedNetworks"`
+	// SourceFlags are the database flags set on the source instance for replication
+	SourceFlags []string `json:"sourceFlags"`
+	Steps       []string `json:"steps"`
+}
+
+// Resource is something setup creates, or reuses from a previous run
+type Resource struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Note   string `json:"note,omitempty"`
+}
+
+// AuthorizedNetwork is an authorized network setup adds to an instance
+type AuthorizedNetwork struct {
+	Instance string `json:"instance"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+// Setup makes the plan for setup, where steps are the descriptions of the steps setup runs
+func Setup(ctx context.Context, cfg *config.Config, steps []string, mgr *common_main.Manager) (*Plan, error) {
+	gcpProject, err := resolved.ResolveGcpProject(ctx, cfg, mgr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve GCP project ID: %w", err)
+	}
+
+	app, err := mgr.AppClient.Get(ctx, cfg.ApplicationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get application: %w", err)
+	}
+
+	sourceName, err := resolved.ResolveInstanceName(app)
+	if err != nil {
+		return nil, err
+	}
+	if sourceName == cfg.TargetInstance.Name {
+		return nil, fmt.Errorf("source and target instance cannot be the same")
+	}
+
+	err = resolved.ResolveLocation(ctx, cfg, gcpProject, mgr, sourceName, cfg.TargetInstance.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve location of the migration: %w", err)
+	}
+	err = resolved.CheckClusterRegion(ctx, gcpProject, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	databaseName, err := resolved.ResolveDatabaseName(app)
+	if err != nil {
+		return nil, err
+	}
+
+	target := instance.DefineInstance(&cfg.TargetInstance, app)
+	changes, err := diff.Compare(app.Spec.GCP.SqlInstances[0], target)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{
+		Application: cfg.ApplicationName,
+		Namespace:   cfg.Namespace,
+		Project:     gcpProject.Id,
+		Location:    gcpProject.Location,
+		Source:      sourceName,
+		Target:      cfg.TargetInstance.Name,
+		Database:    databaseName,
+		TargetSpec:  target,
+		Changes:     changes,
+		Temporary:   temporarySettings(target),
+		SourceFlags: []string{"cloudsql.enable_pglogical=on", "cloudsql.logical_decoding=on"},
+		Steps:       steps,
+	}
+
+	p.Resources, err = resources(ctx, cfg, sourceName, gcpProject, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	migratorNetworks, err := instance.MigratorAuthNetworks(ctx, mgr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine the authorized networks of the migrator: %w", err)
+	}
+	for _, instanceName := range []string{sourceName, cfg.TargetInstance.Name} {
+		for _, network := range migratorNetworks {
+			p.AuthorizedNetworks = append(p.AuthorizedNetworks, AuthorizedNetwork{Instance: instanceName, Name: *network.Name, Value: network.Value})
+		}
+	}
+	// The outgoing ips of the target are only known once it has been created, there is one network for each.
+	// With private connectivity the target reaches the source in their network instead.
+	if mgr.Connectivity != config.ConnectivityPrivateIp {
+		p.AuthorizedNetworks = append(p.AuthorizedNetworks, AuthorizedNetwork{Instance: sourceName, Name: instance.TargetAuthNetworkName(cfg.TargetInstance.Name, 0), Value: "outgoing ips of " + cfg.TargetInstance.Name})
+	}
+
+	return p, nil
+}
+
+// temporarySettings lists the settings that setup disables on the target instance while it is a replica
+func temporarySettings(target *nais_io_v1.CloudSqlInstance) []string {
+	var temporary []string
+	if target.HighAvailability {
+		temporary = append(temporary, "high availability is disabled until promotion")
+	}
+	if target.PointInTimeRecovery {
+		temporary = append(temporary, "point-in-time recovery is disabled until promotion")
+	}
+	if instance.HasPgAuditFlags(target.Flags) {
+		temporary = append(temporary, "pgaudit flags are removed, re-run 'nais postgres enable-audit' after migration")
+	}
+	temporary = append(temporary, "backups are disabled until promotion")
+	return temporary
+}
+
+func resources(ctx context.Context, cfg *config.Config, sourceName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) ([]Resource, error) {
+	var result []Resource
+
+	helperName, err := common_main.HelperName(cfg.ApplicationName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = mgr.AppClient.Get(ctx, helperName)
+	action, err := existing(err, Reuse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get helper application: %w", err)
+	}
+	result = append(result, Resource{Action: action, Kind: "Application", Name: helperName, Note: "helper application owning the target instance until promotion"})
+
+	_, err = mgr.SqlInstanceClient.Get(ctx, cfg.TargetInstance.Name)
+	action, err = existing(err, Reuse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target instance: %w", err)
+	}
+	result = append(result, Resource{Action: action, Kind: "SQLInstance", Name: cfg.TargetInstance.Name, Note: "created by naiserator for the helper application"})
+
+	if cfg.Development.SkipBackup {
+		result = append(result, Resource{Action: Skip, Kind: "BackupRun", Name: sourceName, Note: "skipped in development mode"})
+	} else {
+		result = append(result, Resource{Action: Create, Kind: "BackupRun", Name: sourceName, Note: "backup of the source instance"})
+	}
+
+	for _, instanceName := range []string{sourceName, cfg.TargetInstance.Name} {
+		certName, err := common_main.HelperName(instanceName)
+		if err != nil {
+			return nil, err
+		}
+		_, err = mgr.SqlSslCertClient.Get(ctx, certName)
+		action, err = existing(err, Reuse)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ssl certificate: %w", err)
+		}
+		result = append(result, Resource{Action: action, Kind: "SQLSSLCert", Name: certName, Note: "client certificate for " + instanceName})
+	}
+
+	netpolName, err := netpol.Name(cfg, cfg.TargetInstance.Name)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		result = append(result, Resource{Action: Skip, Kind: "NetworkPolicy", Name: netpolName, Note: "only created when running in kubernetes"})
+	} else {
+		_, err = mgr.K8sClient.NetworkingV1().NetworkPolicies(cfg.Namespace).Get(ctx, netpolName, metav1.GetOptions{})
+		action, err = existing(err, Update)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get network policy: %w", err)
+		}
+		result = append(result, Resource{Action: action, Kind: "NetworkPolicy", Name: netpolName, Note: "egress from the migration job to the instances"})
+	}
+
+	for _, role := range []string{"source", "target"} {
+		profileName := instance.ConnectionProfileName(cfg, role)
+		_, err = mgr.Datamigration.ConnectionProfiles.Get(ctx, gcpProject.GcpComponentURI("connectionProfiles", profileName))
+		action, err = existing(err, Replace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get connection profile: %w", err)
+		}
+		result = append(result, Resource{Action: action, Kind: "ConnectionProfile", Name: profileName, Note: "DMS connection profile of the " + role + " instance"})
+	}
+
+	migrationName, err := resolved.MigrationName(sourceName, cfg.TargetInstance.Name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = mgr.Datamigration.MigrationJobs.Get(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
+	action, err = existing(err, Replace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration job: %w", err)
+	}
+	result = append(result, Resource{Action: action, Kind: "MigrationJob", Name: migrationName, Note: "DMS migration job replicating from the source instance"})
+
+	return result, nil
+}
+
+// existing returns Create when the lookup found nothing, and whenFound when it found the resource
+func existing(err error, whenFound string) (string, error) {
+	if err == nil {
+		return whenFound, nil
+	}
+	if classify.Is(err, classify.NotFound) {
+		return Create, nil
+	}
+	return "", err
+}
+
+// WriteJSON writes the plan as a JSON document
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteText writes the plan for people to read
+func (p *Plan) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Setup of %s in %s (project %s, location %s) will migrate database %s from %s to %s.\n", p.Application, p.Namespace, p.Project, p.Location, p.Database, p.Source, p.Target)
+
+	fmt.Fprintf(b, "\nTarget instance, compared to the source instance in the application spec:\n")
+	for _, change := range p.Changes {
+		fmt.Fprintf(b, "  %s\n", change)
+	}
+
+	fmt.Fprintf(b, "\nWhile replicating:\n")
+	for _, setting := range p.Temporary {
+		fmt.Fprintf(b, "  - %s\n", setting)
+	}
+
+	fmt.Fprintf(b, "\nResources:\n")
+	tw := tabwriter.NewWriter(b, 0, 4, 2, ' ', 0)
+	for _, r := range p.Resources {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", r.Action, r.Kind, r.Name, r.Note)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(b, "\nAuthorized networks:\n")
+	tw = tabwriter.NewWriter(b, 0, 4, 2, ' ', 0)
+	for _, n := range p.AuthorizedNetworks {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", n.Instance, n.Name, n.Value)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(b, "\nDatabase flags set on %s: %s\n", p.Source, strings.Join(p.SourceFlags, ", "))
+
+	fmt.Fprintf(b, "\nSteps:\n")
+	for i, step := range p.Steps {
+		fmt.Fprintf(b, "  %2d. %s\n", i+1, step)
+	}
+
+	// Drop the padding after the last column of the tables
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,64 @@
+package plan_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/diff"
+	"github.com/nais/cloudsql-migrator/internal/pkg/plan"
+	nais_io_v1 "github.com/nais/liberator/pkg/apis/nais.io/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plan", func() {
+	p := &plan.Plan{
+		Application: "myapp",
+		Namespace:   "mynamespace",
+		Project:     "myproject",
+		Location:    "europe-north1",
+		Source:      "myapp",
+		Target:      "myapp-pg16",
+		Database:    "mydb",
+		TargetSpec:  &nais_io_v1.CloudSqlInstance{Name: "myapp-pg16", Tier: "db-custom-2-7680"},
+		Changes: []diff.Change{
+			{Path: "name", Old: "myapp", New: "myapp-pg16"},
+			{Path: "tier", Old: "db-f1-micro", New: "db-custom-2-7680"},
+		},
+		Temporary: []string{"backups are disabled until promotion"},
+		Resources: []plan.Resource{
+			{Action: plan.Create, Kind: "Application", Name: "migrator-myapp", Note: "helper application"},
+			{Action: plan.Replace, Kind: "MigrationJob", Name: "myapp-myapp-pg16"},
+		},
+		AuthorizedNetworks: []plan.AuthorizedNetwork{
+			{Instance: "myapp", Name: "migrator:me@host", Value: "192.0.2.1/32"},
+		},
+		SourceFlags: []string{"cloudsql.logical_decoding=on"},
+		Steps:       []string{"Resolving GCP project ID", "Getting application"},
+	}
+
+	It("writes the plan as text", func() {
+		out := &bytes.Buffer{}
+		Expect(p.WriteText(out)).To(Succeed())
+		text := out.String()
+		Expect(text).To(HavePrefix("Setup of myapp in mynamespace (project myproject, location europe-north1) will migrate database mydb from myapp to myapp-pg16.\n"))
+		Expect(text).To(ContainSubstring(`  tier: "db-f1-micro" -> "db-custom-2-7680"`))
+		Expect(text).To(MatchRegexp(`  create\s+Application\s+migrator-myapp\s+helper application\n`))
+		Expect(text).To(MatchRegexp(`  replace\s+MigrationJob\s+myapp-myapp-pg16\n`))
+		Expect(text).To(MatchRegexp(`  myapp\s+migrator:me@host\s+192.0.2.1/32\n`))
+		Expect(text).To(ContainSubstring("   2. Getting application\n"))
+	})
+
+	It("writes the plan as JSON", func() {
+		out := &bytes.Buffer{}
+		Expect(p.WriteJSON(out)).To(Succeed())
+
+		var document map[string]any
+		Expect(json.Unmarshal(out.Bytes(), &document)).To(Succeed())
+		Expect(document).To(HaveKeyWithValue("target", "myapp-pg16"))
+		Expect(document["targetSpec"]).To(HaveKeyWithValue("tier", "db-custom-2-7680"))
+		Expect(document["changes"]).To(ContainElement(map[string]any{"path": "name", "old": "myapp", "new": "myapp-pg16"}))
+		Expect(document["resources"]).To(HaveLen(2))
+		Expect(document["steps"]).To(HaveLen(2))
+	})
+})
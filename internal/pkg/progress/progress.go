@@ -0,0 +1,299 @@
+// Package progress writes a machine-readable stream of progress events, so that tools like nais-cli can show
+// the progress of a migration phase without parsing log output.
+//
+// Events are written as JSON lines to the file or file descriptor given by EVENTS_FILE or EVENTS_FD,
+// and rendered in the terminal in interactive mode.
+// The format is versioned by the Version field on every event. Fields are only ever added within a version;
+// removing or changing the meaning of a field requires a new version.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+)
+
+// Version is the version of the event protocol. Version 2 added StepStatus events.
+const Version = 2
+
+type EventType string
+
+const (
+	// PhaseStarted is the first event of a phase, and carries the total number of steps
+	PhaseStarted EventType = "phase_started"
+	// StepStarted is emitted when a step starts; the previous step is implicitly completed
+	StepStarted EventType = "step_started"
+	// StepCompleted is emitted when a step has completed
+	StepCompleted EventType = "step_completed"
+	// StepStatus reports what a running step is waiting for, like the phase of the migration job or the replication lag
+	StepStatus EventType = "step_status"
+	// StepSkipped is emitted for steps that are skipped, typically because a previous run completed them
+	StepSkipped EventType = "step_skipped"
+	// StepFailed is emitted when a step fails, and is followed by a Result event
+	StepFailed EventType = "step_failed"
+	// Warning is something the user must act on, either before continuing or after the migration
+	Warning EventType = "warning"
+	// Result is the last event of a phase, and carries the exit code of the process
+	Result EventType = "result"
+)
+
+type Event struct {
+	Version int       `json:"version"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	App     string    `json:"app"`
+
+	// Step is the number of the step the event concerns, starting at 1
+	Step int `json:"step,omitempty"`
+	// StepsTotal is the number of steps in the phase
+	StepsTotal int `json:"stepsTotal,omitempty"`
+	// Description is a human-readable description of the step, or the warning
+	Description string `json:"description,omitempty"`
+	// Details are key-value pairs describing the status of a step, set on StepStatus events
+	Details map[string]string `json:"details,omitempty"`
+	// EtaSeconds is the estimated number of seconds until the phase completes
+	EtaSeconds int `json:"etaSeconds,omitempty"`
+	// Error is the error message of a failed step or phase
+	Error string `json:"error,omitempty"`
+	// ExitCode is the exit code of the process, set on Result events
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Success is set on Result events
+	Success *bool `json:"success,omitempty"`
+}
+
+// Sink receives the events of a phase. Sinks are called sequentially, and closed after the Result event.
+type Sink interface {
+	Handle(event Event)
+	Close() error
+}
+
+type jsonSink struct {
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+// JSON returns a Sink writing events as JSON lines to w
+func JSON(w io.WriteCloser) Sink {
+	return &jsonSink{out: w, enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) Handle(event Event) {
+	// Progress reporting must never break a migration, so write errors are ignored
+	_ = s.enc.Encode(event)
+}
+
+func (s *jsonSink) Close() error {
+	return s.out.Close()
+}
+
+// Reporter sends progress events for a phase to its sinks. A nil Reporter, or one without sinks, discards all events.
+type Reporter struct {
+	mu    sync.Mutex
+	sinks []Sink
+
+	phase string
+	app   string
+
+	stepsTotal  int
+	step        int
+	stepName    string
+	stepsTimed  int
+	timeInSteps time.Duration
+	stepStart   time.Time
+	now         func() time.Time
+}
+
+// Open returns a Reporter sending events to the event stream configured in cfg,
+// and to the terminal in interactive mode
+func Open(cfg *config.Config, phase string) (*Reporter, error) {
+	var sinks []Sink
+
+	switch {
+	case cfg.Events.File != "":
+		f, err := os.OpenFile(cfg.Events.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open events file: %w", err)
+		}
+		sinks = append(sinks, JSON(f))
+	case cfg.Events.FD > 0:
+		f := os.NewFile(uintptr(cfg.Events.FD), "events")
+		if f == nil {
+			return nil, fmt.Errorf("invalid events file descriptor %d", cfg.Events.FD)
+		}
+		sinks = append(sinks, JSON(f))
+	}
+
+	if cfg.Logging.IsInteractive() {
+		sinks = append(sinks, NewTerminal(os.Stdout, cfg.Logging.File, time.Now))
+	}
+
+	return New(phase, cfg.ApplicationName, time.Now, sinks...), nil
+}
+
+// New returns a Reporter sending events to sinks
+func New(phase, app string, now func() time.Time, sinks ...Sink) *Reporter {
+	return &Reporter{
+		sinks: sinks,
+		phase: phase,
+		app:   app,
+		now:   now,
+	}
+}
+
+// Started reports the start of the phase
+func (r *Reporter) Started(stepsTotal int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stepsTotal = stepsTotal
+	r.emit(Event{Type: PhaseStarted, StepsTotal: stepsTotal})
+}
+
+// Step reports the start of a step, completing the previous one
+func (r *Reporter) Step(step int, description string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.completeStep()
+	r.step = step
+	r.stepName = description
+	r.stepStart = r.now()
+	r.emit(Event{Type: StepStarted, Step: step, StepsTotal: r.stepsTotal, Description: description, EtaSeconds: r.eta()})
+}
+
+// Status reports what the current step is waiting for, as key-value pairs
+func (r *Reporter) Status(description string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	details := make(map[string]string, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		details[fmt.Sprint(args[i])] = fmt.Sprint(args[i+1])
+	}
+	r.emit(Event{Type: StepStatus, Step: r.step, StepsTotal: r.stepsTotal, Description: description, Details: details})
+}
+
+// Skip reports that the steps from and to (inclusive) will not be run
+func (r *Reporter) Skip(from, to int, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.completeStep()
+	for step := from; step <= to; step++ {
+		r.emit(Event{Type: StepSkipped, Step: step, StepsTotal: r.stepsTotal, Description: reason})
+	}
+}
+
+// Warning reports something the user must act on
+func (r *Reporter) Warning(message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emit(Event{Type: Warning, Step: r.step, Description: message})
+}
+
+// Fail reports that the current step failed, and the result of the phase
+func (r *Reporter) Fail(description string, err error, exitCode int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	message := description
+	if err != nil {
+		message = fmt.Sprintf("%s: %v", description, err)
+	}
+	r.emit(Event{Type: StepFailed, Step: r.step, StepsTotal: r.stepsTotal, Description: r.stepName, Error: message})
+	r.result(exitCode, message)
+}
+
+// Done reports that the phase completed successfully
+func (r *Reporter) Done() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.completeStep()
+	r.result(0, "")
+}
+
+func (r *Reporter) result(exitCode int, message string) {
+	success := exitCode == 0
+	r.emit(Event{Type: Result, StepsTotal: r.stepsTotal, Error: message, ExitCode: &exitCode, Success: &success})
+	for _, sink := range r.sinks {
+		_ = sink.Close()
+	}
+	r.sinks = nil
+}
+
+func (r *Reporter) completeStep() {
+	if r.step == 0 || r.stepStart.IsZero() {
+		return
+	}
+	r.stepsTimed++
+	r.timeInSteps += r.now().Sub(r.stepStart)
+	r.emit(Event{Type: StepCompleted, Step: r.step, StepsTotal: r.stepsTotal, Description: r.stepName})
+	r.stepStart = time.Time{}
+}
+
+// eta estimates the remaining time of the phase from the average duration of the steps completed so far
+func (r *Reporter) eta() int {
+	if r.stepsTimed == 0 || r.stepsTotal == 0 {
+		return 0
+	}
+	remaining := r.stepsTotal - r.step + 1
+	if remaining <= 0 {
+		return 0
+	}
+	average := r.timeInSteps / time.Duration(r.stepsTimed)
+	return int((average * time.Duration(remaining)).Seconds())
+}
+
+func (r *Reporter) emit(event Event) {
+	event.Version = Version
+	event.Time = r.now().UTC()
+	event.Phase = r.phase
+	event.App = r.app
+	for _, sink := range r.sinks {
+		sink.Handle(event)
+	}
+}
+
+// SortedDetails returns the details of a StepStatus event as "key=value" pairs, sorted by key
+func (e Event) SortedDetails() []string {
+	keys := make([]string, 0, len(e.Details))
+	for key := range e.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+e.Details[key])
+	}
+	return pairs
+}
@@ -0,0 +1,167 @@
+package progress_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/progress"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func decode(b *buffer) []progress.Event {
+	var events []progress.Event
+	dec := json.NewDecoder(&b.Buffer)
+	for dec.More() {
+		var event progress.Event
+		Expect(dec.Decode(&event)).To(Succeed())
+		events = append(events, event)
+	}
+	return events
+}
+
+func types(events []progress.Event) []progress.EventType {
+	result := make([]progress.EventType, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.Type)
+	}
+	return result
+}
+
+var _ = Describe("Reporter", func() {
+	var out *buffer
+	var now time.Time
+	var reporter *progress.Reporter
+
+	BeforeEach(func() {
+		out = &buffer{}
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		reporter = progress.New("setup", "my-app", func() time.Time { return now }, progress.JSON(out))
+	})
+
+	It("reports steps and the result of a successful phase", func() {
+		reporter.Started(3)
+		reporter.Step(1, "first")
+		now = now.Add(10 * time.Second)
+		reporter.Step(2, "second")
+		now = now.Add(20 * time.Second)
+		reporter.Warning("act on this")
+		reporter.Step(3, "third")
+		reporter.Done()
+
+		events := decode(out)
+		Expect(types(events)).To(Equal([]progress.EventType{
+			progress.PhaseStarted,
+			progress.StepStarted,
+			progress.StepCompleted,
+			progress.StepStarted,
+			progress.Warning,
+			progress.StepCompleted,
+			progress.StepStarted,
+			progress.StepCompleted,
+			progress.Result,
+		}))
+		for _, event := range events {
+			Expect(event.Version).To(Equal(progress.Version))
+			Expect(event.Phase).To(Equal("setup"))
+			Expect(event.App).To(Equal("my-app"))
+		}
+		Expect(events[0].StepsTotal).To(Equal(3))
+		Expect(events[4].Step).To(Equal(2))
+		Expect(events[4].Description).To(Equal("act on this"))
+		Expect(*events[8].ExitCode).To(Equal(0))
+		Expect(*events[8].Success).To(BeTrue())
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("estimates the remaining time from completed steps", func() {
+		reporter.Started(4)
+		reporter.Step(1, "first")
+		now = now.Add(10 * time.Second)
+		reporter.Step(2, "second")
+		now = now.Add(30 * time.Second)
+		reporter.Step(3, "third")
+
+		events := decode(out)
+		Expect(events[1].EtaSeconds).To(Equal(0))
+		// one step of 10s done, steps 2 to 4 remaining
+		Expect(events[3].EtaSeconds).To(Equal(30))
+		// two steps averaging 20s done, steps 3 and 4 remaining
+		Expect(events[5].EtaSeconds).To(Equal(40))
+	})
+
+	It("reports the status of the running step", func() {
+		reporter.Started(2)
+		reporter.Step(1, "first")
+		reporter.Status("migration job", "state", "RUNNING", "phase", "CDC")
+
+		events := decode(out)
+		Expect(events[2].Type).To(Equal(progress.StepStatus))
+		Expect(events[2].Step).To(Equal(1))
+		Expect(events[2].Details).To(Equal(map[string]string{"state": "RUNNING", "phase": "CDC"}))
+		Expect(events[2].SortedDetails()).To(Equal([]string{"phase=CDC", "state=RUNNING"}))
+	})
+
+	It("reports skipped steps", func() {
+		reporter.Started(5)
+		reporter.Step(1, "first")
+		reporter.Skip(2, 4, "already done")
+
+		events := decode(out)
+		Expect(types(events)).To(Equal([]progress.EventType{
+			progress.PhaseStarted,
+			progress.StepStarted,
+			progress.StepCompleted,
+			progress.StepSkipped,
+			progress.StepSkipped,
+			progress.StepSkipped,
+		}))
+		Expect(events[3].Step).To(Equal(2))
+		Expect(events[5].Step).To(Equal(4))
+	})
+
+	It("reports the failed step and exit code", func() {
+		reporter.Started(2)
+		reporter.Step(1, "first")
+		reporter.Fail("failed to do the thing", errors.New("boom"), 7)
+
+		events := decode(out)
+		Expect(types(events)).To(Equal([]progress.EventType{
+			progress.PhaseStarted,
+			progress.StepStarted,
+			progress.StepFailed,
+			progress.Result,
+		}))
+		Expect(events[2].Step).To(Equal(1))
+		Expect(events[2].Description).To(Equal("first"))
+		Expect(events[2].Error).To(Equal("failed to do the thing: boom"))
+		Expect(*events[3].ExitCode).To(Equal(7))
+		Expect(*events[3].Success).To(BeFalse())
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("does nothing when nil", func() {
+		var nilReporter *progress.Reporter
+		Expect(func() {
+			nilReporter.Started(1)
+			nilReporter.Step(1, "first")
+			nilReporter.Warning("warning")
+			nilReporter.Status("status", "key", "value")
+			nilReporter.Skip(1, 1, "skipped")
+			nilReporter.Fail("failed", nil, 1)
+			nilReporter.Done()
+		}).NotTo(Panic())
+	})
+})
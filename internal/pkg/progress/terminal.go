@@ -0,0 +1,280 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+type terminalStep struct {
+	number      int
+	description string
+	started     time.Time
+	finished    time.Time
+	skipped     bool
+	failed      bool
+	status      string
+}
+
+// Terminal is a Sink rendering the progress of a phase as a checklist, for operators running the migrator directly.
+// The checklist is redrawn in place, so nothing else should write to the terminal while it is in use.
+type Terminal struct {
+	mu      sync.Mutex
+	out     io.Writer
+	logFile string
+	now     func() time.Time
+	width   int
+
+	phase      string
+	app        string
+	stepsTotal int
+	eta        int
+	started    time.Time
+	steps      []*terminalStep
+	warnings   []string
+	result     *Event
+
+	frame   int
+	drawn   int
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewTerminal returns a Terminal rendering to out, and pointing to logFile for the full log
+func NewTerminal(out io.Writer, logFile string, now func() time.Time) *Terminal {
+	t := &Terminal{
+		out:     out,
+		logFile: logFile,
+		now:     now,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if f, ok := out.(*os.File); ok {
+		if width, _, err := term.GetSize(int(f.Fd())); err == nil {
+			t.width = width
+		}
+	}
+	go t.spin()
+	return t
+}
+
+// spin redraws the checklist regularly, to animate the spinner and update the elapsed time of the running step
+func (t *Terminal) spin() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			if t.result == nil && t.drawn > 0 {
+				t.frame++
+				t.render()
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *Terminal) Handle(event Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.phase = event.Phase
+	t.app = event.App
+	switch event.Type {
+	case PhaseStarted:
+		t.stepsTotal = event.StepsTotal
+		t.started = event.Time
+	case StepStarted:
+		t.eta = event.EtaSeconds
+		t.steps = append(t.steps, &terminalStep{number: event.Step, description: event.Description, started: event.Time})
+	case StepCompleted:
+		if s := t.running(); s != nil {
+			s.finished = event.Time
+		}
+	case StepSkipped:
+		t.steps = append(t.steps, &terminalStep{number: event.Step, description: event.Description, skipped: true})
+	case StepStatus:
+		if s := t.running(); s != nil {
+			s.status = strings.TrimSpace(event.Description + " " + strings.Join(event.SortedDetails(), " "))
+		}
+	case StepFailed:
+		if s := t.running(); s != nil {
+			s.failed = true
+			s.finished = event.Time
+		}
+	case Warning:
+		t.warnings = append(t.warnings, event.Description)
+	case Result:
+		t.result = &event
+	}
+	t.render()
+}
+
+func (t *Terminal) Close() error {
+	close(t.stop)
+	<-t.stopped
+	return nil
+}
+
+// running returns the step that has started but not finished, if any
+func (t *Terminal) running() *terminalStep {
+	if len(t.steps) == 0 {
+		return nil
+	}
+	s := t.steps[len(t.steps)-1]
+	if s.skipped || !s.finished.IsZero() {
+		return nil
+	}
+	return s
+}
+
+func (t *Terminal) render() {
+	title := strings.ToUpper(t.phase[:min(1, len(t.phase))]) + t.phase[min(1, len(t.phase)):]
+
+	header := fmt.Sprintf("%s%s %s%s", ansiBold, title, t.app, ansiReset)
+	if s := t.running(); s != nil && t.stepsTotal > 0 {
+		header += fmt.Sprintf(" %sstep %d of %d", ansiDim, s.number, t.stepsTotal)
+		if t.eta > 0 {
+			header += fmt.Sprintf(", about %s left", time.Duration(t.eta)*time.Second)
+		}
+		header += ansiReset
+	}
+	lines := []string{header}
+
+	for i := 0; i < len(t.steps); i++ {
+		s := t.steps[i]
+		if s.skipped {
+			// Collapse consecutive steps skipped for the same reason into one line
+			last := i
+			for last+1 < len(t.steps) && t.steps[last+1].skipped && t.steps[last+1].description == s.description {
+				last++
+			}
+			steps := fmt.Sprintf("step %d", s.number)
+			if last > i {
+				steps = fmt.Sprintf("steps %d-%d", s.number, t.steps[last].number)
+			}
+			lines = append(lines, fmt.Sprintf("  %s- %s skipped: %s%s", ansiDim, steps, s.description, ansiReset))
+			i = last
+			continue
+		}
+
+		var mark string
+		switch {
+		case s.failed:
+			mark = ansiRed + "✗" + ansiReset
+		case !s.finished.IsZero():
+			mark = ansiGreen + "✓" + ansiReset
+		default:
+			mark = ansiCyan + spinnerFrames[t.frame%len(spinnerFrames)] + ansiReset
+		}
+		end := s.finished
+		if end.IsZero() {
+			end = t.now()
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s %s%s%s", mark, s.description, ansiDim, elapsed(end.Sub(s.started)), ansiReset))
+		if s.status != "" && s.finished.IsZero() {
+			lines = append(lines, fmt.Sprintf("      %s%s%s", ansiDim, s.status, ansiReset))
+		}
+	}
+
+	for _, warning := range t.warnings {
+		lines = append(lines, fmt.Sprintf("  %s! %s%s", ansiYellow, warning, ansiReset))
+	}
+
+	if t.result != nil {
+		lines = append(lines, "")
+		lines = append(lines, t.summary(title)...)
+	}
+
+	var b strings.Builder
+	if t.drawn > 0 {
+		// Move to the start of the previous rendering and clear it
+		fmt.Fprintf(&b, "\x1b[%dF\x1b[J", t.drawn)
+	}
+	for _, line := range lines {
+		// Lines wrapping would break the redraw, but the final rendering is never redrawn and is kept whole
+		if t.result == nil {
+			line = truncate(line, t.width)
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	t.drawn = len(lines)
+	_, _ = io.WriteString(t.out, b.String())
+}
+
+func (t *Terminal) summary(title string) []string {
+	took := ""
+	if !t.started.IsZero() {
+		took = " in " + elapsed(t.result.Time.Sub(t.started))
+	}
+
+	var lines []string
+	if t.result.Success != nil && *t.result.Success {
+		lines = append(lines, fmt.Sprintf("%s%s completed%s%s", ansiGreen, title, took, ansiReset))
+	} else {
+		exitCode := 0
+		if t.result.ExitCode != nil {
+			exitCode = *t.result.ExitCode
+		}
+		lines = append(lines, fmt.Sprintf("%s%s failed%s with exit code %d: %s%s", ansiRed, title, took, exitCode, t.result.Error, ansiReset))
+	}
+	if len(t.warnings) > 0 {
+		lines = append(lines, fmt.Sprintf("%sSee the %d warning(s) above%s", ansiYellow, len(t.warnings), ansiReset))
+	}
+	if t.logFile != "" {
+		lines = append(lines, "Full log: "+t.logFile)
+	}
+	return lines
+}
+
+func elapsed(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// truncate shortens line to width visible characters, not counting ANSI escape sequences
+func truncate(line string, width int) string {
+	if width <= 0 {
+		return line
+	}
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			end := strings.IndexByte(line[i:], 'm')
+			if end < 0 {
+				break
+			}
+			i += end + 1
+			continue
+		}
+		if visible == width-1 {
+			return line[:i] + ansiReset
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		visible++
+	}
+	return line
+}
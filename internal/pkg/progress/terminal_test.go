@@ -0,0 +1,75 @@
+package progress_test
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/progress"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Terminal", func() {
+	var out *buffer
+	var now time.Time
+	var reporter *progress.Reporter
+
+	BeforeEach(func() {
+		out = &buffer{}
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		end := now.Add(time.Hour)
+		terminal := progress.NewTerminal(out, "/tmp/migrator.log", func() time.Time { return end })
+		reporter = progress.New("promote", "my-app", func() time.Time { return now }, terminal)
+	})
+
+	It("renders completed and skipped steps, warnings and a summary", func() {
+		reporter.Started(4)
+		reporter.Step(1, "Resolving GCP project ID")
+		now = now.Add(5 * time.Second)
+		reporter.Skip(2, 3, "helper application is gone")
+		reporter.Warning("update your application spec")
+		reporter.Step(4, "Promote completed")
+		now = now.Add(time.Minute)
+		reporter.Done()
+
+		frame := lastFrame(out.String())
+		Expect(frame).To(ContainSubstring("Promote my-app"))
+		Expect(frame).To(ContainSubstring("✓ Resolving GCP project ID"))
+		Expect(frame).To(ContainSubstring("5s"))
+		Expect(frame).To(ContainSubstring("steps 2-3 skipped: helper application is gone"))
+		Expect(frame).To(ContainSubstring("! update your application spec"))
+		Expect(frame).To(ContainSubstring("Promote completed in 1m5s"))
+		Expect(frame).To(ContainSubstring("Full log: /tmp/migrator.log"))
+	})
+
+	It("renders the status of the running step", func() {
+		reporter.Started(2)
+		reporter.Step(1, "Waiting for replication lag")
+		reporter.Status("replication lag", "lagBytes", 1024)
+
+		Expect(lastFrame(out.String())).To(ContainSubstring("replication lag lagBytes=1024"))
+		Expect(lastFrame(out.String())).To(ContainSubstring("step 1 of 2"))
+	})
+
+	It("renders the failed step and exit code", func() {
+		reporter.Started(2)
+		reporter.Step(1, "Promoting")
+		reporter.Fail("Failed to promote", errors.New("boom"), 14)
+
+		frame := lastFrame(out.String())
+		Expect(frame).To(ContainSubstring("✗ Promoting"))
+		Expect(frame).To(ContainSubstring("Promote failed in 0s with exit code 14: Failed to promote: boom"))
+	})
+})
+
+var (
+	redraw     = regexp.MustCompile(`\x1b\[\d+F\x1b\[J`)
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+)
+
+// lastFrame returns the last rendering of the checklist, without colors
+func lastFrame(output string) string {
+	frames := redraw.Split(output, -1)
+	return ansiEscape.ReplaceAllString(frames[len(frames)-1], "")
+}
@@ -2,7 +2,6 @@ package promote
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"time"
@@ -11,25 +10,25 @@ import (
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
-	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
 
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
 	"github.com/nais/cloudsql-migrator/internal/pkg/instance"
 	"github.com/nais/cloudsql-migrator/internal/pkg/migration"
+	"github.com/nais/cloudsql-migrator/internal/pkg/operation"
 	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
 	"google.golang.org/api/datamigration/v1"
-	"google.golang.org/api/iterator"
 )
 
 const (
-	numberOfZeroPointsForLagToBeConsideredZero = 3
-	acceptableLagBytesForPromotion             = 16 * 1024 * 1024
+	promoteTimeout = 30 * time.Minute
 )
 
 type ReplicationLagPredicate func([]*monpb.Point, *slog.Logger) (bool, error)
 
-func CheckReadyForPromotion(ctx context.Context, source, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+func CheckReadyForPromotion(ctx context.Context, cfg *config.Config, source, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
 	migrationName, err := resolved.MigrationName(source.Name, target.Name)
 	if err != nil {
 		return err
@@ -60,10 +59,10 @@ func CheckReadyForPromotion(ctx context.Context, source, target *resolved.Instan
 		return fmt.Errorf("migration job is not ready for promotion: %s", migrationJob.Phase)
 	}
 
-	return waitForReplicationLagToBeAcceptablyLow(ctx, target, gcpProject, mgr)
+	return waitForReplicationLagToBeAcceptablyLow(ctx, &cfg.Lag, target, gcpProject, mgr)
 }
 
-func Promote(ctx context.Context, source, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+func Promote(ctx context.Context, cfg *config.Config, source, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
 	migrationName, err := resolved.MigrationName(source.Name, target.Name)
 	if err != nil {
 		return err
@@ -76,47 +75,37 @@ func Promote(ctx context.Context, source, target *resolved.Instance, gcpProject
 		return err
 	}
 
+	operationKey := "promote/" + migrationName
 	var op *datamigration.Operation
-	if migrationJob.Phase == "PROMOTE_IN_PROGRESS" {
+	if migrationJob.State == "COMPLETED" {
+		mgr.Logger.Info("migration job is already completed, continuing...", "migrationName", migrationName)
+	} else if migrationJob.Phase == "PROMOTE_IN_PROGRESS" {
 		mgr.Logger.Info("migration job is already under promotion, continuing...", "migrationName", migrationName)
 
-		listOp, err := mgr.DatamigrationService.Projects.Locations.Operations.List(gcpProject.GcpComponentURI("migrationJobs", migrationName)).Context(ctx).Do()
+		op, err = findPromoteOperation(ctx, cfg, operationKey, migrationName, gcpProject, mgr)
 		if err != nil {
-			return fmt.Errorf("failed to list promotion operations: %w", err)
-		}
-		if len(listOp.Operations) == 0 {
-			return fmt.Errorf("failed to find current promotion operation")
-		} else if len(listOp.Operations) > 1 {
-			return fmt.Errorf("too many promotion operations")
-		}
-		op = listOp.Operations[0]
-	} else if migrationJob.State == "COMPLETED" {
-		mgr.Logger.Info("migration job is already completed, continuing...", "migrationName", migrationName)
-		op = &datamigration.Operation{
-			Done: true,
+			return err
 		}
 	} else {
 		mgr.Logger.Info("migration job is ready for promotion, continuing...", "migrationName", migrationName)
-		err = waitForReplicationLagToReachZero(ctx, target, gcpProject, mgr)
+		err = waitForReplicationLagToReachZero(ctx, &cfg.Lag, target, gcpProject, mgr)
 		if err != nil {
 			return err
 		}
 
-		op, err = mgr.DatamigrationService.Projects.Locations.MigrationJobs.Promote(gcpProject.GcpComponentURI("migrationJobs", migrationName), &datamigration.PromoteMigrationJobRequest{}).Context(ctx).Do()
+		op, err = mgr.Datamigration.MigrationJobs.Promote(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
 		if err != nil {
 			return fmt.Errorf("failed to promote target instance: %w", err)
 		}
 	}
 
-	for !op.Done {
-		time.Sleep(10 * time.Second)
-		mgr.Logger.Info("waiting for promote operation to complete")
-		op, err = mgr.DatamigrationService.Projects.Locations.Operations.Get(op.Name).Context(ctx).Do()
+	if op != nil {
+		err = operation.WaitDatamigration(ctx, "promote", op, promoteTimeout, mgr, operation.Tracked(cfg, operationKey))
 		if err != nil {
-			return fmt.Errorf("failed to get promote operation status: %w", err)
+			return err
 		}
 	}
-	err = instance.UpdateTargetInstanceAfterPromotion(ctx, source, target, mgr)
+	err = instance.UpdateTargetInstanceAfterPromotion(ctx, &cfg.TargetInstance, source, target, mgr)
 	if err != nil {
 		return err
 	}
@@ -124,39 +113,57 @@ func Promote(ctx context.Context, source, target *resolved.Instance, gcpProject
 	return nil
 }
 
-func waitForReplicationLagToBeAcceptablyLow(ctx context.Context, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	return waitForReplicationLag(ctx, target, lagAcceptablyLow, gcpProject, mgr)
+// findPromoteOperation returns the promote operation started by a previous run
+func findPromoteOperation(ctx context.Context, cfg *config.Config, operationKey, migrationName string, gcpProject *resolved.GcpProject, mgr *common_main.Manager) (*datamigration.Operation, error) {
+	op, err := operation.ResumeDatamigration(ctx, cfg, operationKey, mgr)
+	if err != nil || op != nil {
+		return op, err
+	}
+
+	operations, err := mgr.Datamigration.Operations.List(ctx, gcpProject.GcpComponentURI("migrationJobs", migrationName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list promotion operations: %w", err)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("failed to find current promotion operation")
+	} else if len(operations) > 1 {
+		return nil, fmt.Errorf("too many promotion operations")
+	}
+	return operations[0], nil
 }
 
-func waitForReplicationLagToReachZero(ctx context.Context, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	return waitForReplicationLag(ctx, target, lagReachedZero, gcpProject, mgr)
+func waitForReplicationLagToBeAcceptablyLow(ctx context.Context, lag *config.Lag, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	return waitForReplicationLag(ctx, target, lagAcceptablyLow(lag.AcceptableBytes), lag.Timeout, gcpProject, mgr)
 }
 
-func waitForReplicationLag(ctx context.Context, target *resolved.Instance, predicate ReplicationLagPredicate, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
-	client, err := monitoring.NewMetricClient(ctx)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create metric client: %v", err))
-	}
-	defer client.Close()
+func waitForReplicationLagToReachZero(ctx context.Context, lag *config.Lag, target *resolved.Instance, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
+	return waitForReplicationLag(ctx, target, lagReachedZero(lag.ZeroPoints), lag.Timeout, gcpProject, mgr)
+}
 
+func waitForReplicationLag(ctx context.Context, target *resolved.Instance, predicate ReplicationLagPredicate, timeout time.Duration, gcpProject *resolved.GcpProject, mgr *common_main.Manager) error {
 	b := retry.NewConstant(30 * time.Second)
-	b = retry.WithMaxDuration(10*time.Minute, b)
+	b = retry.WithMaxDuration(timeout, b)
 
 	return retry.Do(ctx, b, func(ctx context.Context) error {
 		req := makeMetricsRequest(gcpProject, target)
 
 		mgr.Logger.Info("checking replication lag")
-		it := client.ListTimeSeries(ctx, req)
-		data, err := it.Next()
+		series, err := mgr.Monitoring.ListTimeSeries(ctx, req)
 		if err != nil {
-			if !errors.Is(err, iterator.Done) {
-				return retry.RetryableError(fmt.Errorf("failed to fetch time series data: %w", err))
-			}
-			mgr.Logger.Info("no more data in iterator, retrying")
-			return retry.RetryableError(fmt.Errorf("no more data in iterator"))
+			return classify.Retry(fmt.Errorf("failed to fetch time series data: %w", err))
 		}
+		if len(series) == 0 {
+			mgr.Logger.Info("no time series data yet, retrying")
+			return retry.RetryableError(fmt.Errorf("no time series data"))
+		}
+		data := series[0]
 
 		mgr.Logger.Debug("fetched time series data", "number_of_points", len(data.Points))
+		if len(data.Points) > 0 {
+			if lag, err := getPointValue(data.Points[0]); err == nil {
+				mgr.Status("replication lag", "lagBytes", lag)
+			}
+		}
 		result, err := predicate(data.Points, mgr.Logger)
 		if err != nil {
 			return retry.RetryableError(fmt.Errorf("failed to evaluate predicate: %w", err))
@@ -168,37 +175,16 @@ func waitForReplicationLag(ctx context.Context, target *resolved.Instance, predi
 	})
 }
 
-func lagAcceptablyLow(points []*monpb.Point, logger *slog.Logger) (bool, error) {
-	if len(points) == 0 {
-		logger.Debug("no data points available to determine lag")
-		return false, nil
-	}
-
-	point := points[0]
-
-	value, err := getPointValue(point)
-	if err != nil {
-		logger.Warn("failed to get point value", "error", err)
-		return false, err
-	}
-	logger.Debug("lag", "value", value, "point", formatPoint(point))
-
-	if value > acceptableLagBytesForPromotion {
-		logger.Debug("lag is too high for promotion", "lag_bytes", value, "acceptable_lag_bytes", acceptableLagBytesForPromotion)
-		return false, nil
-	}
-
-	logger.Info("lag is acceptably low for promotion", "lag_bytes", value)
-	return true, nil
-}
+// lagAcceptablyLow is satisfied when the latest replication lag is at most acceptableBytes
+func lagAcceptablyLow(acceptableBytes int64) ReplicationLagPredicate {
+	return func(points []*monpb.Point, logger *slog.Logger) (bool, error) {
+		if len(points) == 0 {
+			logger.Debug("no data points available to determine lag")
+			return false, nil
+		}
 
-func lagReachedZero(points []*monpb.Point, logger *slog.Logger) (bool, error) {
-	if len(points) < numberOfZeroPointsForLagToBeConsideredZero {
-		logger.Debug("not enough data points to determine if lag has reached zero", "points_available", len(points), "points_required", numberOfZeroPointsForLagToBeConsideredZero)
-		return false, nil
-	}
+		point := points[0]
 
-	for _, point := range points[0:numberOfZeroPointsForLagToBeConsideredZero] {
 		value, err := getPointValue(point)
 		if err != nil {
 			logger.Warn("failed to get point value", "error", err)
@@ -206,13 +192,40 @@ func lagReachedZero(points []*monpb.Point, logger *slog.Logger) (bool, error) {
 		}
 		logger.Debug("lag", "value", value, "point", formatPoint(point))
 
-		if value != 0 {
+		if value > acceptableBytes {
+			logger.Debug("lag is too high for promotion", "lag_bytes", value, "acceptable_lag_bytes", acceptableBytes)
 			return false, nil
 		}
+
+		logger.Info("lag is acceptably low for promotion", "lag_bytes", value)
+		return true, nil
 	}
+}
+
+// lagReachedZero is satisfied when the latest zeroPoints measurements of replication lag are all zero
+func lagReachedZero(zeroPoints int) ReplicationLagPredicate {
+	return func(points []*monpb.Point, logger *slog.Logger) (bool, error) {
+		if len(points) < zeroPoints {
+			logger.Debug("not enough data points to determine if lag has reached zero", "points_available", len(points), "points_required", zeroPoints)
+			return false, nil
+		}
+
+		for _, point := range points[0:zeroPoints] {
+			value, err := getPointValue(point)
+			if err != nil {
+				logger.Warn("failed to get point value", "error", err)
+				return false, err
+			}
+			logger.Debug("lag", "value", value, "point", formatPoint(point))
 
-	logger.Info("lag has reached zero")
-	return true, nil
+			if value != 0 {
+				return false, nil
+			}
+		}
+
+		logger.Info("lag has reached zero")
+		return true, nil
+	}
 }
 
 func getPointValue(point *monpb.Point) (int64, error) {
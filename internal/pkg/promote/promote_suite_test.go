@@ -0,0 +1,13 @@
+package promote_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPromote(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Promote Suite")
+}
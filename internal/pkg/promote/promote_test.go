@@ -0,0 +1,83 @@
+package promote_test
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	monpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/gcp/fake"
+	"github.com/nais/cloudsql-migrator/internal/pkg/promote"
+	"github.com/nais/cloudsql-migrator/internal/pkg/resolved"
+	"google.golang.org/api/datamigration/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func lag(values ...int64) []*monpb.TimeSeries {
+	points := make([]*monpb.Point, 0, len(values))
+	for _, v := range values {
+		points = append(points, &monpb.Point{Value: &monpb.TypedValue{Value: &monpb.TypedValue_Int64Value{Int64Value: v}}})
+	}
+	return []*monpb.TimeSeries{{Points: points}}
+}
+
+var _ = Describe("CheckReadyForPromotion", func() {
+	const jobName = "projects/my-project/locations/europe-north1/migrationJobs/my-app-my-app-pg16"
+
+	var ctx context.Context
+	var backend *fake.Backend
+	var mgr *common_main.Manager
+	var cfg *config.Config
+	gcpProject := &resolved.GcpProject{Id: "my-project", Location: "europe-north1"}
+	source := &resolved.Instance{Name: "my-app"}
+	target := &resolved.Instance{Name: "my-app-pg16", Region: "europe-north1"}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(cancel)
+
+		backend = fake.New()
+		mgr = &common_main.Manager{
+			Logger:        slog.New(slog.DiscardHandler),
+			Datamigration: backend.Datamigration(),
+			Monitoring:    backend.Monitoring(),
+		}
+		cfg = &config.Config{
+			ApplicationName: "my-app",
+			Namespace:       "my-team",
+			Lag:             config.Lag{AcceptableBytes: 1024, ZeroPoints: 3, Timeout: time.Second},
+		}
+	})
+
+	It("is ready when the migration job replicates with acceptably low lag", func() {
+		backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "RUNNING", Phase: "CDC"}
+		backend.TimeSeries = lag(512, 4096)
+
+		Expect(promote.CheckReadyForPromotion(ctx, cfg, source, target, gcpProject, mgr)).To(Succeed())
+	})
+
+	It("is not ready when the lag stays too high", func() {
+		backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "RUNNING", Phase: "CDC"}
+		backend.TimeSeries = lag(4096)
+
+		Expect(promote.CheckReadyForPromotion(ctx, cfg, source, target, gcpProject, mgr)).NotTo(Succeed())
+	})
+
+	It("is not ready when the migration job is still dumping", func() {
+		backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "RUNNING", Phase: "FULL_DUMP"}
+
+		err := promote.CheckReadyForPromotion(ctx, cfg, source, target, gcpProject, mgr)
+		Expect(err).To(MatchError(ContainSubstring("not ready for promotion: FULL_DUMP")))
+	})
+
+	It("continues when the migration job is already completed", func() {
+		backend.MigrationJobs[jobName] = &datamigration.MigrationJob{Name: jobName, State: "COMPLETED"}
+
+		Expect(promote.CheckReadyForPromotion(ctx, cfg, source, target, gcpProject, mgr)).To(Succeed())
+	})
+})
@@ -3,6 +3,8 @@ package resolved
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
 	"time"
 
@@ -13,12 +15,16 @@ import (
 	"github.com/sethvargo/go-retry"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
 	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
 	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/cloudsql-migrator/internal/pkg/state"
+	"github.com/nais/cloudsql-migrator/internal/pkg/wait"
 	"github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 )
 
 // Resolved is configuration that is resolved by looking up in the cluster
@@ -30,8 +36,11 @@ type SslCert struct {
 }
 
 type Instance struct {
-	Name             string
+	Name string
+	// ConnectionName is project:region:instance, which the Cloud SQL connector dials
+	ConnectionName   string
 	PrimaryIp        string
+	PrivateIp        string
 	OutgoingIps      []string
 	AppUsername      string
 	AppPassword      string
@@ -47,8 +56,54 @@ type Resolved struct {
 	Target       Instance
 }
 
+// LogValue logs the certificates without the private key
+func (s SslCert) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("SslClientKey", config.RedactValue(s.SslClientKey)),
+		slog.String("SslClientCert", s.SslClientCert),
+		slog.String("SslCaCert", s.SslCaCert),
+	)
+}
+
+// LogValue logs the instance without its passwords
+func (i Instance) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("Name", i.Name),
+		slog.String("ConnectionName", i.ConnectionName),
+		slog.String("PrimaryIp", i.PrimaryIp),
+		slog.String("PrivateIp", i.PrivateIp),
+		slog.Any("OutgoingIps", i.OutgoingIps),
+		slog.String("AppUsername", i.AppUsername),
+		slog.String("AppPassword", config.RedactValue(i.AppPassword)),
+		slog.String("PostgresPassword", config.RedactValue(i.PostgresPassword)),
+		slog.String("Region", i.Region),
+		slog.Any("SslCert", i.SslCert),
+	)
+}
+
+// Ip is the address the instance is reached on with the connectivity, its private ip with private connectivity
+// and its public ip otherwise
+func (i Instance) Ip(connectivity string) string {
+	if connectivity == config.ConnectivityPrivateIp {
+		return i.PrivateIp
+	}
+	return i.PrimaryIp
+}
+
+// LogValue logs the instances without their secrets
+func (r Resolved) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("GcpProjectId", r.GcpProjectId),
+		slog.String("DatabaseName", r.DatabaseName),
+		slog.Any("Source", r.Source),
+		slog.Any("Target", r.Target),
+	)
+}
+
 type GcpProject struct {
 	Id string
+	// Location is the region of the Database Migration Service resources, set by ResolveLocation
+	Location string
 }
 
 type Require int
@@ -80,8 +135,118 @@ func ResolveGcpProject(ctx context.Context, cfg *config.Config, mgr *common_main
 	}
 }
 
+// ResolveLocation sets the location of the Database Migration Service resources to the region of the instances,
+// which must all be in the same region, and in the configured location if there is one. Instances that do not exist are
+// skipped, so the location is also found when the migrator is rerun after deleting one of them.
+func ResolveLocation(ctx context.Context, cfg *config.Config, gcpProject *GcpProject, mgr *common_main.Manager, instanceNames ...string) error {
+	location := cfg.Location
+	locatedBy := "the configured location"
+	for _, instanceName := range instanceNames {
+		region, err := instanceRegion(ctx, instanceName, mgr)
+		if err != nil {
+			return err
+		}
+		if region == "" {
+			continue
+		}
+		if location == "" {
+			location = region
+			locatedBy = "instance " + instanceName
+		} else if region != location {
+			return fmt.Errorf("instance %s is in region %s, but %s is in %s", instanceName, region, locatedBy, location)
+		}
+	}
+	if location == "" {
+		return fmt.Errorf("unable to determine the location of the migration, none of the instances %s exist", strings.Join(instanceNames, ", "))
+	}
+
+	mgr.Logger.Info("resolved location of the migration", "location", location)
+	gcpProject.Location = location
+	return nil
+}
+
+// ResolveCleanupLocation sets the location of the Database Migration Service resources for removing them, without
+// checking that the instances agree on it, so a migration that failed on instances in different regions can be cleaned
+// up. The location recorded by setup is used, then the configured location, and then the region of the first instance
+// that exists.
+func ResolveCleanupLocation(ctx context.Context, cfg *config.Config, gcpProject *GcpProject, mgr *common_main.Manager, instanceNames ...string) error {
+	st, err := state.Load(ctx, cfg, mgr)
+	if err != nil {
+		return err
+	}
+
+	location := st.Location
+	if location == "" {
+		location = cfg.Location
+	}
+	for _, instanceName := range instanceNames {
+		if location != "" {
+			break
+		}
+		location, err = instanceRegion(ctx, instanceName, mgr)
+		if err != nil {
+			return err
+		}
+	}
+	if location == "" {
+		return fmt.Errorf("unable to determine the location of the migration, none of the instances %s exist", strings.Join(instanceNames, ", "))
+	}
+
+	mgr.Logger.Info("resolved location of the migration", "location", location)
+	gcpProject.Location = location
+	return nil
+}
+
+// RecordLocation records the location of the migration, for ResolveCleanupLocation
+func RecordLocation(ctx context.Context, cfg *config.Config, gcpProject *GcpProject, mgr *common_main.Manager) error {
+	return state.Update(ctx, cfg, mgr, func(st *state.State) error {
+		st.Location = gcpProject.Location
+		return nil
+	})
+}
+
+// CheckClusterRegion makes sure the cluster, where the target instance is created, is in the location of the migration.
+// The region of the cluster is read from the topology label of its nodes, and the check is skipped with a warning if
+// the nodes can not be listed or are not labelled.
+func CheckClusterRegion(ctx context.Context, gcpProject *GcpProject, mgr *common_main.Manager) error {
+	nodes, err := mgr.K8sClient.CoreV1().Nodes().List(ctx, meta_v1.ListOptions{Limit: 1})
+	if err != nil {
+		if errors.IsForbidden(err) {
+			mgr.Logger.Warn("not allowed to list nodes, the region of the target instance is checked when it is created", "error", err)
+			return nil
+		}
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if len(nodes.Items) == 0 || nodes.Items[0].Labels[v1.LabelTopologyRegion] == "" {
+		mgr.Logger.Warn("unable to determine the region of the cluster, the region of the target instance is checked when it is created")
+		return nil
+	}
+
+	region := nodes.Items[0].Labels[v1.LabelTopologyRegion]
+	if region != gcpProject.Location {
+		return fmt.Errorf("the cluster is in region %s, where the target instance would be created, but the migration is in %s", region, gcpProject.Location)
+	}
+	return nil
+}
+
+// instanceRegion returns the region of the instance, or nothing if it does not exist
+func instanceRegion(ctx context.Context, instanceName string, mgr *common_main.Manager) (string, error) {
+	sqlInstance, err := mgr.SqlInstanceClient.Get(ctx, instanceName)
+	if err != nil {
+		if classify.Is(err, classify.NotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+	region := ptr.Deref(sqlInstance.Spec.Region, "")
+	if region == "" {
+		return "", fmt.Errorf("sql instance %s does not have region", instanceName)
+	}
+	return region, nil
+}
+
 func (r *GcpProject) GcpParentURI() string {
-	return fmt.Sprintf("projects/%s/locations/europe-north1", r.Id)
+	return fmt.Sprintf("projects/%s/locations/%s", r.Id, r.Location)
 }
 
 func (r *GcpProject) GcpComponentURI(kind, name string) string {
@@ -126,7 +291,8 @@ func (i *Instance) resolveAppUsername(secret *v1.Secret) error {
 	return fmt.Errorf("unable to find password in secret %s", secret.Name)
 }
 
-func resolveInstanceName(app *nais_io_v1alpha1.Application) (string, error) {
+// ResolveInstanceName returns the name of the sql instance of the application, which defaults to the application name
+func ResolveInstanceName(app *nais_io_v1alpha1.Application) (string, error) {
 	spec := app.Spec
 	if spec.GCP != nil {
 		gcp := spec.GCP
@@ -142,7 +308,7 @@ func resolveInstanceName(app *nais_io_v1alpha1.Application) (string, error) {
 }
 
 func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr *common_main.Manager, required ...Require) (*Instance, error) {
-	name, err := resolveInstanceName(app)
+	name, err := ResolveInstanceName(app)
 	if err != nil {
 		return nil, err
 	}
@@ -152,19 +318,10 @@ func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr
 
 	mgr.Logger.Info("resolving sql instance", "name", name)
 
-	b := retry.NewConstant(5 * time.Second)
-	b = retry.WithMaxDuration(15*time.Minute, b)
-
-	sqlInstance, err := retry.DoValue(ctx, b, func(ctx context.Context) (*v1beta1.SQLInstance, error) {
-		mgr.Logger.Info("waiting for sql instance to be ready", "instance", instance.Name)
-		sqlInstance, err := mgr.SqlInstanceClient.Get(ctx, instance.Name)
-		if err != nil {
-			if errors.IsNotFound(err) {
-				mgr.Logger.Info("sql instance not found, retrying", "instance", instance.Name)
-				return nil, retry.RetryableError(fmt.Errorf("sql instance not found, retrying: %w", err))
-			}
-			mgr.Logger.Info("unable to get sql instance, retrying", "instance", instance.Name)
-			return nil, retry.RetryableError(fmt.Errorf("unable to get sql instance, retrying: %w", err))
+	sqlInstance, err := wait.For(ctx, mgr.SqlInstanceClient, instance.Name, 15*time.Minute, func(sqlInstance *v1beta1.SQLInstance) (bool, error) {
+		if sqlInstance == nil {
+			mgr.Logger.Info("sql instance not found, waiting", "instance", instance.Name)
+			return false, nil
 		}
 
 		conditionsNotEmpty := len(sqlInstance.Status.Conditions) > 0
@@ -172,36 +329,43 @@ func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr
 			condition := sqlInstance.Status.Conditions[0]
 
 			if condition.Reason == "UpdateFailed" {
-				if strings.Contains(condition.Message, "Cannot assign a private IP address for an existing Cloud SQL instance in a Shared VPC") {
+				if strings.Contains(condition.Message, "Cannot assign a private IP address for an existing Cloud SQL instance in a Shared VPC") && sqlInstance.Spec.Settings.IpConfiguration.PrivateNetworkRef != nil {
 					mgr.Logger.Warn("sql instance update has failed on assigning private IP to existing instance, attempting fix")
-					sqlInstance.Spec.Settings.IpConfiguration.PrivateNetworkRef = nil
-					_, err = mgr.SqlInstanceClient.Patch(ctx, instance.Name, types.JSONPatchType, []byte("[{\"op\": \"remove\", \"path\": \"/spec/settings/ipConfiguration/privateNetworkRef\"}]"))
+					_, err := mgr.SqlInstanceClient.Patch(ctx, instance.Name, types.JSONPatchType, []byte("[{\"op\": \"remove\", \"path\": \"/spec/settings/ipConfiguration/privateNetworkRef\"}]"))
 					if err != nil {
-						mgr.Logger.Error("unable to patch sql instance, retrying", "instance", instance.Name)
-						return nil, retry.RetryableError(fmt.Errorf("unable to patch sql instance, retrying to see if we can recover: %w", err))
+						mgr.Logger.Error("unable to patch sql instance, waiting to see if we can recover", "instance", instance.Name, "error", err)
+						return false, nil
 					}
-					mgr.Logger.Info("attempted patch requires time to resolve, retrying")
-					return nil, retry.RetryableError(fmt.Errorf("attempted patch requires time to resolve, retrying to see if it is resolved"))
+					mgr.Logger.Info("attempted patch requires time to resolve, waiting")
+					return false, nil
 				}
-				return nil, retry.RetryableError(fmt.Errorf("sql instance update has failed, retrying to see if it resolves itself: %s", condition.Message))
+				mgr.Logger.Warn("sql instance update has failed, waiting to see if it resolves itself", "message", condition.Message)
+				return false, nil
 			}
 
 			if condition.Reason == "UpToDate" {
-				return sqlInstance, nil
+				return true, nil
 			}
 		}
-		mgr.Logger.Info("sql instance not ready, retrying")
-		return nil, retry.RetryableError(fmt.Errorf("sql instance not ready, retrying"))
+		mgr.Logger.Info("waiting for sql instance to be ready", "instance", instance.Name)
+		return false, nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	mgr.Logger.Info("sql instance is ready, resolving values")
-	if sqlInstance.Status.PublicIpAddress == nil {
+	instance.PrimaryIp = ptr.Deref(sqlInstance.Status.PublicIpAddress, "")
+	instance.PrivateIp = ptr.Deref(sqlInstance.Status.PrivateIpAddress, "")
+	if mgr.Connectivity == config.ConnectivityPrivateIp {
+		if instance.PrivateIp == "" {
+			return nil, fmt.Errorf("sql instance %s does not have private ip address", instance.Name)
+		}
+	} else if instance.PrimaryIp == "" && (mgr.Connector == nil || instance.PrivateIp == "") {
+		// The connector dials the private ip of an instance without a public ip
 		return nil, fmt.Errorf("sql instance %s does not have public ip address", instance.Name)
 	}
-	instance.PrimaryIp = *sqlInstance.Status.PublicIpAddress
+	instance.ConnectionName = ptr.Deref(sqlInstance.Status.ConnectionName, "")
 
 	if sqlInstance.Spec.Region == nil {
 		return nil, fmt.Errorf("sql instance %s does not have region", instance.Name)
@@ -213,7 +377,7 @@ func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr
 		return nil, err
 	}
 
-	b = retry.NewConstant(5 * time.Second)
+	b := retry.NewConstant(5 * time.Second)
 	b = retry.WithMaxDuration(15*time.Minute, b)
 
 	secretName := "google-sql-" + app.Name
@@ -225,7 +389,7 @@ func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr
 				mgr.Logger.Info("waiting for secret to be created", "secret", secretName)
 				return nil, retry.RetryableError(err)
 			}
-			return nil, err
+			return nil, classify.Retry(err)
 		}
 		if secret.Annotations[nais_io_v1.DeploymentCorrelationIDAnnotation] != app.Status.CorrelationID {
 			mgr.Logger.Info("waiting for secret to be updated", "secret", secretName)
@@ -250,6 +414,23 @@ func ResolveInstance(ctx context.Context, app *nais_io_v1alpha1.Application, mgr
 	return instance, nil
 }
 
+// ResolveSecretKeys returns the sorted keys of the database secret naiserator has created for the application.
+// The keys are the names of the environment variables the application sees.
+func ResolveSecretKeys(ctx context.Context, app *nais_io_v1alpha1.Application, mgr *common_main.Manager) ([]string, error) {
+	secretName := "google-sql-" + app.Name
+	secret, err := mgr.K8sClient.CoreV1().Secrets(app.Namespace).Get(ctx, secretName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %w", secretName, err)
+	}
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
 func resolveOutgoingIps(ctx context.Context, instance *Instance, mgr *common_main.Manager, required bool) error {
 	b := retry.NewConstant(30 * time.Second)
 	b = retry.WithMaxDuration(15*time.Minute, b)
@@ -261,8 +442,8 @@ func resolveOutgoingIps(ctx context.Context, instance *Instance, mgr *common_mai
 				mgr.Logger.Info("sql instance not found, retrying", "instance", instance.Name)
 				return nil, retry.RetryableError(fmt.Errorf("sql instance not found: %w", err))
 			}
-			mgr.Logger.Info("unable to get sql instance, retrying", "instance", instance.Name)
-			return nil, retry.RetryableError(fmt.Errorf("unable to get sql instance: %w", err))
+			mgr.Logger.Info("unable to get sql instance", "instance", instance.Name, "error", err)
+			return nil, classify.Retry(fmt.Errorf("unable to get sql instance: %w", err))
 		}
 
 		outgoingIps := make([]string, 0, 2)
@@ -0,0 +1,170 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	"github.com/nais/cloudsql-migrator/internal/pkg/config"
+	"github.com/nais/liberator/pkg/namegen"
+	"github.com/sethvargo/go-retry"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// State is what a phase records for later phases (or later runs of the same phase) to pick up.
+// It is stored as JSON in a ConfigMap in the namespace of the application, which is deleted by finalize and rollback.
+
+const stateKey = "state.json"
+
+type State struct {
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// Pending is the fingerprint of an application update the migrator is applying, until it is recorded as the Fingerprint
+	Pending *Fingerprint `json:"pending,omitempty"`
+	// Operations maps a caller-defined key to the name of a long-running GCP operation that is in flight
+	Operations map[string]string `json:"operations,omitempty"`
+	// KnownPasswords are the instances where the postgres user has a password set by the migrator, until it is rotated
+	KnownPasswords []string `json:"knownPasswords,omitempty"`
+	// AuthorizedNetworks are the authorized networks the migrator has added to the instances, until they are removed
+	AuthorizedNetworks []AuthorizedNetwork `json:"authorizedNetworks,omitempty"`
+	// Location is the region of the Database Migration Service resources of the migration
+	Location string `json:"location,omitempty"`
+	// SecretKeys are the keys of the database secret of the application when setup ran, before promote moves the
+	// application to the target instance
+	SecretKeys []string `json:"secretKeys,omitempty"`
+}
+
+// AuthorizedNetwork is an authorized network the migrator has added to an instance
+type AuthorizedNetwork struct {
+	Instance string `json:"instance"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+// Fingerprint is a snapshot of the Application as the migrator last left it
+type Fingerprint struct {
+	Hash          string          `json:"hash"`
+	CorrelationID string          `json:"correlationID"`
+	Spec          json.RawMessage `json:"spec"`
+	RecordedAt    time.Time       `json:"recordedAt"`
+}
+
+// Name returns the name of the ConfigMap holding the state for the application
+func Name(appName string) (string, error) {
+	return namegen.ShortName(fmt.Sprintf("migrator-%s-state", appName), 63)
+}
+
+// Load returns the recorded state, or an empty state if nothing has been recorded yet
+func Load(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) (*State, error) {
+	_, st, err := get(ctx, cfg, mgr)
+	return st, err
+}
+
+// Update applies mutate to the current state and stores the result, retrying on conflicting writes
+func Update(ctx context.Context, cfg *config.Config, mgr *common_main.Manager, mutate func(st *State) error) error {
+	b := retry.NewConstant(1 * time.Second)
+	b = retry.WithMaxDuration(1*time.Minute, b)
+
+	return retry.Do(ctx, b, func(ctx context.Context) error {
+		cm, st, err := get(ctx, cfg, mgr)
+		if err != nil {
+			return err
+		}
+
+		err = mutate(st)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return fmt.Errorf("failed to marshal migration state: %w", err)
+		}
+
+		configMaps := mgr.K8sClient.CoreV1().ConfigMaps(cfg.Namespace)
+		if cm == nil {
+			cm, err = newConfigMap(cfg)
+			if err != nil {
+				return err
+			}
+			cm.Data[stateKey] = string(data)
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			if cm.Data == nil {
+				cm.Data = make(map[string]string, 1)
+			}
+			cm.Data[stateKey] = string(data)
+			_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			if k8s_errors.IsConflict(err) || k8s_errors.IsAlreadyExists(err) {
+				mgr.Logger.Warn("conflict while saving migration state, retrying")
+				return retry.RetryableError(err)
+			}
+			return fmt.Errorf("failed to save migration state: %w", err)
+		}
+		return nil
+	})
+}
+
+// Delete removes the recorded state
+func Delete(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) error {
+	name, err := Name(cfg.ApplicationName)
+	if err != nil {
+		return err
+	}
+
+	mgr.Logger.Info("deleting migration state", "name", name)
+	err = mgr.K8sClient.CoreV1().ConfigMaps(cfg.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete migration state: %w", err)
+	}
+	return nil
+}
+
+func get(ctx context.Context, cfg *config.Config, mgr *common_main.Manager) (*corev1.ConfigMap, *State, error) {
+	name, err := Name(cfg.ApplicationName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cm, err := mgr.K8sClient.CoreV1().ConfigMaps(cfg.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return nil, &State{}, nil
+		}
+		return nil, nil, fmt.Errorf("failed to get migration state: %w", err)
+	}
+
+	st := &State{}
+	if data, ok := cm.Data[stateKey]; ok {
+		err = json.Unmarshal([]byte(data), st)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse migration state in %s: %w", name, err)
+		}
+	}
+	return cm, st, nil
+}
+
+func newConfigMap(cfg *config.Config) (*corev1.ConfigMap, error) {
+	name, err := Name(cfg.ApplicationName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cfg.Namespace,
+			Labels: map[string]string{
+				"app":                       cfg.ApplicationName,
+				"team":                      cfg.Namespace,
+				"migrator.nais.io/finalize": cfg.ApplicationName,
+			},
+		},
+		Data: make(map[string]string, 1),
+	}, nil
+}
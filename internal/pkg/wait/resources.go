@@ -0,0 +1,53 @@
+package wait
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/common_main"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+)
+
+// ApplicationRollout waits until naiserator has processed the deployment with the given correlation ID,
+// and the application has reached one of the given synchronization states
+func ApplicationRollout(ctx context.Context, name, correlationID string, timeout time.Duration, mgr *common_main.Manager, states ...string) (*nais_io_v1alpha1.Application, error) {
+	return For(ctx, mgr.AppClient, name, timeout, func(app *nais_io_v1alpha1.Application) (bool, error) {
+		if app == nil {
+			mgr.Logger.Info("waiting for application to exist", "appName", name)
+			return false, nil
+		}
+		if app.Status.CorrelationID == correlationID && slices.Contains(states, app.Status.SynchronizationState) {
+			return true, nil
+		}
+		mgr.Status("waiting for app rollout", "appName", name, "synchronizationState", app.Status.SynchronizationState)
+		mgr.Logger.Debug("waiting for deployment", "wantedCorrelationID", correlationID, "currentCorrelationID", app.Status.CorrelationID)
+		return false, nil
+	})
+}
+
+// SqlInstanceReady waits until Config Connector has reconciled the latest spec of the SQLInstance and reports it as ready
+func SqlInstanceReady(ctx context.Context, name string, timeout time.Duration, mgr *common_main.Manager) (*v1beta1.SQLInstance, error) {
+	return For(ctx, mgr.SqlInstanceClient, name, timeout, func(sqlInstance *v1beta1.SQLInstance) (bool, error) {
+		if sqlInstance == nil {
+			mgr.Logger.Info("waiting for sql instance to exist", "instance", name)
+			return false, nil
+		}
+		if SqlInstanceIsReady(sqlInstance) {
+			return true, nil
+		}
+		mgr.Status("waiting for sql instance to be ready", "instance", name)
+		return false, nil
+	})
+}
+
+// SqlInstanceIsReady reports whether the ready condition is true for the latest generation of the SQLInstance
+func SqlInstanceIsReady(sqlInstance *v1beta1.SQLInstance) bool {
+	observed := sqlInstance.Status.ObservedGeneration
+	if observed != nil && *observed < sqlInstance.Generation {
+		return false
+	}
+	conditions := sqlInstance.Status.Conditions
+	return len(conditions) > 0 && conditions[0].Status == "True"
+}
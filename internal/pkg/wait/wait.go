@@ -0,0 +1,288 @@
+// Package wait provides cancellable waiting for Kubernetes resources and long-running GCP operations.
+//
+// Kubernetes resources are observed through watches on the dynamic client, falling back to a fresh
+// read whenever a watch ends, so that a change is noticed as soon as the API server reports it.
+// GCP operations are polled with exponential backoff.
+//
+// Errors are sorted with the classify package: transient errors are retried until the timeout, while errors that will
+// not go away by themselves, like missing permissions, end the wait at once.
+//
+// In a dry run a wait checks its condition once, and returns an error wrapping dryrun.ErrWait if it is not satisfied,
+// since nothing will change the resources it waits for.
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/dryrun"
+	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
+	"github.com/sethvargo/go-retry"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// watchTimeout makes the API server end each watch periodically, so a stalled watch is replaced by a fresh read
+	watchTimeout = 5 * time.Minute
+	// retryInterval is the delay before reading a resource again after a failed get or watch
+	retryInterval = 2 * time.Second
+
+	pollInitialInterval = 1 * time.Second
+	pollMaxInterval     = 15 * time.Second
+)
+
+var errNotDone = errors.New("not done")
+
+// Condition reports whether the observed resource is in the desired state.
+// The object is nil when the resource does not exist.
+// Returning an error stops the wait.
+type Condition[P any] func(obj *P) (bool, error)
+
+// For waits until condition is satisfied for the named resource, and returns the resource as last observed.
+func For[T interface {
+	runtime.Object
+	*P
+}, P any](ctx context.Context, client k8s.GenericClient[T, P], name string, timeout time.Duration, condition Condition[P]) (*P, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for {
+		obj, err := client.Get(ctx, name)
+		if k8s_errors.IsNotFound(err) {
+			obj, err = nil, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, waitError(ctx, name, err)
+			}
+			if !classify.Of(err).Retryable() {
+				return nil, classify.Permanent(fmt.Errorf("failed to get %s: %w", name, err))
+			}
+			lastErr = err
+			if err = sleep(ctx, retryInterval); err != nil {
+				return nil, waitError(ctx, name, lastErr)
+			}
+			continue
+		}
+
+		done, err := condition(obj)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return obj, nil
+		}
+		if dryrun.FromContext(ctx) != nil {
+			return nil, fmt.Errorf("waiting for %s: %w", name, dryrun.ErrWait)
+		}
+
+		resourceVersion := ""
+		if obj != nil {
+			accessor, err := meta.Accessor(T(obj))
+			if err != nil {
+				return nil, err
+			}
+			resourceVersion = accessor.GetResourceVersion()
+		}
+
+		obj, done, err = watchUntil[T, P](ctx, client, name, resourceVersion, condition)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return obj, nil
+		}
+		if ctx.Err() != nil {
+			return nil, waitError(ctx, name, lastErr)
+		}
+	}
+}
+
+// watchUntil watches the named resource from resourceVersion until the condition is satisfied or the watch ends
+func watchUntil[T interface {
+	runtime.Object
+	*P
+}, P any](ctx context.Context, client k8s.GenericClient[T, P], name, resourceVersion string, condition Condition[P]) (*P, bool, error) {
+	w, err := client.Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: resourceVersion,
+		TimeoutSeconds:  ptr.To(int64(watchTimeout.Seconds())),
+	})
+	if err != nil {
+		// Fall back to reading the resource again
+		_ = sleep(ctx, retryInterval)
+		return nil, false, nil
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil, false, nil
+			}
+
+			var obj *P
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				obj, err = k8s.Convert[P](event.Object)
+				if err != nil {
+					return nil, false, err
+				}
+			case watch.Deleted:
+				obj = nil
+			case watch.Error:
+				// Typically an expired resource version, start over with a fresh read
+				return nil, false, nil
+			default:
+				continue
+			}
+
+			done, err := condition(obj)
+			if err != nil {
+				return nil, false, err
+			}
+			if done {
+				return obj, true, nil
+			}
+		}
+	}
+}
+
+// NoneWithLabel waits until no resources matching the label selector exist
+func NoneWithLabel[T interface {
+	runtime.Object
+	*P
+}, P any](ctx context.Context, client k8s.GenericClient[T, P], labelSelector string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if dryrun.FromContext(ctx) != nil {
+		exists, err := client.ExistsByLabel(ctx, labelSelector)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("waiting for %s: %w", labelSelector, dryrun.ErrWait)
+		}
+		return nil
+	}
+
+	var lastErr error
+	for {
+		w, err := client.Watch(ctx, metav1.ListOptions{
+			LabelSelector:  labelSelector,
+			TimeoutSeconds: ptr.To(int64(watchTimeout.Seconds())),
+		})
+		if err != nil {
+			w = nil
+			lastErr = err
+		}
+
+		// Check after the watch is established, so a deletion in between is not missed
+		exists, err := client.ExistsByLabel(ctx, labelSelector)
+		if err == nil && !exists {
+			stop(w)
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		if w == nil {
+			if err = sleep(ctx, retryInterval); err != nil {
+				return waitError(ctx, labelSelector, lastErr)
+			}
+			continue
+		}
+
+		err = waitForDeletion(ctx, w)
+		stop(w)
+		if err != nil {
+			return waitError(ctx, labelSelector, lastErr)
+		}
+	}
+}
+
+// waitForDeletion returns when a resource is deleted or the watch ends
+func waitForDeletion(ctx context.Context, w watch.Interface) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok || event.Type == watch.Deleted || event.Type == watch.Error {
+				return nil
+			}
+		}
+	}
+}
+
+// Until polls done with exponential backoff until it reports completion, returns an error or the timeout expires.
+// It is intended for long-running GCP operations, which can not be watched.
+// done returns the errors of the calls it makes through classify.Retry, so a transient error is polled again and a
+// permanent error ends the wait at once. Other errors, like a failed operation, also end the wait.
+func Until(ctx context.Context, timeout time.Duration, done func(ctx context.Context) (bool, error)) error {
+	if dryrun.FromContext(ctx) != nil {
+		ok, err := done(ctx)
+		if err == nil && !ok {
+			err = dryrun.ErrWait
+		}
+		return err
+	}
+
+	b := retry.NewExponential(pollInitialInterval)
+	b = retry.WithCappedDuration(pollMaxInterval, b)
+	b = retry.WithMaxDuration(timeout, b)
+
+	err := retry.Do(ctx, b, func(ctx context.Context) error {
+		ok, err := done(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return retry.RetryableError(errNotDone)
+		}
+		return nil
+	})
+	if errors.Is(err, errNotDone) {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return err
+}
+
+func waitError(ctx context.Context, target string, lastErr error) error {
+	if lastErr != nil {
+		return fmt.Errorf("gave up waiting for %s: %w (last error: %v)", target, ctx.Err(), lastErr)
+	}
+	return fmt.Errorf("gave up waiting for %s: %w", target, ctx.Err())
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func stop(w watch.Interface) {
+	if w != nil {
+		w.Stop()
+	}
+}
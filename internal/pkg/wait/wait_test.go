@@ -0,0 +1,216 @@
+package wait_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/k8s/v1alpha1"
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"github.com/nais/cloudsql-migrator/internal/pkg/classify"
+	"github.com/nais/cloudsql-migrator/internal/pkg/k8s"
+	"github.com/nais/cloudsql-migrator/internal/pkg/wait"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	namespace    = "team"
+	instanceName = "my-instance"
+)
+
+var sqlInstances = v1beta1.SchemeGroupVersion.WithResource("sqlinstances")
+
+func sqlInstance(generation, observedGeneration int64, status string) *v1beta1.SQLInstance {
+	return &v1beta1.SQLInstance{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1beta1.SchemeGroupVersion.String(),
+			Kind:       "SQLInstance",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: generation,
+		},
+		Status: v1beta1.SQLInstanceStatus{
+			ObservedGeneration: ptr.To(observedGeneration),
+			Conditions: []v1alpha1.Condition{
+				{Type: "Ready", Status: corev1.ConditionStatus(status)},
+			},
+		},
+	}
+}
+
+var _ = Describe("Wait", func() {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var dynamicClient *dynamicfake.FakeDynamicClient
+	var client k8s.SqlInstanceClient
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(func() { cancel() })
+
+		dynamicClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+			sqlInstances: "SQLInstanceList",
+		})
+		client = k8s.New[*v1beta1.SQLInstance](dynamicClient, namespace, sqlInstances)
+	})
+
+	Describe("For", func() {
+		ready := func(obj *v1beta1.SQLInstance) (bool, error) {
+			return obj != nil && wait.SqlInstanceIsReady(obj), nil
+		}
+
+		It("returns immediately when the condition already holds", func() {
+			_, err := client.Create(ctx, sqlInstance(1, 1, "True"))
+			Expect(err).NotTo(HaveOccurred())
+
+			obj, err := wait.For(ctx, client, instanceName, time.Second, ready)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.Name).To(Equal(instanceName))
+		})
+
+		It("observes changes through the watch", func() {
+			_, err := client.Create(ctx, sqlInstance(2, 1, "True"))
+			Expect(err).NotTo(HaveOccurred())
+
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(100 * time.Millisecond)
+				_, err := client.Update(ctx, sqlInstance(2, 2, "True"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			obj, err := wait.For(ctx, client, instanceName, 5*time.Second, ready)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*obj.Status.ObservedGeneration).To(Equal(int64(2)))
+		})
+
+		It("reports a missing resource as nil", func() {
+			obj, err := wait.For(ctx, client, instanceName, time.Second, func(obj *v1beta1.SQLInstance) (bool, error) {
+				return obj == nil, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).To(BeNil())
+		})
+
+		It("gives up when the timeout expires", func() {
+			_, err := client.Create(ctx, sqlInstance(1, 1, "False"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = wait.For(ctx, client, instanceName, 200*time.Millisecond, ready)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+
+		It("stops on errors from the condition", func() {
+			_, err := client.Create(ctx, sqlInstance(1, 1, "False"))
+			Expect(err).NotTo(HaveOccurred())
+
+			failed := errors.New("failed")
+			_, err = wait.For(ctx, client, instanceName, time.Second, func(*v1beta1.SQLInstance) (bool, error) {
+				return false, failed
+			})
+			Expect(err).To(MatchError(failed))
+		})
+
+		It("reads the resource again after a transient error", func() {
+			_, err := client.Create(ctx, sqlInstance(1, 1, "True"))
+			Expect(err).NotTo(HaveOccurred())
+
+			gets := 0
+			dynamicClient.PrependReactor("get", "sqlinstances", func(k8stesting.Action) (bool, runtime.Object, error) {
+				gets++
+				if gets == 1 {
+					return true, nil, k8s_errors.NewServiceUnavailable("try again")
+				}
+				return false, nil, nil
+			})
+
+			obj, err := wait.For(ctx, client, instanceName, 5*time.Second, ready)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.Name).To(Equal(instanceName))
+			Expect(gets).To(Equal(2))
+		})
+
+		It("fails at once when the resource can not be read for lack of permissions", func() {
+			forbidden := k8s_errors.NewForbidden(sqlInstances.GroupResource(), instanceName, errors.New("no access"))
+			dynamicClient.PrependReactor("get", "sqlinstances", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, forbidden
+			})
+
+			start := time.Now()
+			_, err := wait.For(ctx, client, instanceName, 5*time.Second, ready)
+			Expect(err).To(MatchError(forbidden))
+			Expect(classify.Is(err, classify.Forbidden)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Describe("SqlInstanceIsReady", func() {
+		It("is not ready before the latest generation is observed", func() {
+			Expect(wait.SqlInstanceIsReady(sqlInstance(2, 1, "True"))).To(BeFalse())
+		})
+
+		It("is not ready while the ready condition is false", func() {
+			Expect(wait.SqlInstanceIsReady(sqlInstance(1, 1, "False"))).To(BeFalse())
+		})
+
+		It("is ready when the latest generation is observed and ready", func() {
+			Expect(wait.SqlInstanceIsReady(sqlInstance(1, 1, "True"))).To(BeTrue())
+		})
+	})
+
+	Describe("Until", func() {
+		It("polls until done", func() {
+			calls := 0
+			err := wait.Until(ctx, 5*time.Second, func(context.Context) (bool, error) {
+				calls++
+				return calls == 2, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls).To(Equal(2))
+		})
+
+		It("polls again after a transient error", func() {
+			calls := 0
+			err := wait.Until(ctx, 5*time.Second, func(context.Context) (bool, error) {
+				calls++
+				if calls == 1 {
+					return false, classify.Retry(&googleapi.Error{Code: http.StatusServiceUnavailable})
+				}
+				return true, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls).To(Equal(2))
+		})
+
+		It("stops at once on a permanent error", func() {
+			calls := 0
+			err := wait.Until(ctx, 5*time.Second, func(context.Context) (bool, error) {
+				calls++
+				return false, classify.Retry(&googleapi.Error{Code: http.StatusForbidden})
+			})
+			Expect(classify.Is(err, classify.Forbidden)).To(BeTrue())
+			Expect(calls).To(Equal(1))
+		})
+
+		It("stops when the context is cancelled", func() {
+			cancel()
+			err := wait.Until(ctx, 5*time.Second, func(context.Context) (bool, error) {
+				return false, nil
+			})
+			Expect(err).To(MatchError(context.Canceled))
+		})
+	})
+})